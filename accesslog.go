@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// deviceIdContextKey holds in the echo context the device of an ingested payload, for the access log.
+	deviceIdContextKey = "device_id"
+	// combinedTimeFormat is the time format of the Apache logs.
+	combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// AccessLogConfig sets the access log written for every request.
+type AccessLogConfig struct {
+	Format string `json:"format"` // "json" or "combined" (Apache combined format), no access log when empty
+	Output string `json:"output"` // "stdout" (default), "stderr" or the path of a file the lines are appended to
+}
+
+// accessLogEntry is a line of the access log in the JSON format.
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	RemoteIP  string  `json:"remote_ip"`
+	Method    string  `json:"method"`
+	URI       string  `json:"uri"`
+	Protocol  string  `json:"protocol"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`      // Size of the response body
+	LatencyMs float64 `json:"latency_ms"` // Time to handle the request in milliseconds
+	DeviceId  string  `json:"device_id,omitempty"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+}
+
+// accessLogger writes a line per request in the configured format.
+type accessLogger struct {
+	format string
+	mu     sync.Mutex
+	out    io.Writer
+}
+
+// newAccessLogger validates the format and opens the output of the access log, nil when disabled
+func newAccessLogger(config AccessLogConfig) (*accessLogger, error) {
+	switch config.Format {
+	case "":
+		return nil, nil
+	case "json", "combined":
+	default:
+		return nil, fmt.Errorf("format %q must be json or combined", config.Format)
+	}
+
+	var out io.Writer
+
+	switch config.Output {
+	case "", "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		file, err := os.OpenFile(config.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the access log %s: %w", config.Output, err)
+		}
+
+		out = file
+	}
+
+	return &accessLogger{format: config.Format, out: out}, nil
+}
+
+// middleware logs every request once its response is written
+func (l *accessLogger) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		// The error response is written here so its status and size are logged.
+		if err != nil {
+			c.Error(err)
+		}
+
+		request, response := c.Request(), c.Response()
+		entry := accessLogEntry{
+			Time:      start.Format(time.RFC3339),
+			RemoteIP:  c.RealIP(),
+			Method:    request.Method,
+			URI:       request.RequestURI,
+			Protocol:  request.Proto,
+			Status:    response.Status,
+			Bytes:     response.Size,
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			DeviceId:  routeDeviceId(c),
+			Referer:   request.Referer(),
+			UserAgent: request.UserAgent(),
+		}
+
+		if deviceId, ok := c.Get(deviceIdContextKey).(string); ok && entry.DeviceId == "" {
+			entry.DeviceId = deviceId
+		}
+
+		l.write(&entry, start)
+
+		return err
+	}
+}
+
+// write appends the line of the request to the access log
+func (l *accessLogger) write(entry *accessLogEntry, start time.Time) {
+	var line []byte
+
+	if l.format == "json" {
+		var err error
+
+		if line, err = json.Marshal(entry); err != nil {
+			log.Printf("Access log of %s not written: %v", entry.URI, err)
+			return
+		}
+	} else {
+		line = []byte(combinedLine(entry, start))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		log.Printf("Access log of %s not written: %v", entry.URI, err)
+	}
+}
+
+// combinedLine formats the entry in the Apache combined format followed by the latency in milliseconds and the device,
+// e.g. 10.0.0.1 - - [01/Jan/2025:10:00:00 +0000] "POST /process HTTP/1.1" 201 0 "-" "curl/8.0" 1.204 "1234"
+func combinedLine(entry *accessLogEntry, start time.Time) string {
+	size := "-"
+
+	if entry.Bytes > 0 {
+		size = strconv.FormatInt(entry.Bytes, 10)
+	}
+
+	return fmt.Sprintf("%s - - [%s] %q %d %s %q %q %.3f %q",
+		entry.RemoteIP,
+		start.Format(combinedTimeFormat),
+		entry.Method+" "+entry.URI+" "+entry.Protocol,
+		entry.Status,
+		size,
+		orDash(entry.Referer),
+		orDash(entry.UserAgent),
+		entry.LatencyMs,
+		orDash(entry.DeviceId),
+	)
+}
+
+// orDash returns the value or "-" when it is empty, as in the Apache logs
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Aggregate summarizes a set of values.
+type Aggregate struct {
+	Count  int     `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Avg    float64 `json:"avg"`
+	Stddev float64 `json:"stddev"` // Population standard deviation
+}
+
+// aggregate summarizes the values, nil when there are none
+func aggregate(values []float64) *Aggregate {
+	if len(values) == 0 {
+		return nil
+	}
+
+	result := &Aggregate{Count: len(values), Min: math.Inf(1), Max: math.Inf(-1)}
+	sum := 0.0
+
+	for _, value := range values {
+		result.Min = math.Min(result.Min, value)
+		result.Max = math.Max(result.Max, value)
+		sum += value
+	}
+
+	result.Avg = sum / float64(len(values))
+	squares := 0.0
+
+	for _, value := range values {
+		squares += (value - result.Avg) * (value - result.Avg)
+	}
+
+	result.Stddev = math.Sqrt(squares / float64(len(values)))
+
+	return result
+}
+
+// metricAggregator is implemented by the stores summarizing a measurement themselves, without returning its values.
+type metricAggregator interface {
+	AggregateMetric(ctx context.Context, deviceId, metric string, from, to time.Time) (*Aggregate, error)
+}
+
+// aggregatorOf returns the store under the cache and the coalescing if it summarizes the measurements itself, nil otherwise
+func aggregatorOf(store Store) metricAggregator {
+	for {
+		switch wrapper := store.(type) {
+		case *cachedStore:
+			store = wrapper.Store
+		case *coalescedStore:
+			store = wrapper.Store
+		case metricAggregator:
+			return wrapper
+		default:
+			return nil
+		}
+	}
+}
+
+// mergeAggregates summarizes the values of several summaries, nil when they have no values
+func mergeAggregates(aggregates []*Aggregate) *Aggregate {
+	var result *Aggregate
+	sum, squares := 0.0, 0.0
+
+	for _, a := range aggregates {
+		if a == nil {
+			continue
+		}
+
+		if result == nil {
+			result = &Aggregate{Min: math.Inf(1), Max: math.Inf(-1)}
+		}
+
+		result.Count += a.Count
+		result.Min = math.Min(result.Min, a.Min)
+		result.Max = math.Max(result.Max, a.Max)
+		sum += a.Avg * float64(a.Count)
+		// The sum of the squares of the values, from the variance and the mean of every summary.
+		squares += float64(a.Count) * (a.Stddev*a.Stddev + a.Avg*a.Avg)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	result.Avg = sum / float64(result.Count)
+	result.Stddev = math.Sqrt(math.Max(0, squares/float64(result.Count)-result.Avg*result.Avg))
+
+	return result
+}
+
+// aggregateReport summarizes a measurement of a set of devices over a time range.
+type aggregateReport struct {
+	Group     string                `json:"group,omitempty"`    // Group of the devices, if queried by group
+	Selector  string                `json:"selector,omitempty"` // Label selector of the devices, if queried by labels
+	Metric    string                `json:"metric"`
+	From      time.Time             `json:"from"`
+	To        time.Time             `json:"to"`
+	Aggregate *Aggregate            `json:"aggregate"`
+	Devices   map[string]*Aggregate `json:"devices"` // Summary per device, null for the devices without values
+}
+
+// aggregateDevices summarizes the measurement of the metric query parameter (temp by default) of the devices
+// over the time range of the from and to query parameters
+func aggregateDevices(c echo.Context, store Store, deviceIds []string) (*aggregateReport, error) {
+	metric := c.QueryParam("metric")
+
+	if metric == "" {
+		metric = "temp"
+	}
+
+	if !metricNamePattern.MatchString(metric) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Metric name %q is invalid", metric))
+	}
+
+	from, to, err := parseTimeRange(c, defaultQueryWindow)
+
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	report := &aggregateReport{Metric: metric, From: from, To: to, Devices: make(map[string]*Aggregate)}
+
+	// The stores able to summarize the values themselves don't return years of them.
+	if aggregator := aggregatorOf(store); aggregator != nil {
+		summaries := make([]*Aggregate, 0, len(deviceIds))
+
+		for _, deviceId := range deviceIds {
+			summary, err := aggregator.AggregateMetric(c.Request().Context(), deviceId, metric, from, to)
+
+			if err != nil {
+				return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the %s history of device %s. %v", metric, deviceId, err))
+			}
+
+			report.Devices[deviceId] = summary
+			summaries = append(summaries, summary)
+		}
+
+		report.Aggregate = mergeAggregates(summaries)
+
+		return report, nil
+	}
+
+	var all []float64
+
+	for _, deviceId := range deviceIds {
+		points, err := store.MetricRange(c.Request().Context(), deviceId, metric, from, to)
+
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the %s history of device %s. %v", metric, deviceId, err))
+		}
+
+		values := make([]float64, len(points))
+
+		for i, point := range points {
+			values[i] = point.Value
+		}
+
+		report.Devices[deviceId] = aggregate(values)
+		all = append(all, values...)
+	}
+
+	report.Aggregate = aggregate(all)
+
+	return report, nil
+}
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// alertKeyPrefix prefixes the hash holding an alert.
+	alertKeyPrefix = "alert:"
+	// activeAlertsKey is the Redis hash holding the id of the firing alert of every "<rule>:<device>".
+	activeAlertsKey = "active-alerts"
+	// alertHistoryKey is the Redis sorted set of the ids of the resolved alerts scored by their resolve time in milliseconds.
+	alertHistoryKey = "alert-history"
+	// defaultAlertsLimit is the number of resolved alerts listed without a limit query parameter.
+	defaultAlertsLimit = 100
+	// maxAckNoteLength bounds the length of the note of an acknowledgement.
+	maxAckNoteLength = 1024
+	// maxChangeWindow bounds the window of the rate of change rules, whose values are loaded on every reading.
+	maxChangeWindow = 24 * time.Hour
+)
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// AlertsConfig defines the alert rules evaluated on every reading at ingest.
+type AlertsConfig struct {
+	Rules     []AlertRuleConfig `json:"rules"`     // Rules, evaluated independently
+	History   Duration          `json:"history"`   // How long the resolved alerts are kept, 30 days by default
+	Notifiers []NotifierConfig  `json:"notifiers"` // Channels notified when an alert fires or resolves
+}
+
+// AlertRuleConfig fires an alert for a device while its readings are out of bounds, and resolves it on the first reading back within them.
+//
+// A rate of change rule compares the value of the reading with the lowest and highest values of the measurement within the window before it,
+// e.g. a rise_by of 5 within 10m fires when the reading is more than 5 above any value of the last 10 minutes.
+//
+// The rule applies to every device unless restricted by group, label selector or device type.
+type AlertRuleConfig struct {
+	Name        string   `json:"name"`         // Name of the rule in the alerts
+	Metric      string   `json:"metric"`       // Measurement checked, temp by default
+	Above       *float64 `json:"above"`        // Fires when the value is higher
+	Below       *float64 `json:"below"`        // Fires when the value is lower
+	RiseBy      *float64 `json:"rise_by"`      // Fires when the value rose more within the window
+	FallBy      *float64 `json:"fall_by"`      // Fires when the value fell more within the window
+	Within      Duration `json:"within"`       // Window of the rise_by and fall_by conditions
+	Severity    string   `json:"severity"`     // Free form severity copied into the alerts, e.g. "critical"
+	Group       string   `json:"group"`        // Group the devices must belong to
+	Selector    string   `json:"selector"`     // Label selector the devices must match
+	DeviceTypes []string `json:"device_types"` // Device types the rule applies to, all when empty
+}
+
+// Alert is a period during which the readings of a device broke a rule.
+type Alert struct {
+	Id         string    `json:"id"`
+	Rule       string    `json:"rule"`
+	DeviceId   string    `json:"device_id"`
+	Severity   string    `json:"severity,omitempty"`
+	Condition  string    `json:"condition"`             // Condition of the rule, e.g. "temp > 30"
+	State      string    `json:"state"`                 // "firing" or "resolved"
+	Value      float64   `json:"value"`                 // Value of the reading that fired the alert
+	Change     float64   `json:"change,omitempty"`      // Change of the value within the window of a rate of change rule when fired, negative for a fall
+	LastValue  float64   `json:"last_value"`            // Value of the last reading evaluated, the one resolving the alert once resolved
+	StartedAt  string    `json:"started_at"`            // Time of the reading that fired the alert
+	ResolvedAt string    `json:"resolved_at,omitempty"` // Time of the reading that resolved the alert
+	Ack        *AlertAck `json:"ack,omitempty"`         // Acknowledgement of the alert by an operator
+}
+
+// AlertAck records that an operator took charge of an alert.
+type AlertAck struct {
+	By   string `json:"by"`             // Operator acknowledging the alert
+	Note string `json:"note,omitempty"` // Free form note, e.g. "technician on site"
+	At   string `json:"at"`             // Time of the acknowledgement
+}
+
+// alertAckRequest is the body acknowledging an alert.
+type alertAckRequest struct {
+	By   string `json:"by"`
+	Note string `json:"note"`
+}
+
+// alertRule is a validated alert rule.
+type alertRule struct {
+	AlertRuleConfig
+	selector    labelSelector
+	deviceTypes map[string]bool
+}
+
+// alerter evaluates the alert rules on the readings.
+type alerter struct {
+	rules     []*alertRule
+	notifiers []*notifier
+	history   time.Duration
+	registry  *registry
+	store     Store
+}
+
+// newAlerter validates the alert rules and applies their defaults
+func newAlerter(config AlertsConfig, reg *registry, store Store) (*alerter, error) {
+	if config.History < 0 {
+		return nil, fmt.Errorf("history %v must be positive", time.Duration(config.History))
+	}
+
+	if config.History == 0 {
+		config.History = Duration(30 * 24 * time.Hour)
+	}
+
+	a := &alerter{history: time.Duration(config.History), registry: reg, store: store}
+	names := make(map[string]bool)
+
+	for _, ruleConfig := range config.Rules {
+		if !idPattern.MatchString(ruleConfig.Name) {
+			return nil, fmt.Errorf("alert rule name %q must be 1 to 64 letters, digits, '_', '.' or '-'", ruleConfig.Name)
+		}
+
+		if names[ruleConfig.Name] {
+			return nil, fmt.Errorf("alert rule %s is defined twice", ruleConfig.Name)
+		}
+
+		names[ruleConfig.Name] = true
+
+		if ruleConfig.Metric == "" {
+			ruleConfig.Metric = "temp"
+		}
+
+		if !metricNamePattern.MatchString(ruleConfig.Metric) {
+			return nil, fmt.Errorf("metric name %q of alert rule %s is invalid", ruleConfig.Metric, ruleConfig.Name)
+		}
+
+		if ruleConfig.Above == nil && ruleConfig.Below == nil && ruleConfig.RiseBy == nil && ruleConfig.FallBy == nil {
+			return nil, fmt.Errorf("alert rule %s must have an above, below, rise_by or fall_by threshold", ruleConfig.Name)
+		}
+
+		if ruleConfig.Above != nil && ruleConfig.Below != nil && *ruleConfig.Below >= *ruleConfig.Above {
+			return nil, fmt.Errorf("below threshold of alert rule %s must be lower than its above threshold", ruleConfig.Name)
+		}
+
+		if (ruleConfig.RiseBy != nil && *ruleConfig.RiseBy <= 0) || (ruleConfig.FallBy != nil && *ruleConfig.FallBy <= 0) {
+			return nil, fmt.Errorf("rise_by and fall_by thresholds of alert rule %s must be positive", ruleConfig.Name)
+		}
+
+		if ruleConfig.RiseBy == nil && ruleConfig.FallBy == nil {
+			if ruleConfig.Within != 0 {
+				return nil, fmt.Errorf("within of alert rule %s requires a rise_by or fall_by threshold", ruleConfig.Name)
+			}
+		} else if ruleConfig.Within <= 0 || time.Duration(ruleConfig.Within) > maxChangeWindow {
+			return nil, fmt.Errorf("within %v of alert rule %s must be positive and at most %v", time.Duration(ruleConfig.Within), ruleConfig.Name, maxChangeWindow)
+		}
+
+		if ruleConfig.Group != "" && !idPattern.MatchString(ruleConfig.Group) {
+			return nil, fmt.Errorf("group %q of alert rule %s is invalid", ruleConfig.Group, ruleConfig.Name)
+		}
+
+		selector, err := parseSelector(ruleConfig.Selector)
+
+		if err != nil {
+			return nil, fmt.Errorf("selector of alert rule %s: %w", ruleConfig.Name, err)
+		}
+
+		rule := &alertRule{AlertRuleConfig: ruleConfig, selector: selector}
+
+		if len(ruleConfig.DeviceTypes) > 0 {
+			rule.deviceTypes = make(map[string]bool, len(ruleConfig.DeviceTypes))
+
+			for _, deviceType := range ruleConfig.DeviceTypes {
+				rule.deviceTypes[deviceType] = true
+			}
+		}
+
+		a.rules = append(a.rules, rule)
+	}
+
+	for i, notifierConfig := range config.Notifiers {
+		notifier, err := newNotifier(notifierConfig, i, names)
+
+		if err != nil {
+			return nil, err
+		}
+
+		a.notifiers = append(a.notifiers, notifier)
+	}
+
+	return a, nil
+}
+
+// enabled reports whether at least one alert rule is configured
+func (a *alerter) enabled() bool {
+	return a != nil && len(a.rules) > 0
+}
+
+// condition describes the condition of the rule, e.g. "temp < 5 or temp > 30" or "temp rose by > 5 within 10m0s"
+func (r *alertRule) condition() string {
+	var parts []string
+
+	if r.Below != nil {
+		parts = append(parts, fmt.Sprintf("%s < %g", r.Metric, *r.Below))
+	}
+
+	if r.Above != nil {
+		parts = append(parts, fmt.Sprintf("%s > %g", r.Metric, *r.Above))
+	}
+
+	if r.RiseBy != nil {
+		parts = append(parts, fmt.Sprintf("%s rose by > %g within %v", r.Metric, *r.RiseBy, time.Duration(r.Within)))
+	}
+
+	if r.FallBy != nil {
+		parts = append(parts, fmt.Sprintf("%s fell by > %g within %v", r.Metric, *r.FallBy, time.Duration(r.Within)))
+	}
+
+	return strings.Join(parts, " or ")
+}
+
+// tracksChange reports whether the rule has a rate of change condition
+func (r *alertRule) tracksChange() bool {
+	return r.RiseBy != nil || r.FallBy != nil
+}
+
+// breaks reports whether the value, or its rise or fall within the window, breaks the rule
+func (r *alertRule) breaks(value, rise, fall float64) bool {
+	return (r.Above != nil && value > *r.Above) || (r.Below != nil && value < *r.Below) ||
+		(r.RiseBy != nil && rise > *r.RiseBy) || (r.FallBy != nil && fall > *r.FallBy)
+}
+
+// change returns the change recorded in the alert fired by the rule, the rise or the negated fall breaking it
+func (r *alertRule) change(rise, fall float64) float64 {
+	if r.RiseBy != nil && rise > *r.RiseBy {
+		return rise
+	}
+
+	if r.FallBy != nil && fall > *r.FallBy {
+		return -fall
+	}
+
+	return 0
+}
+
+// changeWithin returns how much the value of the reading rose above the lowest value and fell below the highest value
+// of the measurement of the device stored within the window before it
+func (a *alerter) changeWithin(ctx context.Context, deviceId, metric string, value float64, timestamp time.Time, window time.Duration) (float64, float64, error) {
+	points, err := a.store.MetricRange(ctx, deviceId, metric, timestamp.Add(-window), timestamp)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rise, fall float64
+
+	for _, point := range points {
+		rise = math.Max(rise, value-point.Value)
+		fall = math.Max(fall, point.Value-value)
+	}
+
+	return rise, fall, nil
+}
+
+// alertTarget is the metadata of the device of a reading, loaded once per reading on demand.
+type alertTarget struct {
+	registry     *registry
+	deviceId     string
+	groups       []string
+	groupsLoaded bool
+	labels       map[string]string
+}
+
+// Groups returns the groups of the device
+func (t *alertTarget) Groups(ctx context.Context) ([]string, error) {
+	if !t.groupsLoaded {
+		groups, err := t.registry.DeviceGroups(ctx, t.deviceId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.groups, t.groupsLoaded = groups, true
+	}
+
+	return t.groups, nil
+}
+
+// Labels returns the labels of the device
+func (t *alertTarget) Labels(ctx context.Context) (map[string]string, error) {
+	if t.labels == nil {
+		labels, err := t.registry.Labels(ctx, t.deviceId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.labels = labels
+	}
+
+	return t.labels, nil
+}
+
+// appliesTo reports whether the rule applies to the device of the reading
+func (r *alertRule) appliesTo(ctx context.Context, sensorData *SensorData, target *alertTarget) (bool, error) {
+	if r.deviceTypes != nil && !r.deviceTypes[sensorData.DeviceType] {
+		return false, nil
+	}
+
+	if r.Group != "" {
+		groups, err := target.Groups(ctx)
+
+		if err != nil {
+			return false, err
+		}
+
+		if !contains(groups, r.Group) {
+			return false, nil
+		}
+	}
+
+	if len(r.selector) > 0 {
+		labels, err := target.Labels(ctx)
+
+		if err != nil {
+			return false, err
+		}
+
+		if !r.selector.matches(labels) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// evaluate fires or resolves the alerts of the device of the reading for every rule on its measurements
+func (a *alerter) evaluate(ctx context.Context, sensorData *SensorData) error {
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return err
+	}
+
+	// Readings older than the latest one of the device, e.g. buffered by a gateway, don't change its alerts.
+	latest, err := a.store.Latest(ctx, sensorData.DeviceId)
+
+	if err != nil {
+		return err
+	}
+
+	if latestTime, err := latest.Timestamp(); err == nil && latestTime.After(timestamp) {
+		return nil
+	}
+
+	measurements := sensorData.Measurements()
+	target := &alertTarget{registry: a.registry, deviceId: sensorData.DeviceId}
+
+	for _, rule := range a.rules {
+		value, found := measurements[rule.Metric]
+
+		if !found {
+			continue
+		}
+
+		applies, err := rule.appliesTo(ctx, sensorData, target)
+
+		if err != nil {
+			return err
+		}
+
+		if !applies {
+			continue
+		}
+
+		var rise, fall float64
+
+		if rule.tracksChange() {
+			if rise, fall, err = a.changeWithin(ctx, sensorData.DeviceId, rule.Metric, value, timestamp, time.Duration(rule.Within)); err != nil {
+				return err
+			}
+		}
+
+		if rule.breaks(value, rise, fall) {
+			alert, err := a.registry.FireAlert(ctx, rule, sensorData.DeviceId, value, rule.change(rise, fall), timestamp)
+
+			if err != nil {
+				return err
+			}
+
+			if alert != nil {
+				log.Printf("Alert %s fired: %s of device %s is %g", alert.Id, rule.Name, sensorData.DeviceId, value)
+				a.notify(ctx, alertEventFired, alert, rule, sensorData, value, target)
+			}
+		} else {
+			id, err := a.registry.ResolveAlert(ctx, rule, sensorData.DeviceId, value, timestamp, a.history)
+
+			if err != nil {
+				return err
+			}
+
+			if id != "" {
+				log.Printf("Alert %s resolved: %s of device %s is %g", id, rule.Name, sensorData.DeviceId, value)
+
+				if len(a.notifiers) > 0 {
+					alert, err := a.registry.Alert(ctx, id)
+
+					if err != nil {
+						return err
+					}
+
+					a.notify(ctx, alertEventResolved, alert, rule, sensorData, value, target)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// fireAlertScript creates the alert of a rule and a device unless one is firing already, in which case its last value is updated.
+var fireAlertScript = redis.NewScript(`
+local id = redis.call('HGET', KEYS[1], ARGV[1])
+
+if id then
+  redis.call('HSET', KEYS[3] .. id, 'last_value', ARGV[3])
+  return 0
+end
+
+redis.call('HSET', KEYS[2], unpack(ARGV, 4))
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// resolveAlertScript resolves the firing alert of a rule and a device, moves it to the history and trims the history.
+var resolveAlertScript = redis.NewScript(`
+local id = redis.call('HGET', KEYS[1], ARGV[1])
+
+if not id then
+  return false
+end
+
+local key = KEYS[3] .. id
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HSET', key, 'state', 'resolved', 'last_value', ARGV[2], 'resolved_at', ARGV[3])
+redis.call('EXPIRE', key, ARGV[5])
+redis.call('ZADD', KEYS[2], ARGV[4], id)
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', '(' .. ARGV[6])
+return id
+`)
+
+// ackAlertScript records the acknowledgement of an alert, -1 when the alert doesn't exist and 0 when acknowledged already.
+var ackAlertScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return -1
+end
+
+if redis.call('HEXISTS', KEYS[1], 'acked_at') == 1 then
+  return 0
+end
+
+redis.call('HSET', KEYS[1], 'acked_by', ARGV[1], 'ack_note', ARGV[2], 'acked_at', ARGV[3])
+return 1
+`)
+
+// FireAlert creates the alert of the rule for the device unless one is firing already, the new alert is returned
+func (r *registry) FireAlert(ctx context.Context, rule *alertRule, deviceId string, value, change float64, at time.Time) (*Alert, error) {
+	id, err := newCommandId()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on generating an alert id: %v", err)
+	}
+
+	alert := &Alert{
+		Id:        id,
+		Rule:      rule.Name,
+		DeviceId:  deviceId,
+		Severity:  rule.Severity,
+		Condition: rule.condition(),
+		State:     alertFiring,
+		Value:     value,
+		Change:    change,
+		LastValue: value,
+		StartedAt: at.UTC().Format(time.RFC3339),
+	}
+
+	formattedValue := strconv.FormatFloat(value, 'g', -1, 64)
+	args := []interface{}{rule.Name + ":" + deviceId, id, formattedValue,
+		"rule", alert.Rule,
+		"device_id", alert.DeviceId,
+		"severity", alert.Severity,
+		"condition", alert.Condition,
+		"state", alert.State,
+		"value", formattedValue,
+		"change", strconv.FormatFloat(change, 'g', -1, 64),
+		"last_value", formattedValue,
+		"started_at", alert.StartedAt,
+	}
+
+	created, err := fireAlertScript.Run(ctx, r.rdb, []string{activeAlertsKey, alertKeyPrefix + id, alertKeyPrefix}, args...).Int()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on firing the alert %s of device %s in the cache: %v", rule.Name, deviceId, err)
+	}
+
+	if created == 0 {
+		return nil, nil
+	}
+
+	return alert, nil
+}
+
+// ResolveAlert resolves the firing alert of the rule for the device, its id is returned or empty when none was firing
+func (r *registry) ResolveAlert(ctx context.Context, rule *alertRule, deviceId string, value float64, at time.Time, history time.Duration) (string, error) {
+	id, err := resolveAlertScript.Run(ctx, r.rdb, []string{activeAlertsKey, alertHistoryKey, alertKeyPrefix},
+		rule.Name+":"+deviceId,
+		strconv.FormatFloat(value, 'g', -1, 64),
+		at.UTC().Format(time.RFC3339),
+		at.UnixMilli(),
+		int64(history/time.Second),
+		time.Now().Add(-history).UnixMilli(),
+	).Text()
+
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("fatal error on resolving the alert %s of device %s in the cache: %v", rule.Name, deviceId, err)
+	}
+
+	return id, nil
+}
+
+// Alert returns the alert with the given id
+func (r *registry) Alert(ctx context.Context, id string) (*Alert, error) {
+	fields, err := r.rdb.HGetAll(ctx, alertKeyPrefix+id).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the alert %s from the cache: %v", id, err)
+	}
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("alert %s %w", id, errNotFound)
+	}
+
+	return decodeAlert(id, fields), nil
+}
+
+// Alerts returns the firing alerts and the alerts resolved within [from, to], newest first
+func (r *registry) Alerts(ctx context.Context, firing, resolved bool, from, to time.Time) ([]Alert, error) {
+	var ids []string
+
+	if firing {
+		active, err := r.rdb.HVals(ctx, activeAlertsKey).Result()
+
+		if err != nil {
+			return nil, fmt.Errorf("fatal error on retrieving the firing alerts from the cache: %v", err)
+		}
+
+		ids = append(ids, active...)
+	}
+
+	if resolved {
+		history, err := r.rdb.ZRevRangeByScore(ctx, alertHistoryKey, &redis.ZRangeBy{
+			Min: strconv.FormatInt(from.UnixMilli(), 10),
+			Max: strconv.FormatInt(to.UnixMilli(), 10),
+		}).Result()
+
+		if err != nil {
+			return nil, fmt.Errorf("fatal error on retrieving the alert history from the cache: %v", err)
+		}
+
+		ids = append(ids, history...)
+	}
+
+	pipe := r.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, alertKeyPrefix+id)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("fatal error on retrieving the alerts from the cache: %v", err)
+	}
+
+	alerts := make([]Alert, 0, len(ids))
+
+	for i, id := range ids {
+		// The alerts past the history may be gone before the history is trimmed.
+		if fields := cmds[i].Val(); len(fields) > 0 {
+			alerts = append(alerts, *decodeAlert(id, fields))
+		}
+	}
+
+	// Firing alerts come first, then the alerts resolved last.
+	sort.SliceStable(alerts, func(i, j int) bool {
+		if alerts[i].State != alerts[j].State {
+			return alerts[i].State == alertFiring
+		}
+
+		if alerts[i].State == alertFiring {
+			return alerts[i].StartedAt > alerts[j].StartedAt
+		}
+
+		return alerts[i].ResolvedAt > alerts[j].ResolvedAt
+	})
+
+	return alerts, nil
+}
+
+// AckAlert records the acknowledgement of the alert by an operator
+func (r *registry) AckAlert(ctx context.Context, id string, ack *AlertAck) error {
+	result, err := ackAlertScript.Run(ctx, r.rdb, []string{alertKeyPrefix + id}, ack.By, ack.Note, ack.At).Int()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on acknowledging the alert %s in the cache: %v", id, err)
+	}
+
+	switch result {
+	case -1:
+		return fmt.Errorf("alert %s %w", id, errNotFound)
+	case 0:
+		return fmt.Errorf("acknowledgement of alert %s %w", id, errAlreadyExists)
+	}
+
+	return nil
+}
+
+// decodeAlert builds the alert from its hash fields
+func decodeAlert(id string, fields map[string]string) *Alert {
+	value, _ := strconv.ParseFloat(fields["value"], 64)
+	change, _ := strconv.ParseFloat(fields["change"], 64)
+	lastValue, _ := strconv.ParseFloat(fields["last_value"], 64)
+
+	alert := &Alert{
+		Id:         id,
+		Rule:       fields["rule"],
+		DeviceId:   fields["device_id"],
+		Severity:   fields["severity"],
+		Condition:  fields["condition"],
+		State:      fields["state"],
+		Value:      value,
+		Change:     change,
+		LastValue:  lastValue,
+		StartedAt:  fields["started_at"],
+		ResolvedAt: fields["resolved_at"],
+	}
+
+	if fields["acked_at"] != "" {
+		alert.Ack = &AlertAck{By: fields["acked_by"], Note: fields["ack_note"], At: fields["acked_at"]}
+	}
+
+	return alert
+}
+
+// registerAlertRoutes mounts the alert endpoints on the given group
+func registerAlertRoutes(g *echo.Group, reg *registry) {
+	g.GET("", func(c echo.Context) error {
+		return listAlerts(c, reg)
+	})
+	g.GET("/:id", func(c echo.Context) error {
+		return getAlert(c, reg)
+	})
+	g.POST("/:id/ack", func(c echo.Context) error {
+		return ackAlert(c, reg)
+	})
+}
+
+// listAlerts returns the firing alerts and the last resolved ones, filtered by the state, device and rule query parameters
+func listAlerts(c echo.Context, reg *registry) error {
+	state := c.QueryParam("state")
+
+	if state != "" && state != alertFiring && state != alertResolved {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'state' %s must be firing or resolved", state))
+	}
+
+	from, to, err := parseTimeRange(c, defaultQueryWindow)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	limit := defaultAlertsLimit
+
+	if raw := c.QueryParam("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+
+		if err != nil || parsed < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'limit' %s must be a positive number", raw))
+		}
+
+		limit = parsed
+	}
+
+	alerts, err := reg.Alerts(c.Request().Context(), state != alertResolved, state != alertFiring, from, to)
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	device, rule := c.QueryParam("device"), c.QueryParam("rule")
+	filtered := []Alert{}
+	resolved := 0
+
+	for _, alert := range alerts {
+		if (device != "" && alert.DeviceId != device) || (rule != "" && alert.Rule != rule) {
+			continue
+		}
+
+		// Every firing alert is listed, the limit only applies to the history.
+		if alert.State == alertResolved {
+			if resolved == limit {
+				break
+			}
+
+			resolved++
+		}
+
+		filtered = append(filtered, alert)
+	}
+
+	return c.JSON(http.StatusOK, filtered)
+}
+
+// getAlert returns the alert
+func getAlert(c echo.Context, reg *registry) error {
+	alert, err := reg.Alert(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, alert)
+}
+
+// ackAlert records the acknowledgement of the alert by the operator of the request body
+func ackAlert(c echo.Context, reg *registry) error {
+	var request alertAckRequest
+
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the acknowledgement from the request body: %v", err))
+	}
+
+	if strings.TrimSpace(request.By) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Acknowledgement 'by' is required")
+	}
+
+	if len(request.By) > maxAckNoteLength || len(request.Note) > maxAckNoteLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Acknowledgement 'by' and 'note' must be at most %d characters", maxAckNoteLength))
+	}
+
+	ack := &AlertAck{By: request.By, Note: request.Note, At: time.Now().UTC().Format(time.RFC3339)}
+
+	if err := reg.AckAlert(c.Request().Context(), c.Param("id"), ack); err != nil {
+		return registryHTTPError(err)
+	}
+
+	alert, err := reg.Alert(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, alert)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// apiTokensKey is the Redis set holding the ids of all API tokens.
+	apiTokensKey = "api-tokens"
+	// apiTokenKeyPrefix prefixes the hash holding an API token, with the SHA-256 of its secret but never the secret.
+	apiTokenKeyPrefix = "api-token:"
+	// apiTokenPrefix starts the API tokens, "sdt_<id>_<secret>", so that a leaked one is recognized.
+	apiTokenPrefix = "sdt_"
+	// tenantContextKey holds in the echo context the tenant of the API token of the request.
+	tenantContextKey = "tenant"
+)
+
+// apiTokenScopes are the scopes an API token is granted from.
+var apiTokenScopes = []string{"ingest", "read", "write"}
+
+// APITokensConfig requires an API token on the routes of the API, the admin routes excepted.
+type APITokensConfig struct {
+	Enabled bool   `json:"enabled"` // Rejects the requests without a valid token with the scope of their route
+	Header  string `json:"header"`  // Header carrying the token, X-Api-Key by default, a bearer Authorization is accepted too
+}
+
+// APIToken is an API token of a tenant, its secret is only returned when created or rotated.
+type APIToken struct {
+	Id        string   `json:"id"`
+	Tenant    string   `json:"tenant"`
+	Name      string   `json:"name,omitempty"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt string   `json:"created_at"`
+	ExpiresAt string   `json:"expires_at,omitempty"` // Never expires when empty
+	RotatedAt string   `json:"rotated_at,omitempty"`
+	Token     string   `json:"token,omitempty"` // Secret to send, only known when created or rotated
+
+	hash            string
+	previousHash    string // Hash before the last rotation, valid until previousExpires
+	previousExpires string
+}
+
+// apiTokenRequest is the body creating an API token.
+type apiTokenRequest struct {
+	Tenant    string   `json:"tenant"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn Duration `json:"expires_in"` // Never expires when unset
+}
+
+// rotateTokenRequest is the optional body rotating an API token.
+type rotateTokenRequest struct {
+	Grace Duration `json:"grace"` // Time the previous secret stays valid, for the clients to switch
+}
+
+// tokenAuthenticator rejects the requests without a valid API token having the scope of their route.
+type tokenAuthenticator struct {
+	registry *registry
+	header   string
+}
+
+// newTokenAuthenticator applies the defaults of the API tokens, nil when disabled
+func newTokenAuthenticator(config APITokensConfig, reg *registry) *tokenAuthenticator {
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.Header == "" {
+		config.Header = "X-Api-Key"
+	}
+
+	return &tokenAuthenticator{registry: reg, header: config.Header}
+}
+
+// middleware checks the token of the request and the scope of its route, the tenant of the token is kept in the
+// context for the metering. The admin routes are protected by the admin address or, on the public server, by the IP
+// filter instead, the API doesn't start with the tokens otherwise.
+func (a *tokenAuthenticator) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if strings.HasPrefix(c.Path(), "/admin") {
+			return next(c)
+		}
+
+		secret := c.Request().Header.Get(a.header)
+
+		if bearer, found := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer "); found {
+			secret = strings.TrimSpace(bearer)
+		}
+
+		if secret == "" {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return newProblem(http.StatusUnauthorized, "unauthorized", fmt.Sprintf("The request has no API token in the %s header or as a bearer token", a.header))
+		}
+
+		token, err := a.authenticate(c.Request().Context(), secret, time.Now())
+
+		if err != nil {
+			return registryHTTPError(err)
+		}
+
+		if token == nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return newProblem(http.StatusUnauthorized, "unauthorized", "The API token is unknown, revoked or expired")
+		}
+
+		if scope := routeScope(c); !token.hasScope(scope) {
+			return newProblem(http.StatusForbidden, "insufficient_scope", fmt.Sprintf("The API token doesn't have the %s scope of %s %s", scope, c.Request().Method, c.Path()))
+		}
+
+		c.Set(tenantContextKey, token.Tenant)
+
+		return next(c)
+	}
+}
+
+// authenticate returns the token of the secret, nil when it is unknown, revoked or expired
+func (a *tokenAuthenticator) authenticate(ctx context.Context, secret string, now time.Time) (*APIToken, error) {
+	id, ok := apiTokenId(secret)
+
+	if !ok {
+		return nil, nil
+	}
+
+	token, err := a.registry.APIToken(ctx, id)
+
+	if err != nil || token == nil {
+		return nil, err
+	}
+
+	hash := hashAPIToken(secret)
+
+	if token.ExpiresAt != "" && token.ExpiresAt <= now.UTC().Format(time.RFC3339) {
+		return nil, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(token.hash)) == 1 {
+		return token, nil
+	}
+
+	if token.previousHash != "" && token.previousExpires > now.UTC().Format(time.RFC3339) &&
+		subtle.ConstantTimeCompare([]byte(hash), []byte(token.previousHash)) == 1 {
+		return token, nil
+	}
+
+	return nil, nil
+}
+
+// routeScope returns the scope required by the route of the request, the queries posted by GraphQL and Grafana only read
+func routeScope(c echo.Context) string {
+	method := c.Request().Method
+
+	switch path := c.Path(); {
+	case method == http.MethodPost && (path == "/process" || path == "/ttn/uplink"):
+		return "ingest"
+	case method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions:
+		return "read"
+	case path == "/graphql" || path == "/grafana/search" || path == "/grafana/query":
+		return "read"
+	default:
+		return "write"
+	}
+}
+
+// hasScope reports whether the token is granted the scope
+func (t *APIToken) hasScope(scope string) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newAPITokenSecret returns a random secret of the token with the given id
+func newAPITokenSecret(id string) (string, error) {
+	secret := make([]byte, 32)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return apiTokenPrefix + id + "_" + hex.EncodeToString(secret), nil
+}
+
+// apiTokenId returns the id of the token of a secret, false when it isn't an API token
+func apiTokenId(secret string) (string, bool) {
+	id, _, found := strings.Cut(strings.TrimPrefix(secret, apiTokenPrefix), "_")
+
+	return id, found && strings.HasPrefix(secret, apiTokenPrefix) && id != ""
+}
+
+// hashAPIToken returns the hex SHA-256 of the secret, enough for a random secret of 256 bits
+func hashAPIToken(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// SaveAPIToken saves the token with the hash of its secret
+func (r *registry) SaveAPIToken(ctx context.Context, token *APIToken) error {
+	pipe := r.rdb.TxPipeline()
+	pipe.SAdd(ctx, apiTokensKey, token.Id)
+	pipe.HSet(ctx, apiTokenKeyPrefix+token.Id, map[string]interface{}{
+		"tenant":           token.Tenant,
+		"name":             token.Name,
+		"scopes":           strings.Join(token.Scopes, ","),
+		"created_at":       token.CreatedAt,
+		"expires_at":       token.ExpiresAt,
+		"rotated_at":       token.RotatedAt,
+		"hash":             token.hash,
+		"previous_hash":    token.previousHash,
+		"previous_expires": token.previousExpires,
+	})
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on saving the API token %s in the cache: %v", token.Id, err)
+	}
+
+	return nil
+}
+
+// APIToken returns the token, nil when it doesn't exist
+func (r *registry) APIToken(ctx context.Context, id string) (*APIToken, error) {
+	fields, err := r.rdb.HGetAll(ctx, apiTokenKeyPrefix+id).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the API token %s from the cache: %v", id, err)
+	}
+
+	if fields["hash"] == "" {
+		return nil, nil
+	}
+
+	return &APIToken{
+		Id:              id,
+		Tenant:          fields["tenant"],
+		Name:            fields["name"],
+		Scopes:          strings.Split(fields["scopes"], ","),
+		CreatedAt:       fields["created_at"],
+		ExpiresAt:       fields["expires_at"],
+		RotatedAt:       fields["rotated_at"],
+		hash:            fields["hash"],
+		previousHash:    fields["previous_hash"],
+		previousExpires: fields["previous_expires"],
+	}, nil
+}
+
+// APITokens returns the tokens of the tenant, of every tenant when empty, sorted by tenant and creation time
+func (r *registry) APITokens(ctx context.Context, tenant string) ([]APIToken, error) {
+	ids, err := r.rdb.SMembers(ctx, apiTokensKey).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the API tokens from the cache: %v", err)
+	}
+
+	tokens := []APIToken{}
+
+	for _, id := range ids {
+		token, err := r.APIToken(ctx, id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if token != nil && (tenant == "" || token.Tenant == tenant) {
+			tokens = append(tokens, *token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Tenant != tokens[j].Tenant {
+			return tokens[i].Tenant < tokens[j].Tenant
+		}
+
+		return tokens[i].CreatedAt < tokens[j].CreatedAt
+	})
+
+	return tokens, nil
+}
+
+// DeleteAPIToken revokes the token
+func (r *registry) DeleteAPIToken(ctx context.Context, id string) error {
+	pipe := r.rdb.TxPipeline()
+	deleted := pipe.Del(ctx, apiTokenKeyPrefix+id)
+	pipe.SRem(ctx, apiTokensKey, id)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on deleting the API token %s from the cache: %v", id, err)
+	}
+
+	if deleted.Val() == 0 {
+		return fmt.Errorf("API token %s %w", id, errNotFound)
+	}
+
+	return nil
+}
+
+// registerTokenRoutes mounts the API token management endpoints on the given group
+func registerTokenRoutes(g *echo.Group, reg *registry) {
+	g.POST("/tokens", func(c echo.Context) error {
+		return createAPIToken(c, reg)
+	})
+	g.GET("/tokens", func(c echo.Context) error {
+		tokens, err := reg.APITokens(c.Request().Context(), c.QueryParam("tenant"))
+
+		if err != nil {
+			return registryHTTPError(err)
+		}
+
+		return c.JSON(http.StatusOK, tokens)
+	})
+	g.POST("/tokens/:id/rotate", func(c echo.Context) error {
+		return rotateAPIToken(c, reg)
+	})
+	g.DELETE("/tokens/:id", func(c echo.Context) error {
+		if err := reg.DeleteAPIToken(c.Request().Context(), c.Param("id")); err != nil {
+			return registryHTTPError(err)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+}
+
+// createAPIToken creates a token of the tenant and returns it with its secret, the only time it is returned
+func createAPIToken(c echo.Context, reg *registry) error {
+	var request apiTokenRequest
+
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the API token from the request body: %v", err))
+	}
+
+	if !idPattern.MatchString(request.Tenant) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Token 'tenant' must be 1 to 64 letters, digits, '_', '.' or '-'")
+	}
+
+	if len(request.Name) > 128 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Token 'name' must be at most 128 characters")
+	}
+
+	if len(request.Scopes) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Token 'scopes' must list some of %s", strings.Join(apiTokenScopes, ", ")))
+	}
+
+	for _, scope := range request.Scopes {
+		if !(&APIToken{Scopes: apiTokenScopes}).hasScope(scope) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Scope %q must be one of %s", scope, strings.Join(apiTokenScopes, ", ")))
+		}
+	}
+
+	if request.ExpiresIn < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Token 'expires_in' must be positive")
+	}
+
+	id, err := newCommandId()
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	token := &APIToken{Id: id, Tenant: request.Tenant, Name: request.Name, Scopes: request.Scopes, CreatedAt: now.Format(time.RFC3339)}
+
+	if request.ExpiresIn > 0 {
+		token.ExpiresAt = now.Add(time.Duration(request.ExpiresIn)).Format(time.RFC3339)
+	}
+
+	if token.Token, err = newAPITokenSecret(id); err != nil {
+		return err
+	}
+
+	token.hash = hashAPIToken(token.Token)
+
+	if err := reg.SaveAPIToken(c.Request().Context(), token); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusCreated, token)
+}
+
+// rotateAPIToken replaces the secret of the token and returns the new one, the previous one stays valid for the grace
+func rotateAPIToken(c echo.Context, reg *registry) error {
+	var request rotateTokenRequest
+
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&request); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the rotation from the request body: %v", err))
+		}
+	}
+
+	if request.Grace < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Rotation 'grace' must be positive")
+	}
+
+	ctx := c.Request().Context()
+	token, err := reg.APIToken(ctx, c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	if token == nil {
+		return registryHTTPError(fmt.Errorf("API token %s %w", c.Param("id"), errNotFound))
+	}
+
+	now := time.Now().UTC()
+	token.previousHash, token.previousExpires = "", ""
+
+	if request.Grace > 0 {
+		token.previousHash, token.previousExpires = token.hash, now.Add(time.Duration(request.Grace)).Format(time.RFC3339)
+	}
+
+	if token.Token, err = newAPITokenSecret(token.Id); err != nil {
+		return err
+	}
+
+	token.hash = hashAPIToken(token.Token)
+	token.RotatedAt = now.Format(time.RFC3339)
+
+	if err := reg.SaveAPIToken(ctx, token); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, token)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAsyncWorkers is the number of readings stored at once without a workers setting.
+	defaultAsyncWorkers = 8
+	// defaultAsyncQueueSize is the number of readings waiting to be stored without a queue_size setting.
+	defaultAsyncQueueSize = 10000
+	// respondAsync is the preference of the clients asking for the asynchronous acknowledgement, RFC 7240.
+	respondAsync = "respond-async"
+)
+
+// AsyncIngestConfig sizes the storage of the readings acknowledged before being stored.
+type AsyncIngestConfig struct {
+	Workers   int `json:"workers"`    // Readings stored at once, 8 by default
+	QueueSize int `json:"queue_size"` // Readings waiting to be stored, 10000 by default, the readings are stored before the response once it is full
+
+	ReceiptTTL Duration `json:"receipt_ttl"` // Time the receipts of the readings can be looked up, 24h by default
+}
+
+// asyncReading is a validated reading waiting to be stored.
+type asyncReading struct {
+	receipt *Receipt
+	*ingestReading
+}
+
+// asyncIngester stores in the background the readings acknowledged after their validation.
+type asyncIngester struct {
+	ingester   *ingester
+	queue      chan asyncReading
+	workers    int
+	receiptTTL time.Duration
+	wg         sync.WaitGroup
+
+	mu     sync.RWMutex // Held to send to the queue, so it isn't closed meanwhile
+	closed bool
+}
+
+// newAsyncIngester validates the sizes of the asynchronous ingest
+func newAsyncIngester(config AsyncIngestConfig, ing *ingester) (*asyncIngester, error) {
+	if config.Workers < 0 || config.QueueSize < 0 || config.ReceiptTTL < 0 {
+		return nil, fmt.Errorf("workers %d, queue size %d and receipt TTL %v must be positive", config.Workers, config.QueueSize, time.Duration(config.ReceiptTTL))
+	}
+
+	if config.Workers == 0 {
+		config.Workers = defaultAsyncWorkers
+	}
+
+	if config.QueueSize == 0 {
+		config.QueueSize = defaultAsyncQueueSize
+	}
+
+	if config.ReceiptTTL == 0 {
+		config.ReceiptTTL = Duration(defaultReceiptTTL)
+	}
+
+	return &asyncIngester{
+		ingester:   ing,
+		queue:      make(chan asyncReading, config.QueueSize),
+		workers:    config.Workers,
+		receiptTTL: time.Duration(config.ReceiptTTL),
+	}, nil
+}
+
+// prefersAsync reports whether the Prefer header of the request asks for the asynchronous acknowledgement
+func prefersAsync(prefer string) bool {
+	for _, preference := range strings.Split(prefer, ",") {
+		name, _, _ := strings.Cut(preference, ";")
+
+		if strings.EqualFold(strings.TrimSpace(name), respondAsync) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enqueue validates the reading and queues it to be stored with a pending receipt, it returns the receipt id. Once
+// the queue is full or without the receipt, the reading is stored before returning without a receipt id, and a
+// dropped duplicate returns errDuplicateReading. A reading dropped before the acknowledgement gets no receipt.
+func (a *asyncIngester) enqueue(ctx context.Context, sensorData *SensorData) (string, error) {
+	accepted, err := a.ingester.accept(ctx, sensorData)
+
+	if errors.Is(err, errDropReading) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	id, err := newReceiptId()
+
+	if err != nil {
+		return "", err
+	}
+
+	reading := asyncReading{ingestReading: accepted}
+	reading.receipt = &Receipt{Id: id, DeviceId: sensorData.DeviceId, Status: receiptPending, ReceivedAt: sensorData.ReceivedAt}
+
+	if len(a.queue) < cap(a.queue) {
+		if err := a.ingester.registry.SaveReceipt(ctx, reading.receipt, a.receiptTTL); err != nil {
+			log.Printf("Reading of device %s stored before the response: %v", sensorData.DeviceId, err)
+			return "", acknowledgeDropped(a.ingester.complete(ctx, accepted))
+		}
+	}
+
+	if a.send(reading) {
+		return id, nil
+	}
+
+	// Filled by a concurrent request since the receipt was saved or closed at shutdown, the receipt is completed but
+	// not returned.
+	err = a.ingester.complete(ctx, accepted)
+	completeReceipt(reading.receipt, err)
+	a.ingester.registry.SaveReceipt(ctx, reading.receipt, a.receiptTTL)
+
+	return "", acknowledgeDropped(err)
+}
+
+// send queues the reading unless the queue is full or closed
+func (a *asyncIngester) send(reading asyncReading) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		return false
+	}
+
+	select {
+	case a.queue <- reading:
+		return true
+	default:
+		return false
+	}
+}
+
+// run stores the queued readings until the queue is closed
+func (a *asyncIngester) run() {
+	for n := 0; n < a.workers; n++ {
+		a.wg.Add(1)
+
+		go func() {
+			defer a.wg.Done()
+
+			for reading := range a.queue {
+				a.store(reading)
+			}
+		}()
+	}
+}
+
+// store stores a queued reading and completes its receipt, a failure is logged with the receipt id, a reading dropped
+// by a stage completes it as dropped
+func (a *asyncIngester) store(reading asyncReading) {
+	ctx := context.Background()
+	err := a.ingester.complete(ctx, reading.ingestReading)
+
+	if err != nil && !errors.Is(err, errDuplicateReading) && !errors.Is(err, errDropReading) {
+		log.Printf("Reading %s of device %s not stored: %v", reading.receipt.Id, reading.sensorData.DeviceId, err)
+	}
+
+	completeReceipt(reading.receipt, err)
+
+	if err := a.ingester.registry.SaveReceipt(ctx, reading.receipt, a.receiptTTL); err != nil {
+		log.Printf("Receipt %s not completed: %v", reading.receipt.Id, err)
+	}
+}
+
+// close stores the queued readings and stops, the readings enqueued afterwards are stored before the response
+func (a *asyncIngester) close() {
+	a.mu.Lock()
+	a.closed = true
+	close(a.queue)
+	a.mu.Unlock()
+
+	a.wg.Wait()
+}
+
+// newReceiptId returns a random receipt id
+func newReceiptId() (string, error) {
+	id := make([]byte, 12)
+
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
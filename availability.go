@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Outage is a period the device was down, from a gap in its readings or a restart.
+type Outage struct {
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Duration string   `json:"duration"`
+	Causes   []string `json:"causes"` // "gap" and "restart"
+}
+
+// availabilityReport is the share of a time range a device was up, for the SLA reports.
+type availabilityReport struct {
+	DeviceId         string    `json:"device_id"`
+	ExpectedInterval string    `json:"expected_interval"`
+	From             time.Time `json:"from"`
+	To               time.Time `json:"to"`
+	Readings         int       `json:"readings"`     // Readings received within the range
+	Restarts         int       `json:"restarts"`     // Restarts detected within the range
+	Availability     float64   `json:"availability"` // Percentage of the range the device was up
+	Uptime           string    `json:"uptime"`
+	Downtime         string    `json:"downtime"`
+	Outages          []Outage  `json:"outages"`
+}
+
+// downPeriod is a period the device was down for a cause, before the overlapping ones are merged.
+type downPeriod struct {
+	start, end time.Time
+	cause      string
+}
+
+// findOutages returns the periods the device was down within [from, to] from its readings, oldest first. A gap of
+// more than gapTolerance intervals is down from the time the next reading was due to the reading ending it, a restart
+// from the reading before it to the boot of the device, the time of the reading minus its uptime. It returns the
+// outages, their total duration and the number of restarts.
+func findOutages(readings []SensorData, times []time.Time, from, to time.Time, interval time.Duration) ([]Outage, time.Duration, int) {
+	var periods []downPeriod
+	threshold := time.Duration(float64(interval) * gapTolerance)
+	previous := from
+	restarts := 0
+
+	for n, current := range append(times, to) {
+		if current.Sub(previous) > threshold {
+			periods = append(periods, downPeriod{start: previous.Add(interval), end: current, cause: "gap"})
+		}
+
+		if n > 0 && n < len(readings) && readings[n].Uptime < readings[n-1].Uptime {
+			restarts++
+			boot := current.Add(-time.Duration(readings[n].Uptime) * time.Second)
+
+			if boot.After(previous) {
+				periods = append(periods, downPeriod{start: previous, end: boot, cause: "restart"})
+			}
+		}
+
+		previous = current
+	}
+
+	sort.SliceStable(periods, func(i, j int) bool {
+		return periods[i].start.Before(periods[j].start)
+	})
+
+	// The overlapping periods are merged, a restart during a gap is a single outage.
+	var merged []downPeriod
+
+	for _, period := range periods {
+		if last := len(merged) - 1; last >= 0 && !period.start.After(merged[last].end) {
+			if period.end.After(merged[last].end) {
+				merged[last].end = period.end
+			}
+
+			if !strings.Contains(merged[last].cause, period.cause) {
+				merged[last].cause += "," + period.cause
+			}
+
+			continue
+		}
+
+		merged = append(merged, period)
+	}
+
+	outages := make([]Outage, 0, len(merged))
+	var downtime time.Duration
+
+	for _, period := range merged {
+		causes := strings.Split(period.cause, ",")
+		sort.Strings(causes)
+		downtime += period.end.Sub(period.start)
+		outages = append(outages, Outage{
+			Start:    period.start.UTC().Format(time.RFC3339),
+			End:      period.end.UTC().Format(time.RFC3339),
+			Duration: period.end.Sub(period.start).String(),
+			Causes:   causes,
+		})
+	}
+
+	return outages, downtime, restarts
+}
+
+// getAvailability returns the percentage of the time range the device was up, computed from the gaps in its readings
+// and its restarts
+func getAvailability(c echo.Context, reg *registry, store Store, intervals map[string]Duration) error {
+	ctx := c.Request().Context()
+	deviceId := c.Param("id")
+
+	from, to, err := parseTimeRange(c, defaultQueryWindow)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// The future isn't a downtime yet.
+	if now := time.Now().UTC(); to.After(now) {
+		to = now
+	}
+
+	if !from.Before(to) {
+		return echo.NewHTTPError(http.StatusBadRequest, "'from' must be in the past and before 'to'")
+	}
+
+	interval, err := deviceInterval(ctx, reg, store, intervals, deviceId)
+
+	if err != nil {
+		return err
+	}
+
+	readings, err := store.Range(ctx, deviceId, from, to)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the history of device %s. %v", deviceId, err))
+	}
+
+	times := make([]time.Time, 0, len(readings))
+
+	for _, sensorData := range readings {
+		timestamp, err := sensorData.Timestamp()
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't read the history of device %s. %v", deviceId, err))
+		}
+
+		times = append(times, timestamp)
+	}
+
+	outages, downtime, restarts := findOutages(readings, times, from, to, interval)
+	uptime := to.Sub(from) - downtime
+
+	return c.JSON(http.StatusOK, availabilityReport{
+		DeviceId:         deviceId,
+		ExpectedInterval: interval.String(),
+		From:             from,
+		To:               to,
+		Readings:         len(readings),
+		Restarts:         restarts,
+		Availability:     math.Round(float64(uptime)/float64(to.Sub(from))*100000) / 1000,
+		Uptime:           uptime.String(),
+		Downtime:         downtime.String(),
+		Outages:          outages,
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// benchResult is the outcome of a benchmarked operation.
+type benchResult struct {
+	name      string
+	elapsed   time.Duration
+	latencies []time.Duration
+	errors    int
+}
+
+// percentile returns the latency below which the given percentage of the calls completed
+func (r *benchResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+
+	return r.latencies[int(float64(len(r.latencies)-1)*p/100)]
+}
+
+// runBench measures the ingest and read throughput and latency of the configured storage backend or the one of the
+// flags, e.g. sensor-api bench -redis-url localhost:6379 -devices 100 -readings 10000. It exits with 1 when a call
+// fails or a p99 latency is above -max-p99, so a regression of the storage layer fails the release pipeline.
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	redisAddress := flags.String("redis-url", "localhost:6379", "Redis server address")
+	redisPassword := flags.String("redis-password", os.Getenv("REDIS_PASSWORD"), "Redis server password")
+	configPath := flags.String("config", "", "Path to the JSON configuration file, its backend or shards are benchmarked when set")
+	backend := flags.String("backend", "", "Backend benchmarked, redis, sqlite, bolt or clickhouse, the configured one by default")
+	path := flags.String("path", "", "Database file of the sqlite or bolt backend, the configured one by default")
+	devices := flags.Int("devices", 100, "Number of simulated devices")
+	readings := flags.Int("readings", 10000, "Number of readings ingested, then read back")
+	concurrency := flags.Int("concurrency", 16, "Number of concurrent clients")
+	prefix := flags.String("prefix", "bench-", "Prefix of the ids of the simulated devices, their data is deleted afterwards")
+	maxP99 := flags.Duration("max-p99", 0, "Fails the benchmark when the p99 latency of an operation is above it, not checked when 0")
+
+	flags.Parse(args)
+
+	if *devices < 1 || *readings < 1 || *concurrency < 1 {
+		log.Fatalf("devices, readings and concurrency must be positive")
+	}
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	if *backend == "" {
+		*backend = config.Storage.Backend
+	}
+
+	if *backend == "" {
+		*backend = "redis"
+	}
+
+	store, err := openBackendStore(*backend, *path, config, *redisAddress, *redisPassword)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize %s storage: %v", *backend, err)
+	}
+
+	ids := make([]string, *devices)
+
+	for i := range ids {
+		ids[i] = *prefix + strconv.Itoa(i)
+	}
+
+	ctx := context.Background()
+
+	start := time.Now().Add(-time.Duration(*readings) * time.Second).UTC()
+	results := []*benchResult{
+		benchOperation("save", *readings, *concurrency, func(i int) error {
+			return store.Save(ctx, benchReading(ids[i%len(ids)], start.Add(time.Duration(i)*time.Second)))
+		}),
+		benchOperation("latest", *readings, *concurrency, func(i int) error {
+			_, err := store.Latest(ctx, ids[rand.Intn(len(ids))])
+			return err
+		}),
+		benchOperation("range", *readings, *concurrency, func(i int) error {
+			_, err := store.Range(ctx, ids[rand.Intn(len(ids))], start, time.Now())
+			return err
+		}),
+		benchOperation("metric_range", *readings, *concurrency, func(i int) error {
+			_, err := store.MetricRange(ctx, ids[rand.Intn(len(ids))], "temp", start, time.Now())
+			return err
+		}),
+	}
+
+	failed := printBenchReport(os.Stdout, results, *maxP99)
+	purgeBenchDevices(ctx, store, ids)
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// benchOperation calls the operation the given number of times from concurrent clients and records their latency
+func benchOperation(name string, calls, concurrency int, operation func(i int) error) *benchResult {
+	result := &benchResult{name: name, latencies: make([]time.Duration, calls)}
+	work := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	start := time.Now()
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range work {
+				callStart := time.Now()
+				err := operation(i)
+				result.latencies[i] = time.Since(callStart)
+
+				if err != nil {
+					mu.Lock()
+
+					if result.errors == 0 {
+						log.Printf("Benchmark of %s failed: %v", name, err)
+					}
+
+					result.errors++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < calls; i++ {
+		work <- i
+	}
+
+	close(work)
+	wg.Wait()
+
+	result.elapsed = time.Since(start)
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+
+	return result
+}
+
+// benchReading returns a simulated reading of the device
+func benchReading(deviceId string, at time.Time) *SensorData {
+	humidity := float32(40 + rand.Float64()*20)
+
+	return &SensorData{
+		Time:       at.Format(time.RFC3339),
+		DeviceId:   deviceId,
+		DeviceType: "A",
+		Uptime:     int(at.Unix() % 86400),
+		Temp:       float32(15 + rand.Float64()*10),
+		Humidity:   &humidity,
+		ReceivedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// printBenchReport writes the throughput and the latency percentiles of every operation, it reports whether the
+// benchmark failed
+func printBenchReport(w io.Writer, results []*benchResult, maxP99 time.Duration) bool {
+	failed := false
+
+	fmt.Fprintf(w, "%-14s %8s %8s %12s %10s %10s %10s %10s\n", "operation", "calls", "errors", "ops/s", "p50", "p95", "p99", "max")
+
+	for _, r := range results {
+		calls := len(r.latencies)
+		fmt.Fprintf(w, "%-14s %8d %8d %12.1f %10v %10v %10v %10v\n",
+			r.name,
+			calls,
+			r.errors,
+			float64(calls)/r.elapsed.Seconds(),
+			r.percentile(50).Round(time.Microsecond),
+			r.percentile(95).Round(time.Microsecond),
+			r.percentile(99).Round(time.Microsecond),
+			r.percentile(100).Round(time.Microsecond),
+		)
+
+		if r.errors > 0 {
+			failed = true
+		}
+
+		if maxP99 > 0 && r.percentile(99) > maxP99 {
+			fmt.Fprintf(w, "%s: p99 %v is above the maximum %v\n", r.name, r.percentile(99).Round(time.Microsecond), maxP99)
+			failed = true
+		}
+	}
+
+	return failed
+}
+
+// deviceDeleter is a store able to delete all the data of a device.
+type deviceDeleter interface {
+	deleteDevice(ctx context.Context, id string) error
+}
+
+// purgeBenchDevices deletes the data of the simulated devices from the storage
+func purgeBenchDevices(ctx context.Context, store Store, ids []string) {
+	for _, id := range ids {
+		var deleter deviceDeleter
+
+		switch s := store.(type) {
+		case *shardedStore:
+			deleter = s.shardOf(id).store
+		case deviceDeleter:
+			deleter = s
+		default:
+			return
+		}
+
+		if err := deleter.deleteDevice(ctx, id); err != nil {
+			log.Printf("Data of benchmark device %s not deleted: %v", id, err)
+		}
+	}
+}
+
+// deleteDevice deletes the latest reading, the history and the measurements of the device
+func (s *redisStore) deleteDevice(ctx context.Context, id string) error {
+	names, err := s.rdb.SMembers(ctx, metricsKeyPrefix+id).Result()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on retrieving the metrics of device %s from the cache: %v", id, err)
+	}
+
+	pipe := s.rdb.TxPipeline()
+	pipe.Del(ctx, latestKeyPrefix+id, historyKeyPrefix+id, metricsKeyPrefix+id)
+	pipe.HDel(ctx, latestTimesKey, id)
+	pipe.SRem(ctx, devicesKey, id)
+
+	for _, name := range names {
+		pipe.Del(ctx, metricKey(id, name))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on deleting the data of device %s from the cache: %v", id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchDevices is the number of simulated devices of the Go benchmarks.
+const benchDevices = 100
+
+// BenchmarkSQLiteStore measures the operations of the sqlite backend on a temporary database
+func BenchmarkSQLiteStore(b *testing.B) {
+	store, err := newSQLiteStore(filepath.Join(b.TempDir(), "bench.db"))
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkStore(b, store)
+}
+
+// BenchmarkBoltStore measures the operations of the bolt backend on a temporary database
+func BenchmarkBoltStore(b *testing.B) {
+	store, err := newBoltStore(filepath.Join(b.TempDir(), "bench.bolt"))
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkStore(b, store)
+}
+
+// BenchmarkRedisStore measures the operations of the Redis backend on the server of BENCH_REDIS_URL
+func BenchmarkRedisStore(b *testing.B) {
+	address := os.Getenv("BENCH_REDIS_URL")
+
+	if address == "" {
+		b.Skip("BENCH_REDIS_URL is not set")
+	}
+
+	rdb, err := getRedisClient(RedisConfig{}, os.Getenv("REDIS_PASSWORD"), address)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkStore(b, newRedisStore(rdb))
+}
+
+// BenchmarkClickHouseStore measures the operations of the clickhouse backend on the server of
+// BENCH_CLICKHOUSE_ADDRESS
+func BenchmarkClickHouseStore(b *testing.B) {
+	address := os.Getenv("BENCH_CLICKHOUSE_ADDRESS")
+
+	if address == "" {
+		b.Skip("BENCH_CLICKHOUSE_ADDRESS is not set")
+	}
+
+	store, err := newClickHouseStore(ClickHouseConfig{Address: address})
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkStore(b, store)
+}
+
+// benchmarkStore runs the operations of the bench command against the store, the simulated devices are deleted
+// afterwards
+func benchmarkStore(b *testing.B, store Store) {
+	ctx := context.Background()
+	ids := make([]string, benchDevices)
+
+	for i := range ids {
+		ids[i] = "gobench-" + strconv.Itoa(i)
+	}
+
+	b.Cleanup(func() {
+		purgeBenchDevices(ctx, store, ids)
+	})
+
+	start := time.Now().Add(-24 * time.Hour).UTC()
+
+	// The reads find a history of 10 readings per device.
+	for i := 0; i < 10*benchDevices; i++ {
+		if err := store.Save(ctx, benchReading(ids[i%benchDevices], start.Add(time.Duration(i)*time.Second))); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("save", func(b *testing.B) {
+		saveStart := start.Add(time.Hour)
+
+		for i := 0; i < b.N; i++ {
+			if err := store.Save(ctx, benchReading(ids[i%benchDevices], saveStart.Add(time.Duration(i)*time.Millisecond))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("latest", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.Latest(ctx, ids[i%benchDevices]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("range", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.Range(ctx, ids[i%benchDevices], start, start.Add(time.Hour)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("metric_range", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.MetricRange(ctx, ids[i%benchDevices], "temp", start, start.Add(time.Hour)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
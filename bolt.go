@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// boltLatestBucket holds the time and the JSON of the latest reading of every device, by device id.
+	boltLatestBucket = []byte("latest")
+	// boltHistoryBucket holds a bucket of the readings per device, keyed by their time and JSON.
+	boltHistoryBucket = []byte("history")
+	// boltMetricsBucket holds a bucket per device with a bucket of the values per measurement, keyed by their time and value.
+	boltMetricsBucket = []byte("metrics")
+)
+
+// boltStore keeps the readings in an embedded bbolt file, for the installs where no external database may run.
+// The keys start with the ordered time of the reading, so the ranges are read with a cursor from their start.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// newBoltStore opens the database file, created with its buckets when missing
+func newBoltStore(path string) (*boltStore, error) {
+	if path == "" {
+		return nil, errors.New("the bolt backend needs the path of its database file")
+	}
+
+	// The file is locked by the process, a second one fails after the timeout instead of waiting forever.
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltLatestBucket, boltHistoryBucket, boltMetricsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create the buckets of the database %s: %w", path, err)
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// boltTime encodes the time in milliseconds so the keys sort in time order, the times before 1970 included
+func boltTime(millis int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(millis)^(1<<63))
+
+	return key
+}
+
+// boltKeyTime decodes the time in milliseconds at the start of the key
+func boltKeyTime(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[:8]) ^ (1 << 63))
+}
+
+// Save stores the reading in the history of the device and makes it its latest one unless a later one is stored
+func (s *boltStore) Save(ctx context.Context, sensorData *SensorData) error {
+	dataToSave, err := appendSensorData(nil, sensorData)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on marshalling the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on reading the time of the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return putBoltReading(tx, sensorData, boltTime(timestamp.UnixMilli()), dataToSave)
+	})
+
+	if err != nil {
+		return fmt.Errorf("fatal error on saving the device id %s data in the database: %v", sensorData.DeviceId, err)
+	}
+
+	return nil
+}
+
+// putBoltReading puts the reading with its measurements in the transaction, as the latest one of its device unless a
+// later one is stored
+func putBoltReading(tx *bolt.Tx, sensorData *SensorData, at, dataToSave []byte) error {
+	deviceId := []byte(sensorData.DeviceId)
+	latest := tx.Bucket(boltLatestBucket)
+
+	if current := latest.Get(deviceId); current == nil || bytes.Compare(current[:8], at) <= 0 {
+		if err := latest.Put(deviceId, append(append([]byte(nil), at...), dataToSave...)); err != nil {
+			return err
+		}
+	}
+
+	history, err := tx.Bucket(boltHistoryBucket).CreateBucketIfNotExists(deviceId)
+
+	if err != nil {
+		return err
+	}
+
+	if err := history.Put(append(append([]byte(nil), at...), dataToSave...), nil); err != nil {
+		return err
+	}
+
+	metrics, err := tx.Bucket(boltMetricsBucket).CreateBucketIfNotExists(deviceId)
+
+	if err != nil {
+		return err
+	}
+
+	for name, value := range sensorData.Measurements() {
+		values, err := metrics.CreateBucketIfNotExists([]byte(name))
+
+		if err != nil {
+			return err
+		}
+
+		if err := values.Put(strconv.AppendFloat(append([]byte(nil), at...), value, 'g', -1, 64), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Merge stores the reading in place of the ones at its time unless one was received later, in a single transaction
+func (s *boltStore) Merge(ctx context.Context, sensorData *SensorData) (bool, *SensorData, error) {
+	dataToSave, err := appendSensorData(nil, sensorData)
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on marshalling the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on reading the time of the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	var local *SensorData
+	stored := false
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		existing, err := boltReadings(tx, sensorData.DeviceId, timestamp, timestamp)
+
+		if err != nil {
+			return err
+		}
+
+		var replace bool
+
+		if local, stored, replace = resolveMerge(existing, sensorData); !replace {
+			return nil
+		}
+
+		if err := deleteBoltReadings(tx, sensorData.DeviceId, timestamp); err != nil {
+			return err
+		}
+
+		return putBoltReading(tx, sensorData, boltTime(timestamp.UnixMilli()), dataToSave)
+	})
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on merging the device id %s data in the database: %v", sensorData.DeviceId, err)
+	}
+
+	return stored, local, nil
+}
+
+// Latest retrieves the last sensor data of the device
+func (s *boltStore) Latest(ctx context.Context, id string) (*SensorData, error) {
+	var sensorData *SensorData
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		latest := tx.Bucket(boltLatestBucket).Get([]byte(id))
+
+		if latest == nil {
+			return nil
+		}
+
+		sensorData = new(SensorData)
+
+		return json.Unmarshal(latest[8:], sensorData)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on reading the sensor data for device id %s from the database: %v", id, err)
+	}
+
+	if sensorData == nil {
+		return nil, fmt.Errorf("sensor data for device id with %s %w", id, errNotFound)
+	}
+
+	return sensorData, nil
+}
+
+// Range retrieves the sensor data history of the device between from and to
+func (s *boltStore) Range(ctx context.Context, id string, from, to time.Time) ([]SensorData, error) {
+	var history []SensorData
+
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		history, err = boltReadings(tx, id, from, to)
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on reading the sensor data history for device id %s from the database: %v", id, err)
+	}
+
+	return history, nil
+}
+
+// boltReadings decodes the readings of the device between from and to in the transaction
+func boltReadings(tx *bolt.Tx, id string, from, to time.Time) ([]SensorData, error) {
+	history := []SensorData{}
+
+	err := scanBoltRange(tx.Bucket(boltHistoryBucket).Bucket([]byte(id)), from, to, func(key []byte) error {
+		var sensorData SensorData
+
+		if err := json.Unmarshal(key[8:], &sensorData); err != nil {
+			return err
+		}
+
+		history = append(history, sensorData)
+
+		return nil
+	})
+
+	return history, err
+}
+
+// deleteBoltReadings deletes the readings of the device at the time and their measurements in the transaction
+func deleteBoltReadings(tx *bolt.Tx, id string, at time.Time) error {
+	buckets := []*bolt.Bucket{tx.Bucket(boltHistoryBucket).Bucket([]byte(id))}
+
+	if metrics := tx.Bucket(boltMetricsBucket).Bucket([]byte(id)); metrics != nil {
+		err := metrics.ForEach(func(name, _ []byte) error {
+			buckets = append(buckets, metrics.Bucket(name))
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, bucket := range buckets {
+		// The keys are collected first, a cursor moves unreliably over the keys deleted under it.
+		var keys [][]byte
+
+		err := scanBoltRange(bucket, at, at, func(key []byte) error {
+			keys = append(keys, append([]byte(nil), key...))
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteDevice deletes the latest reading, the history and the measurements of the device
+func (s *boltStore) deleteDevice(ctx context.Context, id string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltHistoryBucket, boltMetricsBucket} {
+			if err := tx.Bucket(name).DeleteBucket([]byte(id)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+
+		return tx.Bucket(boltLatestBucket).Delete([]byte(id))
+	})
+
+	if err != nil {
+		return fmt.Errorf("fatal error on deleting the data of device %s from the database: %v", id, err)
+	}
+
+	return nil
+}
+
+// Devices lists the ids of all devices with a reading
+func (s *boltStore) Devices(ctx context.Context) ([]string, error) {
+	ids := []string{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltLatestBucket).ForEach(func(key, _ []byte) error {
+			ids = append(ids, string(key))
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the device ids from the database: %v", err)
+	}
+
+	return ids, nil
+}
+
+// MetricRange retrieves the values of a measurement of the device between from and to
+func (s *boltStore) MetricRange(ctx context.Context, id, metric string, from, to time.Time) ([]MetricPoint, error) {
+	points := []MetricPoint{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		metrics := tx.Bucket(boltMetricsBucket).Bucket([]byte(id))
+
+		if metrics == nil {
+			return nil
+		}
+
+		return scanBoltRange(metrics.Bucket([]byte(metric)), from, to, func(key []byte) error {
+			value, err := strconv.ParseFloat(string(key[8:]), 64)
+
+			if err != nil {
+				return fmt.Errorf("malformed point %q", key[8:])
+			}
+
+			points = append(points, MetricPoint{Time: time.UnixMilli(boltKeyTime(key)).UTC().Format(time.RFC3339), Value: value})
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on reading the %s history for device id %s from the database: %v", metric, id, err)
+	}
+
+	return points, nil
+}
+
+// Metrics lists the names of the measurements reported by the device
+func (s *boltStore) Metrics(ctx context.Context, id string) ([]string, error) {
+	names := []string{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		metrics := tx.Bucket(boltMetricsBucket).Bucket([]byte(id))
+
+		if metrics == nil {
+			return nil
+		}
+
+		return metrics.ForEach(func(name, _ []byte) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the metric names of device id %s from the database: %v", id, err)
+	}
+
+	return names, nil
+}
+
+// scanBoltRange calls visit with the keys of the bucket timed within [from, to] in order, none without the bucket
+func scanBoltRange(bucket *bolt.Bucket, from, to time.Time, visit func(key []byte) error) error {
+	if bucket == nil {
+		return nil
+	}
+
+	end := to.UnixMilli()
+	cursor := bucket.Cursor()
+
+	for key, _ := cursor.Seek(boltTime(from.UnixMilli())); key != nil && boltKeyTime(key) <= end; key, _ = cursor.Next() {
+		if err := visit(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
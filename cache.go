@@ -0,0 +1,209 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// defaultCacheTTL is the time a cached reading is served without a ttl setting.
+const defaultCacheTTL = time.Second
+
+// CacheConfig keeps the latest reading of the most requested devices in memory, in front of the store.
+type CacheConfig struct {
+	Size int      `json:"size"` // Devices whose latest reading is kept, the least recently requested are evicted. No cache when 0
+	TTL  Duration `json:"ttl"`  // Time a cached reading is served before it is read again from the store, 1s by default
+}
+
+// CacheStats are the counters of the cache.
+type CacheStats struct {
+	Size    int    `json:"size"` // Devices cached
+	MaxSize int    `json:"max_size"`
+	TTL     string `json:"ttl"`
+	Hits    uint64 `json:"hits"`   // Reads served from the cache
+	Misses  uint64 `json:"misses"` // Reads going to the store
+}
+
+// cacheEntry is the cached latest reading of a device.
+type cacheEntry struct {
+	deviceId  string
+	data      SensorData
+	expiresAt time.Time
+}
+
+// cachedStore serves the latest readings of the GET requests from a bounded LRU cache, a saved reading invalidates the
+// entry of its device. The other replicas of the API only see the reading once their entry expires.
+type cachedStore struct {
+	Store
+	size    int
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently requested first
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+// newCachedStore puts a cache in front of the store
+func newCachedStore(store Store, config CacheConfig) (*cachedStore, error) {
+	if config.Size < 0 {
+		return nil, fmt.Errorf("size %d must be positive", config.Size)
+	}
+
+	ttl := time.Duration(config.TTL)
+
+	if ttl < 0 {
+		return nil, fmt.Errorf("ttl %v must be positive", ttl)
+	}
+
+	if ttl == 0 {
+		ttl = defaultCacheTTL
+	}
+
+	return &cachedStore{Store: store, size: config.Size, ttl: ttl, entries: make(map[string]*list.Element), order: list.New()}, nil
+}
+
+// Save stores the reading and drops the cached reading of its device
+func (s *cachedStore) Save(ctx context.Context, sensorData *SensorData) error {
+	err := s.Store.Save(ctx, sensorData)
+	s.invalidate(sensorData.DeviceId)
+
+	return err
+}
+
+// Merge merges the reading and drops the cached reading of its device
+func (s *cachedStore) Merge(ctx context.Context, sensorData *SensorData) (bool, *SensorData, error) {
+	stored, existing, err := s.Store.Merge(ctx, sensorData)
+	s.invalidate(sensorData.DeviceId)
+
+	return stored, existing, err
+}
+
+// Latest returns the cached reading of the device to the GET requests, the ingest always reads the store
+func (s *cachedStore) Latest(ctx context.Context, deviceId string) (*SensorData, error) {
+	if !staleReadsAllowed(ctx) {
+		return s.Store.Latest(ctx, deviceId)
+	}
+
+	if sensorData, found := s.get(deviceId); found {
+		s.hits.Add(1)
+		return sensorData, nil
+	}
+
+	s.misses.Add(1)
+	sensorData, err := s.Store.Latest(ctx, deviceId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.put(deviceId, sensorData)
+
+	return sensorData, nil
+}
+
+// get returns a copy of the unexpired cached reading of the device
+func (s *cachedStore) get(deviceId string) (*SensorData, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, found := s.entries[deviceId]
+
+	if !found {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+
+	if time.Now().After(entry.expiresAt) {
+		s.order.Remove(element)
+		delete(s.entries, deviceId)
+		return nil, false
+	}
+
+	s.order.MoveToFront(element)
+
+	return cloneSensorData(&entry.data), true
+}
+
+// put caches the reading of the device, evicting the least recently requested device when full
+func (s *cachedStore) put(deviceId string, sensorData *SensorData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := &cacheEntry{deviceId: deviceId, data: *cloneSensorData(sensorData), expiresAt: time.Now().Add(s.ttl)}
+
+	if element, found := s.entries[deviceId]; found {
+		element.Value = entry
+		s.order.MoveToFront(element)
+		return
+	}
+
+	s.entries[deviceId] = s.order.PushFront(entry)
+
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheEntry).deviceId)
+	}
+}
+
+// cloneSensorData returns a deep copy of the reading, the cached one shares none of its maps and optional
+// measurements with the callers
+func cloneSensorData(sensorData *SensorData) *SensorData {
+	clone := *sensorData
+
+	for _, field := range []**float32{&clone.Humidity, &clone.Pressure, &clone.BatteryVoltage} {
+		if *field != nil {
+			value := **field
+			*field = &value
+		}
+	}
+
+	for _, values := range []*map[string]float64{&clone.Metrics, &clone.Derived} {
+		if *values != nil {
+			copied := make(map[string]float64, len(*values))
+
+			for name, value := range *values {
+				copied[name] = value
+			}
+
+			*values = copied
+		}
+	}
+
+	return &clone
+}
+
+// invalidate drops the cached reading of the device
+func (s *cachedStore) invalidate(deviceId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, found := s.entries[deviceId]; found {
+		s.order.Remove(element)
+		delete(s.entries, deviceId)
+	}
+}
+
+// stats returns the counters of the cache
+func (s *cachedStore) stats() CacheStats {
+	s.mu.Lock()
+	size := s.order.Len()
+	s.mu.Unlock()
+
+	return CacheStats{Size: size, MaxSize: s.size, TTL: s.ttl.String(), Hits: s.hits.Load(), Misses: s.misses.Load()}
+}
+
+// registerCacheRoutes mounts the cache endpoint on the given group
+func registerCacheRoutes(g *echo.Group, cache *cachedStore) {
+	g.GET("/cache", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, cache.stats())
+	})
+}
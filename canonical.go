@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// canonicalSerializer writes the JSON responses in their canonical form, the same bytes for the same data whatever
+// the version of the API: the object keys sorted, no white space nor HTML escaping, the numbers as marshalled and the
+// timestamps of the readings in UTC. The ?pretty parameter is ignored.
+type canonicalSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+// Serialize writes the canonical JSON of the value
+func (s canonicalSerializer) Serialize(c echo.Context, value interface{}, indent string) error {
+	body, err := canonicalJSON(value)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Response().Write(body)
+
+	return err
+}
+
+// marshalResponse returns the JSON of a value written directly to a response, canonical when the responses are
+func marshalResponse(c echo.Context, value interface{}) ([]byte, error) {
+	if _, canonical := c.Echo().JSONSerializer.(canonicalSerializer); canonical {
+		return canonicalJSON(value)
+	}
+
+	return json.Marshal(value)
+}
+
+// canonicalJSON returns the canonical JSON of the value, its JSON decoded again then encoded with the maps sorted
+func canonicalJSON(value interface{}) ([]byte, error) {
+	raw, ok := value.(json.RawMessage)
+
+	if !ok {
+		var err error
+
+		if raw, err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var generic interface{}
+
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(canonicalValue(generic)); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// canonicalTimeFields are the fields of the readings holding a timestamp, the other strings are kept as they are
+// even when they look like one, e.g. a device id or a label.
+var canonicalTimeFields = map[string]bool{"time": true, "received_at": true, "device_time": true}
+
+// canonicalValue rewrites the RFC 3339 timestamps of the time fields of a decoded JSON value in UTC, with the
+// fraction of a second only when not zero
+func canonicalValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if timestamp, ok := field.(string); ok && canonicalTimeFields[key] {
+				value[key] = canonicalTimestamp(timestamp)
+			} else {
+				value[key] = canonicalValue(field)
+			}
+		}
+	case []interface{}:
+		for i, element := range value {
+			value[i] = canonicalValue(element)
+		}
+	}
+
+	return value
+}
+
+// canonicalTimestamp returns the RFC 3339 timestamp in UTC, the value as it is when it isn't one
+func canonicalTimestamp(value string) string {
+	if timestamp, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return timestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	return value
+}
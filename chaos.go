@@ -0,0 +1,172 @@
+//go:build chaos
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// chaosDropTimeout is the time a call with a dropped response hangs before failing, unless its context is done first.
+const chaosDropTimeout = 5 * time.Second
+
+var (
+	// errChaosInjected is the failure injected in the storage calls.
+	errChaosInjected = errors.New("injected storage failure (chaos mode)")
+	// errChaosDropped fails the storage calls whose response was dropped, after they ran.
+	errChaosDropped = errors.New("i/o timeout, response dropped (chaos mode)")
+)
+
+// chaosStore injects latency, failures and dropped responses in the calls of the store, to test the retries and
+// the timeouts of the clients against a failing storage. It is only built with the chaos tag.
+type chaosStore struct {
+	Store
+	latency   time.Duration
+	jitter    time.Duration
+	errorRate float64
+	dropRate  float64
+}
+
+// registerChaosFlags defines the fault injection flags, the returned function wraps the store with the faults set
+func registerChaosFlags(flags *flag.FlagSet) func(store Store) Store {
+	latency := flags.Duration("chaos-latency", 0, "Latency added to every storage call")
+	jitter := flags.Duration("chaos-jitter", 0, "Random latency up to this duration added on top of -chaos-latency")
+	errorRate := flags.Float64("chaos-error-rate", 0, "Share of the storage calls failing without running, between 0 and 1")
+	dropRate := flags.Float64("chaos-drop-rate", 0, "Share of the storage calls running but timing out without a response, between 0 and 1")
+
+	return func(store Store) Store {
+		if *errorRate < 0 || *errorRate > 1 || *dropRate < 0 || *dropRate > 1 || *latency < 0 || *jitter < 0 {
+			log.Fatalf("Chaos rates must be between 0 and 1, latencies positive")
+		}
+
+		if *latency == 0 && *jitter == 0 && *errorRate == 0 && *dropRate == 0 {
+			return store
+		}
+
+		log.Printf("CHAOS MODE: storage calls delayed by %v (+%v jitter), %g%% failed, %g%% dropped", *latency, *jitter, *errorRate*100, *dropRate*100)
+
+		return &chaosStore{Store: store, latency: *latency, jitter: *jitter, errorRate: *errorRate, dropRate: *dropRate}
+	}
+}
+
+// inject delays the call, then fails it, runs it, or runs it and drops its response
+func (s *chaosStore) inject(ctx context.Context, call func() error) error {
+	delay := s.latency
+
+	if s.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(s.jitter)))
+	}
+
+	if err := chaosSleep(ctx, delay); err != nil {
+		return err
+	}
+
+	draw := rand.Float64()
+
+	if draw < s.errorRate {
+		return fmt.Errorf("fatal error on calling the storage: %w", errChaosInjected)
+	}
+
+	if err := call(); err != nil {
+		return err
+	}
+
+	if draw < s.errorRate+s.dropRate {
+		if err := chaosSleep(ctx, chaosDropTimeout); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("fatal error on calling the storage: %w", errChaosDropped)
+	}
+
+	return nil
+}
+
+// chaosSleep waits for the given time, or until the context is done
+func chaosSleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Save saves the reading with the faults injected
+func (s *chaosStore) Save(ctx context.Context, sensorData *SensorData) error {
+	return s.inject(ctx, func() error {
+		return s.Store.Save(ctx, sensorData)
+	})
+}
+
+// Latest reads the latest reading of the device with the faults injected
+func (s *chaosStore) Latest(ctx context.Context, deviceId string) (sensorData *SensorData, err error) {
+	err = s.inject(ctx, func() error {
+		sensorData, err = s.Store.Latest(ctx, deviceId)
+		return err
+	})
+
+	return sensorData, err
+}
+
+// Range reads the readings of the device with the faults injected
+func (s *chaosStore) Range(ctx context.Context, deviceId string, from, to time.Time) (history []SensorData, err error) {
+	err = s.inject(ctx, func() error {
+		history, err = s.Store.Range(ctx, deviceId, from, to)
+		return err
+	})
+
+	return history, err
+}
+
+// Merge merges the reading with the faults injected
+func (s *chaosStore) Merge(ctx context.Context, sensorData *SensorData) (stored bool, existing *SensorData, err error) {
+	err = s.inject(ctx, func() error {
+		stored, existing, err = s.Store.Merge(ctx, sensorData)
+		return err
+	})
+
+	return stored, existing, err
+}
+
+// Devices reads the devices with the faults injected
+func (s *chaosStore) Devices(ctx context.Context) (ids []string, err error) {
+	err = s.inject(ctx, func() error {
+		ids, err = s.Store.Devices(ctx)
+		return err
+	})
+
+	return ids, err
+}
+
+// MetricRange reads the values of the measurement with the faults injected
+func (s *chaosStore) MetricRange(ctx context.Context, deviceId, metric string, from, to time.Time) (points []MetricPoint, err error) {
+	err = s.inject(ctx, func() error {
+		points, err = s.Store.MetricRange(ctx, deviceId, metric, from, to)
+		return err
+	})
+
+	return points, err
+}
+
+// Metrics reads the measurement names of the device with the faults injected
+func (s *chaosStore) Metrics(ctx context.Context, deviceId string) (names []string, err error) {
+	err = s.inject(ctx, func() error {
+		names, err = s.Store.Metrics(ctx, deviceId)
+		return err
+	})
+
+	return names, err
+}
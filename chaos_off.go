@@ -0,0 +1,12 @@
+//go:build !chaos
+
+package main
+
+import "flag"
+
+// registerChaosFlags defines no flag outside the chaos builds, the store is never wrapped with faults
+func registerChaosFlags(flags *flag.FlagSet) func(store Store) Store {
+	return func(store Store) Store {
+		return store
+	}
+}
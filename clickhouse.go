@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+const (
+	// defaultClickHouseBatchSize is the readings inserted at once without a batch_size setting.
+	defaultClickHouseBatchSize = 1000
+	// defaultClickHouseFlushInterval is the longest wait of a reading for its batch without a flush_interval setting.
+	defaultClickHouseFlushInterval = 500 * time.Millisecond
+)
+
+// clickhouseSchema creates the tables of the readings, partitioned by month so the queries over years only read their
+// months. The duplicates of a reading saved twice are merged away, the reads use FINAL to skip the ones not merged yet.
+var clickhouseSchema = []string{
+	`CREATE TABLE IF NOT EXISTS readings (device_id String, time DateTime64(3, 'UTC'), data String)
+	 ENGINE = ReplacingMergeTree PARTITION BY toYYYYMM(time) ORDER BY (device_id, time, data)`,
+	`CREATE TABLE IF NOT EXISTS metrics (device_id String, metric LowCardinality(String), time DateTime64(3, 'UTC'), value Float64)
+	 ENGINE = ReplacingMergeTree PARTITION BY toYYYYMM(time) ORDER BY (device_id, metric, time, value)`,
+}
+
+// ClickHouseConfig connects to the ClickHouse server of the clickhouse backend.
+type ClickHouseConfig struct {
+	Address       string   `json:"address"` // host:port of the native protocol, e.g. "clickhouse:9000"
+	Database      string   `json:"database"`
+	Username      string   `json:"username"`
+	Password      string   `json:"password"`
+	BatchSize     int      `json:"batch_size"`     // Readings inserted at once, 1000 by default
+	FlushInterval Duration `json:"flush_interval"` // Longest wait of a reading for its batch to fill, 500ms by default
+}
+
+// clickhouseWrite is a reading waiting for its batch.
+type clickhouseWrite struct {
+	sensorData *SensorData
+	time       time.Time
+	data       string
+	done       chan error
+}
+
+// clickhouseStore keeps the readings in ClickHouse for the aggregates over years of readings. The readings are
+// inserted in batches, a Save returns once the batch of its reading is inserted.
+type clickhouseStore struct {
+	conn          driver.Conn
+	batchSize     int
+	flushInterval time.Duration
+	writes        chan *clickhouseWrite
+	merges        sync.Mutex // Serializes the merges of this replica of the API, ClickHouse has no transactions
+}
+
+// newClickHouseStore connects to ClickHouse, creates the tables when missing and starts the batch writer
+func newClickHouseStore(config ClickHouseConfig) (*clickhouseStore, error) {
+	if config.Address == "" {
+		return nil, errors.New("the clickhouse backend needs the address of its server")
+	}
+
+	if config.BatchSize < 0 || config.FlushInterval < 0 {
+		return nil, fmt.Errorf("batch size %d and flush interval %v must be positive", config.BatchSize, time.Duration(config.FlushInterval))
+	}
+
+	s := &clickhouseStore{batchSize: config.BatchSize, flushInterval: time.Duration(config.FlushInterval)}
+
+	if s.batchSize == 0 {
+		s.batchSize = defaultClickHouseBatchSize
+	}
+
+	if s.flushInterval == 0 {
+		s.flushInterval = defaultClickHouseFlushInterval
+	}
+
+	conn, err := clickhouse.Open(&clickhouse.Options{
+		Addr: []string{config.Address},
+		Auth: clickhouse.Auth{Database: config.Database, Username: config.Username, Password: config.Password},
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to ClickHouse at %s: %w", config.Address, err)
+	}
+
+	ctx := context.Background()
+
+	for _, statement := range clickhouseSchema {
+		if err := conn.Exec(ctx, statement); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to create the tables in ClickHouse: %w", err)
+		}
+	}
+
+	s.conn = conn
+	s.writes = make(chan *clickhouseWrite, s.batchSize)
+	go s.run()
+
+	return s, nil
+}
+
+// run inserts the readings once a batch is full or its first reading waited for the flush interval
+func (s *clickhouseStore) run() {
+	batch := make([]*clickhouseWrite, 0, s.batchSize)
+	timer := time.NewTimer(s.flushInterval)
+	timer.Stop()
+
+	for {
+		select {
+		case write := <-s.writes:
+			if len(batch) == 0 {
+				timer.Reset(s.flushInterval)
+			}
+
+			if batch = append(batch, write); len(batch) < s.batchSize {
+				continue
+			}
+
+			timer.Stop()
+		case <-timer.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		err := s.insert(batch)
+
+		if err != nil {
+			log.Printf("Batch of %d readings not inserted in ClickHouse: %v", len(batch), err)
+		}
+
+		for _, write := range batch {
+			write.done <- err
+		}
+
+		batch = batch[:0]
+	}
+}
+
+// insert inserts the readings of the batch with their measurements
+func (s *clickhouseStore) insert(writes []*clickhouseWrite) error {
+	ctx := context.Background()
+	readings, err := s.conn.PrepareBatch(ctx, "INSERT INTO readings (device_id, time, data)")
+
+	if err != nil {
+		return err
+	}
+
+	metrics, err := s.conn.PrepareBatch(ctx, "INSERT INTO metrics (device_id, metric, time, value)")
+
+	if err != nil {
+		readings.Abort()
+		return err
+	}
+
+	for _, write := range writes {
+		if err := readings.Append(write.sensorData.DeviceId, write.time, write.data); err != nil {
+			readings.Abort()
+			metrics.Abort()
+			return err
+		}
+
+		for name, value := range write.sensorData.Measurements() {
+			if err := metrics.Append(write.sensorData.DeviceId, name, write.time, value); err != nil {
+				readings.Abort()
+				metrics.Abort()
+				return err
+			}
+		}
+	}
+
+	// A reading is found by its measurements only once it is found itself.
+	if err := readings.Send(); err != nil {
+		metrics.Abort()
+		return err
+	}
+
+	return metrics.Send()
+}
+
+// Save queues the reading in the current batch and waits for the batch to be inserted
+func (s *clickhouseStore) Save(ctx context.Context, sensorData *SensorData) error {
+	data, err := appendSensorData(nil, sensorData)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on marshalling the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on reading the time of the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	// The done channel is buffered, the writer doesn't wait for a caller gone.
+	write := &clickhouseWrite{sensorData: sensorData, time: timestamp, data: string(data), done: make(chan error, 1)}
+
+	select {
+	case s.writes <- write:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err = <-write.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err != nil {
+		return fmt.Errorf("fatal error on saving the device id %s data in the database: %v", sensorData.DeviceId, err)
+	}
+
+	return nil
+}
+
+// Merge stores the reading in place of the ones at its time unless one was received later. Without transactions, the
+// merges are serialized by the replica of the API, the writes of the other replicas can interleave with them.
+func (s *clickhouseStore) Merge(ctx context.Context, sensorData *SensorData) (bool, *SensorData, error) {
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on reading the time of the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	s.merges.Lock()
+	defer s.merges.Unlock()
+
+	existing, err := s.Range(ctx, sensorData.DeviceId, timestamp, timestamp)
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	local, stored, replace := resolveMerge(existing, sensorData)
+
+	if !replace {
+		return stored, local, nil
+	}
+
+	if len(existing) > 0 {
+		if err := s.deleteAt(ctx, sensorData.DeviceId, timestamp); err != nil {
+			return false, nil, err
+		}
+	}
+
+	if err := s.Save(ctx, sensorData); err != nil {
+		return false, nil, err
+	}
+
+	return true, local, nil
+}
+
+// Latest retrieves the last sensor data of the device
+func (s *clickhouseStore) Latest(ctx context.Context, id string) (*SensorData, error) {
+	var data string
+	err := s.conn.QueryRow(ctx, `SELECT data FROM readings WHERE device_id = ? ORDER BY time DESC, data DESC LIMIT 1`, id).Scan(&data)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("sensor data for device id with %s %w", id, errNotFound)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the sensor data for device id %s from the database: %v", id, err)
+	}
+
+	var sensorData SensorData
+
+	if err := json.Unmarshal([]byte(data), &sensorData); err != nil {
+		return nil, fmt.Errorf("fatal error on reading the sensor data for device id %s from the database: %v", id, err)
+	}
+
+	return &sensorData, nil
+}
+
+// Range retrieves the sensor data history of the device between from and to
+func (s *clickhouseStore) Range(ctx context.Context, id string, from, to time.Time) ([]SensorData, error) {
+	rows, err := s.conn.Query(ctx, `SELECT data FROM readings FINAL WHERE device_id = ? AND time BETWEEN ? AND ? ORDER BY time, data`, id, from, to)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the sensor data history for device id %s from the database: %v", id, err)
+	}
+
+	defer rows.Close()
+	history := []SensorData{}
+
+	for rows.Next() {
+		var data string
+		var sensorData SensorData
+
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("fatal error on retrieving the sensor data history for device id %s from the database: %v", id, err)
+		}
+
+		if err := json.Unmarshal([]byte(data), &sensorData); err != nil {
+			return nil, fmt.Errorf("fatal error on reading the sensor data history for device id %s from the database: %v", id, err)
+		}
+
+		history = append(history, sensorData)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the sensor data history for device id %s from the database: %v", id, err)
+	}
+
+	return history, nil
+}
+
+// deleteAt removes the readings of the device at the time with their measurements, with the lightweight deletes of
+// ClickHouse
+func (s *clickhouseStore) deleteAt(ctx context.Context, id string, at time.Time) error {
+	err := s.conn.Exec(ctx, `DELETE FROM readings WHERE device_id = ? AND time = ?`, id, at)
+
+	if err == nil {
+		err = s.conn.Exec(ctx, `DELETE FROM metrics WHERE device_id = ? AND time = ?`, id, at)
+	}
+
+	if err != nil {
+		return fmt.Errorf("fatal error on deleting the device id %s data from the database: %v", id, err)
+	}
+
+	return nil
+}
+
+// deleteDevice deletes the history and the measurements of the device, its latest reading is the last of its history
+func (s *clickhouseStore) deleteDevice(ctx context.Context, id string) error {
+	err := s.conn.Exec(ctx, `DELETE FROM readings WHERE device_id = ?`, id)
+
+	if err == nil {
+		err = s.conn.Exec(ctx, `DELETE FROM metrics WHERE device_id = ?`, id)
+	}
+
+	if err != nil {
+		return fmt.Errorf("fatal error on deleting the data of device %s from the database: %v", id, err)
+	}
+
+	return nil
+}
+
+// Devices lists the ids of all devices with a reading
+func (s *clickhouseStore) Devices(ctx context.Context) ([]string, error) {
+	ids, err := s.strings(ctx, `SELECT DISTINCT device_id FROM readings`)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the device ids from the database: %v", err)
+	}
+
+	return ids, nil
+}
+
+// MetricRange retrieves the values of a measurement of the device between from and to
+func (s *clickhouseStore) MetricRange(ctx context.Context, id, metric string, from, to time.Time) ([]MetricPoint, error) {
+	rows, err := s.conn.Query(ctx, `SELECT time, value FROM metrics FINAL WHERE device_id = ? AND metric = ? AND time BETWEEN ? AND ? ORDER BY time, value`,
+		id, metric, from, to)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the %s history for device id %s from the database: %v", metric, id, err)
+	}
+
+	defer rows.Close()
+	points := []MetricPoint{}
+
+	for rows.Next() {
+		var at time.Time
+		var value float64
+
+		if err := rows.Scan(&at, &value); err != nil {
+			return nil, fmt.Errorf("fatal error on retrieving the %s history for device id %s from the database: %v", metric, id, err)
+		}
+
+		points = append(points, MetricPoint{Time: at.UTC().Format(time.RFC3339), Value: value})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the %s history for device id %s from the database: %v", metric, id, err)
+	}
+
+	return points, nil
+}
+
+// Metrics lists the names of the measurements reported by the device
+func (s *clickhouseStore) Metrics(ctx context.Context, id string) ([]string, error) {
+	names, err := s.strings(ctx, `SELECT DISTINCT metric FROM metrics WHERE device_id = ?`, id)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the metric names of device id %s from the database: %v", id, err)
+	}
+
+	return names, nil
+}
+
+// AggregateMetric summarizes a measurement of the device between from and to in ClickHouse, without reading its values
+func (s *clickhouseStore) AggregateMetric(ctx context.Context, id, metric string, from, to time.Time) (*Aggregate, error) {
+	var count uint64
+	var result Aggregate
+
+	err := s.conn.QueryRow(ctx, `SELECT count(), min(value), max(value), avg(value), stddevPop(value) FROM metrics FINAL
+		WHERE device_id = ? AND metric = ? AND time BETWEEN ? AND ?`, id, metric, from, to).Scan(&count, &result.Min, &result.Max, &result.Avg, &result.Stddev)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on aggregating the %s history for device id %s in the database: %v", metric, id, err)
+	}
+
+	if count == 0 {
+		return nil, nil
+	}
+
+	result.Count = int(count)
+
+	return &result, nil
+}
+
+// strings runs a query of a single text column
+func (s *clickhouseStore) strings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := s.conn.Query(ctx, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	values := []string{}
+
+	for rows.Next() {
+		var value string
+
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// clockOffsetsKey is the Redis hash holding the estimated clock offset of every device in milliseconds.
+const clockOffsetsKey = "clock-offsets"
+
+// updateClockOffsetScript blends the offset measured on a reading into the estimate of the device
+// with an exponential moving average and returns the new estimate.
+var updateClockOffsetScript = redis.NewScript(`
+local offset = tonumber(ARGV[2])
+local previous = tonumber(redis.call('HGET', KEYS[1], ARGV[1]))
+
+if previous then
+  offset = previous + tonumber(ARGV[3]) * (offset - previous)
+end
+
+redis.call('HSET', KEYS[1], ARGV[1], tostring(offset))
+return tostring(offset)
+`)
+
+// ClockDriftConfig enables the correction of the time of the devices whose clock drifted.
+//
+// The offset of a device is estimated as the moving average of the difference between
+// the receive time and the time it reported. Once the estimate exceeds the threshold,
+// the time of its readings is shifted by the estimate.
+type ClockDriftConfig struct {
+	Correct   bool     `json:"correct"`   // Estimate the offsets and correct the drifted readings
+	Threshold Duration `json:"threshold"` // Offset from which the time is corrected, 5 minutes by default
+	Smoothing float64  `json:"smoothing"` // Weight of the last reading in the estimate, between 0 and 1, 0.2 by default
+}
+
+// ClockOffset is the estimated clock offset of a device, positive when its clock is late.
+type ClockOffset struct {
+	DeviceId string  `json:"device_id"`
+	Offset   string  `json:"offset"`    // Offset as a duration, e.g. "-1h2m3s"
+	OffsetMs float64 `json:"offset_ms"` // Offset in milliseconds
+}
+
+// clockCorrector shifts the time of the readings of the devices with a drifted clock.
+type clockCorrector struct {
+	config   ClockDriftConfig
+	registry *registry
+}
+
+// newClockCorrector validates the configuration and applies its defaults
+func newClockCorrector(config ClockDriftConfig, reg *registry) (*clockCorrector, error) {
+	if config.Threshold <= 0 {
+		config.Threshold = Duration(5 * time.Minute)
+	}
+
+	if config.Smoothing == 0 {
+		config.Smoothing = 0.2
+	}
+
+	if config.Smoothing < 0 || config.Smoothing > 1 {
+		return nil, fmt.Errorf("clock drift smoothing %v must be between 0 and 1", config.Smoothing)
+	}
+
+	return &clockCorrector{config: config, registry: reg}, nil
+}
+
+// enabled reports whether the correction is configured
+func (c *clockCorrector) enabled() bool {
+	return c != nil && c.config.Correct
+}
+
+// correct updates the offset estimate of the device and shifts the time of the reading when it exceeds the threshold
+func (c *clockCorrector) correct(ctx context.Context, sensorData *SensorData, receivedAt time.Time) error {
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return err
+	}
+
+	measured := float64(receivedAt.Sub(timestamp)) / float64(time.Millisecond)
+	offset, err := c.registry.UpdateClockOffset(ctx, sensorData.DeviceId, measured, c.config.Smoothing)
+
+	if err != nil {
+		return err
+	}
+
+	shift := time.Duration(offset * float64(time.Millisecond))
+
+	if math.Abs(float64(shift)) < float64(c.config.Threshold) {
+		return nil
+	}
+
+	sensorData.DeviceTime = sensorData.Time
+	sensorData.Time = timestamp.Add(shift).UTC().Format(time.RFC3339)
+
+	return nil
+}
+
+// UpdateClockOffset blends the offset measured on a reading into the estimate of the device and returns it
+func (r *registry) UpdateClockOffset(ctx context.Context, deviceId string, measuredMs, smoothing float64) (float64, error) {
+	raw, err := updateClockOffsetScript.Run(ctx, r.rdb, []string{clockOffsetsKey}, deviceId, measuredMs, smoothing).Text()
+
+	if err != nil {
+		return 0, fmt.Errorf("fatal error on saving the clock offset of device %s in the cache: %v", deviceId, err)
+	}
+
+	offset, err := strconv.ParseFloat(raw, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("fatal error on reading the clock offset of device %s from cache: %v", deviceId, err)
+	}
+
+	return offset, nil
+}
+
+// ClockOffset returns the estimated clock offset of the device
+func (r *registry) ClockOffset(ctx context.Context, deviceId string) (*ClockOffset, error) {
+	raw, err := r.rdb.HGet(ctx, clockOffsetsKey, deviceId).Result()
+
+	if err == redis.Nil {
+		return nil, fmt.Errorf("clock offset of device %s %w", deviceId, errNotFound)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the clock offset of device %s from the cache: %v", deviceId, err)
+	}
+
+	offset, err := strconv.ParseFloat(raw, 64)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on reading the clock offset of device %s from cache: %v", deviceId, err)
+	}
+
+	return &ClockOffset{
+		DeviceId: deviceId,
+		Offset:   time.Duration(offset * float64(time.Millisecond)).Round(time.Millisecond).String(),
+		OffsetMs: offset,
+	}, nil
+}
+
+// getClockOffset returns the estimated clock offset of the device
+func getClockOffset(c echo.Context, reg *registry) error {
+	offset, err := reg.ClockOffset(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, offset)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// coalescedStore makes the concurrent identical reads of the GET requests share a single call to the store, so the
+// dashboards refreshed at once don't send hundreds of the same request to Redis. The ingest reads are not coalesced.
+type coalescedStore struct {
+	Store
+	group singleflight.Group
+}
+
+// newCoalescedStore coalesces the reads of the store
+func newCoalescedStore(store Store) *coalescedStore {
+	return &coalescedStore{Store: store}
+}
+
+// do runs the read once for all the concurrent callers of the same key. The read isn't canceled with the request
+// that started it, the other callers are still waiting for it.
+func (s *coalescedStore) do(ctx context.Context, key string, read func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	value, err, _ := s.group.Do(key, func() (interface{}, error) {
+		return read(context.WithoutCancel(ctx))
+	})
+
+	return value, err
+}
+
+// Latest returns the last reading of the device, read once for the concurrent requests
+func (s *coalescedStore) Latest(ctx context.Context, deviceId string) (*SensorData, error) {
+	if !staleReadsAllowed(ctx) {
+		return s.Store.Latest(ctx, deviceId)
+	}
+
+	value, err := s.do(ctx, "latest\x00"+deviceId, func(ctx context.Context) (interface{}, error) {
+		return s.Store.Latest(ctx, deviceId)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Every caller gets its own copy, a handler changing its reading doesn't change the others.
+	sensorData := *value.(*SensorData)
+
+	return &sensorData, nil
+}
+
+// Range returns the readings of the device within [from, to], read once for the concurrent requests
+func (s *coalescedStore) Range(ctx context.Context, deviceId string, from, to time.Time) ([]SensorData, error) {
+	if !staleReadsAllowed(ctx) {
+		return s.Store.Range(ctx, deviceId, from, to)
+	}
+
+	value, err := s.do(ctx, "range\x00"+deviceId+"\x00"+rangeKey(from, to), func(ctx context.Context) (interface{}, error) {
+		return s.Store.Range(ctx, deviceId, from, to)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]SensorData(nil), value.([]SensorData)...), nil
+}
+
+// Devices returns the ids of all the devices, read once for the concurrent requests
+func (s *coalescedStore) Devices(ctx context.Context) ([]string, error) {
+	if !staleReadsAllowed(ctx) {
+		return s.Store.Devices(ctx)
+	}
+
+	value, err := s.do(ctx, "devices", func(ctx context.Context) (interface{}, error) {
+		return s.Store.Devices(ctx)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string(nil), value.([]string)...), nil
+}
+
+// MetricRange returns the values of the measurement of the device within [from, to], read once for the concurrent requests
+func (s *coalescedStore) MetricRange(ctx context.Context, deviceId, metric string, from, to time.Time) ([]MetricPoint, error) {
+	if !staleReadsAllowed(ctx) {
+		return s.Store.MetricRange(ctx, deviceId, metric, from, to)
+	}
+
+	value, err := s.do(ctx, "metric\x00"+deviceId+"\x00"+metric+"\x00"+rangeKey(from, to), func(ctx context.Context) (interface{}, error) {
+		return s.Store.MetricRange(ctx, deviceId, metric, from, to)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]MetricPoint(nil), value.([]MetricPoint)...), nil
+}
+
+// Metrics returns the measurement names of the device, read once for the concurrent requests
+func (s *coalescedStore) Metrics(ctx context.Context, deviceId string) ([]string, error) {
+	if !staleReadsAllowed(ctx) {
+		return s.Store.Metrics(ctx, deviceId)
+	}
+
+	value, err := s.do(ctx, "metrics\x00"+deviceId, func(ctx context.Context) (interface{}, error) {
+		return s.Store.Metrics(ctx, deviceId)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string(nil), value.([]string)...), nil
+}
+
+// rangeKey identifies the time range of a read
+func rangeKey(from, to time.Time) string {
+	return strconv.FormatInt(from.UnixNano(), 10) + "\x00" + strconv.FormatInt(to.UnixNano(), 10)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/fxamacker/cbor/v2"
+	piondtls "github.com/pion/dtls/v3"
+	coap "github.com/plgd-dev/go-coap/v3"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/mux"
+)
+
+// errUnsupportedCoAPFormat rejects payloads neither CBOR nor JSON encoded.
+var errUnsupportedCoAPFormat = errors.New("payload must be application/cbor or application/json")
+
+// CoAPConfig configures the CoAP endpoint for constrained devices.
+type CoAPConfig struct {
+	Address string          `json:"address"` // UDP address to listen on, e.g. ":5683", the endpoint is disabled when empty
+	DTLS    *CoAPDTLSConfig `json:"dtls"`    // Serves over DTLS when set
+}
+
+// CoAPDTLSConfig holds the pre-shared keys of the devices allowed over DTLS.
+type CoAPDTLSConfig struct {
+	PSK map[string]string `json:"psk"` // Hex encoded pre-shared key by device PSK identity
+}
+
+// coapServer accepts CBOR (or JSON) encoded sensor data on POST /process.
+type coapServer struct {
+	config CoAPConfig
+	ing    *ingester
+}
+
+// newCoAPServer validates the configuration of the CoAP endpoint
+func newCoAPServer(config CoAPConfig, ing *ingester) (*coapServer, error) {
+	if config.DTLS != nil {
+		if len(config.DTLS.PSK) == 0 {
+			return nil, errors.New("coap dtls requires at least one psk")
+		}
+
+		for identity, key := range config.DTLS.PSK {
+			if _, err := hex.DecodeString(key); err != nil {
+				return nil, fmt.Errorf("coap dtls psk of identity %s is not hex encoded: %w", identity, err)
+			}
+		}
+	}
+
+	return &coapServer{config: config, ing: ing}, nil
+}
+
+// listenAndServe serves the CoAP endpoint until it fails
+func (s *coapServer) listenAndServe() error {
+	router := mux.NewRouter()
+
+	if err := router.Handle("/process", mux.HandlerFunc(s.process)); err != nil {
+		return err
+	}
+
+	if s.config.DTLS == nil {
+		return coap.ListenAndServe("udp", s.config.Address, router)
+	}
+
+	return coap.ListenAndServeDTLS("udp", s.config.Address, &piondtls.Config{
+		PSK:          s.psk,
+		CipherSuites: []piondtls.CipherSuiteID{piondtls.TLS_PSK_WITH_AES_128_CCM_8},
+	}, router)
+}
+
+// psk returns the pre-shared key of the identity presented by the device
+func (s *coapServer) psk(identity []byte) ([]byte, error) {
+	key, ok := s.config.DTLS.PSK[string(identity)]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown psk identity %s", identity)
+	}
+
+	return hex.DecodeString(key)
+}
+
+// process decodes the sensor data of the request and ingests it
+func (s *coapServer) process(w mux.ResponseWriter, r *mux.Message) {
+	if r.Code() != codes.POST {
+		coapRespond(w, codes.MethodNotAllowed, "only POST is supported")
+		return
+	}
+
+	var raw []byte
+
+	if body := r.Body(); body != nil {
+		var err error
+
+		if raw, err = io.ReadAll(body); err != nil {
+			coapRespond(w, codes.BadRequest, fmt.Sprintf("unable to read the payload: %v", err))
+			return
+		}
+	}
+
+	sensorDataToProcess, err := s.decode(r, raw)
+
+	if errors.Is(err, errUnsupportedCoAPFormat) {
+		coapRespond(w, codes.UnsupportedMediaType, err.Error())
+		return
+	}
+
+	if err != nil {
+		coapRespond(w, codes.BadRequest, fmt.Sprintf("unable to get sensor data from the payload: %v", err))
+		return
+	}
+
+	err = s.ing.ingest(r.Context(), sensorDataToProcess)
+
+	if errors.Is(err, errInvalidSensorData) {
+		coapRespond(w, codes.BadRequest, err.Error())
+		return
+	}
+
+	if errors.Is(err, errDuplicateReading) {
+		coapRespond(w, codes.Changed, "")
+		return
+	}
+
+	if err != nil {
+		log.Printf("CoAP ingest of device %s failed: %v", sensorDataToProcess.DeviceId, err)
+		coapRespond(w, codes.InternalServerError, "error on saving the sensor data")
+		return
+	}
+
+	coapRespond(w, codes.Created, "")
+}
+
+// decode reads the sensor data from the payload, running the payload transformations first when configured
+func (s *coapServer) decode(r *mux.Message, raw []byte) (*SensorData, error) {
+	unmarshal := cbor.Unmarshal
+	format, err := r.ContentFormat()
+
+	switch {
+	case err != nil || format == message.AppCBOR:
+	case format == message.AppJSON:
+		unmarshal = json.Unmarshal
+	default:
+		return nil, errUnsupportedCoAPFormat
+	}
+
+	rules := s.ing.currentRules()
+	transforms := rules.transforms
+
+	if !transforms.enabled() {
+		sensorData := new(SensorData)
+
+		if err == nil && format == message.AppJSON {
+			return sensorData, decodeSensorDataJSON(raw, sensorData, rules.strict)
+		}
+
+		return sensorData, unmarshal(raw, sensorData)
+	}
+
+	var payload map[string]interface{}
+
+	if err := unmarshal(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	return transforms.transform(r.Context(), payload)
+}
+
+// coapRespond sets the response code with an optional diagnostic payload
+func coapRespond(w mux.ResponseWriter, code codes.Code, diagnostic string) {
+	var payload io.ReadSeeker
+
+	if diagnostic != "" {
+		payload = bytes.NewReader([]byte(diagnostic))
+	}
+
+	if err := w.SetResponse(code, message.TextPlain, payload); err != nil {
+		log.Printf("Failed to set the CoAP response: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// pollOnInterval calls poll right away and then on every interval until the context is cancelled, logging its failures
+func pollOnInterval(ctx context.Context, interval time.Duration, name string, poll func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := poll(ctx); err != nil {
+			log.Printf("%s failed: %v", name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// numberSize returns the size in bytes of a binary number format, 0 for an unknown format
+func numberSize(format string) int {
+	switch format {
+	case "int8", "uint8":
+		return 1
+	case "int16", "uint16":
+		return 2
+	case "int32", "uint32", "float32":
+		return 4
+	}
+
+	return 0
+}
+
+// decodeNumber decodes a binary number of the given format ("int16", "uint32", "float32"...) from raw
+func decodeNumber(format string, raw []byte, order binary.ByteOrder) (float64, error) {
+	if size := numberSize(format); size == 0 || len(raw) < size {
+		return 0, fmt.Errorf("unable to decode %d bytes as %s", len(raw), format)
+	}
+
+	switch format {
+	case "int8":
+		return float64(int8(raw[0])), nil
+	case "uint8":
+		return float64(raw[0]), nil
+	case "int16":
+		return float64(int16(order.Uint16(raw))), nil
+	case "uint16":
+		return float64(order.Uint16(raw)), nil
+	case "int32":
+		return float64(int32(order.Uint32(raw))), nil
+	case "uint32":
+		return float64(order.Uint32(raw)), nil
+	default:
+		return float64(math.Float32frombits(order.Uint32(raw))), nil
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// outboxKeyPrefix prefixes the list of the commands queued for a device, oldest first.
+	outboxKeyPrefix = "outbox:"
+	// deliveredCommandsKeyPrefix prefixes the list of the last commands delivered to a device, newest first.
+	deliveredCommandsKeyPrefix = "delivered-commands:"
+	// deliveredCommandsKept is the number of delivered commands kept per device.
+	deliveredCommandsKept = 100
+	// maxCommandWait bounds the time a device can wait for commands in a single request.
+	maxCommandWait = 60 * time.Second
+)
+
+// Command is an instruction queued by an operator for a device, e.g. a configuration push.
+type Command struct {
+	Id          string          `json:"id"`
+	Name        string          `json:"name"`                   // Name of the command, e.g. "set_interval"
+	Params      json.RawMessage `json:"params,omitempty"`       // Arguments of the command, any JSON value
+	CreatedAt   string          `json:"created_at"`             // Time the command was queued
+	ExpiresAt   string          `json:"expires_at,omitempty"`   // Time after which the command is dropped if not delivered
+	DeliveredAt string          `json:"delivered_at,omitempty"` // Time the device fetched the command
+}
+
+// commandRequest is the body queuing a command.
+type commandRequest struct {
+	Name   string          `json:"name"`
+	Params json.RawMessage `json:"params"`
+	TTL    Duration        `json:"ttl"` // Time to live of the command, unlimited when empty
+}
+
+// commandList is the outbox of a device as seen by the operators.
+type commandList struct {
+	Pending   []Command `json:"pending"`
+	Delivered []Command `json:"delivered"`
+}
+
+// takeCommandsScript removes and returns all the commands queued for a device atomically.
+var takeCommandsScript = redis.NewScript(`
+local commands = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1])
+return commands
+`)
+
+// QueueCommand appends a command to the outbox of the device
+func (r *registry) QueueCommand(ctx context.Context, deviceId string, command *Command) error {
+	raw, err := json.Marshal(command)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on marshalling the command for device %s: %v", deviceId, err)
+	}
+
+	if err := r.rdb.RPush(ctx, outboxKeyPrefix+deviceId, raw).Err(); err != nil {
+		return fmt.Errorf("fatal error on queuing the command for device %s in the cache: %v", deviceId, err)
+	}
+
+	return nil
+}
+
+// Commands returns the pending and the last delivered commands of the device
+func (r *registry) Commands(ctx context.Context, deviceId string) (*commandList, error) {
+	pipe := r.rdb.Pipeline()
+	pending := pipe.LRange(ctx, outboxKeyPrefix+deviceId, 0, -1)
+	delivered := pipe.LRange(ctx, deliveredCommandsKeyPrefix+deviceId, 0, -1)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the commands of device %s from the cache: %v", deviceId, err)
+	}
+
+	list := &commandList{}
+	var err error
+
+	if list.Pending, err = decodeCommands(pending.Val()); err != nil {
+		return nil, fmt.Errorf("fatal error on reading the commands of device %s from cache: %v", deviceId, err)
+	}
+
+	if list.Delivered, err = decodeCommands(delivered.Val()); err != nil {
+		return nil, fmt.Errorf("fatal error on reading the commands of device %s from cache: %v", deviceId, err)
+	}
+
+	return list, nil
+}
+
+// CancelCommand removes a pending command from the outbox of the device
+func (r *registry) CancelCommand(ctx context.Context, deviceId, commandId string) error {
+	pending, err := r.rdb.LRange(ctx, outboxKeyPrefix+deviceId, 0, -1).Result()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on retrieving the commands of device %s from the cache: %v", deviceId, err)
+	}
+
+	for _, raw := range pending {
+		var command Command
+
+		if err := json.Unmarshal([]byte(raw), &command); err != nil || command.Id != commandId {
+			continue
+		}
+
+		removed, err := r.rdb.LRem(ctx, outboxKeyPrefix+deviceId, 1, raw).Result()
+
+		if err != nil {
+			return fmt.Errorf("fatal error on cancelling the command %s of device %s in the cache: %v", commandId, deviceId, err)
+		}
+
+		// A zero count means the device fetched the command meanwhile.
+		if removed > 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("pending command %s of device %s %w", commandId, deviceId, errNotFound)
+}
+
+// DeliverCommands takes the pending commands of the device, waiting up to wait for one when there is none
+func (r *registry) DeliverCommands(ctx context.Context, deviceId string, wait time.Duration) ([]Command, error) {
+	key := outboxKeyPrefix + deviceId
+	var raws []string
+
+	if wait > 0 {
+		popped, err := r.rdb.BLPop(ctx, wait, key).Result()
+
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("fatal error on waiting for the commands of device %s in the cache: %v", deviceId, err)
+		}
+
+		// BLPOP returns the key followed by the command.
+		if len(popped) == 2 {
+			raws = append(raws, popped[1])
+		}
+	}
+
+	rest, err := takeCommandsScript.Run(ctx, r.rdb, []string{key}).StringSlice()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on taking the commands of device %s from the cache: %v", deviceId, err)
+	}
+
+	commands, err := decodeCommands(append(raws, rest...))
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on reading the commands of device %s from cache: %v", deviceId, err)
+	}
+
+	now := time.Now().UTC()
+	delivered := make([]Command, 0, len(commands))
+
+	for _, command := range commands {
+		if command.ExpiresAt != "" {
+			if expiresAt, err := time.Parse(time.RFC3339, command.ExpiresAt); err == nil && now.After(expiresAt) {
+				continue
+			}
+		}
+
+		command.DeliveredAt = now.Format(time.RFC3339)
+		delivered = append(delivered, command)
+	}
+
+	if len(delivered) == 0 {
+		return delivered, nil
+	}
+
+	pipe := r.rdb.TxPipeline()
+
+	for _, command := range delivered {
+		raw, _ := json.Marshal(command)
+		pipe.LPush(ctx, deliveredCommandsKeyPrefix+deviceId, raw)
+	}
+
+	pipe.LTrim(ctx, deliveredCommandsKeyPrefix+deviceId, 0, deliveredCommandsKept-1)
+
+	// The commands are handed to the device even if their delivery isn't recorded.
+	if _, err := pipe.Exec(ctx); err != nil {
+		return delivered, fmt.Errorf("fatal error on recording the commands delivered to device %s in the cache: %v", deviceId, err)
+	}
+
+	return delivered, nil
+}
+
+// decodeCommands parses the commands stored as JSON
+func decodeCommands(raws []string) ([]Command, error) {
+	commands := make([]Command, 0, len(raws))
+
+	for _, raw := range raws {
+		var command Command
+
+		if err := json.Unmarshal([]byte(raw), &command); err != nil {
+			return nil, err
+		}
+
+		commands = append(commands, command)
+	}
+
+	return commands, nil
+}
+
+// newCommandId returns a random command id
+func newCommandId() (string, error) {
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// queueCommand queues a command for the device
+func queueCommand(c echo.Context, reg *registry) error {
+	var request commandRequest
+
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the command from the request body: %v", err))
+	}
+
+	if !idPattern.MatchString(request.Name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Command 'name' must be 1 to 64 letters, digits, '_', '.' or '-'")
+	}
+
+	id, err := newCommandId()
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't generate the command id. %v", err))
+	}
+
+	now := time.Now().UTC()
+	command := &Command{Id: id, Name: request.Name, Params: request.Params, CreatedAt: now.Format(time.RFC3339)}
+
+	if request.TTL > 0 {
+		command.ExpiresAt = now.Add(time.Duration(request.TTL)).Format(time.RFC3339)
+	}
+
+	if err := reg.QueueCommand(c.Request().Context(), c.Param("id"), command); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusCreated, command)
+}
+
+// listCommands returns the pending and the last delivered commands of the device
+func listCommands(c echo.Context, reg *registry) error {
+	list, err := reg.Commands(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
+
+// cancelCommand removes a pending command of the device
+func cancelCommand(c echo.Context, reg *registry) error {
+	if err := reg.CancelCommand(c.Request().Context(), c.Param("id"), c.Param("command")); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// fetchCommands delivers the pending commands to the device, long-polling for up to the wait query parameter
+func fetchCommands(c echo.Context, reg *registry) error {
+	var wait time.Duration
+
+	if raw := c.QueryParam("wait"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+
+		if err != nil {
+			seconds, errSeconds := strconv.Atoi(raw)
+
+			if errSeconds != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'wait' %s is not a duration such as \"30s\"", raw))
+			}
+
+			parsed = time.Duration(seconds) * time.Second
+		}
+
+		if parsed > maxCommandWait {
+			parsed = maxCommandWait
+		}
+
+		wait = parsed
+	}
+
+	commands, err := reg.DeliverCommands(c.Request().Context(), c.Param("id"), wait)
+
+	if err != nil && commands == nil {
+		return registryHTTPError(err)
+	}
+
+	if err != nil {
+		log.Printf("Commands delivered to device %s: %v", c.Param("id"), err)
+	}
+
+	return c.JSON(http.StatusOK, commands)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config holds the settings read from the optional JSON configuration file.
+type Config struct {
+	Server ServerConfig `json:"server"` // Address, timeouts and limits of the HTTP server
+
+	Redis        RedisConfig        `json:"redis"`         // User, database and TLS of the main Redis
+	Storage      StorageConfig      `json:"storage"`       // Backend of the readings, Redis by default
+	Shards       []ShardConfig      `json:"shards"`        // Redis instances the readings are spread over, all on the main Redis when empty
+	ReadReplicas ReadReplicasConfig `json:"read_replicas"` // Replicas of the main Redis serving the reads of the GET requests
+	Cache        CacheConfig        `json:"cache"`         // In-memory cache of the latest readings of the most requested devices
+	WarmUp       WarmUpConfig       `json:"warm_up"`       // Connections and cache prepared before listening
+	Snapshots    SnapshotConfig     `json:"snapshots"`     // Consistent exports of the readings while the ingest goes on
+
+	SNMP   SNMPConfig   `json:"snmp"`   // SNMP polling collector
+	Modbus ModbusConfig `json:"modbus"` // Modbus TCP client
+	CoAP   CoAPConfig   `json:"coap"`   // CoAP endpoint
+	TTN    TTNConfig    `json:"ttn"`    // The Things Network uplink webhook
+	OPCUA  OPCUAConfig  `json:"opcua"`  // OPC UA subscription client
+
+	Transforms     []TransformConfig       `json:"transforms"`      // Scripts rewriting the incoming payloads before validation
+	Schemas        map[string]SchemaConfig `json:"schemas"`         // JSON Schema of the payloads per device type, checked before decoding
+	StrictDecoding bool                    `json:"strict_decoding"` // Rejects the JSON readings with unknown fields or without a required field
+	DerivedFields  []DerivedFieldConfig    `json:"derived_fields"`  // Fields computed at ingest and stored with the readings
+	MetricLimits   map[string]MetricLimit  `json:"metric_limits"`   // Accepted range of the measurements, merged over the defaults
+	DeviceTypes    []string                `json:"device_types"`    // Device types accepted at ingest, A and B by default
+	DeviceIds      DeviceIdConfig          `json:"device_ids"`      // Normalization and format of the device ids accepted at ingest
+	Pipeline       PipelineConfig          `json:"pipeline"`        // Stages of the ingest in their order
+
+	SilentDeviceStubs bool `json:"silent_device_stubs"` // Returns a stub instead of 404 for the registered devices that never reported
+	CanonicalJSON     bool `json:"canonical_json"`      // Writes the JSON responses and exports with sorted keys and UTC timestamps, byte for byte stable
+
+	ExpectedFirmware  map[string]string   `json:"expected_firmware"`  // Firmware version the devices of each type should run
+	ExpectedIntervals map[string]Duration `json:"expected_intervals"` // Reporting interval of the devices of each type, for the gap reports
+	ClockDrift        ClockDriftConfig    `json:"clock_drift"`        // Correction of the drifted device clocks
+	Dedup             DedupConfig         `json:"dedup"`              // Detection of the readings received twice
+	LateData          LateDataConfig      `json:"late_data"`          // Policy of the readings arriving long after their time
+	RollingStats      RollingStatsConfig  `json:"rolling_stats"`      // Measurements with rolling statistics maintained at ingest
+	Percentiles       PercentilesConfig   `json:"percentiles"`        // Measurements with percentile sketches maintained at ingest
+	Rollups           []RollupConfig      `json:"rollups"`            // Continuous queries maintained at ingest
+	Alerts            AlertsConfig        `json:"alerts"`             // Alert rules evaluated at ingest
+	GraphQL           GraphQLConfig       `json:"graphql"`            // GraphQL query API
+	RequestLog        RequestLogConfig    `json:"request_log"`        // Logging of the full requests and responses
+	AccessLog         AccessLogConfig     `json:"access_log"`         // Access log line written for every request
+	RateLimit         RateLimitConfig     `json:"rate_limit"`         // Requests allowed per client across the replicas
+	Quota             QuotaConfig         `json:"quota"`              // Readings accepted per device or API key per hour and day
+	AsyncIngest       AsyncIngestConfig   `json:"async_ingest"`       // Storage of the readings acknowledged before being stored
+	Replication       ReplicationConfig   `json:"replication"`        // Readings forwarded to the instances of the other regions
+	Metering          MeteringConfig      `json:"metering"`           // Usage of the API per tenant for the billing
+	APITokens         APITokensConfig     `json:"api_tokens"`         // API tokens of the tenants required on the API routes
+	OTel              OTelConfig          `json:"otel"`               // Temperature of the devices pushed as OpenTelemetry metrics
+	StatsD            StatsDConfig        `json:"statsd"`             // Request and ingest metrics emitted to StatsD or Datadog
+	IPFilter          IPFilterConfig      `json:"ip_filter"`          // Client IPs allowed on the route groups
+	Signing           SigningConfig       `json:"signing"`            // HMAC signature of the ingested payloads
+
+	FeatureFlags map[string]FeatureFlagConfig `json:"feature_flags"` // Risky features enabled in this environment, overridden at runtime through the admin API
+}
+
+// Duration is a time.Duration read from a JSON string such as "30s" or "5m".
+type Duration time.Duration
+
+// UnmarshalJSON parses the duration from its string representation.
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var value string
+
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+
+	parsed, err := time.ParseDuration(value)
+
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// MarshalJSON writes the duration in its string representation.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// loadConfig reads the configuration file, an empty path gives the default configuration
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+
+	if path == "" {
+		return config, nil
+	}
+
+	raw, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return config, nil
+}
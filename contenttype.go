@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// supportedContentTypes are the media types of the bodies accepted by the write endpoints.
+var supportedContentTypes = []string{echo.MIMEApplicationJSON}
+
+// routeContentTypes are the media types accepted by a route on top of the supported ones, by route path.
+var routeContentTypes = map[string][]string{
+	"/devices/import": {"text/csv"},
+}
+
+// requireContentType rejects with 415 Unsupported Media Type the bodies of the write requests not declared with a
+// supported type, instead of echo binding a form or an XML post into an empty payload
+func requireContentType(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		request := c.Request()
+
+		if request.Method != http.MethodPost && request.Method != http.MethodPut && request.Method != http.MethodPatch {
+			return next(c)
+		}
+
+		// The writes without a body, e.g. an acknowledgement, don't declare a type.
+		if request.ContentLength == 0 {
+			return next(c)
+		}
+
+		contentType := request.Header.Get(echo.HeaderContentType)
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		accepted := append(append([]string(nil), supportedContentTypes...), routeContentTypes[c.Path()]...)
+
+		if err == nil && supportsContentType(mediaType, accepted) {
+			return next(c)
+		}
+
+		supported := strings.Join(accepted, ", ")
+
+		switch request.Method {
+		case http.MethodPost:
+			c.Response().Header().Set("Accept-Post", supported)
+		case http.MethodPatch:
+			c.Response().Header().Set("Accept-Patch", supported)
+		}
+
+		if contentType == "" {
+			return newProblem(http.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("The body has no Content-Type, supported types: %s", supported))
+		}
+
+		return newProblem(http.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("Content-Type %q isn't supported, supported types: %s", contentType, supported))
+	}
+}
+
+// supportsContentType reports whether the media type is one of the accepted ones
+func supportsContentType(mediaType string, accepted []string) bool {
+	for _, supported := range accepted {
+		if mediaType == supported {
+			return true
+		}
+	}
+
+	return false
+}
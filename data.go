@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// defaultQueryWindow is the time range of the queries without a from parameter.
+const defaultQueryWindow = 24 * time.Hour
+
+// registerDataRoutes mounts the per-device query endpoints on the given group, the device ids normalized as at ingest
+func registerDataRoutes(g *echo.Group, store Store, reg *registry, normalizeDeviceId func(deviceId string) string) {
+	g.Use(normalizeDeviceIdParam(normalizeDeviceId))
+	g.GET("/:id/range", func(c echo.Context) error {
+		return getRange(c, store)
+	})
+	g.GET("/:id/metrics", func(c echo.Context) error {
+		return getMetricNames(c, store)
+	})
+	g.GET("/:id/metric/:metric/range", func(c echo.Context) error {
+		return getMetricRange(c, store)
+	})
+	g.GET("/:id/stats", func(c echo.Context) error {
+		return getRollingStats(c, reg)
+	})
+	g.GET("/:id/percentiles", func(c echo.Context) error {
+		return getPercentiles(c, reg)
+	})
+	g.GET("/:id/histogram", func(c echo.Context) error {
+		return getHistogram(c, store)
+	})
+}
+
+// getRange returns the readings of the device over the requested time range, oldest first
+func getRange(c echo.Context, store Store) error {
+	deviceId := c.Param("id")
+	from, to, err := parseTimeRange(c, defaultQueryWindow)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	fields, err := parseFieldSelection(c)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	history, err := store.Range(c.Request().Context(), deviceId, from, to)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the readings of device %s. %v", deviceId, err))
+	}
+
+	if history == nil {
+		history = []SensorData{}
+	}
+
+	return c.JSON(http.StatusOK, fields.readings(history))
+}
+
+// getMetricNames lists the measurements reported by the device
+func getMetricNames(c echo.Context, store Store) error {
+	deviceId := c.Param("id")
+	names, err := store.Metrics(c.Request().Context(), deviceId)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the metrics of device %s. %v", deviceId, err))
+	}
+
+	sort.Strings(names)
+
+	return c.JSON(http.StatusOK, names)
+}
+
+// getMetricRange returns the values of a measurement of the device over the requested time range
+func getMetricRange(c echo.Context, store Store) error {
+	deviceId := c.Param("id")
+	metric := c.Param("metric")
+
+	if !metricNamePattern.MatchString(metric) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Metric name %q is invalid", metric))
+	}
+
+	from, to, err := parseTimeRange(c, defaultQueryWindow)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	points, err := store.MetricRange(c.Request().Context(), deviceId, metric, from, to)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the %s history of device %s. %v", metric, deviceId, err))
+	}
+
+	return c.JSON(http.StatusOK, points)
+}
+
+// parseTimeRange reads the RFC 3339 from and to query parameters, to defaults to now and from to window before to,
+// both in UTC so the responses echo them the same whatever the offset of the client
+func parseTimeRange(c echo.Context, window time.Duration) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+
+	if raw := c.QueryParam("to"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("'to' %s is not a valid RFC 3339 timestamp", raw)
+		}
+
+		to = parsed.UTC()
+	}
+
+	from := to.Add(-window)
+
+	if raw := c.QueryParam("from"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("'from' %s is not a valid RFC 3339 timestamp", raw)
+		}
+
+		from = parsed.UTC()
+	}
+
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("'to' is before 'from'")
+	}
+
+	return from, to, nil
+}
+
+// latestReport is the latest reading of a set of devices.
+type latestReport struct {
+	Group    string       `json:"group,omitempty"`    // Group of the devices, if queried by group
+	Selector string       `json:"selector,omitempty"` // Label selector of the devices, if queried by labels
+	Readings []SensorData `json:"readings"`
+	Missing  []string     `json:"missing"` // Devices without any reading
+}
+
+// latestReadings collects the latest reading of every device, in device id order
+func latestReadings(ctx context.Context, store Store, deviceIds []string) (*latestReport, error) {
+	deviceIds = append([]string(nil), deviceIds...)
+	sort.Strings(deviceIds)
+	report := &latestReport{Readings: []SensorData{}, Missing: []string{}}
+
+	for _, deviceId := range deviceIds {
+		sensorData, err := store.Latest(ctx, deviceId)
+
+		if errors.Is(err, errNotFound) {
+			report.Missing = append(report.Missing, deviceId)
+			continue
+		}
+
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the Sensor data for device %s. %v", deviceId, err))
+		}
+
+		report.Readings = append(report.Readings, *sensorData)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// errDuplicateReading is returned when a reading already ingested within the window is dropped.
+var errDuplicateReading = errors.New("duplicate reading")
+
+// seenKeyPrefix prefixes the keys marking the fingerprints of the readings ingested within the window.
+const seenKeyPrefix = "seen:"
+
+// DedupConfig enables the detection of the readings sent twice, e.g. by gateways retrying aggressively.
+//
+// A duplicate has the same device id, time and values as a reading ingested within the window.
+type DedupConfig struct {
+	Window Duration `json:"window"` // How long a reading is remembered, the detection is disabled when empty
+	Mode   string   `json:"mode"`   // "drop" (default) discards the duplicates, "flag" stores them marked as duplicate
+}
+
+// deduplicator detects the readings already ingested within the window.
+type deduplicator struct {
+	config   DedupConfig
+	registry *registry
+}
+
+// newDeduplicator validates the configuration and applies its defaults
+func newDeduplicator(config DedupConfig, reg *registry) (*deduplicator, error) {
+	if config.Mode == "" {
+		config.Mode = "drop"
+	}
+
+	if config.Mode != "drop" && config.Mode != "flag" {
+		return nil, fmt.Errorf("dedup mode %q must be drop or flag", config.Mode)
+	}
+
+	return &deduplicator{config: config, registry: reg}, nil
+}
+
+// enabled reports whether the detection is configured
+func (d *deduplicator) enabled() bool {
+	return d != nil && d.config.Window > 0
+}
+
+// check drops the reading with errDuplicateReading or flags it when it was already ingested within the window,
+// it returns the fingerprint of the reading
+func (d *deduplicator) check(ctx context.Context, sensorData *SensorData) (string, error) {
+	fingerprint, err := readingFingerprint(sensorData)
+
+	if err != nil {
+		return "", err
+	}
+
+	first, err := d.registry.MarkSeen(ctx, fingerprint, time.Duration(d.config.Window))
+
+	if err != nil {
+		return "", err
+	}
+
+	if first {
+		return fingerprint, nil
+	}
+
+	if d.config.Mode == "flag" {
+		sensorData.Duplicate = true
+		return fingerprint, nil
+	}
+
+	return "", fmt.Errorf("%w of device %s at %s", errDuplicateReading, sensorData.DeviceId, sensorData.Time)
+}
+
+// forget removes the fingerprint of a reading that failed to be stored
+func (d *deduplicator) forget(ctx context.Context, fingerprint string) {
+	if err := d.registry.ForgetSeen(ctx, fingerprint); err != nil {
+		log.Printf("Reading %s may be dropped as a duplicate on retry: %v", fingerprint, err)
+	}
+}
+
+// MarkSeen remembers the fingerprint for the window and reports whether it was new
+func (r *registry) MarkSeen(ctx context.Context, fingerprint string, window time.Duration) (bool, error) {
+	first, err := r.rdb.SetNX(ctx, seenKeyPrefix+fingerprint, 1, window).Result()
+
+	if err != nil {
+		return false, fmt.Errorf("fatal error on checking the reading %s for duplicates in the cache: %v", fingerprint, err)
+	}
+
+	return first, nil
+}
+
+// ForgetSeen removes the fingerprint so the reading is accepted again
+func (r *registry) ForgetSeen(ctx context.Context, fingerprint string) error {
+	if err := r.rdb.Del(ctx, seenKeyPrefix+fingerprint).Err(); err != nil {
+		return fmt.Errorf("fatal error on forgetting the reading %s in the cache: %v", fingerprint, err)
+	}
+
+	return nil
+}
+
+// readingFingerprint hashes the device id, time and values of the reading
+func readingFingerprint(sensorData *SensorData) (string, error) {
+	// Marshalling sorts the measurement names so the hash doesn't depend on the payload order.
+	raw, err := json.Marshal(struct {
+		DeviceId     string
+		DeviceType   string
+		Time         string
+		Uptime       int
+		Firmware     string
+		Measurements map[string]float64
+	}{sensorData.DeviceId, sensorData.DeviceType, sensorData.Time, sensorData.Uptime, sensorData.Firmware, sensorData.Measurements()})
+
+	if err != nil {
+		return "", fmt.Errorf("fatal error on fingerprinting the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	sum := sha256.Sum256(raw)
+
+	return hex.EncodeToString(sum[:]), nil
+}
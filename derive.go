@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// DerivedFieldConfig defines a field computed at ingest from the raw values of the reading.
+//
+// The expression is Lua and can use the reading values (uptime, device_id,
+// device_type and the measurements such as temp or humidity), the fields
+// derived before it and the helper functions of derivedFieldsPrelude. A nil
+// or false result leaves the field out of the reading.
+type DerivedFieldConfig struct {
+	Name        string   `json:"name"`         // Name of the field in the derived values of the reading
+	Expr        string   `json:"expr"`         // Lua expression computing the value, e.g. "temp * 9 / 5 + 32"
+	DeviceTypes []string `json:"device_types"` // Device types the field applies to, all when empty
+}
+
+// derivedFieldsPrelude defines the helper functions available to the expressions.
+const derivedFieldsPrelude = `
+function fahrenheit(c)
+  return c * 9 / 5 + 32
+end
+
+-- dewpoint approximates the dew point in °C with the Magnus formula
+function dewpoint(t, rh)
+  local a, b = 17.62, 243.12
+  local gamma = math.log(rh / 100) + a * t / (b + t)
+  return b * gamma / (a - gamma)
+end
+`
+
+// derivedFieldsTimeout bounds the time spent computing the derived fields of a reading.
+const derivedFieldsTimeout = 100 * time.Millisecond
+
+// derivedField is a compiled derived field.
+type derivedField struct {
+	name        string
+	deviceTypes map[string]bool
+	proto       *lua.FunctionProto
+}
+
+// derivedState is an interpreter with the expressions of the derived fields loaded.
+type derivedState struct {
+	L     *lua.LState
+	exprs []*lua.LFunction
+}
+
+// deriver computes the configured derived fields of the readings.
+type deriver struct {
+	fields  []derivedField
+	prelude *lua.FunctionProto
+	states  sync.Pool
+}
+
+// newDeriver compiles the expressions of the derived fields
+func newDeriver(configs []DerivedFieldConfig) (*deriver, error) {
+	prelude, err := compileLua("prelude", derivedFieldsPrelude)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile the derived fields prelude: %w", err)
+	}
+
+	d := &deriver{prelude: prelude}
+	names := make(map[string]bool)
+
+	for _, config := range configs {
+		if config.Name == "" || config.Expr == "" {
+			return nil, fmt.Errorf("derived field %+v must have a name and an expr", config)
+		}
+
+		if names[config.Name] {
+			return nil, fmt.Errorf("derived field %s is defined twice", config.Name)
+		}
+
+		names[config.Name] = true
+
+		proto, err := compileLua(config.Name, "return ("+config.Expr+")")
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile derived field %s: %w", config.Name, err)
+		}
+
+		field := derivedField{name: config.Name, proto: proto}
+
+		if len(config.DeviceTypes) > 0 {
+			field.deviceTypes = make(map[string]bool, len(config.DeviceTypes))
+
+			for _, deviceType := range config.DeviceTypes {
+				field.deviceTypes[deviceType] = true
+			}
+		}
+
+		d.fields = append(d.fields, field)
+	}
+
+	return d, nil
+}
+
+// enabled reports whether at least one derived field is configured
+func (d *deriver) enabled() bool {
+	return d != nil && len(d.fields) > 0
+}
+
+// derive computes the derived fields of the reading, a failing expression only leaves its field out
+func (d *deriver) derive(ctx context.Context, sensorData *SensorData) {
+	state, ok := d.states.Get().(*derivedState)
+
+	if !ok {
+		var err error
+
+		if state, err = d.newState(); err != nil {
+			log.Printf("Derived fields of device %s not computed: %v", sensorData.DeviceId, err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, derivedFieldsTimeout)
+	defer cancel()
+
+	L := state.L
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	// Every reading gets a fresh environment so no value leaks between readings.
+	env := L.NewTable()
+	meta := L.NewTable()
+	meta.RawSetString("__index", L.Get(lua.GlobalsIndex))
+	L.SetMetatable(env, meta)
+
+	for name, value := range derivedFieldsVars(sensorData) {
+		env.RawSetString(name, toLua(L, value))
+	}
+
+	derived := make(map[string]float64)
+
+	for i, field := range d.fields {
+		if field.deviceTypes != nil && !field.deviceTypes[sensorData.DeviceType] {
+			continue
+		}
+
+		expr := state.exprs[i]
+		L.SetFEnv(expr, env)
+
+		if err := L.CallByParam(lua.P{Fn: expr, NRet: 1, Protect: true}); err != nil {
+			log.Printf("Derived field %s of device %s not computed: %v", field.name, sensorData.DeviceId, err)
+
+			if ctx.Err() != nil {
+				// The interpreter was interrupted mid-run and is not reused.
+				L.Close()
+				return
+			}
+
+			continue
+		}
+
+		result := L.Get(-1)
+		L.Pop(1)
+
+		switch value := result.(type) {
+		case lua.LNumber:
+			// e.g. the dew point of a 0% humidity, the reading can't be stored with it.
+			if f := float64(value); math.IsNaN(f) || math.IsInf(f, 0) {
+				log.Printf("Derived field %s of device %s is not a finite number: %v", field.name, sensorData.DeviceId, result)
+				continue
+			}
+
+			derived[field.name] = float64(value)
+			env.RawSetString(field.name, value)
+		case *lua.LNilType, lua.LBool:
+		default:
+			log.Printf("Derived field %s of device %s is not a number: %v", field.name, sensorData.DeviceId, result)
+		}
+	}
+
+	d.states.Put(state)
+
+	if len(derived) > 0 {
+		sensorData.Derived = derived
+	}
+}
+
+// newState creates an interpreter with the prelude and the expressions loaded
+func (d *deriver) newState() (*derivedState, error) {
+	L, err := newLuaState()
+
+	if err != nil {
+		return nil, err
+	}
+
+	L.Push(L.NewFunctionFromProto(d.prelude))
+
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to load the derived fields prelude: %w", err)
+	}
+
+	state := &derivedState{L: L, exprs: make([]*lua.LFunction, len(d.fields))}
+
+	for i, field := range d.fields {
+		state.exprs[i] = L.NewFunctionFromProto(field.proto)
+	}
+
+	return state, nil
+}
+
+// derivedFieldsVars returns the values of the reading available to the expressions
+func derivedFieldsVars(sensorData *SensorData) map[string]interface{} {
+	vars := map[string]interface{}{
+		"uptime":      float64(sensorData.Uptime),
+		"device_id":   sensorData.DeviceId,
+		"device_type": sensorData.DeviceType,
+	}
+
+	for name, value := range sensorData.Measurements() {
+		vars[name] = value
+	}
+
+	return vars
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DeviceIdRule restricts the format of the device ids, an unset limit isn't checked.
+type DeviceIdRule struct {
+	Pattern   string `json:"pattern"`    // Regular expression the whole id must match, e.g. "th-[0-9]{4}"
+	MinLength int    `json:"min_length"` // Minimum number of characters
+	MaxLength int    `json:"max_length"` // Maximum number of characters
+}
+
+// DeviceIdConfig normalizes and validates the device ids of the ingested readings. The empty ids, with control
+// characters or with white space around them are always rejected, unless trimmed.
+type DeviceIdConfig struct {
+	Trim      bool `json:"trim"`      // Removes the leading and trailing white space of the ids
+	Lowercase bool `json:"lowercase"` // Folds the ids to lower case, "TH-01" and "th-01" are the same device
+	DeviceIdRule
+	Types map[string]DeviceIdRule `json:"types"` // Rule of the devices of a type, instead of the one of all devices
+}
+
+// deviceIdRule is a validated device id rule.
+type deviceIdRule struct {
+	pattern   *regexp.Regexp
+	minLength int
+	maxLength int
+}
+
+// deviceIdRules normalizes and validates the device ids.
+type deviceIdRules struct {
+	trim      bool
+	lowercase bool
+	rule      deviceIdRule
+	types     map[string]deviceIdRule
+}
+
+// newDeviceIdRules compiles the rules of the device ids
+func newDeviceIdRules(config DeviceIdConfig) (*deviceIdRules, error) {
+	rules := &deviceIdRules{trim: config.Trim, lowercase: config.Lowercase, types: make(map[string]deviceIdRule, len(config.Types))}
+	var err error
+
+	if rules.rule, err = newDeviceIdRule(config.DeviceIdRule); err != nil {
+		return nil, err
+	}
+
+	for deviceType, ruleConfig := range config.Types {
+		if rules.types[deviceType], err = newDeviceIdRule(ruleConfig); err != nil {
+			return nil, fmt.Errorf("device type %s: %w", deviceType, err)
+		}
+	}
+
+	return rules, nil
+}
+
+// newDeviceIdRule compiles the pattern of the rule, anchored to match the whole id
+func newDeviceIdRule(config DeviceIdRule) (deviceIdRule, error) {
+	rule := deviceIdRule{minLength: config.MinLength, maxLength: config.MaxLength}
+
+	if config.MinLength < 0 || config.MaxLength < 0 || config.MaxLength > 0 && config.MaxLength < config.MinLength {
+		return rule, fmt.Errorf("device id lengths %d to %d are invalid", config.MinLength, config.MaxLength)
+	}
+
+	if config.Pattern != "" {
+		pattern, err := regexp.Compile(`^(?:` + config.Pattern + `)$`)
+
+		if err != nil {
+			return rule, fmt.Errorf("device id pattern %q: %w", config.Pattern, err)
+		}
+
+		rule.pattern = pattern
+	}
+
+	return rule, nil
+}
+
+// normalize trims and folds the device id as configured
+func (r *deviceIdRules) normalize(deviceId string) string {
+	if r.trim {
+		deviceId = strings.TrimSpace(deviceId)
+	}
+
+	if r.lowercase {
+		deviceId = strings.ToLower(deviceId)
+	}
+
+	return deviceId
+}
+
+// normalizeDeviceIdParam normalizes the device id of the :id path parameter with the ingest rules, so the queries find
+// the device under the id it was ingested with
+func normalizeDeviceIdParam(normalizeDeviceId func(deviceId string) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			values := c.ParamValues()
+
+			for n, name := range c.ParamNames() {
+				if name == "id" && n < len(values) {
+					values[n] = normalizeDeviceId(values[n])
+				}
+			}
+
+			c.SetParamValues(values...)
+
+			return next(c)
+		}
+	}
+}
+
+// validate adds the errors of the normalized id of a device of the given type
+func (r *deviceIdRules) validate(errs *fieldErrors, deviceId, deviceType string) {
+	if deviceId == "" {
+		errs.add("device_id", "required", deviceId, "device id must not be empty")
+		return
+	}
+
+	if !utf8.ValidString(deviceId) || strings.IndexFunc(deviceId, unicode.IsControl) >= 0 {
+		errs.add("device_id", "control_character", deviceId, "device id %q must not contain control characters", deviceId)
+		return
+	}
+
+	if strings.TrimSpace(deviceId) != deviceId {
+		errs.add("device_id", "whitespace", deviceId, "device id %q must not start or end with white space", deviceId)
+		return
+	}
+
+	rule, found := r.types[deviceType]
+
+	if !found {
+		rule = r.rule
+	}
+
+	length := utf8.RuneCountInString(deviceId)
+
+	if rule.minLength > 0 && length < rule.minLength {
+		errs.add("device_id", "min_length", deviceId, "device id %q must be at least %d characters", deviceId, rule.minLength)
+	}
+
+	if rule.maxLength > 0 && length > rule.maxLength {
+		errs.add("device_id", "max_length", deviceId, "device id %q must be at most %d characters", deviceId, rule.maxLength)
+	}
+
+	if rule.pattern != nil && !rule.pattern.MatchString(deviceId) {
+		errs.add("device_id", "pattern", deviceId, "device id %q must match %s", deviceId, rule.pattern)
+	}
+}
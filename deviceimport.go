@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// maxImportedDevices bounds the rows of an import, a larger shipment is imported in several requests.
+const maxImportedDevices = 10000
+
+// DeviceImport is a device onboarded by an import, an element of the JSON array or a row of the CSV.
+type DeviceImport struct {
+	Id     string            `json:"id"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+// DeviceImportResult is the outcome of a row of an import.
+type DeviceImportResult struct {
+	Row    int    `json:"row"` // From 1, the CSV header isn't counted
+	Id     string `json:"id"`
+	Status string `json:"status"` // "imported", "valid" in a dry run, "invalid" or "failed" when the registry failed
+	Error  string `json:"error,omitempty"`
+}
+
+// DeviceImportReport is the outcome of an import, row by row.
+type DeviceImportReport struct {
+	DryRun   bool                 `json:"dry_run"`
+	Imported int                  `json:"imported"` // Valid rows in a dry run
+	Invalid  int                  `json:"invalid"`
+	Failed   int                  `json:"failed"`
+	Results  []DeviceImportResult `json:"results"`
+}
+
+// importDevices registers the type and replaces the labels of every valid device of the JSON or CSV body, the
+// invalid rows are reported and skipped. Nothing is saved in a dry run.
+func importDevices(c echo.Context, reg *registry, ing *ingester) error {
+	dryRun := c.QueryParam("dry_run") == "true"
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	var devices []DeviceImport
+	var err error
+
+	if mediaType == "text/csv" {
+		devices, err = readDeviceCSV(c.Request().Body)
+	} else {
+		err = json.NewDecoder(c.Request().Body).Decode(&devices)
+	}
+
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to get the devices from the request body: %v", err))
+	}
+
+	if len(devices) > maxImportedDevices {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("An import is limited to %d devices, got %d", maxImportedDevices, len(devices)))
+	}
+
+	ctx := c.Request().Context()
+	report := DeviceImportReport{DryRun: dryRun, Results: make([]DeviceImportResult, 0, len(devices))}
+	rows := make(map[string]int, len(devices))
+
+	for i, device := range devices {
+		result := DeviceImportResult{Row: i + 1, Id: device.Id, Status: "imported"}
+
+		if dryRun {
+			result.Status = "valid"
+		}
+
+		if err := validateDeviceImport(device, ing); err != nil {
+			result.Status, result.Error = "invalid", err.Error()
+		} else if row, found := rows[device.Id]; found {
+			result.Status, result.Error = "invalid", fmt.Sprintf("Device %s is imported by row %d already", device.Id, row)
+		} else if !dryRun {
+			if err := reg.ImportDevice(ctx, device); err != nil {
+				log.Printf("Device %s not imported: %v", device.Id, err)
+				result.Status, result.Error = "failed", "The registry failed, the device isn't imported"
+			}
+		}
+
+		switch result.Status {
+		case "invalid":
+			report.Invalid++
+		case "failed":
+			report.Failed++
+		default:
+			report.Imported++
+			rows[device.Id] = result.Row
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// readDeviceCSV reads the devices of a CSV with an id and a type column, the other columns are labels named after
+// their header, an empty cell is no label
+func readDeviceCSV(body io.Reader) ([]DeviceImport, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+
+	if err == io.EOF {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	idColumn, typeColumn := -1, -1
+
+	for i, name := range header {
+		switch strings.TrimSpace(name) {
+		case "id":
+			idColumn = i
+		case "type":
+			typeColumn = i
+		}
+	}
+
+	if idColumn < 0 || typeColumn < 0 {
+		return nil, errors.New("the CSV header must have an id and a type column")
+	}
+
+	var devices []DeviceImport
+
+	for {
+		record, err := reader.Read()
+
+		if err == io.EOF {
+			return devices, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		device := DeviceImport{Id: record[idColumn], Type: record[typeColumn], Labels: map[string]string{}}
+
+		for i, value := range record {
+			if i != idColumn && i != typeColumn && value != "" {
+				device.Labels[strings.TrimSpace(header[i])] = value
+			}
+		}
+
+		devices = append(devices, device)
+	}
+}
+
+// validateDeviceImport checks the id, the type and the labels of an imported device
+func validateDeviceImport(device DeviceImport, ing *ingester) error {
+	if !idPattern.MatchString(device.Id) {
+		return fmt.Errorf("Device 'id' %q must be 1 to 64 letters, digits, '_', '.' or '-'", device.Id)
+	}
+
+	if !ing.validDeviceType(device.Type) {
+		return fmt.Errorf("Device type %q is not supported", device.Type)
+	}
+
+	return validateLabels(device.Labels)
+}
+
+// ImportDevice registers the type of the device and replaces its labels
+func (r *registry) ImportDevice(ctx context.Context, device DeviceImport) error {
+	pipe := r.rdb.TxPipeline()
+	pipe.HSet(ctx, deviceTypesKey, device.Id, device.Type)
+	pipe.Del(ctx, labelsKeyPrefix+device.Id)
+
+	if len(device.Labels) > 0 {
+		pipe.HSet(ctx, labelsKeyPrefix+device.Id, device.Labels)
+		pipe.SAdd(ctx, labeledDevicesKey, device.Id)
+	} else {
+		pipe.SRem(ctx, labeledDevicesKey, device.Id)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on importing device %s in the cache: %v", device.Id, err)
+	}
+
+	return nil
+}
+
+// DeviceType returns the type the device was registered with by an import, empty when it wasn't imported
+func (r *registry) DeviceType(ctx context.Context, deviceId string) (string, error) {
+	deviceType, err := r.rdb.HGet(ctx, deviceTypesKey, deviceId).Result()
+
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("fatal error on retrieving the type of device %s from the cache: %v", deviceId, err)
+	}
+
+	return deviceType, nil
+}
+
+// DeviceTypes returns the type of every device registered by an import
+func (r *registry) DeviceTypes(ctx context.Context) (map[string]string, error) {
+	types, err := r.rdb.HGetAll(ctx, deviceTypesKey).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the device types from the cache: %v", err)
+	}
+
+	return types, nil
+}
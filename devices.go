@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Device is a device with its metadata.
+type Device struct {
+	Id     string            `json:"id"`
+	Type   string            `json:"type,omitempty"` // Type the device was registered with by an import
+	Labels map[string]string `json:"labels"`
+}
+
+// registerDeviceRoutes mounts the device metadata and label selection endpoints on the given group, the device ids
+// normalized as at ingest
+func registerDeviceRoutes(g *echo.Group, reg *registry, store Store, ing *ingester, intervals map[string]Duration) {
+	g.Use(normalizeDeviceIdParam(ing.normalizeDeviceId))
+	g.GET("", func(c echo.Context) error {
+		return listDevices(c, reg, store)
+	})
+	g.POST("/import", func(c echo.Context) error {
+		return importDevices(c, reg, ing)
+	})
+	g.GET("/latest", func(c echo.Context) error {
+		return getSelectedLatest(c, reg, store)
+	})
+	g.GET("/aggregate", func(c echo.Context) error {
+		return getSelectedAggregate(c, reg, store)
+	})
+	g.GET("/:id/labels", func(c echo.Context) error {
+		return getLabels(c, reg)
+	})
+	g.PUT("/:id/labels", func(c echo.Context) error {
+		return putLabels(c, reg)
+	})
+	g.PATCH("/:id/labels", func(c echo.Context) error {
+		return patchLabels(c, reg)
+	})
+	g.DELETE("/:id/labels/:key", func(c echo.Context) error {
+		return deleteLabel(c, reg)
+	})
+	g.GET("/:id/firmware", func(c echo.Context) error {
+		return getFirmware(c, reg)
+	})
+	g.PUT("/:id/firmware", func(c echo.Context) error {
+		return putFirmware(c, reg, ing)
+	})
+	g.GET("/:id/clock", func(c echo.Context) error {
+		return getClockOffset(c, reg)
+	})
+	g.GET("/:id/gaps", func(c echo.Context) error {
+		return getGaps(c, reg, store, intervals)
+	})
+	g.PUT("/:id/expected-interval", func(c echo.Context) error {
+		return putExpectedInterval(c, reg)
+	})
+	g.DELETE("/:id/expected-interval", func(c echo.Context) error {
+		return deleteExpectedInterval(c, reg)
+	})
+	g.GET("/:id/restarts", func(c echo.Context) error {
+		return getRestarts(c, reg)
+	})
+	g.GET("/:id/availability", func(c echo.Context) error {
+		return getAvailability(c, reg, store, intervals)
+	})
+	g.GET("/:id/late-data", func(c echo.Context) error {
+		return getLateData(c, reg)
+	})
+	g.GET("/:id/shadow", func(c echo.Context) error {
+		return getShadow(c, reg)
+	})
+	g.PUT("/:id/shadow/desired", func(c echo.Context) error {
+		return updateShadow(c, reg, shadowDesired)
+	})
+	g.PATCH("/:id/shadow/desired", func(c echo.Context) error {
+		return updateShadow(c, reg, shadowDesired)
+	})
+	g.PUT("/:id/shadow/reported", func(c echo.Context) error {
+		return updateShadow(c, reg, shadowReported)
+	})
+	g.PATCH("/:id/shadow/reported", func(c echo.Context) error {
+		return updateShadow(c, reg, shadowReported)
+	})
+	g.POST("/:id/commands", func(c echo.Context) error {
+		return queueCommand(c, reg)
+	})
+	g.GET("/:id/commands", func(c echo.Context) error {
+		return listCommands(c, reg)
+	})
+	g.GET("/:id/commands/pending", func(c echo.Context) error {
+		return fetchCommands(c, reg)
+	})
+	g.DELETE("/:id/commands/:command", func(c echo.Context) error {
+		return cancelCommand(c, reg)
+	})
+}
+
+// selectDevices returns the ids of the devices matching the selector query parameter
+func selectDevices(c echo.Context, reg *registry, store Store) ([]string, error) {
+	selector, err := parseSelector(c.QueryParam("selector"))
+
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ids, err := reg.SelectDevices(c.Request().Context(), store, selector)
+
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't select the devices. %v", err))
+	}
+
+	return ids, nil
+}
+
+// listDevices returns the devices matching the selector with their labels
+func listDevices(c echo.Context, reg *registry, store Store) error {
+	ids, err := selectDevices(c, reg, store)
+
+	if err != nil {
+		return err
+	}
+
+	types, err := reg.DeviceTypes(c.Request().Context())
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	devices := make([]Device, 0, len(ids))
+
+	for _, id := range ids {
+		labels, err := reg.Labels(c.Request().Context(), id)
+
+		if err != nil {
+			return registryHTTPError(err)
+		}
+
+		devices = append(devices, Device{Id: id, Type: types[id], Labels: labels})
+	}
+
+	return c.JSON(http.StatusOK, devices)
+}
+
+// getSelectedLatest returns the latest reading of every device matching the selector
+func getSelectedLatest(c echo.Context, reg *registry, store Store) error {
+	fields, err := parseFieldSelection(c)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ids, err := selectDevices(c, reg, store)
+
+	if err != nil {
+		return err
+	}
+
+	report, err := latestReadings(c.Request().Context(), store, ids)
+
+	if err != nil {
+		return err
+	}
+
+	report.Selector = c.QueryParam("selector")
+
+	return c.JSON(http.StatusOK, fields.latestReport(report))
+}
+
+// getSelectedAggregate summarizes a measurement of the devices matching the selector over the time range
+func getSelectedAggregate(c echo.Context, reg *registry, store Store) error {
+	ids, err := selectDevices(c, reg, store)
+
+	if err != nil {
+		return err
+	}
+
+	report, err := aggregateDevices(c, store, ids)
+
+	if err != nil {
+		return err
+	}
+
+	report.Selector = c.QueryParam("selector")
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// silentDevice is the stub of a registered device that never reported, its last_seen is always null.
+type silentDevice struct {
+	DeviceId   string            `json:"device_id"`
+	DeviceType string            `json:"device_type,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	LastSeen   *string           `json:"last_seen"`
+}
+
+// getSilentDevice returns the stub of a device registered by an import or labeled but without any reading, the
+// unknown devices aren't found
+func getSilentDevice(c echo.Context, reg *registry, deviceId string) error {
+	ctx := c.Request().Context()
+	deviceType, err := reg.DeviceType(ctx, deviceId)
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	labels, err := reg.Labels(ctx, deviceId)
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	if deviceType == "" && len(labels) == 0 {
+		return newProblem(http.StatusNotFound, "device_not_found", fmt.Sprintf("Device %s is unknown", deviceId))
+	}
+
+	return c.JSON(http.StatusOK, silentDevice{DeviceId: deviceId, DeviceType: deviceType, Labels: labels})
+}
+
+// getLabels returns the labels of the device
+func getLabels(c echo.Context, reg *registry) error {
+	labels, err := reg.Labels(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, labels)
+}
+
+// putLabels replaces the labels of the device
+func putLabels(c echo.Context, reg *registry) error {
+	labels, err := bindLabels(c)
+
+	if err != nil {
+		return err
+	}
+
+	if err := reg.SetLabels(c.Request().Context(), c.Param("id"), labels); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, labels)
+}
+
+// patchLabels adds the labels to the device, replacing the values of the existing keys
+func patchLabels(c echo.Context, reg *registry) error {
+	patch, err := bindLabels(c)
+
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	labels, err := reg.Labels(ctx, c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	for key, value := range patch {
+		labels[key] = value
+	}
+
+	if err := reg.SetLabels(ctx, c.Param("id"), labels); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, labels)
+}
+
+// deleteLabel removes a label from the device
+func deleteLabel(c echo.Context, reg *registry) error {
+	if err := reg.DeleteLabel(c.Request().Context(), c.Param("id"), c.Param("key")); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// bindLabels reads and validates a label set from the request body
+func bindLabels(c echo.Context) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	// The body is decoded directly, binding a map would also pick up the path parameters.
+	if err := json.NewDecoder(c.Request().Body).Decode(&labels); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the labels from the request body: %v", err))
+	}
+
+	if err := validateLabels(labels); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return labels, nil
+}
+
+// validateLabels checks the keys and the values of the labels, the first invalid one in key order is reported
+func validateLabels(labels map[string]string) error {
+	keys := make([]string, 0, len(labels))
+
+	for key := range labels {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !idPattern.MatchString(key) {
+			return fmt.Errorf("Label key %q must be 1 to 64 letters, digits, '_', '.' or '-'", key)
+		}
+
+		if !labelValuePattern.MatchString(labels[key]) {
+			return fmt.Errorf("Label value %q of %s must be up to 64 letters, digits, '_', '.' or '-'", labels[key], key)
+		}
+	}
+
+	return nil
+}
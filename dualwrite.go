@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// defaultVerifyRate is the share of the reads verified on the secondary without a verify_rate setting.
+	defaultVerifyRate = 0.01
+	// maxRecentMismatches is the number of mismatches kept for the admin endpoint.
+	maxRecentMismatches = 20
+	// verifyTimeout bounds the read of the secondary verifying a read of the primary.
+	verifyTimeout = 10 * time.Second
+)
+
+// DualWriteConfig writes the readings to a secondary backend along the primary one, to migrate to it once its reads
+// match the ones of the primary.
+type DualWriteConfig struct {
+	Secondary  StorageConfig `json:"secondary"`   // Backend migrated to, its dual_write is ignored
+	VerifyRate float64       `json:"verify_rate"` // Share of the reads run on the secondary too and compared, 0.01 by default
+}
+
+// DualWriteStats are the counters of the dual writes and of the read verification.
+type DualWriteStats struct {
+	Writes           uint64     `json:"writes"`
+	SecondaryFailed  uint64     `json:"secondary_failed"` // Writes to the secondary failed, the readings are missing from it
+	Verified         uint64     `json:"verified"`         // Reads compared
+	Mismatches       uint64     `json:"mismatches"`       // Reads with a different result on the secondary
+	VerifyFailed     uint64     `json:"verify_failed"`    // Reads of the secondary failed
+	RecentMismatches []Mismatch `json:"recent_mismatches"`
+}
+
+// Mismatch is a read with a different result on the secondary.
+type Mismatch struct {
+	Time      string          `json:"time"`
+	Read      string          `json:"read"` // Read and its arguments, e.g. "Latest(d1)"
+	Primary   json.RawMessage `json:"primary"`
+	Secondary json.RawMessage `json:"secondary"`
+}
+
+// dualWriteStore saves the readings in the primary and the secondary stores and serves the reads from the primary,
+// a sample of the reads is compared with the secondary in the background. A failure of the secondary doesn't fail
+// the request.
+type dualWriteStore struct {
+	primary    Store
+	secondary  Store
+	verifyRate float64
+
+	writes, secondaryFailed, verified, mismatches, verifyFailed atomic.Uint64
+
+	mu     sync.Mutex
+	recent []Mismatch // Latest last
+}
+
+// newDualWriteStore validates the verification rate of the dual writes
+func newDualWriteStore(primary, secondary Store, config DualWriteConfig) (*dualWriteStore, error) {
+	if config.VerifyRate < 0 || config.VerifyRate > 1 {
+		return nil, fmt.Errorf("verify rate %g must be between 0 and 1", config.VerifyRate)
+	}
+
+	if config.VerifyRate == 0 {
+		config.VerifyRate = defaultVerifyRate
+	}
+
+	return &dualWriteStore{primary: primary, secondary: secondary, verifyRate: config.VerifyRate}, nil
+}
+
+// Save saves the reading in the primary, then in the secondary when it was saved
+func (s *dualWriteStore) Save(ctx context.Context, sensorData *SensorData) error {
+	if err := s.primary.Save(ctx, sensorData); err != nil {
+		return err
+	}
+
+	s.writes.Add(1)
+
+	if err := s.secondary.Save(ctx, sensorData); err != nil {
+		s.secondaryFailed.Add(1)
+		log.Printf("Reading of device %s not saved in the secondary store: %v", sensorData.DeviceId, err)
+	}
+
+	return nil
+}
+
+// Latest reads the latest reading of the device from the primary
+func (s *dualWriteStore) Latest(ctx context.Context, deviceId string) (*SensorData, error) {
+	sensorData, err := s.primary.Latest(ctx, deviceId)
+	s.verify(ctx, "Latest("+deviceId+")", sensorData, err, func(ctx context.Context) (interface{}, error) {
+		return s.secondary.Latest(ctx, deviceId)
+	})
+
+	return sensorData, err
+}
+
+// Range reads the readings of the device from the primary
+func (s *dualWriteStore) Range(ctx context.Context, deviceId string, from, to time.Time) ([]SensorData, error) {
+	history, err := s.primary.Range(ctx, deviceId, from, to)
+	s.verify(ctx, fmt.Sprintf("Range(%s, %s, %s)", deviceId, from.Format(time.RFC3339), to.Format(time.RFC3339)), history, err, func(ctx context.Context) (interface{}, error) {
+		return s.secondary.Range(ctx, deviceId, from, to)
+	})
+
+	return history, err
+}
+
+// Merge merges the reading in the primary, then in the secondary when it was stored, which keeps the same one
+func (s *dualWriteStore) Merge(ctx context.Context, sensorData *SensorData) (bool, *SensorData, error) {
+	stored, existing, err := s.primary.Merge(ctx, sensorData)
+
+	if err != nil || !stored {
+		return stored, existing, err
+	}
+
+	s.writes.Add(1)
+
+	if _, _, err := s.secondary.Merge(ctx, sensorData); err != nil {
+		s.secondaryFailed.Add(1)
+		log.Printf("Reading of device %s not merged in the secondary store: %v", sensorData.DeviceId, err)
+	}
+
+	return stored, existing, nil
+}
+
+// Devices reads the devices from the primary
+func (s *dualWriteStore) Devices(ctx context.Context) ([]string, error) {
+	ids, err := s.primary.Devices(ctx)
+	s.verify(ctx, "Devices()", sortedCopy(ids), err, func(ctx context.Context) (interface{}, error) {
+		ids, err := s.secondary.Devices(ctx)
+		return sortedCopy(ids), err
+	})
+
+	return ids, err
+}
+
+// MetricRange reads the values of the measurement of the device from the primary
+func (s *dualWriteStore) MetricRange(ctx context.Context, deviceId, metric string, from, to time.Time) ([]MetricPoint, error) {
+	points, err := s.primary.MetricRange(ctx, deviceId, metric, from, to)
+	s.verify(ctx, fmt.Sprintf("MetricRange(%s, %s, %s, %s)", deviceId, metric, from.Format(time.RFC3339), to.Format(time.RFC3339)), points, err, func(ctx context.Context) (interface{}, error) {
+		return s.secondary.MetricRange(ctx, deviceId, metric, from, to)
+	})
+
+	return points, err
+}
+
+// Metrics reads the measurements of the device from the primary
+func (s *dualWriteStore) Metrics(ctx context.Context, deviceId string) ([]string, error) {
+	names, err := s.primary.Metrics(ctx, deviceId)
+	s.verify(ctx, "Metrics("+deviceId+")", sortedCopy(names), err, func(ctx context.Context) (interface{}, error) {
+		names, err := s.secondary.Metrics(ctx, deviceId)
+		return sortedCopy(names), err
+	})
+
+	return names, err
+}
+
+// verify compares a sample of the successful reads of the primary with the same read of the secondary in the background.
+// A device missing from both stores matches.
+func (s *dualWriteStore) verify(ctx context.Context, read string, primary interface{}, primaryErr error, secondaryRead func(ctx context.Context) (interface{}, error)) {
+	if (primaryErr != nil && !errors.Is(primaryErr, errNotFound)) || rand.Float64() >= s.verifyRate {
+		return
+	}
+
+	// The result of the primary is encoded now, before the caller can change it.
+	expected := resultJSON(primary)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), verifyTimeout)
+		defer cancel()
+
+		secondary, err := secondaryRead(ctx)
+
+		if err != nil && !errors.Is(err, errNotFound) {
+			s.verifyFailed.Add(1)
+			log.Printf("%s not verified on the secondary store: %v", read, err)
+			return
+		}
+
+		actual := resultJSON(secondary)
+		s.verified.Add(1)
+
+		if string(expected) == string(actual) {
+			return
+		}
+
+		s.mismatches.Add(1)
+		log.Printf("%s differs on the secondary store", read)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.recent = append(s.recent, Mismatch{Time: time.Now().UTC().Format(time.RFC3339), Read: read, Primary: expected, Secondary: actual})
+
+		if len(s.recent) > maxRecentMismatches {
+			s.recent = s.recent[len(s.recent)-maxRecentMismatches:]
+		}
+	}()
+}
+
+// stats returns the counters of the dual writes with the recent mismatches, the latest first
+func (s *dualWriteStore) stats() DualWriteStats {
+	stats := DualWriteStats{
+		Writes:          s.writes.Load(),
+		SecondaryFailed: s.secondaryFailed.Load(),
+		Verified:        s.verified.Load(),
+		Mismatches:      s.mismatches.Load(),
+		VerifyFailed:    s.verifyFailed.Load(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats.RecentMismatches = make([]Mismatch, 0, len(s.recent))
+
+	for i := len(s.recent) - 1; i >= 0; i-- {
+		stats.RecentMismatches = append(stats.RecentMismatches, s.recent[i])
+	}
+
+	return stats
+}
+
+// resultJSON encodes the result of a read, an empty list as null since the stores return either for no values
+func resultJSON(result interface{}) json.RawMessage {
+	encoded, err := json.Marshal(result)
+
+	if err != nil || string(encoded) == "[]" {
+		return json.RawMessage("null")
+	}
+
+	return encoded
+}
+
+// sortedCopy returns the values sorted, the stores list the devices and measurements in any order
+func sortedCopy(values []string) []string {
+	if values == nil {
+		return nil
+	}
+
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+// registerDualWriteRoutes mounts the dual write endpoint on the given group
+func registerDualWriteRoutes(g *echo.Group, store *dualWriteStore) {
+	g.GET("/dual-write", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, store.stats())
+	})
+}
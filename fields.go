@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// fieldSelection is the fields of the readings requested by the fields parameter, in their declaration order.
+type fieldSelection []sensorDataField
+
+// parseFieldSelection reads the comma-separated fields parameter, e.g. "temp,time", nil without it: the readings
+// are returned whole
+func parseFieldSelection(c echo.Context) (fieldSelection, error) {
+	raw := c.QueryParam("fields")
+
+	if raw == "" {
+		return nil, nil
+	}
+
+	requested := map[string]bool{}
+
+	for _, name := range strings.Split(raw, ",") {
+		requested[strings.TrimSpace(name)] = true
+	}
+
+	var fields fieldSelection
+	names := make([]string, 0, len(sensorDataFields))
+
+	for _, field := range sensorDataFields {
+		names = append(names, field.name)
+
+		if requested[field.name] {
+			fields = append(fields, field)
+			delete(requested, field.name)
+		}
+	}
+
+	for name := range requested {
+		return nil, fmt.Errorf("'fields' %q isn't a field of the readings, expected %s", name, strings.Join(names, ", "))
+	}
+
+	return fields, nil
+}
+
+// projectedReading encodes the selected fields of a reading, the optional ones only when set.
+type projectedReading struct {
+	reading *SensorData
+	fields  fieldSelection
+}
+
+// MarshalJSON encodes the selected fields in their declaration order
+func (p projectedReading) MarshalJSON() ([]byte, error) {
+	value := reflect.ValueOf(p.reading).Elem()
+	b := []byte{'{'}
+
+	for _, field := range p.fields {
+		fieldValue := value.Field(field.index)
+
+		if !field.required && (fieldValue.IsZero() || fieldValue.Kind() == reflect.Map && fieldValue.Len() == 0) {
+			continue
+		}
+
+		encoded, err := json.Marshal(fieldValue.Interface())
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(b) > 1 {
+			b = append(b, ',')
+		}
+
+		b = appendJSONString(b, field.name)
+		b = append(b, ':')
+		b = append(b, encoded...)
+	}
+
+	return append(b, '}'), nil
+}
+
+// reading returns the reading with the selected fields only, the whole reading without a selection
+func (f fieldSelection) reading(sensorData *SensorData) interface{} {
+	if f == nil {
+		return sensorData
+	}
+
+	return projectedReading{reading: sensorData, fields: f}
+}
+
+// readings returns the readings with the selected fields only, the whole readings without a selection
+func (f fieldSelection) readings(history []SensorData) interface{} {
+	if f == nil {
+		return history
+	}
+
+	projected := make([]projectedReading, len(history))
+
+	for i := range history {
+		projected[i] = projectedReading{reading: &history[i], fields: f}
+	}
+
+	return projected
+}
+
+// latestReport returns the report with the selected fields of its readings only
+func (f fieldSelection) latestReport(report *latestReport) interface{} {
+	if f == nil {
+		return report
+	}
+
+	// The readings of the outer struct hide the ones of the embedded report in the JSON.
+	return struct {
+		*latestReport
+		Readings interface{} `json:"readings"`
+	}{report, f.readings(report.Readings)}
+}
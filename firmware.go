@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// firmwarePattern restricts the firmware versions, e.g. "1.4.2" or "2.0.0-rc.1+b42".
+var firmwarePattern = regexp.MustCompile(`^[a-zA-Z0-9_.+-]{1,64}$`)
+
+const (
+	// firmwareKeyPrefix prefixes the hash holding the version, device type and since time of the firmware of a device.
+	firmwareKeyPrefix = "firmware:"
+	// firmwareHistoryKeyPrefix prefixes the list of the firmware changes of a device, oldest first.
+	firmwareHistoryKeyPrefix = "firmware-history:"
+	// firmwareDevicesKey is the Redis set holding the ids of the devices with a known firmware.
+	firmwareDevicesKey = "firmware-devices"
+)
+
+// recordFirmwareScript updates the firmware of a device and appends to its history when the version changed,
+// atomically so concurrent readings of the same device record a change once.
+var recordFirmwareScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'version')
+redis.call('HSET', KEYS[1], 'device_type', ARGV[2])
+redis.call('SADD', KEYS[3], ARGV[4])
+
+if current == ARGV[1] then
+  return 0
+end
+
+redis.call('HSET', KEYS[1], 'version', ARGV[1], 'since', ARGV[3])
+redis.call('RPUSH', KEYS[2], ARGV[5])
+return 1
+`)
+
+// FirmwareChange is a firmware version first seen on a device at the given time.
+type FirmwareChange struct {
+	Time    string `json:"time"`
+	Version string `json:"version"`
+}
+
+// Firmware is the firmware a device runs.
+type Firmware struct {
+	DeviceId   string           `json:"device_id"`
+	DeviceType string           `json:"device_type"`
+	Version    string           `json:"version"`
+	Since      string           `json:"since"`             // Time the version was first seen
+	History    []FirmwareChange `json:"history,omitempty"` // Versions run by the device, oldest first
+}
+
+// FirmwareMismatch is a device not running the expected firmware of its type.
+type FirmwareMismatch struct {
+	DeviceId   string `json:"device_id"`
+	DeviceType string `json:"device_type"`
+	Version    string `json:"version"`
+	Expected   string `json:"expected"`
+	Since      string `json:"since"`
+}
+
+// firmwareRequest is the body reporting the firmware of a device out of band.
+type firmwareRequest struct {
+	Version    string `json:"version"`
+	DeviceType string `json:"device_type"`
+}
+
+// RecordFirmware sets the firmware version of the device and reports whether it changed
+func (r *registry) RecordFirmware(ctx context.Context, deviceId, deviceType, version, since string) (bool, error) {
+	change, err := json.Marshal(FirmwareChange{Time: since, Version: version})
+
+	if err != nil {
+		return false, fmt.Errorf("fatal error on marshalling the firmware change of device %s: %v", deviceId, err)
+	}
+
+	keys := []string{firmwareKeyPrefix + deviceId, firmwareHistoryKeyPrefix + deviceId, firmwareDevicesKey}
+	changed, err := recordFirmwareScript.Run(ctx, r.rdb, keys, version, deviceType, since, deviceId, change).Int()
+
+	if err != nil {
+		return false, fmt.Errorf("fatal error on saving the firmware of device %s in the cache: %v", deviceId, err)
+	}
+
+	return changed == 1, nil
+}
+
+// Firmware returns the firmware of the device with its history
+func (r *registry) Firmware(ctx context.Context, deviceId string) (*Firmware, error) {
+	pipe := r.rdb.Pipeline()
+	fields := pipe.HGetAll(ctx, firmwareKeyPrefix+deviceId)
+	history := pipe.LRange(ctx, firmwareHistoryKeyPrefix+deviceId, 0, -1)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the firmware of device %s from the cache: %v", deviceId, err)
+	}
+
+	if fields.Val()["version"] == "" {
+		return nil, fmt.Errorf("firmware of device %s %w", deviceId, errNotFound)
+	}
+
+	firmware := &Firmware{
+		DeviceId:   deviceId,
+		DeviceType: fields.Val()["device_type"],
+		Version:    fields.Val()["version"],
+		Since:      fields.Val()["since"],
+	}
+
+	for _, entry := range history.Val() {
+		var change FirmwareChange
+
+		if err := json.Unmarshal([]byte(entry), &change); err != nil {
+			return nil, fmt.Errorf("fatal error on reading the firmware history of device %s from cache: %v", deviceId, err)
+		}
+
+		firmware.History = append(firmware.History, change)
+	}
+
+	return firmware, nil
+}
+
+// FirmwareMismatches returns the devices whose firmware differs from the expected version of their type, by device id
+func (r *registry) FirmwareMismatches(ctx context.Context, expected map[string]string, deviceType string) ([]FirmwareMismatch, error) {
+	ids, err := r.rdb.SMembers(ctx, firmwareDevicesKey).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the devices with a firmware from the cache: %v", err)
+	}
+
+	sort.Strings(ids)
+	pipe := r.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, firmwareKeyPrefix+id)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the device firmwares from the cache: %v", err)
+	}
+
+	mismatches := []FirmwareMismatch{}
+
+	for i, id := range ids {
+		fields := cmds[i].Val()
+		want, found := expected[fields["device_type"]]
+
+		if !found || (deviceType != "" && fields["device_type"] != deviceType) || fields["version"] == want {
+			continue
+		}
+
+		mismatches = append(mismatches, FirmwareMismatch{
+			DeviceId:   id,
+			DeviceType: fields["device_type"],
+			Version:    fields["version"],
+			Expected:   want,
+			Since:      fields["since"],
+		})
+	}
+
+	return mismatches, nil
+}
+
+// registerFirmwareRoutes mounts the firmware report endpoints on the given group
+func registerFirmwareRoutes(g *echo.Group, reg *registry, expected map[string]string) {
+	g.GET("/mismatches", func(c echo.Context) error {
+		return getFirmwareMismatches(c, reg, expected)
+	})
+}
+
+// getFirmwareMismatches lists the devices not running the expected firmware of their type
+func getFirmwareMismatches(c echo.Context, reg *registry, expected map[string]string) error {
+	mismatches, err := reg.FirmwareMismatches(c.Request().Context(), expected, c.QueryParam("device_type"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, mismatches)
+}
+
+// getFirmware returns the firmware of the device with its history
+func getFirmware(c echo.Context, reg *registry) error {
+	firmware, err := reg.Firmware(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, firmware)
+}
+
+// putFirmware records the firmware of a device that doesn't report it in its payloads
+func putFirmware(c echo.Context, reg *registry, ing *ingester) error {
+	var request firmwareRequest
+
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the firmware from the request body: %v", err))
+	}
+
+	if !firmwarePattern.MatchString(request.Version) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Firmware 'version' must be 1 to 64 letters, digits, '_', '.', '+' or '-'")
+	}
+
+	if !ing.validDeviceType(request.DeviceType) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Device type %s is not supported", request.DeviceType))
+	}
+
+	ctx := c.Request().Context()
+	since := time.Now().UTC().Format(time.RFC3339)
+
+	if _, err := reg.RecordFirmware(ctx, c.Param("id"), request.DeviceType, request.Version, since); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return getFirmware(c, reg)
+}
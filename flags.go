@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// flagOverridesKey is the Redis hash holding the JSON override of the feature flags changed through the admin API.
+	flagOverridesKey = "feature-flags"
+	// flagsRefreshInterval is how often the overrides set through another replica are picked up.
+	flagsRefreshInterval = 10 * time.Second
+)
+
+// FeatureFlagConfig enables a risky feature, for every device or a percentage of them.
+type FeatureFlagConfig struct {
+	Enabled    bool     `json:"enabled"`    // Enables the feature
+	Percentage *float64 `json:"percentage"` // Percentage of the devices the enabled feature applies to, 100 by default
+}
+
+// FeatureFlag is the state of a feature flag.
+type FeatureFlag struct {
+	Name       string  `json:"name"`
+	Enabled    bool    `json:"enabled"`
+	Percentage float64 `json:"percentage"`
+	Source     string  `json:"source"` // "config" or "override" when changed through the admin API
+}
+
+// featureFlags decides which features are enabled, from the configuration overridden at runtime through Redis.
+type featureFlags struct {
+	registry  *registry
+	mu        sync.RWMutex
+	config    map[string]FeatureFlag
+	overrides map[string]FeatureFlag
+}
+
+// newFeatureFlags validates the flags of the configuration
+func newFeatureFlags(configs map[string]FeatureFlagConfig, reg *registry) (*featureFlags, error) {
+	f := &featureFlags{registry: reg, config: make(map[string]FeatureFlag, len(configs)), overrides: map[string]FeatureFlag{}}
+
+	for name, config := range configs {
+		flag, err := newFeatureFlag(name, config, "config")
+
+		if err != nil {
+			return nil, err
+		}
+
+		f.config[name] = flag
+	}
+
+	return f, nil
+}
+
+// newFeatureFlag validates a flag and applies its defaults
+func newFeatureFlag(name string, config FeatureFlagConfig, source string) (FeatureFlag, error) {
+	if !idPattern.MatchString(name) {
+		return FeatureFlag{}, fmt.Errorf("feature flag name %q must be 1 to 64 letters, digits, '_', '.' or '-'", name)
+	}
+
+	percentage := 100.0
+
+	if config.Percentage != nil {
+		percentage = *config.Percentage
+	}
+
+	if percentage < 0 || percentage > 100 {
+		return FeatureFlag{}, fmt.Errorf("percentage %g of feature flag %s must be between 0 and 100", percentage, name)
+	}
+
+	return FeatureFlag{Name: name, Enabled: config.Enabled, Percentage: percentage, Source: source}, nil
+}
+
+// flag returns the state of the flag in effect, the zero flag for an unknown one
+func (f *featureFlags) flag(name string) (FeatureFlag, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if flag, found := f.overrides[name]; found {
+		return flag, true
+	}
+
+	flag, found := f.config[name]
+
+	return flag, found
+}
+
+// enabled reports whether the feature applies to the device, the same devices always fall in the percentage.
+// Without a device the percentage is a share of the calls.
+func (f *featureFlags) enabled(name, deviceId string) bool {
+	flag, found := f.flag(name)
+
+	if !found || !flag.Enabled {
+		return false
+	}
+
+	if flag.Percentage >= 100 {
+		return true
+	}
+
+	if deviceId == "" {
+		return rand.Float64()*100 < flag.Percentage
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(name + ":" + deviceId))
+
+	return float64(hash.Sum32()%10000)/100 < flag.Percentage
+}
+
+// list returns every flag in effect sorted by name
+func (f *featureFlags) list() []FeatureFlag {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	flags := make([]FeatureFlag, 0, len(f.config)+len(f.overrides))
+
+	for name, flag := range f.config {
+		if _, found := f.overrides[name]; !found {
+			flags = append(flags, flag)
+		}
+	}
+
+	for _, flag := range f.overrides {
+		flags = append(flags, flag)
+	}
+
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+
+	return flags
+}
+
+// refresh loads the overrides from Redis
+func (f *featureFlags) refresh(ctx context.Context) error {
+	raw, err := f.registry.FlagOverrides(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	overrides := make(map[string]FeatureFlag, len(raw))
+
+	for name, config := range raw {
+		flag, err := newFeatureFlag(name, config, "override")
+
+		if err != nil {
+			log.Printf("Feature flag override %s ignored: %v", name, err)
+			continue
+		}
+
+		overrides[name] = flag
+	}
+
+	f.mu.Lock()
+	f.overrides = overrides
+	f.mu.Unlock()
+
+	return nil
+}
+
+// run refreshes the overrides until the context is done
+func (f *featureFlags) run(ctx context.Context) {
+	ticker := time.NewTicker(flagsRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := f.refresh(ctx); err != nil {
+			log.Printf("Feature flag overrides not refreshed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetFlagOverride overrides the configuration of the feature flag on every replica
+func (r *registry) SetFlagOverride(ctx context.Context, name string, config FeatureFlagConfig) error {
+	raw, err := json.Marshal(config)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on marshalling the feature flag %s: %v", name, err)
+	}
+
+	if err := r.rdb.HSet(ctx, flagOverridesKey, name, raw).Err(); err != nil {
+		return fmt.Errorf("fatal error on saving the feature flag %s in the cache: %v", name, err)
+	}
+
+	return nil
+}
+
+// DeleteFlagOverride removes the override of the feature flag, its configuration applies again
+func (r *registry) DeleteFlagOverride(ctx context.Context, name string) error {
+	deleted, err := r.rdb.HDel(ctx, flagOverridesKey, name).Result()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on deleting the feature flag %s from the cache: %v", name, err)
+	}
+
+	if deleted == 0 {
+		return fmt.Errorf("override of feature flag %s %w", name, errNotFound)
+	}
+
+	return nil
+}
+
+// FlagOverrides returns the overrides of the feature flags by name
+func (r *registry) FlagOverrides(ctx context.Context) (map[string]FeatureFlagConfig, error) {
+	fields, err := r.rdb.HGetAll(ctx, flagOverridesKey).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the feature flags from the cache: %v", err)
+	}
+
+	overrides := make(map[string]FeatureFlagConfig, len(fields))
+
+	for name, raw := range fields {
+		var config FeatureFlagConfig
+
+		if err := json.Unmarshal([]byte(raw), &config); err != nil {
+			return nil, fmt.Errorf("fatal error on reading the feature flag %s from the cache: %v", name, err)
+		}
+
+		overrides[name] = config
+	}
+
+	return overrides, nil
+}
+
+// registerFlagRoutes mounts the feature flag endpoints on the given group
+func registerFlagRoutes(g *echo.Group, flags *featureFlags, reg *registry) {
+	g.GET("/flags", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, flags.list())
+	})
+	g.PUT("/flags/:name", func(c echo.Context) error {
+		return putFlag(c, flags, reg)
+	})
+	g.DELETE("/flags/:name", func(c echo.Context) error {
+		return deleteFlag(c, flags, reg)
+	})
+}
+
+// putFlag overrides the feature flag on every replica, the replica of the request applies it right away
+func putFlag(c echo.Context, flags *featureFlags, reg *registry) error {
+	var config FeatureFlagConfig
+
+	if err := c.Bind(&config); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to get the feature flag from the request body: %v", err)).withFields(err)
+	}
+
+	flag, err := newFeatureFlag(c.Param("name"), config, "override")
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := reg.SetFlagOverride(c.Request().Context(), flag.Name, config); err != nil {
+		return registryHTTPError(err)
+	}
+
+	if err := flags.refresh(c.Request().Context()); err != nil {
+		return registryHTTPError(err)
+	}
+
+	log.Printf("Feature flag %s overridden: enabled %t, percentage %g", flag.Name, flag.Enabled, flag.Percentage)
+
+	return c.JSON(http.StatusOK, flag)
+}
+
+// deleteFlag removes the override of the feature flag
+func deleteFlag(c echo.Context, flags *featureFlags, reg *registry) error {
+	if err := reg.DeleteFlagOverride(c.Request().Context(), c.Param("name")); err != nil {
+		return registryHTTPError(err)
+	}
+
+	if err := flags.refresh(c.Request().Context()); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// defaultFleetWindow is the time within which a device must have reported to count as reporting without a window parameter.
+	defaultFleetWindow = 15 * time.Minute
+	// maxFleetWindow bounds the window of the fleet summary.
+	maxFleetWindow = 7 * 24 * time.Hour
+)
+
+// FleetSummary is the state of the whole fleet at a glance.
+type FleetSummary struct {
+	Devices       int            `json:"devices"`         // Devices that reported at least once
+	DevicesByType map[string]int `json:"devices_by_type"` // Devices by the type of their latest reading
+	Window        string         `json:"window"`          // Time within which a device must have reported to count as reporting
+	Reporting     int            `json:"reporting"`       // Devices with a reading received within the window
+	Temp          *FleetTemp     `json:"temp"`            // Current temperature of the reporting devices, null when none is
+	Alerts        FleetAlerts    `json:"alerts"`
+}
+
+// FleetTemp summarizes the latest temperature of the reporting devices.
+type FleetTemp struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+// FleetAlerts counts the alerts of the fleet.
+type FleetAlerts struct {
+	Firing           int            `json:"firing"`
+	Unacknowledged   int            `json:"unacknowledged"`     // Firing alerts nobody took charge of
+	FiringBySeverity map[string]int `json:"firing_by_severity"` // Firing alerts by severity, "none" for the rules without one
+	Resolved         int            `json:"resolved"`           // Alerts resolved within the window
+}
+
+// registerFleetRoutes mounts the fleet summary endpoint on the given group
+func registerFleetRoutes(g *echo.Group, reg *registry, store Store) {
+	g.GET("/summary", func(c echo.Context) error {
+		return getFleetSummary(c, reg, store)
+	})
+}
+
+// getFleetSummary returns the device counts, the current temperature and the alert counts of the fleet
+func getFleetSummary(c echo.Context, reg *registry, store Store) error {
+	window := defaultFleetWindow
+
+	if raw := c.QueryParam("window"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+
+		if err != nil || parsed <= 0 || parsed > maxFleetWindow {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'window' %s must be a positive duration up to %v", raw, maxFleetWindow))
+		}
+
+		window = parsed
+	}
+
+	summary, err := fleetSummary(c.Request().Context(), reg, store, window, time.Now().UTC())
+
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, summary)
+}
+
+// fleetSummary summarizes the latest readings of every device and the alerts at the given time
+func fleetSummary(ctx context.Context, reg *registry, store Store, window time.Duration, now time.Time) (*FleetSummary, error) {
+	ids, err := store.Devices(ctx)
+
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the devices. %v", err))
+	}
+
+	latest, err := latestReadings(ctx, store, ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &FleetSummary{
+		Devices:       len(latest.Readings),
+		DevicesByType: map[string]int{},
+		Window:        window.String(),
+		Alerts:        FleetAlerts{FiringBySeverity: map[string]int{}},
+	}
+	since := now.Add(-window)
+	temp := FleetTemp{Min: math.Inf(1), Max: math.Inf(-1)}
+
+	for _, reading := range latest.Readings {
+		summary.DevicesByType[reading.DeviceType]++
+
+		if !reportedSince(&reading, since) {
+			continue
+		}
+
+		value := float64(reading.Temp)
+		summary.Reporting++
+		temp.Min = math.Min(temp.Min, value)
+		temp.Max = math.Max(temp.Max, value)
+		temp.Avg += value
+	}
+
+	if summary.Reporting > 0 {
+		temp.Avg /= float64(summary.Reporting)
+		summary.Temp = &temp
+	}
+
+	alerts, err := reg.Alerts(ctx, true, true, since, now)
+
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the alerts. %v", err))
+	}
+
+	for _, alert := range alerts {
+		if alert.State != alertFiring {
+			summary.Alerts.Resolved++
+			continue
+		}
+
+		severity := alert.Severity
+
+		if severity == "" {
+			severity = "none"
+		}
+
+		summary.Alerts.Firing++
+		summary.Alerts.FiringBySeverity[severity]++
+
+		if alert.Ack == nil {
+			summary.Alerts.Unacknowledged++
+		}
+	}
+
+	return summary, nil
+}
+
+// reportedSince reports whether the reading was received at or after the given time, by its device time when the
+// time it was received at isn't recorded
+func reportedSince(reading *SensorData, since time.Time) bool {
+	received, err := time.Parse(time.RFC3339, reading.ReceivedAt)
+
+	if err != nil {
+		if received, err = reading.Timestamp(); err != nil {
+			return false
+		}
+	}
+
+	return !received.Before(since)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// expectedIntervalsKey is the Redis hash holding the expected reporting interval set on the devices.
+const expectedIntervalsKey = "expected-intervals"
+
+// gapTolerance is the multiple of the expected interval two readings can be apart before a gap is reported.
+const gapTolerance = 1.5
+
+// Gap is a period without any reading from a device.
+type Gap struct {
+	Start    string `json:"start"`    // Time of the reading before the gap, or the start of the range
+	End      string `json:"end"`      // Time of the reading after the gap, or the end of the range
+	Duration string `json:"duration"` // Length of the gap, e.g. "1h30m0s"
+	Missing  int    `json:"missing"`  // Estimated number of readings that didn't arrive
+	Open     bool   `json:"open"`     // The gap runs to the end of the range, the device may still be silent
+}
+
+// gapReport lists the gaps in the readings of a device over a time range.
+type gapReport struct {
+	DeviceId         string    `json:"device_id"`
+	ExpectedInterval string    `json:"expected_interval"`
+	From             time.Time `json:"from"`
+	To               time.Time `json:"to"`
+	Readings         int       `json:"readings"` // Readings received within the range
+	Gaps             []Gap     `json:"gaps"`
+}
+
+// expectedIntervalRequest is the body setting the expected reporting interval of a device.
+type expectedIntervalRequest struct {
+	Interval Duration `json:"interval"`
+}
+
+// SetExpectedInterval sets the interval the device is expected to report at
+func (r *registry) SetExpectedInterval(ctx context.Context, deviceId string, interval time.Duration) error {
+	if err := r.rdb.HSet(ctx, expectedIntervalsKey, deviceId, interval.String()).Err(); err != nil {
+		return fmt.Errorf("fatal error on saving the expected interval of device %s in the cache: %v", deviceId, err)
+	}
+
+	return nil
+}
+
+// DeleteExpectedInterval removes the interval set on the device
+func (r *registry) DeleteExpectedInterval(ctx context.Context, deviceId string) error {
+	removed, err := r.rdb.HDel(ctx, expectedIntervalsKey, deviceId).Result()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on deleting the expected interval of device %s from the cache: %v", deviceId, err)
+	}
+
+	if removed == 0 {
+		return fmt.Errorf("expected interval of device %s %w", deviceId, errNotFound)
+	}
+
+	return nil
+}
+
+// ExpectedInterval returns the interval set on the device
+func (r *registry) ExpectedInterval(ctx context.Context, deviceId string) (time.Duration, error) {
+	raw, err := r.rdb.HGet(ctx, expectedIntervalsKey, deviceId).Result()
+
+	if err == redis.Nil {
+		return 0, fmt.Errorf("expected interval of device %s %w", deviceId, errNotFound)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("fatal error on retrieving the expected interval of device %s from the cache: %v", deviceId, err)
+	}
+
+	interval, err := time.ParseDuration(raw)
+
+	if err != nil {
+		return 0, fmt.Errorf("fatal error on reading the expected interval of device %s from cache: %v", deviceId, err)
+	}
+
+	return interval, nil
+}
+
+// findGaps returns the periods of more than gapTolerance intervals without any of the reading times within [from, to]
+func findGaps(times []time.Time, from, to time.Time, interval time.Duration) []Gap {
+	gaps := []Gap{}
+	threshold := time.Duration(float64(interval) * gapTolerance)
+	previous := from
+
+	for _, current := range append(times, to) {
+		if current.Sub(previous) > threshold {
+			gaps = append(gaps, Gap{
+				Start:    previous.UTC().Format(time.RFC3339),
+				End:      current.UTC().Format(time.RFC3339),
+				Duration: current.Sub(previous).String(),
+				Missing:  int(math.Round(float64(current.Sub(previous))/float64(interval))) - 1,
+			})
+		}
+
+		previous = current
+	}
+
+	if len(gaps) > 0 && gaps[len(gaps)-1].End == to.UTC().Format(time.RFC3339) {
+		gaps[len(gaps)-1].Open = true
+	}
+
+	return gaps
+}
+
+// deviceInterval returns the interval the device is expected to report at, the one set on the device or else the one
+// of its type, as an HTTP error when it has none
+func deviceInterval(ctx context.Context, reg *registry, store Store, intervals map[string]Duration, deviceId string) (time.Duration, error) {
+	interval, err := reg.ExpectedInterval(ctx, deviceId)
+
+	if errors.Is(err, errNotFound) {
+		// Without an interval set on the device, the one of its type applies.
+		sensorData, errLatest := store.Latest(ctx, deviceId)
+
+		if errLatest != nil && !errors.Is(errLatest, errNotFound) {
+			return 0, echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the Sensor data for device %s. %v", deviceId, errLatest))
+		}
+
+		if sensorData != nil && intervals[sensorData.DeviceType] > 0 {
+			interval, err = time.Duration(intervals[sensorData.DeviceType]), nil
+		}
+	}
+
+	if errors.Is(err, errNotFound) {
+		return 0, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Device %s has no expected interval, set it on the device or its type", deviceId))
+	}
+
+	if err != nil {
+		return 0, registryHTTPError(err)
+	}
+
+	return interval, nil
+}
+
+// getGaps lists the periods without readings of the device over the time range
+func getGaps(c echo.Context, reg *registry, store Store, intervals map[string]Duration) error {
+	ctx := c.Request().Context()
+	deviceId := c.Param("id")
+
+	from, to, err := parseTimeRange(c, defaultQueryWindow)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	interval, err := deviceInterval(ctx, reg, store, intervals, deviceId)
+
+	if err != nil {
+		return err
+	}
+
+	// Every reading has a temperature, its history gives the times of all of them.
+	points, err := store.MetricRange(ctx, deviceId, "temp", from, to)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the history of device %s. %v", deviceId, err))
+	}
+
+	times := make([]time.Time, 0, len(points))
+
+	for _, point := range points {
+		timestamp, err := time.Parse(time.RFC3339, point.Time)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't read the history of device %s. %v", deviceId, err))
+		}
+
+		times = append(times, timestamp)
+	}
+
+	return c.JSON(http.StatusOK, gapReport{
+		DeviceId:         deviceId,
+		ExpectedInterval: interval.String(),
+		From:             from,
+		To:               to,
+		Readings:         len(times),
+		Gaps:             findGaps(times, from, to, interval),
+	})
+}
+
+// putExpectedInterval sets the interval the device is expected to report at
+func putExpectedInterval(c echo.Context, reg *registry) error {
+	var request expectedIntervalRequest
+
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the interval from the request body: %v", err))
+	}
+
+	if request.Interval <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Expected 'interval' must be a positive duration such as \"5m\"")
+	}
+
+	if err := reg.SetExpectedInterval(c.Request().Context(), c.Param("id"), time.Duration(request.Interval)); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// deleteExpectedInterval removes the interval set on the device, the one of its type applies again
+func deleteExpectedInterval(c echo.Context, reg *registry) error {
+	if err := reg.DeleteExpectedInterval(c.Request().Context(), c.Param("id")); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The handlers below implement the Grafana SimpleJSON datasource contract
+// (https://github.com/grafana/simple-json-datasource), which the Infinity
+// datasource can also consume. Each query target is a device id and the
+// returned series is its temperature.
+
+// grafanaSearchRequest is the body of a /search call made by the query editor.
+type grafanaSearchRequest struct {
+	Target string `json:"target"`
+}
+
+// grafanaQueryRequest is the body of a /query call made by a panel.
+type grafanaQueryRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	MaxDataPoints int             `json:"maxDataPoints"`
+	Targets       []grafanaTarget `json:"targets"`
+}
+
+// grafanaTarget is a single query of a panel.
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefId  string `json:"refId"`
+	Type   string `json:"type"` // "timeserie" (default) or "table"
+}
+
+// grafanaTimeSeries is a series of [value, unix milliseconds] datapoints.
+type grafanaTimeSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// grafanaTable is the table variant of a query response.
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// registerGrafanaRoutes mounts the datasource endpoints on the given group
+func registerGrafanaRoutes(g *echo.Group, store Store) {
+	// Grafana calls the datasource root to test the connection.
+	testConnection := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	g.GET("", testConnection)
+	g.GET("/", testConnection)
+	g.POST("/search", func(c echo.Context) error {
+		return grafanaSearch(c, store)
+	})
+	g.POST("/query", func(c echo.Context) error {
+		return grafanaQuery(c, store)
+	})
+	g.POST("/annotations", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, []interface{}{})
+	})
+}
+
+// grafanaSearch lists the device ids matching the typed target
+func grafanaSearch(c echo.Context, store Store) error {
+	var request grafanaSearchRequest
+
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the search from the request body: %v", err))
+	}
+
+	ids, err := store.Devices(c.Request().Context())
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't list the devices. %v", err))
+	}
+
+	matching := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		if strings.Contains(id, request.Target) {
+			matching = append(matching, id)
+		}
+	}
+
+	sort.Strings(matching)
+
+	return c.JSON(http.StatusOK, matching)
+}
+
+// grafanaQuery returns the temperature of every targeted device over the requested time range
+func grafanaQuery(c echo.Context, store Store) error {
+	var request grafanaQueryRequest
+
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the query from the request body: %v", err))
+	}
+
+	if request.Range.To.Before(request.Range.From) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Query range 'to' is before 'from'")
+	}
+
+	response := make([]interface{}, 0, len(request.Targets))
+
+	for _, target := range request.Targets {
+		if target.Target == "" {
+			continue
+		}
+
+		history, err := store.Range(c.Request().Context(), target.Target, request.Range.From, request.Range.To)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the Sensor data history for device %s. %v", target.Target, err))
+		}
+
+		history = downsample(history, request.MaxDataPoints)
+
+		if target.Type == "table" {
+			response = append(response, grafanaTableOf(history))
+		} else {
+			response = append(response, grafanaTimeSeriesOf(target.Target, history))
+		}
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// grafanaTimeSeriesOf converts the readings into a temperature time series
+func grafanaTimeSeriesOf(target string, history []SensorData) grafanaTimeSeries {
+	series := grafanaTimeSeries{Target: target, Datapoints: make([][2]float64, 0, len(history))}
+
+	for _, sensorData := range history {
+		timestamp, err := sensorData.Timestamp()
+
+		if err != nil {
+			continue
+		}
+
+		series.Datapoints = append(series.Datapoints, [2]float64{float64(sensorData.Temp), float64(timestamp.UnixMilli())})
+	}
+
+	return series
+}
+
+// grafanaTableOf converts the readings into a table with one row per reading
+func grafanaTableOf(history []SensorData) grafanaTable {
+	table := grafanaTable{
+		Type: "table",
+		Columns: []grafanaColumn{
+			{Text: "Time", Type: "time"},
+			{Text: "Device", Type: "string"},
+			{Text: "Type", Type: "string"},
+			{Text: "Uptime", Type: "number"},
+			{Text: "Temp", Type: "number"},
+		},
+		Rows: make([][]interface{}, 0, len(history)),
+	}
+
+	for _, sensorData := range history {
+		timestamp, err := sensorData.Timestamp()
+
+		if err != nil {
+			continue
+		}
+
+		table.Rows = append(table.Rows, []interface{}{timestamp.UnixMilli(), sensorData.DeviceId, sensorData.DeviceType, sensorData.Uptime, sensorData.Temp})
+	}
+
+	return table
+}
+
+// downsample keeps at most maxPoints evenly spaced readings, a non-positive maxPoints keeps all of them
+func downsample(history []SensorData, maxPoints int) []SensorData {
+	if maxPoints <= 0 || len(history) <= maxPoints {
+		return history
+	}
+
+	sampled := make([]SensorData, 0, maxPoints)
+	step := float64(len(history)) / float64(maxPoints)
+
+	for i := 0; i < maxPoints; i++ {
+		sampled = append(sampled, history[int(float64(i)*step)])
+	}
+
+	return sampled
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/labstack/echo/v4"
+)
+
+// GraphQLConfig enables the GraphQL query API.
+type GraphQLConfig struct {
+	Enabled bool `json:"enabled"` // Serves POST and GET /graphql when true
+}
+
+// graphqlRequest is the body of a GraphQL query.
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// namedValue is an entry of the metrics or derived fields of a reading, GraphQL having no map type.
+type namedValue struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+// label is a label of a device.
+type label struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// graphqlAPI resolves the GraphQL queries from the store and the registry.
+type graphqlAPI struct {
+	registry *registry
+	store    Store
+	schema   graphql.Schema
+}
+
+// newGraphQLAPI builds the schema of the GraphQL query API
+func newGraphQLAPI(reg *registry, store Store) (*graphqlAPI, error) {
+	api := &graphqlAPI{registry: reg, store: store}
+
+	rangeArgs := graphql.FieldConfigArgument{
+		"from": &graphql.ArgumentConfig{Type: graphql.String, Description: "RFC 3339 start of the range, 24h before to by default"},
+		"to":   &graphql.ArgumentConfig{Type: graphql.String, Description: "RFC 3339 end of the range, now by default"},
+	}
+
+	metricRangeArgs := graphql.FieldConfigArgument{
+		"metric": &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "temp"},
+		"from":   rangeArgs["from"],
+		"to":     rangeArgs["to"],
+	}
+
+	namedValueType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "NamedValue",
+		Fields: graphql.Fields{
+			"name":  &graphql.Field{Type: graphql.String},
+			"value": &graphql.Field{Type: graphql.Float},
+		},
+	})
+
+	labelType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Label",
+		Fields: graphql.Fields{
+			"key":   &graphql.Field{Type: graphql.String},
+			"value": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	readingType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Reading",
+		Fields: graphql.Fields{
+			"time":            &graphql.Field{Type: graphql.String},
+			"device_id":       &graphql.Field{Type: graphql.String},
+			"device_type":     &graphql.Field{Type: graphql.String},
+			"uptime":          &graphql.Field{Type: graphql.Int},
+			"temp":            &graphql.Field{Type: graphql.Float},
+			"humidity":        &graphql.Field{Type: graphql.Float},
+			"pressure":        &graphql.Field{Type: graphql.Float},
+			"battery_voltage": &graphql.Field{Type: graphql.Float},
+			"firmware":        &graphql.Field{Type: graphql.String},
+			"received_at":     &graphql.Field{Type: graphql.String},
+			"device_time":     &graphql.Field{Type: graphql.String},
+			"duplicate":       &graphql.Field{Type: graphql.Boolean},
+			"region":          &graphql.Field{Type: graphql.String},
+			"metrics": &graphql.Field{
+				Type: graphql.NewList(namedValueType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return namedValues(p.Source.(SensorData).Metrics), nil
+				},
+			},
+			"derived": &graphql.Field{
+				Type: graphql.NewList(namedValueType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return namedValues(p.Source.(SensorData).Derived), nil
+				},
+			},
+		},
+	})
+
+	pointType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "MetricPoint",
+		Fields: graphql.Fields{
+			"time":  &graphql.Field{Type: graphql.String},
+			"value": &graphql.Field{Type: graphql.Float},
+		},
+	})
+
+	aggregateType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Aggregate",
+		Fields: graphql.Fields{
+			"count":  &graphql.Field{Type: graphql.Int},
+			"min":    &graphql.Field{Type: graphql.Float},
+			"max":    &graphql.Field{Type: graphql.Float},
+			"avg":    &graphql.Field{Type: graphql.Float},
+			"stddev": &graphql.Field{Type: graphql.Float},
+		},
+	})
+
+	ackType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "AlertAck",
+		Fields: graphql.Fields{
+			"by":   &graphql.Field{Type: graphql.String},
+			"note": &graphql.Field{Type: graphql.String},
+			"at":   &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	alertType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Alert",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.String},
+			"rule":        &graphql.Field{Type: graphql.String},
+			"device_id":   &graphql.Field{Type: graphql.String},
+			"severity":    &graphql.Field{Type: graphql.String},
+			"condition":   &graphql.Field{Type: graphql.String},
+			"state":       &graphql.Field{Type: graphql.String},
+			"value":       &graphql.Field{Type: graphql.Float},
+			"change":      &graphql.Field{Type: graphql.Float},
+			"last_value":  &graphql.Field{Type: graphql.Float},
+			"started_at":  &graphql.Field{Type: graphql.String},
+			"resolved_at": &graphql.Field{Type: graphql.String},
+			"ack":         &graphql.Field{Type: ackType},
+		},
+	})
+
+	alertArgs := graphql.FieldConfigArgument{
+		"state": &graphql.ArgumentConfig{Type: graphql.String, Description: "firing or resolved, both by default"},
+		"rule":  &graphql.ArgumentConfig{Type: graphql.String},
+		"from":  rangeArgs["from"],
+		"to":    rangeArgs["to"],
+	}
+
+	deviceType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Device",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{Type: graphql.String},
+			"labels": &graphql.Field{
+				Type: graphql.NewList(labelType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					labels, err := reg.Labels(p.Context, p.Source.(Device).Id)
+
+					if err != nil {
+						return nil, err
+					}
+
+					list := make([]label, 0, len(labels))
+
+					for key, value := range labels {
+						list = append(list, label{Key: key, Value: value})
+					}
+
+					sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+					return list, nil
+				},
+			},
+			"groups": &graphql.Field{
+				Type: graphql.NewList(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					groups, err := reg.DeviceGroups(p.Context, p.Source.(Device).Id)
+
+					if err != nil {
+						return nil, err
+					}
+
+					sort.Strings(groups)
+
+					return groups, nil
+				},
+			},
+			"metrics": &graphql.Field{
+				Type: graphql.NewList(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					names, err := store.Metrics(p.Context, p.Source.(Device).Id)
+
+					if err != nil {
+						return nil, err
+					}
+
+					sort.Strings(names)
+
+					return names, nil
+				},
+			},
+			"latest": &graphql.Field{
+				Type: readingType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					sensorData, err := store.Latest(p.Context, p.Source.(Device).Id)
+
+					// A device that never reported has no latest reading rather than an error.
+					if errors.Is(err, errNotFound) {
+						return nil, nil
+					}
+
+					if err != nil {
+						return nil, err
+					}
+
+					return *sensorData, nil
+				},
+			},
+			"readings": &graphql.Field{
+				Type: graphql.NewList(readingType),
+				Args: rangeArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					from, to, err := graphqlTimeRange(p.Args)
+
+					if err != nil {
+						return nil, err
+					}
+
+					return store.Range(p.Context, p.Source.(Device).Id, from, to)
+				},
+			},
+			"series": &graphql.Field{
+				Type: graphql.NewList(pointType),
+				Args: metricRangeArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					metric, from, to, err := graphqlMetricRange(p.Args)
+
+					if err != nil {
+						return nil, err
+					}
+
+					return store.MetricRange(p.Context, p.Source.(Device).Id, metric, from, to)
+				},
+			},
+			"aggregate": &graphql.Field{
+				Type: aggregateType,
+				Args: metricRangeArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return api.aggregate(p, []string{p.Source.(Device).Id})
+				},
+			},
+			"alerts": &graphql.Field{
+				Type: graphql.NewList(alertType),
+				Args: alertArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return api.alerts(p, p.Source.(Device).Id)
+				},
+			},
+		},
+	})
+
+	groupType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Group",
+		Fields: graphql.Fields{
+			"id":   &graphql.Field{Type: graphql.String},
+			"name": &graphql.Field{Type: graphql.String},
+			"devices": &graphql.Field{
+				Type: graphql.NewList(deviceType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return devicesOf(p.Source.(Group).Devices), nil
+				},
+			},
+			"aggregate": &graphql.Field{
+				Type: aggregateType,
+				Args: metricRangeArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return api.aggregate(p, p.Source.(Group).Devices)
+				},
+			},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"device": &graphql.Field{
+				Type: deviceType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return Device{Id: p.Args["id"].(string)}, nil
+				},
+			},
+			"devices": &graphql.Field{
+				Type: graphql.NewList(deviceType),
+				Args: graphql.FieldConfigArgument{
+					"selector": &graphql.ArgumentConfig{Type: graphql.String, Description: "Label selector the devices must match"},
+					"group":    &graphql.ArgumentConfig{Type: graphql.String, Description: "Group the devices must belong to"},
+				},
+				Resolve: api.devices,
+			},
+			"group": &graphql.Field{
+				Type: groupType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					group, err := reg.Group(p.Context, p.Args["id"].(string))
+
+					if errors.Is(err, errNotFound) {
+						return nil, nil
+					}
+
+					if err != nil {
+						return nil, err
+					}
+
+					return *group, nil
+				},
+			},
+			"groups": &graphql.Field{
+				Type: graphql.NewList(groupType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					groups, err := reg.Groups(p.Context)
+
+					if err != nil {
+						return nil, err
+					}
+
+					sort.Slice(groups, func(i, j int) bool { return groups[i].Id < groups[j].Id })
+
+					return groups, nil
+				},
+			},
+			"alert": &graphql.Field{
+				Type: alertType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					alert, err := reg.Alert(p.Context, p.Args["id"].(string))
+
+					if errors.Is(err, errNotFound) {
+						return nil, nil
+					}
+
+					if err != nil {
+						return nil, err
+					}
+
+					return *alert, nil
+				},
+			},
+			"alerts": &graphql.Field{
+				Type: graphql.NewList(alertType),
+				Args: graphql.FieldConfigArgument{
+					"state":  alertArgs["state"],
+					"rule":   alertArgs["rule"],
+					"device": &graphql.ArgumentConfig{Type: graphql.String},
+					"from":   alertArgs["from"],
+					"to":     alertArgs["to"],
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					device, _ := p.Args["device"].(string)
+					return api.alerts(p, device)
+				},
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the graphql schema: %w", err)
+	}
+
+	api.schema = schema
+
+	return api, nil
+}
+
+// devices resolves the devices matching the selector, restricted to the devices of the group when set
+func (api *graphqlAPI) devices(p graphql.ResolveParams) (interface{}, error) {
+	raw, _ := p.Args["selector"].(string)
+	selector, err := parseSelector(raw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	groupId, _ := p.Args["group"].(string)
+
+	if groupId == "" {
+		ids, err := api.registry.SelectDevices(p.Context, api.store, selector)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return devicesOf(ids), nil
+	}
+
+	group, err := api.registry.Group(p.Context, groupId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+
+	for _, id := range group.Devices {
+		if len(selector) > 0 {
+			labels, err := api.registry.Labels(p.Context, id)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if !selector.matches(labels) {
+				continue
+			}
+		}
+
+		ids = append(ids, id)
+	}
+
+	return devicesOf(ids), nil
+}
+
+// aggregate resolves the summary of the measurement of the devices over the time range of the arguments
+func (api *graphqlAPI) aggregate(p graphql.ResolveParams, deviceIds []string) (interface{}, error) {
+	metric, from, to, err := graphqlMetricRange(p.Args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var values []float64
+
+	for _, deviceId := range deviceIds {
+		points, err := api.store.MetricRange(p.Context, deviceId, metric, from, to)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, point := range points {
+			values = append(values, point.Value)
+		}
+	}
+
+	// A nil *Aggregate would be resolved as an empty object rather than null.
+	if result := aggregate(values); result != nil {
+		return result, nil
+	}
+
+	return nil, nil
+}
+
+// alerts resolves the firing alerts and the alerts resolved within the time range of the arguments, of the device when set
+func (api *graphqlAPI) alerts(p graphql.ResolveParams, deviceId string) (interface{}, error) {
+	state, _ := p.Args["state"].(string)
+
+	if state != "" && state != alertFiring && state != alertResolved {
+		return nil, fmt.Errorf("state %s must be firing or resolved", state)
+	}
+
+	from, to, err := graphqlTimeRange(p.Args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	alerts, err := api.registry.Alerts(p.Context, state != alertResolved, state != alertFiring, from, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rule, _ := p.Args["rule"].(string)
+	filtered := []Alert{}
+
+	for _, alert := range alerts {
+		if (deviceId == "" || alert.DeviceId == deviceId) && (rule == "" || alert.Rule == rule) {
+			filtered = append(filtered, alert)
+		}
+	}
+
+	return filtered, nil
+}
+
+// graphqlTimeRange reads the RFC 3339 from and to arguments, to defaults to now and from to a day before to
+func graphqlTimeRange(args map[string]interface{}) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+
+	if raw, _ := args["to"].(string); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("to %s is not a valid RFC 3339 timestamp", raw)
+		}
+
+		to = parsed
+	}
+
+	from := to.Add(-defaultQueryWindow)
+
+	if raw, _ := args["from"].(string); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("from %s is not a valid RFC 3339 timestamp", raw)
+		}
+
+		from = parsed
+	}
+
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, errors.New("to is before from")
+	}
+
+	return from, to, nil
+}
+
+// graphqlMetricRange reads the metric argument and the time range
+func graphqlMetricRange(args map[string]interface{}) (string, time.Time, time.Time, error) {
+	metric, _ := args["metric"].(string)
+
+	if !metricNamePattern.MatchString(metric) {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("metric name %q is invalid", metric)
+	}
+
+	from, to, err := graphqlTimeRange(args)
+
+	return metric, from, to, err
+}
+
+// namedValues lists the values by name, sorted
+func namedValues(values map[string]float64) []namedValue {
+	list := make([]namedValue, 0, len(values))
+
+	for _, name := range sortedKeys(values) {
+		list = append(list, namedValue{Name: name, Value: values[name]})
+	}
+
+	return list
+}
+
+// devicesOf returns the devices with the given ids, their fields resolved on demand
+func devicesOf(ids []string) []Device {
+	devices := make([]Device, len(ids))
+
+	for i, id := range ids {
+		devices[i] = Device{Id: id}
+	}
+
+	return devices
+}
+
+// registerGraphQLRoutes mounts the GraphQL endpoint, queried by POST with a JSON body or by GET with query parameters
+func registerGraphQLRoutes(e *echo.Echo, api *graphqlAPI) {
+	e.POST("/graphql", func(c echo.Context) error {
+		var request graphqlRequest
+
+		if err := c.Bind(&request); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the query from the request body: %v", err))
+		}
+
+		return api.execute(c, &request)
+	})
+	e.GET("/graphql", func(c echo.Context) error {
+		return api.execute(c, &graphqlRequest{Query: c.QueryParam("query"), OperationName: c.QueryParam("operationName")})
+	})
+}
+
+// execute runs the query, the errors of its fields are reported in the response along with the data resolved
+func (api *graphqlAPI) execute(c echo.Context, request *graphqlRequest) error {
+	if request.Query == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "GraphQL 'query' is required")
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         api.schema,
+		RequestString:  request.Query,
+		VariableValues: request.Variables,
+		OperationName:  request.OperationName,
+		Context:        c.Request().Context(),
+	})
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+// groupRequest is the body creating a group.
+type groupRequest struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// registerGroupRoutes mounts the device group endpoints on the given group
+func registerGroupRoutes(g *echo.Group, reg *registry, store Store) {
+	g.POST("", func(c echo.Context) error {
+		return createGroup(c, reg)
+	})
+	g.GET("", func(c echo.Context) error {
+		return listGroups(c, reg)
+	})
+	g.GET("/:id", func(c echo.Context) error {
+		return getGroup(c, reg)
+	})
+	g.DELETE("/:id", func(c echo.Context) error {
+		return deleteGroup(c, reg)
+	})
+	g.PUT("/:id/devices/:device", func(c echo.Context) error {
+		return assignGroupDevice(c, reg)
+	})
+	g.DELETE("/:id/devices/:device", func(c echo.Context) error {
+		return unassignGroupDevice(c, reg)
+	})
+	g.GET("/:id/latest", func(c echo.Context) error {
+		return getGroupLatest(c, reg, store)
+	})
+	g.GET("/:id/aggregate", func(c echo.Context) error {
+		return getGroupAggregate(c, reg, store)
+	})
+	g.GET("/:id/histogram", func(c echo.Context) error {
+		return getGroupHistogram(c, reg, store)
+	})
+}
+
+// registryHTTPError maps the registry errors to their HTTP status
+func registryHTTPError(err error) error {
+	switch {
+	case errors.Is(err, errNotFound):
+		return newProblem(http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, errAlreadyExists):
+		return newProblem(http.StatusConflict, "already_exists", err.Error())
+	}
+
+	return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+}
+
+// createGroup creates an empty group
+func createGroup(c echo.Context, reg *registry) error {
+	var request groupRequest
+
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the group from the request body: %v", err))
+	}
+
+	if !idPattern.MatchString(request.Id) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Group 'id' must be 1 to 64 letters, digits, '_', '.' or '-'")
+	}
+
+	if err := reg.CreateGroup(c.Request().Context(), request.Id, request.Name); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusCreated, Group{Id: request.Id, Name: request.Name, Devices: []string{}})
+}
+
+// listGroups returns all the groups sorted by id
+func listGroups(c echo.Context, reg *registry) error {
+	groups, err := reg.Groups(c.Request().Context())
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Id < groups[j].Id })
+
+	for _, group := range groups {
+		sort.Strings(group.Devices)
+	}
+
+	return c.JSON(http.StatusOK, groups)
+}
+
+// getGroup returns the group with its devices
+func getGroup(c echo.Context, reg *registry) error {
+	group, err := reg.Group(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	sort.Strings(group.Devices)
+
+	return c.JSON(http.StatusOK, group)
+}
+
+// deleteGroup deletes the group, its devices are kept
+func deleteGroup(c echo.Context, reg *registry) error {
+	if err := reg.DeleteGroup(c.Request().Context(), c.Param("id")); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// assignGroupDevice adds the device to the group
+func assignGroupDevice(c echo.Context, reg *registry) error {
+	if err := reg.AssignDevice(c.Request().Context(), c.Param("id"), c.Param("device")); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// unassignGroupDevice removes the device from the group
+func unassignGroupDevice(c echo.Context, reg *registry) error {
+	if err := reg.UnassignDevice(c.Request().Context(), c.Param("id"), c.Param("device")); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getGroupLatest returns the latest reading of every device of the group
+func getGroupLatest(c echo.Context, reg *registry, store Store) error {
+	fields, err := parseFieldSelection(c)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	group, err := reg.Group(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	report, err := latestReadings(c.Request().Context(), store, group.Devices)
+
+	if err != nil {
+		return err
+	}
+
+	report.Group = group.Id
+
+	return c.JSON(http.StatusOK, fields.latestReport(report))
+}
+
+// getGroupAggregate summarizes a measurement (temp by default) of the devices of the group over the time range
+func getGroupAggregate(c echo.Context, reg *registry, store Store) error {
+	group, err := reg.Group(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	report, err := aggregateDevices(c, store, group.Devices)
+
+	if err != nil {
+		return err
+	}
+
+	report.Group = group.Id
+
+	return c.JSON(http.StatusOK, report)
+}
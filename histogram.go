@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// defaultHistogramBuckets is the number of equal width buckets without buckets or bounds parameters.
+	defaultHistogramBuckets = 10
+	// maxHistogramBuckets bounds the number of buckets of a histogram.
+	maxHistogramBuckets = 1000
+)
+
+// HistogramBucket counts the values within [Min, Max), the last bucket includes its max.
+type HistogramBucket struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+// Histogram is the distribution of the values of a measurement over a time range.
+type Histogram struct {
+	Group    string            `json:"group,omitempty"`     // Group of the devices, if queried by group
+	DeviceId string            `json:"device_id,omitempty"` // Device, if queried by device
+	Metric   string            `json:"metric"`
+	From     time.Time         `json:"from"`
+	To       time.Time         `json:"to"`
+	Count    int               `json:"count"`   // Values within the range
+	Below    int               `json:"below"`   // Values lower than the first bound
+	Above    int               `json:"above"`   // Values higher than the last bound
+	Buckets  []HistogramBucket `json:"buckets"` // Buckets in ascending order
+}
+
+// histogramBounds returns the bucket bounds of the bounds query parameter, or equal width buckets
+// between the min and max of the values of the buckets query parameter
+func histogramBounds(c echo.Context, values []float64) ([]float64, error) {
+	if raw := c.QueryParam("bounds"); raw != "" {
+		var bounds []float64
+
+		for _, part := range strings.Split(raw, ",") {
+			bound, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+
+			if err != nil {
+				return nil, fmt.Errorf("bound %q is not a number", part)
+			}
+
+			if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+				return nil, fmt.Errorf("'bounds' must be increasing")
+			}
+
+			bounds = append(bounds, bound)
+		}
+
+		if len(bounds) < 2 || len(bounds) > maxHistogramBuckets+1 {
+			return nil, fmt.Errorf("'bounds' must have between 2 and %d values", maxHistogramBuckets+1)
+		}
+
+		return bounds, nil
+	}
+
+	buckets := defaultHistogramBuckets
+
+	if raw := c.QueryParam("buckets"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+
+		if err != nil || parsed < 1 || parsed > maxHistogramBuckets {
+			return nil, fmt.Errorf("'buckets' %s must be a number between 1 and %d", raw, maxHistogramBuckets)
+		}
+
+		buckets = parsed
+	}
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	min, max := values[0], values[0]
+
+	for _, value := range values {
+		min = math.Min(min, value)
+		max = math.Max(max, value)
+	}
+
+	// All the values being equal, a single bucket holds them.
+	if min == max {
+		return []float64{min, max}, nil
+	}
+
+	bounds := make([]float64, buckets+1)
+
+	for i := range bounds {
+		bounds[i] = min + (max-min)*float64(i)/float64(buckets)
+	}
+
+	bounds[buckets] = max
+
+	return bounds, nil
+}
+
+// histogram counts the values in the buckets between the bounds
+func histogram(values []float64, bounds []float64) *Histogram {
+	result := &Histogram{Count: len(values), Buckets: []HistogramBucket{}}
+
+	if len(bounds) < 2 {
+		return result
+	}
+
+	for i := 0; i+1 < len(bounds); i++ {
+		result.Buckets = append(result.Buckets, HistogramBucket{Min: bounds[i], Max: bounds[i+1]})
+	}
+
+	last := len(bounds) - 1
+
+	for _, value := range values {
+		switch {
+		case value < bounds[0]:
+			result.Below++
+		case value > bounds[last]:
+			result.Above++
+		case value == bounds[last]:
+			result.Buckets[last-1].Count++
+		default:
+			// The bucket is the one of the last bound not greater than the value.
+			result.Buckets[sort.SearchFloat64s(bounds, math.Nextafter(value, math.Inf(1)))-1].Count++
+		}
+	}
+
+	return result
+}
+
+// histogramOf builds the histogram of a measurement (temp by default) of the devices over the time range of the query
+func histogramOf(c echo.Context, store Store, deviceIds []string) (*Histogram, error) {
+	metric := c.QueryParam("metric")
+
+	if metric == "" {
+		metric = "temp"
+	}
+
+	if !metricNamePattern.MatchString(metric) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Metric name %q is invalid", metric))
+	}
+
+	from, to, err := parseTimeRange(c, defaultQueryWindow)
+
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	values, err := metricValues(c.Request().Context(), store, deviceIds, metric, from, to)
+
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	bounds, err := histogramBounds(c, values)
+
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	result := histogram(values, bounds)
+	result.Metric, result.From, result.To = metric, from, to
+
+	return result, nil
+}
+
+// metricValues collects the values of a measurement of the devices within [from, to]
+func metricValues(ctx context.Context, store Store, deviceIds []string, metric string, from, to time.Time) ([]float64, error) {
+	var values []float64
+
+	for _, deviceId := range deviceIds {
+		points, err := store.MetricRange(ctx, deviceId, metric, from, to)
+
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get the %s history of device %s. %v", metric, deviceId, err)
+		}
+
+		for _, point := range points {
+			values = append(values, point.Value)
+		}
+	}
+
+	return values, nil
+}
+
+// getHistogram returns the histogram of a measurement of the device over the time range
+func getHistogram(c echo.Context, store Store) error {
+	result, err := histogramOf(c, store, []string{c.Param("id")})
+
+	if err != nil {
+		return err
+	}
+
+	result.DeviceId = c.Param("id")
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// getGroupHistogram returns the histogram of a measurement of the devices of the group over the time range
+func getGroupHistogram(c echo.Context, reg *registry, store Store) error {
+	group, err := reg.Group(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	result, err := histogramOf(c, store, group.Devices)
+
+	if err != nil {
+		return err
+	}
+
+	result.Group = group.Id
+
+	return c.JSON(http.StatusOK, result)
+}
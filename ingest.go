@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// errInvalidSensorData marks sensor data rejected by the validation.
+var errInvalidSensorData = errors.New("invalid sensor data")
+
+// defaultDeviceTypes are the device types accepted without a device_types setting.
+var defaultDeviceTypes = []string{"A", "B"}
+
+// ingester runs the sensor data of every source (HTTP, collectors) through the same validation and storage.
+type ingester struct {
+	store    Store
+	registry *registry
+	clock    *clockCorrector
+	dedup    *deduplicator
+	late     *lateDataPolicy
+	stats    *statsRecorder
+	sketches *sketchRecorder
+	rollups  *rollups
+	flags    *featureFlags // Gates the risky features of the ingest per device
+	otel     *otelExporter
+	statsd   *statsdSink
+	async    *asyncIngester // Stores the readings acknowledged after their validation
+	replicas *replicator    // Forwards the stored readings to the other regions, nil without targets
+	merged   bool           // Receives the readings of the other regions, the ingested ones are merged with them
+	pipeline *pipeline      // Stages every reading goes through
+
+	mu    sync.RWMutex
+	rules *ingestRules
+}
+
+// ingestRules are the settings of the ingest reloaded from the configuration file without a restart.
+type ingestRules struct {
+	deviceTypes  map[string]bool
+	transforms   *transformer
+	schemas      *schemaValidator
+	strict       bool // Rejects the JSON readings with unknown fields or without a required field
+	deviceIds    *deviceIdRules
+	derived      *deriver
+	metricLimits map[string]MetricLimit
+	alerts       *alerter
+}
+
+// newIngestRules validates the reloadable settings of the configuration
+func newIngestRules(store Store, reg *registry, config *Config) (*ingestRules, error) {
+	deviceTypes := config.DeviceTypes
+
+	if len(deviceTypes) == 0 {
+		deviceTypes = defaultDeviceTypes
+	}
+
+	rules := &ingestRules{
+		deviceTypes:  make(map[string]bool, len(deviceTypes)),
+		metricLimits: mergeMetricLimits(config.MetricLimits),
+		strict:       config.StrictDecoding,
+	}
+
+	for _, deviceType := range deviceTypes {
+		if deviceType == "" {
+			return nil, errors.New("device types must not be empty")
+		}
+
+		rules.deviceTypes[deviceType] = true
+	}
+
+	var err error
+
+	if rules.deviceIds, err = newDeviceIdRules(config.DeviceIds); err != nil {
+		return nil, fmt.Errorf("device ids: %w", err)
+	}
+
+	if rules.transforms, err = newTransformer(config.Transforms); err != nil {
+		return nil, fmt.Errorf("payload transformations: %w", err)
+	}
+
+	if rules.schemas, err = newSchemaValidator(config.Schemas); err != nil {
+		return nil, fmt.Errorf("payload schemas: %w", err)
+	}
+
+	if rules.derived, err = newDeriver(config.DerivedFields); err != nil {
+		return nil, fmt.Errorf("derived fields: %w", err)
+	}
+
+	if rules.alerts, err = newAlerter(config.Alerts, reg, store); err != nil {
+		return nil, fmt.Errorf("alerts: %w", err)
+	}
+
+	return rules, nil
+}
+
+// newIngester creates an ingester saving into the given store and registry with the settings of the configuration
+func newIngester(store Store, reg *registry, config *Config) (*ingester, error) {
+	rules, err := newIngestRules(store, reg, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clock, err := newClockCorrector(config.ClockDrift, reg)
+
+	if err != nil {
+		return nil, fmt.Errorf("clock drift: %w", err)
+	}
+
+	dedup, err := newDeduplicator(config.Dedup, reg)
+
+	if err != nil {
+		return nil, fmt.Errorf("dedup: %w", err)
+	}
+
+	late, err := newLateDataPolicy(config.LateData, reg)
+
+	if err != nil {
+		return nil, fmt.Errorf("late data: %w", err)
+	}
+
+	stats, err := newStatsRecorder(config.RollingStats, reg)
+
+	if err != nil {
+		return nil, fmt.Errorf("rolling stats: %w", err)
+	}
+
+	sketches, err := newSketchRecorder(config.Percentiles, reg)
+
+	if err != nil {
+		return nil, fmt.Errorf("percentiles: %w", err)
+	}
+
+	rollups, err := newRollups(config.Rollups, reg)
+
+	if err != nil {
+		return nil, fmt.Errorf("rollups: %w", err)
+	}
+
+	flags, err := newFeatureFlags(config.FeatureFlags, reg)
+
+	if err != nil {
+		return nil, fmt.Errorf("feature flags: %w", err)
+	}
+
+	otel, err := newOTelExporter(config.OTel)
+
+	if err != nil {
+		return nil, fmt.Errorf("OpenTelemetry export: %w", err)
+	}
+
+	statsd, err := newStatsDSink(config.StatsD)
+
+	if err != nil {
+		return nil, fmt.Errorf("StatsD: %w", err)
+	}
+
+	ing := &ingester{
+		store:    store,
+		registry: reg,
+		clock:    clock,
+		dedup:    dedup,
+		late:     late,
+		stats:    stats,
+		sketches: sketches,
+		rollups:  rollups,
+		flags:    flags,
+		otel:     otel,
+		statsd:   statsd,
+		rules:    rules,
+	}
+
+	if ing.async, err = newAsyncIngester(config.AsyncIngest, ing); err != nil {
+		return nil, fmt.Errorf("asynchronous ingest: %w", err)
+	}
+
+	if ing.replicas, err = newReplicator(config.Replication, reg); err != nil {
+		return nil, fmt.Errorf("replication: %w", err)
+	}
+
+	ing.merged = config.Replication.Secret != ""
+
+	if ing.pipeline, err = newPipeline(config.Pipeline, ing); err != nil {
+		return nil, fmt.Errorf("pipeline: %w", err)
+	}
+
+	return ing, nil
+}
+
+// currentRules returns the rules in effect, a reading is ingested with the same rules from start to end
+func (i *ingester) currentRules() *ingestRules {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.rules
+}
+
+// normalizeDeviceId returns the id a device is ingested under with the rules in effect
+func (i *ingester) normalizeDeviceId(deviceId string) string {
+	return i.currentRules().deviceIds.normalize(deviceId)
+}
+
+// reload replaces the rules with the ones of the configuration, the current rules are kept when they are invalid
+func (i *ingester) reload(config *Config) error {
+	rules, err := newIngestRules(i.store, i.registry, config)
+
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	i.rules = rules
+	i.mu.Unlock()
+
+	return nil
+}
+
+// validDeviceType reports whether the device type is accepted
+func (i *ingester) validDeviceType(deviceType string) bool {
+	return i.currentRules().deviceTypes[deviceType]
+}
+
+// ingest runs the sensor data through every stage of the pipeline, a dropped duplicate returns errDuplicateReading
+// and a reading dropped by another stage no error
+func (i *ingester) ingest(ctx context.Context, sensorData *SensorData) error {
+	reading := &ingestReading{rules: i.currentRules(), sensorData: sensorData}
+
+	return acknowledgeDropped(i.pipeline.run(ctx, reading, 0, len(i.pipeline.stages)))
+}
+
+// accept runs the sensor data through the stages of the pipeline up to the validation, the ones run before the
+// asynchronous acknowledgement, a reading dropped by one of them returns errDropReading
+func (i *ingester) accept(ctx context.Context, sensorData *SensorData) (*ingestReading, error) {
+	reading := &ingestReading{rules: i.currentRules(), sensorData: sensorData}
+
+	return reading, i.pipeline.run(ctx, reading, 0, i.pipeline.accepted)
+}
+
+// complete runs the accepted reading through the rest of the stages, a dropped duplicate returns errDuplicateReading
+// and a reading dropped by another stage errDropReading
+func (i *ingester) complete(ctx context.Context, reading *ingestReading) error {
+	return i.pipeline.run(ctx, reading, i.pipeline.accepted, len(i.pipeline.stages))
+}
+
+// acknowledgeDropped returns no error for a reading dropped by a stage, it is acknowledged as if it were stored
+func acknowledgeDropped(err error) error {
+	if errors.Is(err, errDropReading) {
+		return nil
+	}
+
+	return err
+}
+
+// validate stamps the sensor data with its receive time and validates it without any call to the storage
+func (i *ingester) validate(ctx context.Context, reading *ingestReading) error {
+	sensorData, rules := reading.sensorData, reading.rules
+	reading.receivedAt = time.Now().UTC()
+	reading.reportedTime = sensorData.Time != ""
+
+	// The receive time, corrected time, duplicate flag, region and derived values are only set at ingest, never
+	// taken from the payload.
+	sensorData.ReceivedAt = reading.receivedAt.Format(time.RFC3339)
+	sensorData.DeviceTime = ""
+	sensorData.Duplicate = false
+	sensorData.Region = ""
+	sensorData.Derived = nil
+
+	if !reading.reportedTime {
+		sensorData.Time = sensorData.ReceivedAt
+	}
+
+	return checkSensorData(sensorData, rules)
+}
+
+// checkSensorData normalizes the device id of the sensor data and validates it against the rules, the readings
+// ingested here and the ones replicated from another region alike
+func checkSensorData(sensorData *SensorData, rules *ingestRules) error {
+	// The readings of " th-01" and "th-01" are stored under the same device once normalized.
+	sensorData.DeviceId = rules.deviceIds.normalize(sensorData.DeviceId)
+
+	if err := validateSensorData(sensorData, rules); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidSensorData, err)
+	}
+
+	if err := validateMeasurements(sensorData, rules.metricLimits); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidSensorData, err)
+	}
+
+	return nil
+}
+
+// enrich runs the validated sensor data through the dedup, clock and late data checks, a dropped duplicate returns
+// errDuplicateReading
+func (i *ingester) enrich(ctx context.Context, reading *ingestReading) error {
+	sensorData := reading.sensorData
+
+	if i.dedup.enabled() {
+		fingerprint, err := i.dedup.check(ctx, sensorData)
+
+		if err != nil {
+			return err
+		}
+
+		if !sensorData.Duplicate {
+			// The retry of a reading rejected or not stored afterwards is not a duplicate.
+			reading.undo = append(reading.undo, func(ctx context.Context) {
+				i.dedup.forget(ctx, fingerprint)
+			})
+		}
+	}
+
+	if reading.reportedTime && i.clock.enabled() {
+		if err := i.clock.correct(ctx, sensorData, reading.receivedAt); err != nil {
+			return err
+		}
+	}
+
+	return i.late.check(ctx, sensorData, reading.receivedAt)
+}
+
+// transform computes the derived values of the sensor data
+func (i *ingester) transform(ctx context.Context, reading *ingestReading) error {
+	if reading.rules.derived.enabled() {
+		reading.rules.derived.derive(ctx, reading.sensorData)
+	}
+
+	return nil
+}
+
+// save stores the sensor data, merged with a reading replicated at the same time when replicating
+func (i *ingester) save(ctx context.Context, reading *ingestReading) error {
+	sensorData := reading.sensorData
+
+	if i.replicas == nil && !i.merged {
+		return i.store.Save(ctx, sensorData)
+	}
+
+	// A reading replicated from another region at the same time may have been received later.
+	if i.replicas != nil {
+		sensorData.Region = i.replicas.region
+	}
+
+	stored, err := i.merge(ctx, sensorData)
+
+	if err == nil && !stored {
+		return errDropReading
+	}
+
+	return err
+}
+
+// publish updates the statistics, alerts and trackers of the stored sensor data and forwards it
+func (i *ingester) publish(ctx context.Context, reading *ingestReading) error {
+	sensorData := reading.sensorData
+
+	// The reading is stored already, failing to update its statistics or alerts or to track its uptime or firmware doesn't reject it.
+	if err := i.stats.record(ctx, sensorData); err != nil {
+		log.Printf("Rolling statistics of device %s not updated: %v", sensorData.DeviceId, err)
+	}
+
+	if err := i.sketches.record(ctx, sensorData); err != nil {
+		log.Printf("Percentile sketches of device %s not updated: %v", sensorData.DeviceId, err)
+	}
+
+	if i.rollups.enabled() {
+		if err := i.rollups.record(ctx, sensorData); err != nil {
+			log.Printf("Rollups of device %s not updated: %v", sensorData.DeviceId, err)
+		}
+	}
+
+	if reading.rules.alerts.enabled() {
+		if err := reading.rules.alerts.evaluate(ctx, sensorData); err != nil {
+			log.Printf("Alerts of device %s not evaluated: %v", sensorData.DeviceId, err)
+		}
+	}
+
+	if timestamp, err := sensorData.Timestamp(); err == nil {
+		if _, err := i.registry.TrackUptime(ctx, sensorData.DeviceId, timestamp, sensorData.Uptime); err != nil {
+			log.Printf("Uptime of device %s not tracked: %v", sensorData.DeviceId, err)
+		}
+	}
+
+	i.otel.record(sensorData)
+	i.statsd.recordIngest(sensorData, reading.receivedAt, reading.reportedTime)
+	i.replicas.enqueue(ctx, sensorData)
+
+	if sensorData.Firmware != "" {
+		if _, err := i.registry.RecordFirmware(ctx, sensorData.DeviceId, sensorData.DeviceType, sensorData.Firmware, sensorData.Time); err != nil {
+			log.Printf("Firmware of device %s not tracked: %v", sensorData.DeviceId, err)
+		}
+	}
+
+	return nil
+}
@@ -1,3 +1,21 @@
 go mod init sensorservice
 go get github.com/labstack/echo/v4
-go get github.com/redis/go-redis/v9
\ No newline at end of file
+go get github.com/redis/go-redis/v9
+go get github.com/gosnmp/gosnmp
+go get github.com/goburrow/modbus
+go get github.com/gopcua/opcua
+go get github.com/plgd-dev/go-coap/v3
+go get github.com/pion/dtls/v3
+go get github.com/fxamacker/cbor/v2
+go get github.com/yuin/gopher-lua
+go get github.com/graphql-go/graphql
+go get golang.org/x/sync
+go get golang.org/x/net
+go get golang.org/x/sys
+go get github.com/santhosh-tekuri/jsonschema/v5
+go get go.opentelemetry.io/otel/sdk/metric
+go get go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp
+go get github.com/DataDog/datadog-go/v5
+go get modernc.org/sqlite
+go get go.etcd.io/bbolt
+go get github.com/ClickHouse/clickhouse-go/v2
\ No newline at end of file
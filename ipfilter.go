@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// IPFilterConfig restricts the clients of the routes by their IP.
+type IPFilterConfig struct {
+	TrustedProxies []string `json:"trusted_proxies"` // Proxies whose X-Forwarded-For header gives the client IP, the peer address is used otherwise
+	Rules          []IPRule `json:"rules"`           // Rules of the route groups, the one of the longest matching path applies
+}
+
+// IPRule allows or denies the clients of the routes under a path by CIDR, e.g. "10.0.0.0/8" or a single "10.0.0.1".
+type IPRule struct {
+	Path  string   `json:"path"`  // Prefix of the routes, e.g. "/admin" or "/" for all of them
+	Allow []string `json:"allow"` // Only the clients in these ranges are accepted, all of them when empty
+	Deny  []string `json:"deny"`  // Clients rejected, even when allowed
+}
+
+// ipRule is a validated IP rule.
+type ipRule struct {
+	path  string
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// accepts reports whether the client is accepted by the rule
+func (r *ipRule) accepts(ip netip.Addr) bool {
+	if containsIP(r.deny, ip) {
+		return false
+	}
+
+	return len(r.allow) == 0 || containsIP(r.allow, ip)
+}
+
+// ipFilter rejects with 403 Forbidden the requests of the clients not accepted by the rule of their route.
+type ipFilter struct {
+	rules     []ipRule // Longest path first
+	extractIP echo.IPExtractor
+}
+
+// newIPFilter validates the rules and the trusted proxies, nil without rules
+func newIPFilter(config IPFilterConfig) (*ipFilter, error) {
+	if len(config.Rules) == 0 {
+		return nil, nil
+	}
+
+	f := &ipFilter{extractIP: echo.ExtractIPDirect()}
+
+	if len(config.TrustedProxies) > 0 {
+		proxies, err := parsePrefixes(config.TrustedProxies)
+
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxies: %w", err)
+		}
+
+		options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+
+		for _, proxy := range proxies {
+			_, network, _ := net.ParseCIDR(proxy.String())
+			options = append(options, echo.TrustIPRange(network))
+		}
+
+		f.extractIP = echo.ExtractIPFromXFFHeader(options...)
+	}
+
+	for _, config := range config.Rules {
+		if !strings.HasPrefix(config.Path, "/") {
+			return nil, fmt.Errorf("path %q of an IP rule must start with /", config.Path)
+		}
+
+		rule := ipRule{path: config.Path}
+		var err error
+
+		if rule.allow, err = parsePrefixes(config.Allow); err != nil {
+			return nil, fmt.Errorf("allowed IPs of %s: %w", config.Path, err)
+		}
+
+		if rule.deny, err = parsePrefixes(config.Deny); err != nil {
+			return nil, fmt.Errorf("denied IPs of %s: %w", config.Path, err)
+		}
+
+		f.rules = append(f.rules, rule)
+	}
+
+	sort.SliceStable(f.rules, func(i, j int) bool { return len(f.rules[i].path) > len(f.rules[j].path) })
+
+	return f, nil
+}
+
+// ruleOf returns the rule of the longest path matching the request path, nil when none does
+func (f *ipFilter) ruleOf(path string) *ipRule {
+	for i := range f.rules {
+		rule := &f.rules[i]
+
+		if rule.path == "/" || path == rule.path || strings.HasPrefix(path, strings.TrimSuffix(rule.path, "/")+"/") {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// restricts reports whether the routes under the path only accept the allowed clients, the rules of their sub paths
+// included
+func (f *ipFilter) restricts(path string) bool {
+	if f == nil {
+		return false
+	}
+
+	if rule := f.ruleOf(path); rule == nil || len(rule.allow) == 0 {
+		return false
+	}
+
+	for _, rule := range f.rules {
+		if strings.HasPrefix(rule.path, strings.TrimSuffix(path, "/")+"/") && len(rule.allow) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// middleware rejects the clients not accepted by the rule of the route, before any other check
+func (f *ipFilter) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		rule := f.ruleOf(c.Request().URL.Path)
+
+		if rule == nil {
+			return next(c)
+		}
+
+		client := f.extractIP(c.Request())
+		ip, err := netip.ParseAddr(client)
+
+		if err != nil || !rule.accepts(ip.Unmap()) {
+			log.Printf("Request of %s to %s rejected by the IP rule of %s", client, c.Request().URL.Path, rule.path)
+			return newProblem(http.StatusForbidden, "ip_forbidden", fmt.Sprintf("The client IP %s isn't allowed on %s", client, rule.path))
+		}
+
+		return next(c)
+	}
+}
+
+// parsePrefixes parses the CIDR ranges, a single IP is a range of one address
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip, err := netip.ParseAddr(value)
+
+			if err != nil {
+				return nil, fmt.Errorf("%q is neither an IP nor a CIDR range", value)
+			}
+
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP nor a CIDR range", value)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// containsIP reports whether the IP is in one of the ranges
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// lateDataKeyPrefix prefixes the hash counting the late readings of a device.
+	lateDataKeyPrefix = "late-data:"
+	// lateDevicesKey is the Redis set holding the ids of the devices that sent late readings.
+	lateDevicesKey = "late-devices"
+)
+
+// LateDataConfig sets the policy of the readings arriving long after their time, e.g. buffered by an offline gateway.
+//
+// Late readings are stored at their time in the history, without replacing a more recent latest reading.
+type LateDataConfig struct {
+	LateAfter   Duration `json:"late_after"`   // Delay after which a reading counts as late, 1 minute by default
+	MaxLateness Duration `json:"max_lateness"` // Delay after which a reading is rejected, unlimited when empty
+}
+
+// LateData counts the late readings sent by a device.
+type LateData struct {
+	DeviceId   string `json:"device_id"`
+	Late       int64  `json:"late"`                   // Readings accepted late
+	Rejected   int64  `json:"rejected"`               // Readings rejected for exceeding the max lateness
+	MaxDelay   string `json:"max_delay"`              // Largest delay of a late reading, e.g. "2h30m0s"
+	LastLateAt string `json:"last_late_at,omitempty"` // Receive time of the last late reading
+}
+
+// lateDataPolicy counts the late readings and rejects the ones exceeding the max lateness.
+type lateDataPolicy struct {
+	config   LateDataConfig
+	registry *registry
+}
+
+// newLateDataPolicy validates the configuration and applies its defaults
+func newLateDataPolicy(config LateDataConfig, reg *registry) (*lateDataPolicy, error) {
+	if config.LateAfter <= 0 {
+		config.LateAfter = Duration(time.Minute)
+	}
+
+	if config.MaxLateness < 0 {
+		return nil, fmt.Errorf("max lateness %v must be positive", time.Duration(config.MaxLateness))
+	}
+
+	if config.MaxLateness > 0 && config.MaxLateness < config.LateAfter {
+		return nil, fmt.Errorf("max lateness %v must not be shorter than late after %v", time.Duration(config.MaxLateness), time.Duration(config.LateAfter))
+	}
+
+	return &lateDataPolicy{config: config, registry: reg}, nil
+}
+
+// check counts the reading if it is late and rejects it with errInvalidSensorData when it exceeds the max lateness
+func (p *lateDataPolicy) check(ctx context.Context, sensorData *SensorData, receivedAt time.Time) error {
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return err
+	}
+
+	delay := receivedAt.Sub(timestamp)
+
+	if delay < time.Duration(p.config.LateAfter) {
+		return nil
+	}
+
+	rejected := p.config.MaxLateness > 0 && delay > time.Duration(p.config.MaxLateness)
+
+	if err := p.registry.CountLateReading(ctx, sensorData.DeviceId, delay, receivedAt, rejected); err != nil {
+		return err
+	}
+
+	if rejected {
+		var errs fieldErrors
+		errs.add("time", "max_lateness", sensorData.Time, "time %s is more than %v old", sensorData.Time, time.Duration(p.config.MaxLateness))
+
+		return fmt.Errorf("%w: %w", errInvalidSensorData, errs)
+	}
+
+	return nil
+}
+
+// CountLateReading adds a late reading of the device to its counters
+func (r *registry) CountLateReading(ctx context.Context, deviceId string, delay time.Duration, receivedAt time.Time, rejected bool) error {
+	key := lateDataKeyPrefix + deviceId
+	pipe := r.rdb.TxPipeline()
+
+	if rejected {
+		pipe.HIncrBy(ctx, key, "rejected", 1)
+	} else {
+		pipe.HIncrBy(ctx, key, "late", 1)
+		pipe.HSet(ctx, key, "last_late_at", receivedAt.Format(time.RFC3339))
+		maxDelayScript.Eval(ctx, pipe, []string{key}, delay.Milliseconds())
+	}
+
+	pipe.SAdd(ctx, lateDevicesKey, deviceId)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on counting the late reading of device %s in the cache: %v", deviceId, err)
+	}
+
+	return nil
+}
+
+// maxDelayScript keeps the largest delay of the late readings of a device.
+var maxDelayScript = redis.NewScript(`
+local current = tonumber(redis.call('HGET', KEYS[1], 'max_delay_ms'))
+
+if not current or current < tonumber(ARGV[1]) then
+  redis.call('HSET', KEYS[1], 'max_delay_ms', ARGV[1])
+end
+
+return 0
+`)
+
+// LateData returns the late reading counters of the device, zero when it never sent late readings
+func (r *registry) LateData(ctx context.Context, deviceId string) (*LateData, error) {
+	fields, err := r.rdb.HGetAll(ctx, lateDataKeyPrefix+deviceId).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the late readings of device %s from the cache: %v", deviceId, err)
+	}
+
+	return decodeLateData(deviceId, fields), nil
+}
+
+// LateDevices returns the late reading counters of every device that sent late readings, most late first
+func (r *registry) LateDevices(ctx context.Context) ([]LateData, error) {
+	ids, err := r.rdb.SMembers(ctx, lateDevicesKey).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the devices with late readings from the cache: %v", err)
+	}
+
+	pipe := r.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, lateDataKeyPrefix+id)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the late readings from the cache: %v", err)
+	}
+
+	devices := make([]LateData, len(ids))
+
+	for i, id := range ids {
+		devices[i] = *decodeLateData(id, cmds[i].Val())
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Late+devices[i].Rejected != devices[j].Late+devices[j].Rejected {
+			return devices[i].Late+devices[i].Rejected > devices[j].Late+devices[j].Rejected
+		}
+
+		return devices[i].DeviceId < devices[j].DeviceId
+	})
+
+	return devices, nil
+}
+
+// decodeLateData builds the late reading counters of the device from its hash fields
+func decodeLateData(deviceId string, fields map[string]string) *LateData {
+	late, _ := strconv.ParseInt(fields["late"], 10, 64)
+	rejected, _ := strconv.ParseInt(fields["rejected"], 10, 64)
+	maxDelay, _ := strconv.ParseInt(fields["max_delay_ms"], 10, 64)
+
+	return &LateData{
+		DeviceId:   deviceId,
+		Late:       late,
+		Rejected:   rejected,
+		MaxDelay:   (time.Duration(maxDelay) * time.Millisecond).String(),
+		LastLateAt: fields["last_late_at"],
+	}
+}
+
+// registerLateDataRoutes mounts the fleet-wide late data report on the given group
+func registerLateDataRoutes(g *echo.Group, reg *registry) {
+	g.GET("", func(c echo.Context) error {
+		return listLateData(c, reg)
+	})
+}
+
+// listLateData returns the late reading counters of every device that sent late readings
+func listLateData(c echo.Context, reg *registry) error {
+	devices, err := reg.LateDevices(c.Request().Context())
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, devices)
+}
+
+// getLateData returns the late reading counters of the device
+func getLateData(c echo.Context, reg *registry) error {
+	lateData, err := reg.LateData(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, lateData)
+}
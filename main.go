@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/redis/go-redis/v9"
@@ -17,144 +21,643 @@ import (
 type SensorData struct {
 	Time       string  `json:"time"`        // Timestamp of the sensor data
 	DeviceId   string  `json:"device_id"`   // Unique identifier for the device
-	DeviceType string  `json:"device_type"` // Type of the device (A or B)
+	DeviceType string  `json:"device_type"` // Type of the device, A or B unless configured
 	Uptime     int     `json:"uptime"`      // Uptime of the device in seconds
 	Temp       float32 `json:"temp"`        // Temperature recorded by the sensor
+
+	// Optional measurements of the sensors able to report them, omitted by temperature-only devices
+	Humidity       *float32 `json:"humidity,omitempty"`        // Relative humidity in %
+	Pressure       *float32 `json:"pressure,omitempty"`        // Atmospheric pressure in hPa
+	BatteryVoltage *float32 `json:"battery_voltage,omitempty"` // Battery voltage in V
+
+	Metrics map[string]float64 `json:"metrics,omitempty"` // Any other measurement by name
+
+	Firmware string `json:"firmware,omitempty"` // Firmware version of the device, its changes are tracked
+
+	ReceivedAt string `json:"received_at,omitempty"` // Time the server received the sensor data, set at ingest
+	DeviceTime string `json:"device_time,omitempty"` // Time reported by the device when its drifted clock was corrected
+	Duplicate  bool   `json:"duplicate,omitempty"`   // Set at ingest on the readings already received within the dedup window
+	Region     string `json:"region,omitempty"`      // Region the reading was received in, set at ingest when replicated
+
+	Derived map[string]float64 `json:"derived,omitempty"` // Fields computed at ingest from the raw values
 }
 
-// IsValidType checks if the device type is either A or B.
-func (s SensorData) IsValidType() bool {
-	return s.DeviceType == "A" || s.DeviceType == "B"
+// Timestamp parses the device reported time of the sensor data.
+func (s SensorData) Timestamp() (time.Time, error) {
+	return time.Parse(time.RFC3339, s.Time)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "migrate-keys":
+			runMigrateKeys(os.Args[2:])
+			return
+		case "service":
+			runServiceCommand(os.Args[2:])
+			return
+		}
+	}
 
+	if runningAsService() {
+		runService()
+		return
+	}
+
+	// On SIGTERM the requests in progress are completed, a restart started the new process beforehand doesn't drop any.
+	shutdown := make(chan struct{})
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		<-signals
+		close(shutdown)
+	}()
+
+	if err := runAPI(shutdown); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runAPI starts the API with the flags of the command line and serves it until the shutdown channel is closed
+func runAPI(shutdown <-chan struct{}) error {
 	redisAddress := flag.String("redis-url", "localhost:6379", "Redis server address")
 	redisPassword := flag.String("redis-password", os.Getenv("REDIS_PASSWORD"), "Redis server password")
+	configPath := flag.String("config", "", "Path to the JSON configuration file")
+	withChaos := registerChaosFlags(flag.CommandLine)
 
 	flag.Parse()
 
-	rdb, err := getRedisClient(*redisPassword, *redisAddress)
+	config, err := loadConfig(*configPath)
 
 	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	rdb, err := getRedisClient(config.Redis, *redisPassword, *redisAddress)
+
+	// The embedded backends store the readings without Redis, only the metadata features need it then.
+	if err != nil && (config.Storage.inRedis() || rdb == nil) {
 		log.Fatalf("Failed to initialize Redis client: %v", err)
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	if err != nil {
+		log.Printf("Redis unavailable, the groups, labels, alerts and other metadata fail until it is reachable: %v", err)
+	}
+
+	if !config.Storage.inRedis() && (len(config.Shards) > 0 || len(config.ReadReplicas.Addresses) > 0) {
+		log.Fatalf("Shards and read replicas only apply to the readings stored in Redis, not to the %s backend", config.Storage.Backend)
+	}
+
+	// The metadata stays on the main Redis, only the readings are sharded.
+	mainStore := newRedisStore(rdb)
+	var store Store = mainStore
+	var sharded *shardedStore
+
+	if len(config.ReadReplicas.Addresses) > 0 {
+		password := config.ReadReplicas.Password
+
+		if password == "" {
+			password = *redisPassword
+		}
+
+		// The replicas are reached as the main Redis, with its user, database and TLS.
+		options, _ := config.Redis.options("", password)
+
+		if mainStore.replicas, err = newReplicaSet(config.ReadReplicas.Addresses, *options, config.Redis.Namespace, time.Duration(config.ReadReplicas.MaxStaleness)); err != nil {
+			log.Fatalf("Failed to initialize Redis read replicas: %v", err)
+		}
+
+		go mainStore.replicas.run(context.Background())
+	}
+
+	if len(config.Shards) > 0 {
+		if sharded, err = newShardedStore(config.Shards, config.Redis, time.Duration(config.ReadReplicas.MaxStaleness)); err != nil {
+			log.Fatalf("Failed to initialize Redis shards: %v", err)
+		}
+
+		go sharded.run(context.Background())
+		store = sharded
+	}
+
+	// The previous versions stored the latest readings under the bare device ids.
+	if config.Storage.inRedis() || config.Storage.DualWrite != nil {
+		stores := []*redisStore{mainStore}
+
+		if sharded != nil {
+			for _, sh := range sharded.shards {
+				stores = append(stores, sh.store)
+			}
+		}
+
+		migrateLatestKeys(stores)
+	}
+
+	if !config.Storage.inRedis() {
+		if store, err = newBackendStore(config.Storage); err != nil {
+			log.Fatalf("Failed to initialize %s storage: %v", config.Storage.Backend, err)
+		}
+	}
+
+	// The faults of the chaos builds are injected in the primary store, the wrappers above see a failing storage.
+	store = withChaos(store)
+	var dualWrite *dualWriteStore
+
+	if dual := config.Storage.DualWrite; dual != nil {
+		var secondary Store = mainStore
+
+		if config.Storage.inRedis() && dual.Secondary.inRedis() {
+			log.Fatalf("The secondary store of the dual writes must be another backend than the primary one")
+		}
+
+		if !dual.Secondary.inRedis() {
+			if secondary, err = newBackendStore(dual.Secondary); err != nil {
+				log.Fatalf("Failed to initialize secondary %s storage: %v", dual.Secondary.Backend, err)
+			}
+		}
+
+		if dualWrite, err = newDualWriteStore(store, secondary, *dual); err != nil {
+			log.Fatalf("Failed to initialize dual writes: %v", err)
+		}
+
+		store = dualWrite
+	}
+
+	reg := newRegistry(rdb)
+	var snapshots *snapshotStore
+
+	// The snapshots record the writes below the cache, the exports read the stores.
+	if config.Snapshots.Enabled {
+		snapshots = newSnapshotStore(store, reg)
+		store = snapshots
+		go snapshots.run(context.Background())
+	}
+
+	// The concurrent identical reads share a single call to Redis, the misses of the cache included.
+	store = newCoalescedStore(store)
+	var cache *cachedStore
+
+	if config.Cache.Size > 0 {
+		if cache, err = newCachedStore(store, config.Cache); err != nil {
+			log.Fatalf("Failed to initialize cache: %v", err)
+		}
+
+		store = cache
+	}
+
+	ing, err := newIngester(store, reg, config)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize ingest: %v", err)
+	}
+
+	if len(config.SNMP.Targets) > 0 {
+		collector, err := newSNMPCollector(config.SNMP, ing)
+
+		if err != nil {
+			log.Fatalf("Failed to initialize SNMP collector: %v", err)
+		}
+
+		go collector.run(context.Background())
+	}
+
+	if len(config.Modbus.Devices) > 0 {
+		collector, err := newModbusCollector(config.Modbus, ing)
+
+		if err != nil {
+			log.Fatalf("Failed to initialize Modbus client: %v", err)
+		}
+
+		go collector.run(context.Background())
+	}
+
+	if len(config.OPCUA.Servers) > 0 {
+		collector, err := newOPCUACollector(config.OPCUA, ing)
+
+		if err != nil {
+			log.Fatalf("Failed to initialize OPC UA client: %v", err)
+		}
+
+		go collector.run(context.Background())
+	}
+
+	if config.CoAP.Address != "" {
+		server, err := newCoAPServer(config.CoAP, ing)
+
+		if err != nil {
+			log.Fatalf("Failed to initialize CoAP endpoint: %v", err)
+		}
+
+		go func() {
+			log.Fatalf("CoAP endpoint stopped: %v", server.listenAndServe())
+		}()
+	}
+
+	accessLog, err := newAccessLogger(config.AccessLog)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize access log: %v", err)
+	}
+
+	requestLog, err := newRequestLogger(config.RequestLog, ing.normalizeDeviceId)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize request logging: %v", err)
+	}
+
+	limiter, err := newRateLimiter(config.RateLimit, reg)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize rate limiting: %v", err)
+	}
+
+	quota, err := newQuotaLimiter(config.Quota, reg, ing.normalizeDeviceId)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize quotas: %v", err)
+	}
+
+	tokens := newTokenAuthenticator(config.APITokens, reg)
+	meter, err := newMeter(config.Metering, reg)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize usage metering: %v", err)
+	}
+
+	serverConfig, err := config.Server.withDefaults()
+
+	if err != nil {
+		log.Fatalf("Failed to initialize HTTP server: %v", err)
+	}
+
+	verifier, err := newSignatureVerifier(config.Signing, reg, ing.normalizeDeviceId)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize payload signing: %v", err)
+	}
+
+	filter, err := newIPFilter(config.IPFilter)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize IP filter: %v", err)
+	}
+
+	// The admin routes mint the API tokens without one, on the public server only the allowed clients may reach them.
+	if tokens != nil && serverConfig.AdminAddress == "" && !filter.restricts("/admin") {
+		log.Fatalf("API tokens need an admin_address or an IP rule with allow ranges on /admin, the admin routes are open otherwise")
+	}
+
 	e := echo.New()
+	e.HTTPErrorHandler = problemErrorHandler
+
+	if config.CanonicalJSON {
+		e.JSONSerializer = canonicalSerializer{}
+	}
+	e.Use(staleReadsMiddleware)
+
+	if accessLog != nil {
+		e.Use(accessLog.middleware)
+	}
+
+	if filter != nil {
+		e.Use(filter.middleware)
+	}
+
+	e.Use(requireContentType)
+
+	// The admin routes get their own server on the management network when configured, they aren't on the public one then.
+	adminServer := e
+
+	if serverConfig.AdminAddress != "" {
+		adminServer = echo.New()
+		adminServer.HTTPErrorHandler = problemErrorHandler
+		adminServer.JSONSerializer = e.JSONSerializer
+
+		if accessLog != nil {
+			adminServer.Use(accessLog.middleware)
+		}
+
+		if filter != nil {
+			adminServer.Use(filter.middleware)
+		}
+
+		adminServer.Use(requireContentType)
+	}
+
+	if ing.statsd != nil {
+		e.Use(ing.statsd.middleware)
+	}
+
+	if tokens != nil {
+		e.Use(tokens.middleware)
+	}
+
+	if meter != nil {
+		e.Use(meter.middleware)
+	}
+
+	e.Use(limiter.middleware)
+	e.Use(requestLog.middleware)
+	var ingestMiddlewares []echo.MiddlewareFunc
+
+	if verifier != nil {
+		ingestMiddlewares = append(ingestMiddlewares, verifier.middleware)
+	}
+
+	// The quotas count the readings of the authentic devices only.
+	ingestMiddlewares = append(ingestMiddlewares, quota.middleware)
+
 	e.POST("/process", func(c echo.Context) error {
-		return saveSensor(c, rdb)
-	})
+		return saveSensor(c, ing)
+	}, ingestMiddlewares...)
 	e.GET("/getDataById", func(c echo.Context) error {
-		return getSensor(c, rdb)
+		return getSensor(c, store, reg, config.SilentDeviceStubs, ing.normalizeDeviceId)
 	})
-	e.Logger.Fatal(e.Start(":8080"))
+	registerDataRoutes(e.Group("/data"), store, reg, ing.normalizeDeviceId)
+	registerGroupRoutes(e.Group("/groups"), reg, store)
+	registerDeviceRoutes(e.Group("/devices"), reg, store, ing, config.ExpectedIntervals)
+	registerFirmwareRoutes(e.Group("/firmware"), reg, config.ExpectedFirmware)
+	registerShadowRoutes(e.Group("/shadows"), reg)
+	registerLateDataRoutes(e.Group("/late-data"), reg)
+	registerRestartRoutes(e.Group("/restarts"), reg)
+	registerRollupRoutes(e.Group("/rollups"), reg, ing.rollups)
+	registerAlertRoutes(e.Group("/alerts"), reg)
+	registerFleetRoutes(e.Group("/fleet"), reg, store)
+	registerReceiptRoutes(e.Group("/ingest-status"), reg)
+	registerGrafanaRoutes(e.Group("/grafana"), store)
+	admin := adminServer.Group("/admin")
+	registerRequestLogRoutes(admin, requestLog)
+
+	registerFlagRoutes(admin, ing.flags, reg)
+	registerSecretRoutes(admin, reg)
+	registerTokenRoutes(admin, reg)
+
+	if sharded != nil {
+		registerShardRoutes(admin, sharded)
+	}
+
+	if mainStore.replicas != nil {
+		registerReplicaRoutes(admin, mainStore.replicas)
+	}
+
+	if cache != nil {
+		registerCacheRoutes(admin, cache)
+	}
+
+	if dualWrite != nil {
+		registerDualWriteRoutes(admin, dualWrite)
+	}
+
+	if snapshots != nil {
+		registerSnapshotRoutes(admin, snapshots)
+	}
+
+	if meter != nil {
+		registerUsageRoutes(admin, reg)
+		go meter.run(context.Background())
+	}
+
+	registerReplicationAdminRoutes(admin, ing)
+
+	// The other regions sign their requests with the secret shared with this one, without it nothing is replicated here.
+	if config.Replication.Secret != "" {
+		registerReplicationRoutes(e.Group("/replication", replicationAuth(config.Replication.Secret)), ing)
+	}
+
+	if ing.replicas != nil {
+		go ing.replicas.run(context.Background())
+	}
+
+	go ing.flags.run(context.Background())
+	ing.async.run()
+
+	reloader := newConfigReloader(*configPath, ing, limiter, quota)
+	registerReloadRoutes(admin, reloader)
+	go reloader.watchSignals()
+
+	if config.GraphQL.Enabled {
+		api, err := newGraphQLAPI(reg, store)
+
+		if err != nil {
+			log.Fatalf("Failed to initialize GraphQL API: %v", err)
+		}
+
+		registerGraphQLRoutes(e, api)
+	}
+
+	if len(config.TTN.Decoders) > 0 {
+		webhook, err := newTTNWebhook(config.TTN, ing)
+
+		if err != nil {
+			log.Fatalf("Failed to initialize TTN webhook: %v", err)
+		}
+
+		e.POST("/ttn/uplink", webhook.handle)
+	}
+
+	if err := warmUp(config.WarmUp, rdb, reg, cache); err != nil {
+		log.Fatalf("Failed to initialize warm-up: %v", err)
+	}
+
+	listeners, err := listen(serverConfig)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize HTTP server: %v", err)
+	}
+
+	if adminServer != e {
+		adminListener, err := listenTCP(serverConfig.AdminAddress, serverConfig)
+
+		if err != nil {
+			log.Fatalf("Failed to initialize admin HTTP server: %v", err)
+		}
+
+		go func() {
+			if err := serve(newHTTPServer(serverConfig, adminServer), []net.Listener{adminListener}, shutdown); err != nil {
+				log.Fatalf("Admin HTTP server failed: %v", err)
+			}
+		}()
+	}
+
+	err = serve(newHTTPServer(serverConfig, e), listeners, shutdown)
+
+	// The readings acknowledged before being stored are stored before exiting.
+	ing.async.close()
+
+	// The next start pre-loads the devices requested the most by now.
+	if cache != nil && config.WarmUp.Enabled {
+		if err := reg.SaveWarmDevices(context.Background(), cache.hottest()); err != nil {
+			log.Printf("Devices to warm up not saved: %v", err)
+		}
+	}
+
+	return err
 }
 
 // saveSensor processes the incoming sensor data, validates it, and stores it in Redis
-func saveSensor(c echo.Context, redisClient *redis.Client) error {
-	sensorDataToProcess := new(SensorData)
+func saveSensor(c echo.Context, ing *ingester) error {
+	rules := ing.currentRules()
 
-	err := c.Bind(sensorDataToProcess)
+	// The raw body is checked before the binding drops the fields unknown to SensorData.
+	if err := rules.schemas.check(c); err != nil {
+		return newProblem(http.StatusBadRequest, "schema_violation", fmt.Sprintf("The payload breaks the schema of its device type: %v", err)).withFields(err)
+	}
+
+	sensorDataToProcess, err := bindSensorData(c, rules)
 
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get sensor data from the request body: %v", err))
+		return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to get sensor data from the request body: %v", err)).withFields(err)
 	}
 
-	err = validateSensorData(sensorDataToProcess)
+	c.Set(deviceIdContextKey, sensorDataToProcess.DeviceId)
+	var receipt string
 
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err)
+	// The gateways preferring an early acknowledgement get it once the reading is validated, with its receipt.
+	if prefersAsync(c.Request().Header.Get("Prefer")) {
+		receipt, err = ing.async.enqueue(c.Request().Context(), sensorDataToProcess)
+	} else {
+		err = ing.ingest(c.Request().Context(), sensorDataToProcess)
+	}
+
+	status := http.StatusCreated
+
+	if errors.Is(err, errInvalidSensorData) {
+		return newProblem(http.StatusBadRequest, "invalid_sensor_data", err.Error()).withFields(err)
 	}
 
-	err = saveToRedis(redisClient, sensorDataToProcess, c.Request().Context())
+	// A duplicate was stored already, the retrying client gets a success without a second copy.
+	if errors.Is(err, errDuplicateReading) {
+		status, err = http.StatusOK, nil
+	}
 
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Error on saving user in the cache: %v", err)
 	}
 
-	return c.NoContent(http.StatusCreated)
+	response := map[string]interface{}{}
+
+	// A full queue stores the reading before the response, it is acknowledged as created then.
+	if receipt != "" {
+		status = http.StatusAccepted
+		c.Response().Header().Set("Preference-Applied", respondAsync)
+		c.Response().Header().Set(echo.HeaderLocation, "/ingest-status/"+receipt)
+		response["receipt_id"] = receipt
+	}
+
+	// Devices asking for their commands get them in the response instead of polling for them separately.
+	if c.QueryParam("commands") == "true" {
+		commands, err := ing.registry.DeliverCommands(c.Request().Context(), sensorDataToProcess.DeviceId, 0)
+
+		if err != nil {
+			log.Printf("Commands of device %s not delivered: %v", sensorDataToProcess.DeviceId, err)
+		}
+
+		if commands == nil {
+			commands = []Command{}
+		}
+
+		response["commands"] = commands
+	}
+
+	if len(response) > 0 {
+		return c.JSON(status, response)
+	}
+
+	return c.NoContent(status)
 }
 
-// validateSensorData checks if the sensor data is valid based on device type
-func validateSensorData(s *SensorData) (e error) {
-	if !s.IsValidType() {
-		return fmt.Errorf("device type %s is not supported", s.DeviceType)
+// bindSensorData reads the sensor data from the request, running the payload transformations first when configured
+func bindSensorData(c echo.Context, rules *ingestRules) (*SensorData, error) {
+	transforms := rules.transforms
+
+	if !transforms.enabled() {
+		sensorData := new(SensorData)
+		return sensorData, decodeSensorData(c, sensorData, rules.strict)
 	}
 
-	return nil
+	var payload map[string]interface{}
+
+	if err := c.Bind(&payload); err != nil {
+		return nil, err
+	}
+
+	return transforms.transform(c.Request().Context(), payload)
 }
 
-// saveToRedis serializes the sensor data and stores it in Redis
-func saveToRedis(rdb *redis.Client, sensorData *SensorData, ctx context.Context) (e error) {
-	dataToSave, err := json.Marshal(sensorData)
+// validateSensorData checks if the sensor data is valid based on device id and type, every invalid field is reported
+func validateSensorData(s *SensorData, rules *ingestRules) error {
+	var errs fieldErrors
+	rules.deviceIds.validate(&errs, s.DeviceId, s.DeviceType)
 
-	if err != nil {
-		return fmt.Errorf("fatal error on marshalling the sensor data for device %s: %v", sensorData.DeviceId, err)
+	if !rules.deviceTypes[s.DeviceType] {
+		errs.add("device_type", "enum", s.DeviceType, "device type %s is not supported", s.DeviceType)
 	}
 
-	err = rdb.Set(ctx, sensorData.DeviceId, dataToSave, 0).Err()
+	if _, err := s.Timestamp(); err != nil {
+		errs.add("time", "rfc3339", s.Time, "time %s is not a valid RFC 3339 timestamp", s.Time)
+	}
 
-	if err != nil {
-		return fmt.Errorf("fatal error on saving the device id %s data in the cache: %v", sensorData.DeviceId, err)
+	if s.Firmware != "" && !firmwarePattern.MatchString(s.Firmware) {
+		errs.add("firmware", "pattern", s.Firmware, "firmware %q must be 1 to 64 letters, digits, '_', '.', '+' or '-'", s.Firmware)
 	}
 
-	return nil
+	return errs.err()
 }
 
-// getRedisClient initializes a Redis client with the provided credentials
-func getRedisClient(password, url string) (*redis.Client, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     url,
-		Password: password,
-		DB:       0,
-	})
+// getRedisClient initializes a Redis client with the provided credentials and connection settings, the client is
+// returned along with the error of an unreachable server, which it keeps trying to reach
+func getRedisClient(config RedisConfig, password, url string) (*redis.Client, error) {
+	options, err := config.options(url, password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rdb := newRedisClient(options, config.Namespace)
 
 	if err := rdb.Ping(context.Background()).Err(); err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+		return rdb, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
 	return rdb, nil
 }
 
-// getSensor handles the GET request to retrieve sensor data by device ID
-func getSensor(c echo.Context, rdb *redis.Client) error {
-	deviceId := c.QueryParam("id")
+// getSensor handles the GET request to retrieve sensor data by device ID, a registered device without any reading
+// gets a stub when enabled
+func getSensor(c echo.Context, store Store, reg *registry, stubs bool, normalizeDeviceId func(deviceId string) string) error {
+	deviceId := normalizeDeviceId(c.QueryParam("id"))
 
 	if deviceId == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "Device 'id' is missing")
 	}
 
-	sensorData, err := getSensorDataById(deviceId, rdb, c.Request().Context())
+	fields, err := parseFieldSelection(c)
 
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Couldn't get the Sensor data for device %s from the cache. %v", deviceId, err))
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, sensorData)
-}
-
-// getSensorDataById retrieves sensor data from Redis by device ID
-func getSensorDataById(id string, rdb *redis.Client, ctx context.Context) (*SensorData, error) {
-
-	fromDB, err := rdb.Get(ctx, id).Bytes()
+	sensorData, err := store.Latest(c.Request().Context(), deviceId)
 
-	if err != nil {
-		if err == redis.Nil {
-			return nil, fmt.Errorf("sensor data for device id with %s not found", id)
-		}
-
-		return nil, fmt.Errorf("fatal error on retrieiving the sensor data for device id %s from the cache: %v", id, err)
+	if errors.Is(err, errNotFound) && stubs {
+		return getSilentDevice(c, reg, deviceId)
 	}
 
-	var sensorData SensorData
-
-	err = json.Unmarshal(fromDB, &sensorData)
+	if errors.Is(err, errNotFound) {
+		return newProblem(http.StatusNotFound, "device_not_found", fmt.Sprintf("Device %s has no sensor data", deviceId))
+	}
 
 	if err != nil {
-		return nil, fmt.Errorf("fatal error on reading the sensor data for device id %s from cache: %v", id, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't get the Sensor data for device %s. %v", deviceId, err))
 	}
 
-	return &sensorData, nil
+	return c.JSON(http.StatusOK, fields.reading(sensorData))
 }
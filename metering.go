@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// usageKeyPrefix prefixes the Redis hash of the usage of the tenants in a UTC day, by "<counter>:<tenant>".
+	usageKeyPrefix = "usage:"
+	// usageFlushInterval is the time the usage is counted in memory before being added to Redis.
+	usageFlushInterval = 10 * time.Second
+	// defaultUsageRetention is the time the daily usage is kept without a retention setting, a year and a billing period.
+	defaultUsageRetention = 400 * 24 * time.Hour
+	// anonymousTenant is the tenant of the requests without the tenant header.
+	anonymousTenant = "anonymous"
+)
+
+// MeteringConfig meters the usage of the API per tenant, told apart by a header such as their API key.
+type MeteringConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Header    string   `json:"header"`    // Header giving the tenant of a request, X-Api-Key by default
+	Retention Duration `json:"retention"` // Time the daily usage is kept, 400 days by default
+}
+
+// Usage is the use of the API by a tenant over a period.
+type Usage struct {
+	Tenant        string `json:"tenant"`
+	Readings      int64  `json:"readings"`       // Readings ingested
+	BytesIngested int64  `json:"bytes_ingested"` // Size of the payloads of the readings ingested, the storage billed
+	Queries       int64  `json:"queries"`        // Read requests served
+}
+
+// UsageReport is the usage of every tenant over a billing period.
+type UsageReport struct {
+	Period  string  `json:"period"` // Month of the report, e.g. "2025-01"
+	Tenants []Usage `json:"tenants"`
+}
+
+// meter counts the usage of the tenants in memory and adds it to their daily usage in Redis periodically.
+type meter struct {
+	registry  *registry
+	header    string
+	retention time.Duration
+
+	mu    sync.Mutex
+	usage map[string]map[string]*Usage // By UTC day "2006-01-02" and tenant
+}
+
+// newMeter validates the metering settings, nil when disabled
+func newMeter(config MeteringConfig, reg *registry) (*meter, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	if config.Retention < 0 {
+		return nil, fmt.Errorf("retention %v must be positive", time.Duration(config.Retention))
+	}
+
+	m := &meter{registry: reg, header: config.Header, retention: time.Duration(config.Retention), usage: map[string]map[string]*Usage{}}
+
+	if m.header == "" {
+		m.header = "X-Api-Key"
+	}
+
+	if m.retention == 0 {
+		m.retention = defaultUsageRetention
+	}
+
+	return m, nil
+}
+
+// middleware counts the readings ingested with their payload size and the queries served of the tenant of the request.
+// The admin routes aren't metered.
+func (m *meter) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body := &countingReader{ReadCloser: c.Request().Body}
+		c.Request().Body = body
+		err := next(c)
+
+		if err != nil {
+			return err
+		}
+
+		status := c.Response().Status
+
+		if status < http.StatusOK || status >= http.StatusMultipleChoices || strings.HasPrefix(c.Path(), "/admin") {
+			return nil
+		}
+
+		// The tenant of the API token of the request, when the tokens are required, rather than its secret.
+		tenant, _ := c.Get(tenantContextKey).(string)
+
+		if tenant == "" {
+			tenant = c.Request().Header.Get(m.header)
+		}
+
+		if tenant == "" {
+			tenant = anonymousTenant
+		}
+
+		switch {
+		case c.Request().Method == http.MethodPost && (c.Path() == "/process" || c.Path() == "/ttn/uplink"):
+			m.add(tenant, Usage{Readings: 1, BytesIngested: body.read})
+		case c.Request().Method == http.MethodGet:
+			m.add(tenant, Usage{Queries: 1})
+		}
+
+		return nil
+	}
+}
+
+// add counts the usage of the tenant in the current day
+func (m *meter) add(tenant string, usage Usage) {
+	day := time.Now().UTC().Format("2006-01-02")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tenants := m.usage[day]
+
+	if tenants == nil {
+		tenants = map[string]*Usage{}
+		m.usage[day] = tenants
+	}
+
+	total := tenants[tenant]
+
+	if total == nil {
+		total = &Usage{Tenant: tenant}
+		tenants[tenant] = total
+	}
+
+	total.Readings += usage.Readings
+	total.BytesIngested += usage.BytesIngested
+	total.Queries += usage.Queries
+}
+
+// run adds the usage counted to Redis until the context is done
+func (m *meter) run(ctx context.Context) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.flush(ctx)
+	}
+}
+
+// flush adds the usage counted to Redis, it is counted again on failure
+func (m *meter) flush(ctx context.Context) {
+	m.mu.Lock()
+	usage := m.usage
+	m.usage = map[string]map[string]*Usage{}
+	m.mu.Unlock()
+
+	for day, tenants := range usage {
+		if err := m.registry.AddUsage(ctx, day, tenants, m.retention); err != nil {
+			log.Printf("Usage of %s not saved, retrying: %v", day, err)
+
+			for _, total := range tenants {
+				m.add(total.Tenant, *total)
+			}
+		}
+	}
+}
+
+// countingReader counts the bytes read from the request body.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+// Read reads from the body and counts the bytes read
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+
+	return n, err
+}
+
+// AddUsage adds the usage of the tenants to their usage of the day, kept for the retention
+func (r *registry) AddUsage(ctx context.Context, day string, tenants map[string]*Usage, retention time.Duration) error {
+	pipe := r.rdb.TxPipeline()
+	key := usageKeyPrefix + day
+
+	for tenant, usage := range tenants {
+		pipe.HIncrBy(ctx, key, "readings:"+tenant, usage.Readings)
+		pipe.HIncrBy(ctx, key, "bytes_ingested:"+tenant, usage.BytesIngested)
+		pipe.HIncrBy(ctx, key, "queries:"+tenant, usage.Queries)
+	}
+
+	pipe.Expire(ctx, key, retention)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on saving the usage of %s in the cache: %v", day, err)
+	}
+
+	return nil
+}
+
+// Usage returns the usage of every tenant over the days of the month, by tenant
+func (r *registry) Usage(ctx context.Context, month time.Time) ([]Usage, error) {
+	pipe := r.rdb.Pipeline()
+	var days []*redis.MapStringStringCmd
+
+	for day := month; day.Month() == month.Month(); day = day.AddDate(0, 0, 1) {
+		days = append(days, pipe.HGetAll(ctx, usageKeyPrefix+day.Format("2006-01-02")))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the usage of %s from the cache: %v", month.Format("2006-01"), err)
+	}
+
+	totals := map[string]*Usage{}
+
+	for _, day := range days {
+		for field, raw := range day.Val() {
+			counter, tenant, _ := strings.Cut(field, ":")
+			value, err := strconv.ParseInt(raw, 10, 64)
+
+			if err != nil {
+				return nil, fmt.Errorf("fatal error on reading the usage from the cache: malformed counter %s %q", field, raw)
+			}
+
+			total := totals[tenant]
+
+			if total == nil {
+				total = &Usage{Tenant: tenant}
+				totals[tenant] = total
+			}
+
+			switch counter {
+			case "readings":
+				total.Readings += value
+			case "bytes_ingested":
+				total.BytesIngested += value
+			case "queries":
+				total.Queries += value
+			}
+		}
+	}
+
+	usage := make([]Usage, 0, len(totals))
+
+	for _, total := range totals {
+		usage = append(usage, *total)
+	}
+
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+
+	return usage, nil
+}
+
+// registerUsageRoutes mounts the usage report endpoint on the given group
+func registerUsageRoutes(g *echo.Group, reg *registry) {
+	g.GET("/usage", func(c echo.Context) error {
+		return getUsage(c, reg)
+	})
+}
+
+// getUsage returns the usage of every tenant in the billing period, the current month by default, in JSON or in CSV
+// with format=csv
+func getUsage(c echo.Context, reg *registry) error {
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	if raw := c.QueryParam("period"); raw != "" {
+		parsed, err := time.Parse("2006-01", raw)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'period' %s must be a month, e.g. 2025-01", raw))
+		}
+
+		month = parsed
+	}
+
+	usage, err := reg.Usage(c.Request().Context(), month)
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	report := UsageReport{Period: month.Format("2006-01"), Tenants: usage}
+
+	switch c.QueryParam("format") {
+	case "", "json":
+		return c.JSON(http.StatusOK, report)
+	case "csv":
+		return writeUsageCSV(c, &report)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'format' %s must be json or csv", c.QueryParam("format")))
+	}
+}
+
+// writeUsageCSV writes the report as a CSV attachment with a line per tenant
+func writeUsageCSV(c echo.Context, report *UsageReport) error {
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	response.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"usage-%s.csv\"", report.Period))
+	response.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(response)
+	writer.Write([]string{"period", "tenant", "readings", "bytes_ingested", "queries"})
+
+	for _, usage := range report.Tenants {
+		writer.Write([]string{
+			report.Period,
+			usage.Tenant,
+			strconv.FormatInt(usage.Readings, 10),
+			strconv.FormatInt(usage.BytesIngested, 10),
+			strconv.FormatInt(usage.Queries, 10),
+		})
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
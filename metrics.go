@@ -0,0 +1,127 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+)
+
+// metricNamePattern restricts the metric names so they can be used in keys and URLs.
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// MetricPoint is a timestamped value of a metric.
+type MetricPoint struct {
+	Time  string  `json:"time"`
+	Value float64 `json:"value"`
+}
+
+// MetricLimit bounds the accepted values of a measurement, an unset bound is not checked.
+type MetricLimit struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+// typedMeasurements are the measurements with their own SensorData field, not accepted in the metrics.
+var typedMeasurements = map[string]bool{"temp": true, "humidity": true, "pressure": true, "battery_voltage": true}
+
+// defaultMetricLimits rejects physically impossible measurements.
+var defaultMetricLimits = map[string]MetricLimit{
+	"humidity":        {Min: floatPtr(0), Max: floatPtr(100)},
+	"pressure":        {Min: floatPtr(0)},
+	"battery_voltage": {Min: floatPtr(0)},
+}
+
+// Measurements returns the measurements carried by the reading by name, the temperature always included.
+func (s SensorData) Measurements() map[string]float64 {
+	measurements := make(map[string]float64, len(s.Metrics)+4)
+
+	for name, value := range s.Metrics {
+		measurements[name] = value
+	}
+
+	measurements["temp"] = float64(s.Temp)
+
+	for name, value := range map[string]*float32{
+		"humidity":        s.Humidity,
+		"pressure":        s.Pressure,
+		"battery_voltage": s.BatteryVoltage,
+	} {
+		if value != nil {
+			measurements[name] = float64(*value)
+		}
+	}
+
+	return measurements
+}
+
+// mergeMetricLimits overrides the default limits with the configured ones
+func mergeMetricLimits(configured map[string]MetricLimit) map[string]MetricLimit {
+	limits := make(map[string]MetricLimit, len(defaultMetricLimits)+len(configured))
+
+	for name, limit := range defaultMetricLimits {
+		limits[name] = limit
+	}
+
+	for name, limit := range configured {
+		limits[name] = limit
+	}
+
+	return limits
+}
+
+// validateMeasurements checks the metric names and every measurement of the reading against its limit, every invalid field is reported
+func validateMeasurements(s *SensorData, limits map[string]MetricLimit) error {
+	var errs fieldErrors
+
+	for _, name := range sortedKeys(s.Metrics) {
+		if !metricNamePattern.MatchString(name) {
+			errs.add("metrics."+name, "pattern", name, "metric name %q must be 1 to 64 letters, digits, '_', '.' or '-'", name)
+		}
+
+		if typedMeasurements[name] {
+			errs.add("metrics."+name, "typed_field", name, "metric %s must be sent as the %s field", name, name)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	measurements := s.Measurements()
+
+	for _, name := range sortedKeys(measurements) {
+		value := measurements[name]
+		limit := limits[name]
+		field := name
+
+		if !typedMeasurements[name] {
+			field = "metrics." + name
+		}
+
+		if limit.Min != nil && value < *limit.Min {
+			errs.add(field, "min", value, "%s %v is below the minimum %v", name, value, *limit.Min)
+		}
+
+		if limit.Max != nil && value > *limit.Max {
+			errs.add(field, "max", value, "%s %v is above the maximum %v", name, value, *limit.Max)
+		}
+	}
+
+	return errs.err()
+}
+
+// sortedKeys returns the names of the values sorted, so the same payload always reports the same error
+func sortedKeys(values map[string]float64) []string {
+	names := make([]string, 0, len(values))
+
+	for name := range values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
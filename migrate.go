@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// migrateProgressInterval is the time between two progress lines of the migration.
+	migrateProgressInterval = 10 * time.Second
+	// maxReportedMismatches is the number of mismatching devices listed by the consistency report.
+	maxReportedMismatches = 20
+)
+
+// migrationReport is the consistency of the destination with the source, device by device.
+type migrationReport struct {
+	devices    int
+	readings   int
+	mismatches []string // Devices with a different history or latest reading, with the difference
+}
+
+// runMigrate copies all the readings of a backend into another one, e.g.
+// sensor-api migrate --config config.json --from redis --to sqlite --to-path readings.db
+// The devices copied are recorded in the checkpoint file, a migration started again skips them. It exits with 1 when
+// the consistency check finds a device whose readings differ between the backends.
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	redisAddress := flags.String("redis-url", "localhost:6379", "Redis server address")
+	redisPassword := flags.String("redis-password", os.Getenv("REDIS_PASSWORD"), "Redis server password")
+	configPath := flags.String("config", "", "Path to the JSON configuration file, with the shards and the settings of the backends")
+	from := flags.String("from", "redis", "Backend copied: redis, sqlite, bolt or clickhouse")
+	to := flags.String("to", "", "Backend the readings are copied to: redis, sqlite, bolt or clickhouse")
+	fromPath := flags.String("from-path", "", "Database file of a sqlite or bolt source, the configured one by default")
+	toPath := flags.String("to-path", "", "Database file of a sqlite or bolt destination, the configured one by default")
+	checkpointPath := flags.String("checkpoint", "migrate.checkpoint", "File recording the devices copied, to resume an interrupted migration")
+	concurrency := flags.Int("concurrency", 16, "Number of readings saved at once")
+	verify := flags.Bool("verify", true, "Compares the readings of every device in both backends once copied")
+
+	flags.Parse(args)
+
+	if *to == "" || *to == *from {
+		log.Fatalf("-to must be a backend other than -from %s", *from)
+	}
+
+	if *concurrency < 1 {
+		log.Fatalf("concurrency must be positive")
+	}
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	source, err := openBackendStore(*from, *fromPath, config, *redisAddress, *redisPassword)
+
+	if err != nil {
+		log.Fatalf("Failed to open the %s source: %v", *from, err)
+	}
+
+	destination, err := openBackendStore(*to, *toPath, config, *redisAddress, *redisPassword)
+
+	if err != nil {
+		log.Fatalf("Failed to open the %s destination: %v", *to, err)
+	}
+
+	ctx := context.Background()
+	ids, err := source.Devices(ctx)
+
+	if err != nil {
+		log.Fatalf("Failed to list the devices of the source: %v", err)
+	}
+
+	// The devices are copied in a stable order, the checkpoint lets a new run skip the ones done.
+	sort.Strings(ids)
+	done, err := readCheckpoint(*checkpointPath)
+
+	if err != nil {
+		log.Fatalf("Failed to read the checkpoint %s: %v", *checkpointPath, err)
+	}
+
+	checkpoint, err := os.OpenFile(*checkpointPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+
+	if err != nil {
+		log.Fatalf("Failed to open the checkpoint %s: %v", *checkpointPath, err)
+	}
+
+	defer checkpoint.Close()
+
+	log.Printf("Copying the readings of %d devices from %s to %s, %d done already", len(ids), *from, *to, len(done))
+	start, lastProgress := time.Now(), time.Now()
+	copied := 0
+
+	for i, deviceId := range ids {
+		if done[deviceId] {
+			continue
+		}
+
+		readings, err := migrateDevice(ctx, source, destination, deviceId, *concurrency)
+
+		if err != nil {
+			log.Fatalf("Migration stopped at device %s, run it again to resume: %v", deviceId, err)
+		}
+
+		if _, err := fmt.Fprintln(checkpoint, deviceId); err != nil {
+			log.Fatalf("Failed to record device %s in the checkpoint: %v", deviceId, err)
+		}
+
+		copied += readings
+
+		if time.Since(lastProgress) >= migrateProgressInterval {
+			lastProgress = time.Now()
+			log.Printf("%d/%d devices, %d readings copied, %.0f readings/s", i+1, len(ids), copied, float64(copied)/time.Since(start).Seconds())
+		}
+	}
+
+	log.Printf("%d devices, %d readings copied in %v", len(ids), copied, time.Since(start).Round(time.Second))
+
+	if !*verify {
+		return
+	}
+
+	report, err := verifyMigration(ctx, source, destination, ids)
+
+	if err != nil {
+		log.Fatalf("Consistency check failed: %v", err)
+	}
+
+	if printMigrationReport(os.Stdout, report) {
+		os.Exit(1)
+	}
+}
+
+// openBackendStore opens the store of a backend for the migrate and bench commands, with the settings of the
+// configuration when it is the configured backend or the secondary of its dual writes
+func openBackendStore(backend, path string, config *Config, redisAddress, redisPassword string) (Store, error) {
+	if backend == "redis" {
+		if len(config.Shards) > 0 {
+			return newShardedStore(config.Shards, config.Redis, 0)
+		}
+
+		rdb, err := getRedisClient(config.Redis, redisPassword, redisAddress)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return newRedisStore(rdb), nil
+	}
+
+	storage := StorageConfig{Backend: backend}
+	configured := []StorageConfig{config.Storage}
+
+	if config.Storage.DualWrite != nil {
+		configured = append(configured, config.Storage.DualWrite.Secondary)
+	}
+
+	for _, candidate := range configured {
+		if candidate.Backend == backend {
+			storage = candidate
+			storage.DualWrite = nil
+		}
+	}
+
+	if path != "" {
+		storage.Path = path
+	}
+
+	return newBackendStore(storage)
+}
+
+// migrateDevice copies the readings of the device, concurrently since the stores keep the latest one by its time.
+// A reading copied twice is stored once, a device is copied again from its start after an interruption.
+func migrateDevice(ctx context.Context, source, destination Store, deviceId string, concurrency int) (int, error) {
+	history, err := source.Range(ctx, deviceId, time.UnixMilli(0), time.Now())
+
+	if err != nil {
+		return 0, err
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(concurrency)
+
+	for i := range history {
+		sensorData := &history[i]
+		group.Go(func() error {
+			return destination.Save(ctx, sensorData)
+		})
+	}
+
+	return len(history), group.Wait()
+}
+
+// readCheckpoint returns the devices recorded in the checkpoint, none when it doesn't exist yet
+func readCheckpoint(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	file, err := os.Open(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		if deviceId := strings.TrimSpace(scanner.Text()); deviceId != "" {
+			done[deviceId] = true
+		}
+	}
+
+	return done, scanner.Err()
+}
+
+// verifyMigration compares the history and the latest reading of every device in both stores
+func verifyMigration(ctx context.Context, source, destination Store, ids []string) (*migrationReport, error) {
+	report := &migrationReport{devices: len(ids)}
+	now := time.Now()
+
+	for _, deviceId := range ids {
+		expected, err := source.Range(ctx, deviceId, time.UnixMilli(0), now)
+
+		if err != nil {
+			return nil, err
+		}
+
+		actual, err := destination.Range(ctx, deviceId, time.UnixMilli(0), now)
+
+		if err != nil {
+			return nil, err
+		}
+
+		report.readings += len(expected)
+
+		if string(resultJSON(expected)) != string(resultJSON(actual)) {
+			report.mismatches = append(report.mismatches, fmt.Sprintf("%s: %d readings in the source, %d in the destination", deviceId, len(expected), len(actual)))
+			continue
+		}
+
+		expectedLatest, err := source.Latest(ctx, deviceId)
+
+		if err != nil && !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+
+		actualLatest, err := destination.Latest(ctx, deviceId)
+
+		if err != nil && !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+
+		if string(resultJSON(expectedLatest)) != string(resultJSON(actualLatest)) {
+			report.mismatches = append(report.mismatches, fmt.Sprintf("%s: the latest readings differ", deviceId))
+		}
+	}
+
+	return report, nil
+}
+
+// printMigrationReport prints the consistency report, it reports whether a device differs
+func printMigrationReport(w io.Writer, report *migrationReport) bool {
+	fmt.Fprintf(w, "devices: %d\nreadings: %d\nmismatching devices: %d\n", report.devices, report.readings, len(report.mismatches))
+
+	for i, mismatch := range report.mismatches {
+		if i == maxReportedMismatches {
+			fmt.Fprintf(w, "  ... and %d more\n", len(report.mismatches)-maxReportedMismatches)
+			break
+		}
+
+		fmt.Fprintf(w, "  %s\n", mismatch)
+	}
+
+	return len(report.mismatches) > 0
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// ModbusConfig configures the client reading PLC-attached sensors over Modbus TCP.
+type ModbusConfig struct {
+	Interval Duration       `json:"interval"` // Polling interval of the devices, 1 minute by default
+	Timeout  Duration       `json:"timeout"`  // Timeout of a single read, 5 seconds by default
+	Devices  []ModbusDevice `json:"devices"`  // Devices to read, the client is disabled when empty
+}
+
+// ModbusDevice maps the registers of a Modbus slave into the sensor data of a device.
+type ModbusDevice struct {
+	Address    string          `json:"address"`     // host:port of the Modbus TCP server, port 502 by default
+	SlaveId    byte            `json:"slave_id"`    // Unit identifier of the slave
+	DeviceId   string          `json:"device_id"`   // Device id the readings are stored under
+	DeviceType string          `json:"device_type"` // Device type of the readings
+	Temp       ModbusRegister  `json:"temp"`        // Register holding the temperature
+	Uptime     *ModbusRegister `json:"uptime"`      // Register holding the uptime in seconds, optional
+	Interval   Duration        `json:"interval"`    // Overrides the client polling interval
+}
+
+// ModbusRegister describes where a value lives and how it is encoded.
+type ModbusRegister struct {
+	Address   uint16  `json:"address"`    // Address of the first register
+	Table     string  `json:"table"`      // "holding" (default) or "input" registers
+	Format    string  `json:"format"`     // "int16" (default), "uint16", "int32", "uint32" or "float32"
+	SwapWords bool    `json:"swap_words"` // Low word first for the 32 bits formats
+	Scale     float64 `json:"scale"`      // Factor applied to the raw value, 1 by default
+}
+
+// modbusCollector reads the configured Modbus devices and ingests their readings.
+type modbusCollector struct {
+	config ModbusConfig
+	ing    *ingester
+}
+
+// newModbusCollector validates the configuration and applies its defaults
+func newModbusCollector(config ModbusConfig, ing *ingester) (*modbusCollector, error) {
+	if config.Interval <= 0 {
+		config.Interval = Duration(time.Minute)
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = Duration(5 * time.Second)
+	}
+
+	devices := make([]ModbusDevice, len(config.Devices))
+
+	for i, device := range config.Devices {
+		if device.Address == "" || device.DeviceId == "" {
+			return nil, fmt.Errorf("modbus device %d must have an address and a device_id", i)
+		}
+
+		if _, _, err := net.SplitHostPort(device.Address); err != nil {
+			device.Address = net.JoinHostPort(device.Address, "502")
+		}
+
+		if err := device.Temp.applyDefaults(); err != nil {
+			return nil, fmt.Errorf("modbus device %s temp register: %w", device.DeviceId, err)
+		}
+
+		if device.Uptime != nil {
+			if err := device.Uptime.applyDefaults(); err != nil {
+				return nil, fmt.Errorf("modbus device %s uptime register: %w", device.DeviceId, err)
+			}
+		}
+
+		if device.Interval <= 0 {
+			device.Interval = config.Interval
+		}
+
+		devices[i] = device
+	}
+
+	config.Devices = devices
+
+	return &modbusCollector{config: config, ing: ing}, nil
+}
+
+// applyDefaults validates the register and fills its unset fields
+func (r *ModbusRegister) applyDefaults() error {
+	if r.Table == "" {
+		r.Table = "holding"
+	}
+
+	if r.Table != "holding" && r.Table != "input" {
+		return fmt.Errorf("unsupported table %s", r.Table)
+	}
+
+	if r.Format == "" {
+		r.Format = "int16"
+	}
+
+	if r.quantity() == 0 {
+		return fmt.Errorf("unsupported format %s", r.Format)
+	}
+
+	if r.Scale == 0 {
+		r.Scale = 1
+	}
+
+	return nil
+}
+
+// quantity returns the number of 16 bits registers the value spans, 0 for an unknown format
+func (r ModbusRegister) quantity() uint16 {
+	switch r.Format {
+	case "int16", "uint16":
+		return 1
+	case "int32", "uint32", "float32":
+		return 2
+	}
+
+	return 0
+}
+
+// decode converts the raw register bytes into the scaled value
+func (r ModbusRegister) decode(raw []byte) (float64, error) {
+	if len(raw) != int(r.quantity())*2 {
+		return 0, fmt.Errorf("expected %d bytes, got %d", r.quantity()*2, len(raw))
+	}
+
+	if r.SwapWords && len(raw) == 4 {
+		raw = []byte{raw[2], raw[3], raw[0], raw[1]}
+	}
+
+	value, err := decodeNumber(r.Format, raw, binary.BigEndian)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return value * r.Scale, nil
+}
+
+// run reads every device on its interval until the context is cancelled
+func (c *modbusCollector) run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, device := range c.config.Devices {
+		wg.Add(1)
+
+		go func(device ModbusDevice) {
+			defer wg.Done()
+
+			pollOnInterval(ctx, time.Duration(device.Interval), "Modbus read of device "+device.DeviceId, func(ctx context.Context) error {
+				return c.poll(ctx, device)
+			})
+		}(device)
+	}
+
+	wg.Wait()
+}
+
+// poll reads the device registers and ingests them as a reading
+func (c *modbusCollector) poll(ctx context.Context, device ModbusDevice) error {
+	handler := modbus.NewTCPClientHandler(device.Address)
+	handler.Timeout = time.Duration(c.config.Timeout)
+	handler.SlaveId = device.SlaveId
+
+	if err := handler.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", device.Address, err)
+	}
+
+	defer handler.Close()
+
+	client := modbus.NewClient(handler)
+
+	temp, err := readModbusRegister(client, device.Temp)
+
+	if err != nil {
+		return fmt.Errorf("failed to read the temperature from %s: %w", device.Address, err)
+	}
+
+	sensorData := &SensorData{
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		DeviceId:   device.DeviceId,
+		DeviceType: device.DeviceType,
+		Temp:       float32(temp),
+	}
+
+	if device.Uptime != nil {
+		uptime, err := readModbusRegister(client, *device.Uptime)
+
+		if err != nil {
+			return fmt.Errorf("failed to read the uptime from %s: %w", device.Address, err)
+		}
+
+		sensorData.Uptime = int(uptime)
+	}
+
+	return c.ing.ingest(ctx, sensorData)
+}
+
+// readModbusRegister reads and decodes the value of the register
+func readModbusRegister(client modbus.Client, register ModbusRegister) (float64, error) {
+	var raw []byte
+	var err error
+
+	if register.Table == "input" {
+		raw, err = client.ReadInputRegisters(register.Address, register.quantity())
+	} else {
+		raw, err = client.ReadHoldingRegisters(register.Address, register.quantity())
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return register.decode(raw)
+}
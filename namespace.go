@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keylessCommands are the Redis commands sent by the API without any key among their arguments.
+var keylessCommands = map[string]bool{
+	"auth": true, "client": true, "command": true, "dbsize": true, "discard": true, "echo": true, "exec": true,
+	"hello": true, "info": true, "multi": true, "ping": true, "quit": true, "readonly": true, "script": true,
+	"select": true, "time": true, "unwatch": true,
+}
+
+// namespaceHook prefixes the keys of every command with the namespace, so the API shares a Redis with other
+// applications, and removes it from the keys listed by SCAN. The code keeps using the bare key names.
+type namespaceHook struct {
+	prefix string
+}
+
+// newRedisClient returns a client of the Redis with the options, its keys in the namespace when set
+func newRedisClient(options *redis.Options, namespace string) *redis.Client {
+	rdb := redis.NewClient(options)
+
+	if namespace != "" {
+		rdb.AddHook(namespaceHook{prefix: namespace + ":"})
+	}
+
+	return rdb
+}
+
+// validateNamespace checks the namespace can't be mistaken for a key pattern
+func validateNamespace(namespace string) error {
+	if namespace != "" && (!idPattern.MatchString(namespace) || strings.ContainsAny(namespace, "*?[]")) {
+		return fmt.Errorf("Redis namespace %q must be 1 to 64 letters, digits, '_', '.' or '-'", namespace)
+	}
+
+	return nil
+}
+
+// DialHook leaves the connections as they are
+func (h namespaceHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook prefixes the keys of a command
+func (h namespaceHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.prefixKeys(cmd)
+		err := next(ctx, cmd)
+		h.stripKeys(cmd)
+
+		return err
+	}
+}
+
+// ProcessPipelineHook prefixes the keys of the commands of a pipeline or a transaction
+func (h namespaceHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			h.prefixKeys(cmd)
+		}
+
+		err := next(ctx, cmds)
+
+		for _, cmd := range cmds {
+			h.stripKeys(cmd)
+		}
+
+		return err
+	}
+}
+
+// prefixKeys prefixes the key arguments of the command, the first one unless the command is known to differ
+func (h namespaceHook) prefixKeys(cmd redis.Cmder) {
+	args := cmd.Args()
+	name := cmd.Name()
+
+	switch {
+	case keylessCommands[name]:
+	case name == "del" || name == "exists" || name == "unlink" || name == "touch" || name == "watch" || name == "mget" || name == "rename" || name == "renamenx":
+		h.prefixArgs(args, 1, len(args))
+	case name == "blpop" || name == "brpop":
+		// The timeout follows the keys.
+		h.prefixArgs(args, 1, len(args)-1)
+	case name == "eval" || name == "evalsha" || name == "eval_ro" || name == "evalsha_ro":
+		// The script or its hash, then the number of keys before the keys.
+		if len(args) > 2 {
+			if keys, ok := args[2].(int); ok {
+				h.prefixArgs(args, 3, 3+keys)
+			}
+		}
+	case name == "scan":
+		// The iterator sends the same command again for the next pages, its pattern is prefixed once.
+		for i := 2; i+1 < len(args); i += 2 {
+			if option, _ := args[i].(string); strings.EqualFold(option, "match") {
+				if pattern, ok := args[i+1].(string); ok && !strings.HasPrefix(pattern, h.prefix) {
+					args[i+1] = h.prefix + pattern
+				}
+			}
+		}
+	default:
+		h.prefixArgs(args, 1, 2)
+	}
+}
+
+// prefixArgs prefixes the string arguments from the start to the end index
+func (h namespaceHook) prefixArgs(args []interface{}, start, end int) {
+	for i := start; i < end && i < len(args); i++ {
+		if key, ok := args[i].(string); ok {
+			args[i] = h.prefix + key
+		}
+	}
+}
+
+// stripKeys removes the namespace from the keys listed by SCAN, which the API passes to other commands
+func (h namespaceHook) stripKeys(cmd redis.Cmder) {
+	scan, ok := cmd.(*redis.ScanCmd)
+
+	if !ok || scan.Err() != nil {
+		return
+	}
+
+	page, cursor := scan.Val()
+
+	for i, key := range page {
+		page[i] = strings.TrimPrefix(key, h.prefix)
+	}
+
+	scan.SetVal(page, cursor)
+}
+
+// runMigrateKeys renames the keys of the main Redis and of the shards into the namespace of the configuration, once
+// for the deployments started before it was set, e.g.
+// sensor-api migrate-keys --config config.json
+// It must run while the API is stopped and before the Redis is shared, every key outside the namespace is moved.
+func runMigrateKeys(args []string) {
+	flags := flag.NewFlagSet("migrate-keys", flag.ExitOnError)
+	redisAddress := flags.String("redis-url", "localhost:6379", "Redis server address")
+	redisPassword := flags.String("redis-password", os.Getenv("REDIS_PASSWORD"), "Redis server password")
+	configPath := flags.String("config", "", "Path to the JSON configuration file, with the namespace and the shards")
+	dryRun := flags.Bool("dry-run", false, "Counts the keys to rename without renaming them")
+
+	flags.Parse(args)
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	if config.Redis.Namespace == "" {
+		log.Fatalf("The configuration has no Redis namespace to move the keys into")
+	}
+
+	// The clients have no namespace, the bare keys are listed and renamed.
+	options, err := config.Redis.options(*redisAddress, *redisPassword)
+
+	if err != nil {
+		log.Fatalf("Failed to initialize Redis client: %v", err)
+	}
+
+	clients := map[string]*redis.Client{*redisAddress: redis.NewClient(options)}
+
+	for _, shard := range config.Shards {
+		shardOptions, err := config.Redis.options(shard.Address, shard.Password)
+
+		if err != nil {
+			log.Fatalf("Failed to initialize Redis client of shard %s: %v", shard.Address, err)
+		}
+
+		clients[shard.Address] = redis.NewClient(shardOptions)
+	}
+
+	ctx := context.Background()
+
+	for address, rdb := range clients {
+		renamed, conflicts, err := migrateKeys(ctx, rdb, config.Redis.Namespace+":", *dryRun)
+
+		if err != nil {
+			log.Fatalf("Renaming of the keys of %s stopped after %d, run it again to resume: %v", address, renamed, err)
+		}
+
+		if *dryRun {
+			log.Printf("%s: %d keys to rename", address, renamed)
+		} else {
+			log.Printf("%s: %d keys renamed, %d left as they exist in the namespace already", address, renamed, conflicts)
+		}
+	}
+}
+
+// migrateKeys renames the keys without the prefix, a key existing with the prefix already isn't overwritten
+func migrateKeys(ctx context.Context, rdb *redis.Client, prefix string, dryRun bool) (int, int, error) {
+	renamed, conflicts := 0, 0
+	iter := rdb.Scan(ctx, 0, "*", 1000).Iterator()
+
+	for iter.Next(ctx) {
+		key := iter.Val()
+
+		if strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if dryRun {
+			renamed++
+			continue
+		}
+
+		moved, err := rdb.RenameNX(ctx, key, prefix+key).Result()
+
+		if err == redis.Nil || err != nil && strings.HasPrefix(err.Error(), "ERR no such key") {
+			// Expired since it was listed.
+			continue
+		}
+
+		if err != nil {
+			return renamed, conflicts, err
+		}
+
+		if !moved {
+			log.Printf("Key %s left, %s exists already", key, prefix+key)
+			conflicts++
+			continue
+		}
+
+		renamed++
+	}
+
+	return renamed, conflicts, iter.Err()
+}
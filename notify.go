@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	alertEventFired    = "fired"
+	alertEventResolved = "resolved"
+	// notificationTimeout bounds the time spent delivering a notification.
+	notificationTimeout = 10 * time.Second
+)
+
+// defaultNotificationTemplate is the message of the notifiers without a template.
+const defaultNotificationTemplate = `{{if .Alert.Severity}}[{{.Alert.Severity}}] {{end}}Alert {{.Rule.Name}} {{.Event}} on device {{.Device.Id}}: {{.Alert.Condition}}, value {{.Value}}`
+
+// defaultNotificationSubject is the subject of the emails without a subject template.
+const defaultNotificationSubject = `Alert {{.Rule.Name}} {{.Event}} on device {{.Device.Id}}`
+
+// NotifierConfig defines a channel notified when an alert fires or resolves.
+//
+// The message is a Go template (text/template) over a Notification, e.g.
+//
+//	{{.Rule.Name}}: {{.Device.Id}} in {{index .Device.Labels "zone"}} reads {{printf "%.1f" .Value}}
+type NotifierConfig struct {
+	Name     string   `json:"name"`     // Name of the notifier in the logs
+	Type     string   `json:"type"`     // "webhook", "slack" or "email"
+	URL      string   `json:"url"`      // Endpoint of the webhook or Slack incoming webhook
+	Rules    []string `json:"rules"`    // Rules notified, all when empty
+	Template string   `json:"template"` // Message, the JSON notification is posted to webhooks without a template
+	Subject  string   `json:"subject"`  // Subject template of the emails
+
+	ContentType string `json:"content_type"` // Content type of the templated webhook bodies, application/json by default
+
+	SMTPAddress  string   `json:"smtp_address"`  // SMTP server as host:port
+	SMTPUsername string   `json:"smtp_username"` // Anonymous when empty
+	SMTPPassword string   `json:"smtp_password"` // Password of the SMTP user
+	From         string   `json:"from"`          // Sender of the emails
+	To           []string `json:"to"`            // Recipients of the emails
+}
+
+// Notification is what the templates render: the alert, the rule that fired it and the device.
+type Notification struct {
+	Event  string             `json:"event"` // "fired" or "resolved"
+	Alert  *Alert             `json:"alert"`
+	Rule   AlertRuleConfig    `json:"rule"`
+	Device NotificationDevice `json:"device"`
+	Value  float64            `json:"value"` // Value of the reading that fired or resolved the alert
+	Time   string             `json:"time"`  // Time of the reading
+}
+
+// NotificationDevice is the metadata of the device of a notification.
+type NotificationDevice struct {
+	Id       string            `json:"id"`
+	Type     string            `json:"type"`
+	Firmware string            `json:"firmware,omitempty"`
+	Labels   map[string]string `json:"labels"`
+	Groups   []string          `json:"groups"`
+}
+
+// notifier is a validated notification channel with its templates parsed.
+type notifier struct {
+	NotifierConfig
+	rules   map[string]bool
+	message *template.Template
+	subject *template.Template
+	client  *http.Client
+}
+
+// newNotifier validates the notifier and parses its templates, the rules it refers to must be among the rule names
+func newNotifier(config NotifierConfig, index int, ruleNames map[string]bool) (*notifier, error) {
+	if config.Name == "" {
+		config.Name = fmt.Sprintf("notifier-%d", index)
+	}
+
+	switch config.Type {
+	case "webhook", "slack":
+		if !strings.HasPrefix(config.URL, "http://") && !strings.HasPrefix(config.URL, "https://") {
+			return nil, fmt.Errorf("notifier %s must have an http or https url", config.Name)
+		}
+	case "email":
+		if config.SMTPAddress == "" || config.From == "" || len(config.To) == 0 {
+			return nil, fmt.Errorf("notifier %s must have an smtp_address, a from and at least one to", config.Name)
+		}
+	default:
+		return nil, fmt.Errorf("type %q of notifier %s must be webhook, slack or email", config.Type, config.Name)
+	}
+
+	n := &notifier{NotifierConfig: config, client: &http.Client{Timeout: notificationTimeout}}
+
+	if len(config.Rules) > 0 {
+		n.rules = make(map[string]bool, len(config.Rules))
+
+		for _, rule := range config.Rules {
+			if !ruleNames[rule] {
+				return nil, fmt.Errorf("notifier %s refers to the undefined alert rule %s", config.Name, rule)
+			}
+
+			n.rules[rule] = true
+		}
+	}
+
+	message := config.Template
+
+	// Webhooks without a template receive the notification as JSON.
+	if message == "" && config.Type != "webhook" {
+		message = defaultNotificationTemplate
+	}
+
+	var err error
+
+	if message != "" {
+		if n.message, err = template.New(config.Name).Option("missingkey=zero").Parse(message); err != nil {
+			return nil, fmt.Errorf("failed to parse the template of notifier %s: %w", config.Name, err)
+		}
+	}
+
+	if config.Type == "email" {
+		subject := config.Subject
+
+		if subject == "" {
+			subject = defaultNotificationSubject
+		}
+
+		if n.subject, err = template.New(config.Name + "-subject").Option("missingkey=zero").Parse(subject); err != nil {
+			return nil, fmt.Errorf("failed to parse the subject template of notifier %s: %w", config.Name, err)
+		}
+	}
+
+	if n.ContentType == "" {
+		n.ContentType = "application/json"
+	}
+
+	return n, nil
+}
+
+// notify sends the notification of the alert event to the notifiers of its rule in the background
+func (a *alerter) notify(ctx context.Context, event string, alert *Alert, rule *alertRule, sensorData *SensorData, value float64, target *alertTarget) {
+	if len(a.notifiers) == 0 {
+		return
+	}
+
+	notification := &Notification{
+		Event: event,
+		Alert: alert,
+		Rule:  rule.AlertRuleConfig,
+		Value: value,
+		Time:  sensorData.Time,
+		Device: NotificationDevice{
+			Id:       sensorData.DeviceId,
+			Type:     sensorData.DeviceType,
+			Firmware: sensorData.Firmware,
+		},
+	}
+
+	// Missing metadata only leaves it out of the message.
+	if labels, err := target.Labels(ctx); err == nil {
+		notification.Device.Labels = labels
+	} else {
+		log.Printf("Labels of device %s missing from the notifications: %v", sensorData.DeviceId, err)
+	}
+
+	if groups, err := target.Groups(ctx); err == nil {
+		notification.Device.Groups = groups
+	} else {
+		log.Printf("Groups of device %s missing from the notifications: %v", sensorData.DeviceId, err)
+	}
+
+	for _, n := range a.notifiers {
+		if n.rules != nil && !n.rules[rule.Name] {
+			continue
+		}
+
+		go func(n *notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+			defer cancel()
+
+			if err := n.send(ctx, notification); err != nil {
+				log.Printf("Notifier %s failed to notify alert %s: %v", n.Name, alert.Id, err)
+			}
+		}(n)
+	}
+}
+
+// render executes the template on the notification
+func render(tmpl *template.Template, notification *Notification) (string, error) {
+	var out bytes.Buffer
+
+	if err := tmpl.Execute(&out, notification); err != nil {
+		return "", fmt.Errorf("failed to render template %s: %w", tmpl.Name(), err)
+	}
+
+	return out.String(), nil
+}
+
+// send delivers the notification through the channel of the notifier
+func (n *notifier) send(ctx context.Context, notification *Notification) error {
+	var message string
+
+	if n.message != nil {
+		var err error
+
+		if message, err = render(n.message, notification); err != nil {
+			return err
+		}
+	}
+
+	switch n.Type {
+	case "webhook":
+		if n.message == nil {
+			body, err := json.Marshal(notification)
+
+			if err != nil {
+				return fmt.Errorf("unable to encode the notification: %w", err)
+			}
+
+			return n.post(ctx, "application/json", body)
+		}
+
+		return n.post(ctx, n.ContentType, []byte(message))
+	case "slack":
+		body, err := json.Marshal(map[string]string{"text": message})
+
+		if err != nil {
+			return fmt.Errorf("unable to encode the notification: %w", err)
+		}
+
+		return n.post(ctx, "application/json", body)
+	case "email":
+		subject, err := render(n.subject, notification)
+
+		if err != nil {
+			return err
+		}
+
+		return n.mail(subject, message)
+	}
+
+	return nil
+}
+
+// post sends the body to the url of the notifier
+func (n *notifier) post(ctx context.Context, contentType string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", contentType)
+	response, err := n.client.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", n.URL, response.Status)
+	}
+
+	return nil
+}
+
+// mail sends the message to the recipients of the notifier
+func (n *notifier) mail(subject, message string) error {
+	var auth smtp.Auth
+
+	if n.SMTPUsername != "" {
+		host, _, _ := strings.Cut(n.SMTPAddress, ":")
+		auth = smtp.PlainAuth("", n.SMTPUsername, n.SMTPPassword, host)
+	}
+
+	// Line breaks in the rendered subject would inject headers.
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", n.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject)
+	body.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(message, "\n", "\r\n"))
+
+	return smtp.SendMail(n.SMTPAddress, auth, n.From, n.To, []byte(body.String()))
+}
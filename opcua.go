@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// OPCUAConfig configures the client subscribing to industrial OPC UA servers.
+type OPCUAConfig struct {
+	Servers []OPCUAServer `json:"servers"` // Servers to subscribe to, the client is disabled when empty
+}
+
+// OPCUAServer describes a server connection and the nodes to monitor on it.
+type OPCUAServer struct {
+	Endpoint       string      `json:"endpoint"`        // Endpoint URL, e.g. "opc.tcp://plc-1:4840"
+	SecurityPolicy string      `json:"security_policy"` // "None" (default), "Basic256Sha256"...
+	SecurityMode   string      `json:"security_mode"`   // "None" (default), "Sign" or "SignAndEncrypt"
+	CertFile       string      `json:"cert_file"`       // Client certificate, required by a secure policy
+	KeyFile        string      `json:"key_file"`        // Client private key, required by a secure policy
+	Username       string      `json:"username"`        // Anonymous authentication when empty
+	Password       string      `json:"password"`        // Password of the user
+	Interval       Duration    `json:"interval"`        // Publishing interval of the subscription, 1 second by default
+	RetryInterval  Duration    `json:"retry_interval"`  // Delay before reconnecting after a failure, 10 seconds by default
+	Nodes          []OPCUANode `json:"nodes"`           // Nodes whose value changes become readings
+}
+
+// OPCUANode maps the value of a node to the temperature of a device.
+type OPCUANode struct {
+	NodeId     string  `json:"node_id"`     // Node id, e.g. "ns=2;s=Oven1.Temperature"
+	DeviceId   string  `json:"device_id"`   // Device id the readings are stored under
+	DeviceType string  `json:"device_type"` // Device type of the readings
+	Scale      float64 `json:"scale"`       // Factor applied to the value, 1 by default
+}
+
+// opcuaCollector subscribes to the configured nodes and ingests their value changes.
+type opcuaCollector struct {
+	config OPCUAConfig
+	ing    *ingester
+}
+
+// newOPCUACollector validates the configuration and applies its defaults
+func newOPCUACollector(config OPCUAConfig, ing *ingester) (*opcuaCollector, error) {
+	servers := make([]OPCUAServer, len(config.Servers))
+
+	for i, server := range config.Servers {
+		if server.Endpoint == "" || len(server.Nodes) == 0 {
+			return nil, fmt.Errorf("opcua server %d must have an endpoint and nodes", i)
+		}
+
+		if server.SecurityPolicy == "" {
+			server.SecurityPolicy = "None"
+		}
+
+		if server.SecurityMode == "" {
+			server.SecurityMode = "None"
+		}
+
+		if server.Interval <= 0 {
+			server.Interval = Duration(time.Second)
+		}
+
+		if server.RetryInterval <= 0 {
+			server.RetryInterval = Duration(10 * time.Second)
+		}
+
+		nodes := make([]OPCUANode, len(server.Nodes))
+
+		for j, node := range server.Nodes {
+			if node.DeviceId == "" {
+				return nil, fmt.Errorf("opcua node %s of %s must have a device_id", node.NodeId, server.Endpoint)
+			}
+
+			if _, err := ua.ParseNodeID(node.NodeId); err != nil {
+				return nil, fmt.Errorf("opcua node %s of %s is invalid: %w", node.NodeId, server.Endpoint, err)
+			}
+
+			if node.Scale == 0 {
+				node.Scale = 1
+			}
+
+			nodes[j] = node
+		}
+
+		server.Nodes = nodes
+		servers[i] = server
+	}
+
+	config.Servers = servers
+
+	return &opcuaCollector{config: config, ing: ing}, nil
+}
+
+// run keeps a subscription open on every server until the context is cancelled
+func (c *opcuaCollector) run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, server := range c.config.Servers {
+		wg.Add(1)
+
+		go func(server OPCUAServer) {
+			defer wg.Done()
+
+			for {
+				err := c.subscribe(ctx, server)
+
+				if ctx.Err() != nil {
+					return
+				}
+
+				log.Printf("OPC UA subscription to %s failed, reconnecting in %v: %v", server.Endpoint, time.Duration(server.RetryInterval), err)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(server.RetryInterval)):
+				}
+			}
+		}(server)
+	}
+
+	wg.Wait()
+}
+
+// subscribe connects to the server and ingests the value changes of its nodes until the session fails
+func (c *opcuaCollector) subscribe(ctx context.Context, server OPCUAServer) error {
+	opts := []opcua.Option{
+		opcua.SecurityPolicy(server.SecurityPolicy),
+		opcua.SecurityModeString(server.SecurityMode),
+		opcua.AutoReconnect(false),
+	}
+
+	if server.CertFile != "" {
+		opts = append(opts, opcua.CertificateFile(server.CertFile), opcua.PrivateKeyFile(server.KeyFile))
+	}
+
+	if server.Username != "" {
+		opts = append(opts, opcua.AuthUsername(server.Username, server.Password))
+	} else {
+		opts = append(opts, opcua.AuthAnonymous())
+	}
+
+	client, err := opcua.NewClient(server.Endpoint, opts...)
+
+	if err != nil {
+		return fmt.Errorf("invalid client configuration: %w", err)
+	}
+
+	if err := client.Connect(ctx); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+
+	defer client.Close(context.Background())
+
+	notifyCh := make(chan *opcua.PublishNotificationData)
+	subscription, err := client.Subscribe(ctx, &opcua.SubscriptionParameters{Interval: time.Duration(server.Interval)}, notifyCh)
+
+	if err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	defer subscription.Cancel(context.Background())
+
+	// The client handle of a monitored item is the index of its node.
+	requests := make([]*ua.MonitoredItemCreateRequest, len(server.Nodes))
+
+	for i, node := range server.Nodes {
+		nodeId, _ := ua.ParseNodeID(node.NodeId)
+		requests[i] = opcua.NewMonitoredItemCreateRequestWithDefaults(nodeId, ua.AttributeIDValue, uint32(i))
+	}
+
+	response, err := subscription.Monitor(ctx, ua.TimestampsToReturnBoth, requests...)
+
+	if err != nil {
+		return fmt.Errorf("failed to monitor the nodes: %w", err)
+	}
+
+	for i, result := range response.Results {
+		if result.StatusCode != ua.StatusOK {
+			log.Printf("OPC UA node %s of %s cannot be monitored: %v", server.Nodes[i].NodeId, server.Endpoint, result.StatusCode)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case notification := <-notifyCh:
+			if notification.Error != nil {
+				return notification.Error
+			}
+
+			changes, ok := notification.Value.(*ua.DataChangeNotification)
+
+			if !ok {
+				continue
+			}
+
+			for _, item := range changes.MonitoredItems {
+				if int(item.ClientHandle) >= len(server.Nodes) {
+					continue
+				}
+
+				node := server.Nodes[item.ClientHandle]
+
+				if err := c.ingestValue(ctx, node, item.Value); err != nil {
+					log.Printf("OPC UA value of node %s for device %s not ingested: %v", node.NodeId, node.DeviceId, err)
+				}
+			}
+		}
+	}
+}
+
+// ingestValue converts the value change of the node into a reading
+func (c *opcuaCollector) ingestValue(ctx context.Context, node OPCUANode, value *ua.DataValue) error {
+	if value == nil || value.Value == nil {
+		return errors.New("the notification has no value")
+	}
+
+	if value.Status != ua.StatusOK {
+		return fmt.Errorf("the value status is %v", value.Status)
+	}
+
+	temp, err := opcuaFloat(value.Value.Value())
+
+	if err != nil {
+		return err
+	}
+
+	timestamp := value.SourceTimestamp
+
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	return c.ing.ingest(ctx, &SensorData{
+		Time:       timestamp.UTC().Format(time.RFC3339),
+		DeviceId:   node.DeviceId,
+		DeviceType: node.DeviceType,
+		Temp:       float32(temp * node.Scale),
+	})
+}
+
+// opcuaFloat converts a numeric variant value into a float
+func opcuaFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case int8:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	}
+
+	return 0, fmt.Errorf("value of type %T is not numeric", value)
+}
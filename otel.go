@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+const (
+	// defaultOTelInterval is the time between two pushes to the collector without an interval setting.
+	defaultOTelInterval = time.Minute
+	// defaultOTelStaleAfter is the time a device without readings is still exported without a stale_after setting.
+	defaultOTelStaleAfter = 15 * time.Minute
+	// otelServiceName is the service.name of the metrics pushed.
+	otelServiceName = "sensor-data-api"
+)
+
+// OTelConfig pushes the temperature of every device as an OTLP gauge to an OpenTelemetry collector.
+type OTelConfig struct {
+	Endpoint   string            `json:"endpoint"`    // OTLP/HTTP URL of the collector, e.g. "http://otel-collector:4318", no export when empty
+	Headers    map[string]string `json:"headers"`     // Headers of the pushes, e.g. an API key of the collector
+	Interval   Duration          `json:"interval"`    // Time between two pushes, 1m by default
+	StaleAfter Duration          `json:"stale_after"` // Time a device without readings is still exported, 15m by default
+}
+
+// otelReading is the latest temperature of a device.
+type otelReading struct {
+	deviceType string
+	temp       float64
+	time       time.Time // Time of the reading, an earlier one arriving late doesn't replace it
+	receivedAt time.Time
+}
+
+// otelExporter keeps the latest temperature of the devices, observed by the gauge at every push.
+type otelExporter struct {
+	provider   *sdkmetric.MeterProvider
+	staleAfter time.Duration
+
+	mu     sync.Mutex
+	latest map[string]otelReading
+}
+
+// newOTelExporter starts pushing the temperature gauge to the collector, nil without an endpoint
+func newOTelExporter(config OTelConfig) (*otelExporter, error) {
+	if config.Endpoint == "" {
+		return nil, nil
+	}
+
+	if endpoint, err := url.Parse(config.Endpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("endpoint %q must be an http or https URL", config.Endpoint)
+	}
+
+	interval, staleAfter := time.Duration(config.Interval), time.Duration(config.StaleAfter)
+
+	if interval < 0 || staleAfter < 0 {
+		return nil, fmt.Errorf("interval %v and stale after %v must be positive", interval, staleAfter)
+	}
+
+	if interval == 0 {
+		interval = defaultOTelInterval
+	}
+
+	if staleAfter == 0 {
+		staleAfter = defaultOTelStaleAfter
+	}
+
+	exporter, err := otlpmetrichttp.New(context.Background(), otlpmetrichttp.WithEndpointURL(config.Endpoint), otlpmetrichttp.WithHeaders(config.Headers))
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the OTLP exporter: %w", err)
+	}
+
+	x := &otelExporter{staleAfter: staleAfter, latest: map[string]otelReading{}}
+	x.provider = sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(interval))),
+		sdkmetric.WithResource(resource.NewSchemaless(attribute.String("service.name", otelServiceName))),
+	)
+
+	_, err = x.provider.Meter("sensordataapi").Float64ObservableGauge(
+		"sensor.temperature",
+		metric.WithUnit("Cel"),
+		metric.WithDescription("Temperature of the latest reading of the device"),
+		metric.WithFloat64Callback(x.observe),
+	)
+
+	if err != nil {
+		x.provider.Shutdown(context.Background())
+		return nil, fmt.Errorf("unable to create the temperature gauge: %w", err)
+	}
+
+	return x, nil
+}
+
+// record keeps the temperature of the reading as the latest one of its device, unless a later reading was recorded
+func (x *otelExporter) record(sensorData *SensorData) {
+	if x == nil {
+		return
+	}
+
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return
+	}
+
+	reading := otelReading{deviceType: sensorData.DeviceType, temp: float64(sensorData.Temp), time: timestamp, receivedAt: time.Now()}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if latest, found := x.latest[sensorData.DeviceId]; found && latest.time.After(timestamp) {
+		return
+	}
+
+	x.latest[sensorData.DeviceId] = reading
+}
+
+// observe reports the latest temperature of the devices with a recent reading, the others are forgotten
+func (x *otelExporter) observe(ctx context.Context, observer metric.Float64Observer) error {
+	staleBefore := time.Now().Add(-x.staleAfter)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for deviceId, reading := range x.latest {
+		if reading.receivedAt.Before(staleBefore) {
+			delete(x.latest, deviceId)
+			continue
+		}
+
+		observer.Observe(reading.temp, metric.WithAttributes(
+			attribute.String("device_id", deviceId),
+			attribute.String("device_type", reading.deviceType),
+		))
+	}
+
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// sketchKeyPrefix prefixes the per-device, measurement and hour hash of the sketch bins.
+	sketchKeyPrefix = "sketch:"
+	// sketchBucket is the time resolution of the sketches, the ranges are widened to whole buckets.
+	sketchBucket = time.Hour
+	// sketchAccuracy is the relative accuracy of the estimated percentiles.
+	sketchAccuracy = 0.01
+	// sketchMinValue is the magnitude under which the values count as zero.
+	sketchMinValue = 1e-9
+)
+
+// sketchGamma is the ratio between the bounds of a bin, derived from the accuracy.
+var sketchGamma = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+
+// defaultPercentiles are the percentiles returned without a p parameter.
+var defaultPercentiles = []float64{50, 95, 99}
+
+// PercentilesConfig selects the measurements whose percentile sketches are maintained at ingest.
+//
+// The sketches bin the values on a logarithmic scale (DDSketch), so any percentile over
+// any range is estimated within 1% of the actual value from mergeable hourly sketches.
+type PercentilesConfig struct {
+	Metrics   []string `json:"metrics"`   // Measurements with percentiles, ["temp"] by default
+	Retention Duration `json:"retention"` // How long the hourly sketches are kept, 30 days by default
+}
+
+// percentilesReport is the estimated percentiles of a measurement of a device over a time range.
+type percentilesReport struct {
+	DeviceId    string             `json:"device_id"`
+	Metric      string             `json:"metric"`
+	From        time.Time          `json:"from"`
+	To          time.Time          `json:"to"`
+	Count       int64              `json:"count"`
+	Percentiles map[string]float64 `json:"percentiles"` // Estimated values by percentile, e.g. "p95", empty without values
+	Accuracy    float64            `json:"relative_accuracy"`
+}
+
+// sketch counts the values in bins growing exponentially, positive and negative values apart.
+type sketch struct {
+	positive map[int]int64
+	negative map[int]int64
+	zero     int64
+	count    int64
+}
+
+// sketchField returns the hash field of the bin of the value
+func sketchField(value float64) string {
+	if math.Abs(value) < sketchMinValue {
+		return "z"
+	}
+
+	index := int(math.Ceil(math.Log(math.Abs(value)) / math.Log(sketchGamma)))
+
+	if value < 0 {
+		return "n" + strconv.Itoa(index)
+	}
+
+	return "p" + strconv.Itoa(index)
+}
+
+// merge adds the bins stored in a hash to the sketch
+func (s *sketch) merge(fields map[string]string) {
+	for field, raw := range fields {
+		count, err := strconv.ParseInt(raw, 10, 64)
+
+		if err != nil || field == "" {
+			continue
+		}
+
+		switch {
+		case field == "z":
+			s.zero += count
+		case strings.HasPrefix(field, "p"):
+			index, _ := strconv.Atoi(field[1:])
+			s.positive[index] += count
+		case strings.HasPrefix(field, "n"):
+			index, _ := strconv.Atoi(field[1:])
+			s.negative[index] += count
+		default:
+			continue
+		}
+
+		s.count += count
+	}
+}
+
+// quantile estimates the value at the quantile, between 0 and 1
+func (s *sketch) quantile(q float64) float64 {
+	rank := int64(q * float64(s.count-1))
+	var seen int64
+
+	// The negative values come first, the largest magnitudes (highest bins) lowest.
+	negative := sortedBins(s.negative)
+
+	for i := len(negative) - 1; i >= 0; i-- {
+		if seen += s.negative[negative[i]]; seen > rank {
+			return -binValue(negative[i])
+		}
+	}
+
+	if seen += s.zero; seen > rank {
+		return 0
+	}
+
+	positive := sortedBins(s.positive)
+
+	for _, index := range positive {
+		if seen += s.positive[index]; seen > rank {
+			return binValue(index)
+		}
+	}
+
+	return binValue(positive[len(positive)-1])
+}
+
+// binValue returns the value representing a bin, within the accuracy of all its values
+func binValue(index int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+}
+
+// sortedBins returns the indexes of the bins in ascending order
+func sortedBins(bins map[int]int64) []int {
+	indexes := make([]int, 0, len(bins))
+
+	for index := range bins {
+		indexes = append(indexes, index)
+	}
+
+	sort.Ints(indexes)
+
+	return indexes
+}
+
+// sketchKey returns the key of the sketch of the measurement of the device for the bucket starting at the given time
+func sketchKey(deviceId, metric string, bucket time.Time) string {
+	return sketchKeyPrefix + deviceId + ":" + metric + ":" + strconv.FormatInt(bucket.Unix()/int64(sketchBucket/time.Second), 10)
+}
+
+// AddToSketch counts the value of a measurement of the device in the sketch of its bucket
+func (r *registry) AddToSketch(ctx context.Context, deviceId, metric string, timestamp time.Time, value float64, retention time.Duration) error {
+	bucket := timestamp.Truncate(sketchBucket)
+	ttl := time.Until(bucket.Add(retention + sketchBucket))
+
+	// Readings older than the retention are left out.
+	if ttl <= 0 {
+		return nil
+	}
+
+	key := sketchKey(deviceId, metric, bucket)
+	pipe := r.rdb.TxPipeline()
+	pipe.HIncrBy(ctx, key, sketchField(value), 1)
+	pipe.PExpire(ctx, key, ttl)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on updating the %s sketch of device %s in the cache: %v", metric, deviceId, err)
+	}
+
+	return nil
+}
+
+// Sketch merges the sketches of the measurement of the device of the buckets overlapping [from, to]
+func (r *registry) Sketch(ctx context.Context, deviceId, metric string, from, to time.Time) (*sketch, error) {
+	pipe := r.rdb.Pipeline()
+	var cmds []*redis.MapStringStringCmd
+
+	for bucket := from.Truncate(sketchBucket); !bucket.After(to); bucket = bucket.Add(sketchBucket) {
+		cmds = append(cmds, pipe.HGetAll(ctx, sketchKey(deviceId, metric, bucket)))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the %s sketches of device %s from the cache: %v", metric, deviceId, err)
+	}
+
+	merged := &sketch{positive: make(map[int]int64), negative: make(map[int]int64)}
+
+	for _, cmd := range cmds {
+		merged.merge(cmd.Val())
+	}
+
+	return merged, nil
+}
+
+// sketchRecorder maintains the percentile sketches of the configured measurements at ingest.
+type sketchRecorder struct {
+	metrics   []string
+	retention time.Duration
+	registry  *registry
+}
+
+// newSketchRecorder validates the configuration and applies its defaults
+func newSketchRecorder(config PercentilesConfig, reg *registry) (*sketchRecorder, error) {
+	if config.Metrics == nil {
+		config.Metrics = []string{"temp"}
+	}
+
+	for _, metric := range config.Metrics {
+		if !metricNamePattern.MatchString(metric) {
+			return nil, fmt.Errorf("metric name %q is invalid", metric)
+		}
+	}
+
+	if config.Retention <= 0 {
+		config.Retention = Duration(30 * 24 * time.Hour)
+	}
+
+	return &sketchRecorder{metrics: config.Metrics, retention: time.Duration(config.Retention), registry: reg}, nil
+}
+
+// record adds the configured measurements of the reading to the sketches of its device
+func (s *sketchRecorder) record(ctx context.Context, sensorData *SensorData) error {
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return err
+	}
+
+	measurements := sensorData.Measurements()
+
+	for _, metric := range s.metrics {
+		value, found := measurements[metric]
+
+		if !found {
+			continue
+		}
+
+		if err := s.registry.AddToSketch(ctx, sensorData.DeviceId, metric, timestamp, value, s.retention); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parsePercentiles reads the comma separated percentiles of the p query parameter, e.g. "50,95,99.9"
+func parsePercentiles(raw string) ([]float64, error) {
+	if raw == "" {
+		return defaultPercentiles, nil
+	}
+
+	var percentiles []float64
+
+	for _, part := range strings.Split(raw, ",") {
+		percentile, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(part), "p"), 64)
+
+		if err != nil || percentile < 0 || percentile > 100 {
+			return nil, fmt.Errorf("percentile %q must be a number between 0 and 100", part)
+		}
+
+		percentiles = append(percentiles, percentile)
+	}
+
+	return percentiles, nil
+}
+
+// getPercentiles estimates the percentiles of a measurement (temp by default) of the device over the time range
+func getPercentiles(c echo.Context, reg *registry) error {
+	deviceId := c.Param("id")
+	metric := c.QueryParam("metric")
+
+	if metric == "" {
+		metric = "temp"
+	}
+
+	if !metricNamePattern.MatchString(metric) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Metric name %q is invalid", metric))
+	}
+
+	percentiles, err := parsePercentiles(c.QueryParam("p"))
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	from, to, err := parseTimeRange(c, defaultQueryWindow)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	merged, err := reg.Sketch(c.Request().Context(), deviceId, metric, from, to)
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	report := percentilesReport{
+		DeviceId:    deviceId,
+		Metric:      metric,
+		From:        from.Truncate(sketchBucket),
+		To:          to.Truncate(sketchBucket).Add(sketchBucket),
+		Count:       merged.count,
+		Percentiles: make(map[string]float64),
+		Accuracy:    sketchAccuracy,
+	}
+
+	if merged.count > 0 {
+		for _, percentile := range percentiles {
+			report.Percentiles["p"+strconv.FormatFloat(percentile, 'f', -1, 64)] = merged.quantile(percentile / 100)
+		}
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultIngestStages are the stages of the ingest without a pipeline setting, in their order.
+var defaultIngestStages = []string{"validate", "enrich", "transform", "store", "publish"}
+
+// errDropReading is returned by a stage to stop the ingest of a reading without failing it, e.g. a reading filtered
+// out, the reading is acknowledged as if it were stored.
+var errDropReading = errors.New("reading dropped")
+
+// PipelineConfig orders the stages every reading goes through at ingest.
+type PipelineConfig struct {
+	Stages []string `json:"stages"` // Stages in their order, validate, enrich, transform, store and publish by default
+}
+
+// ingestReading is a reading going through the stages of the pipeline with the state of its ingest.
+type ingestReading struct {
+	rules        *ingestRules // Rules in effect when the ingest of the reading started
+	sensorData   *SensorData
+	receivedAt   time.Time // Set by the validate stage
+	reportedTime bool      // Whether the device reported the time of the reading, set by the validate stage
+
+	undo []func(ctx context.Context) // Run in reverse order when a later stage fails
+}
+
+// ingestStage processes a reading going through the pipeline, an error stops the ingest of the reading.
+type ingestStage func(ctx context.Context, reading *ingestReading) error
+
+// ingestStages builds the stages of the pipeline by name, the built-in ones and the ones registered in code.
+var ingestStages = map[string]func(ing *ingester) (ingestStage, error){
+	"validate":  builtinStage((*ingester).validate),
+	"enrich":    builtinStage((*ingester).enrich),
+	"transform": builtinStage((*ingester).transform),
+	"store":     builtinStage((*ingester).save),
+	"publish":   builtinStage((*ingester).publish),
+}
+
+// registerIngestStage adds a custom stage the pipeline setting can list by name, to call from an init function. The
+// stage is built with the ingester when the API starts, an error stops it.
+func registerIngestStage(name string, newStage func(ing *ingester) (ingestStage, error)) {
+	if _, exists := ingestStages[name]; exists {
+		panic(fmt.Sprintf("ingest stage %s is registered already", name))
+	}
+
+	ingestStages[name] = newStage
+}
+
+// builtinStage returns the builder of a stage implemented by a method of the ingester
+func builtinStage(method func(i *ingester, ctx context.Context, reading *ingestReading) error) func(ing *ingester) (ingestStage, error) {
+	return func(ing *ingester) (ingestStage, error) {
+		return func(ctx context.Context, reading *ingestReading) error {
+			return method(ing, ctx, reading)
+		}, nil
+	}
+}
+
+// pipeline runs the readings through the stages of the ingest in their order.
+type pipeline struct {
+	stages   []ingestStage
+	accepted int // Number of stages run before the asynchronous acknowledgement, up to the validate stage
+}
+
+// newPipeline builds the stages of the configuration for the ingester, the validate and store stages are required,
+// validate first and store before publish
+func newPipeline(config PipelineConfig, ing *ingester) (*pipeline, error) {
+	names := config.Stages
+
+	if len(names) == 0 {
+		names = defaultIngestStages
+	}
+
+	p := &pipeline{}
+	listed := make(map[string]bool, len(names))
+
+	for _, name := range names {
+		newStage, ok := ingestStages[name]
+
+		if !ok {
+			return nil, fmt.Errorf("stage %q is neither built in nor registered", name)
+		}
+
+		if listed[name] {
+			return nil, fmt.Errorf("stage %s is listed twice", name)
+		}
+
+		// Every stage gets a validated reading, and the published reading is stored.
+		if name != "validate" && !listed["validate"] {
+			return nil, fmt.Errorf("stage %s must come after the validate stage", name)
+		}
+
+		if name == "publish" && !listed["store"] {
+			return nil, errors.New("stage publish must come after the store stage")
+		}
+
+		stage, err := newStage(ing)
+
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %w", name, err)
+		}
+
+		listed[name] = true
+		p.stages = append(p.stages, stage)
+
+		if name == "validate" {
+			p.accepted = len(p.stages)
+		}
+	}
+
+	if !listed["validate"] || !listed["store"] {
+		return nil, errors.New("the validate and store stages are required")
+	}
+
+	return p, nil
+}
+
+// run runs the reading through the stages from the first index to the last one excluded. A failure undoes the
+// stages run, a dropped reading returns errDropReading without undoing them.
+func (p *pipeline) run(ctx context.Context, reading *ingestReading, from, to int) error {
+	var err error
+
+	for n := from; n < to && err == nil; n++ {
+		err = p.stages[n](ctx, reading)
+	}
+
+	if err == nil || errors.Is(err, errDropReading) {
+		return err
+	}
+
+	for n := len(reading.undo) - 1; n >= 0; n-- {
+		reading.undo[n](ctx)
+	}
+
+	return err
+}
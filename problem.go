@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// problemContentType is the media type of the RFC 7807 error responses.
+	problemContentType = "application/problem+json"
+	// problemTypePrefix prefixes the code of a problem to make its type URI.
+	problemTypePrefix = "urn:sensordata:problem:"
+	// internalErrorDetail replaces the detail of the server errors, which may carry Redis or other internal messages.
+	internalErrorDetail = "The request couldn't be processed, please retry later"
+)
+
+// problemCodes are the codes of the problems by HTTP status, for the errors raised without a code.
+var problemCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// Problem is an RFC 7807 problem details error response.
+type Problem struct {
+	Type     string       `json:"type"`               // URI of the code, e.g. "urn:sensordata:problem:not_found"
+	Title    string       `json:"title"`              // Summary of the problem, the same for every occurrence of the code
+	Status   int          `json:"status"`             // HTTP status
+	Detail   string       `json:"detail,omitempty"`   // Explanation of this occurrence, never an internal error message
+	Instance string       `json:"instance,omitempty"` // Path of the request
+	Code     string       `json:"code"`               // Stable code of the problem, e.g. "invalid_sensor_data"
+	Errors   []FieldError `json:"errors,omitempty"`   // Fields of the payload breaking their constraints
+}
+
+// problemError is an error returned by a handler with its problem code.
+type problemError struct {
+	status int
+	code   string
+	title  string
+	detail string
+	fields []FieldError
+}
+
+// newProblem creates the error of a problem, the title defaults to the text of the status
+func newProblem(status int, code, detail string) *problemError {
+	return &problemError{status: status, code: code, title: http.StatusText(status), detail: detail}
+}
+
+// withFields adds the field errors of a payload rejected by the decoding or the validation to the problem
+func (p *problemError) withFields(err error) *problemError {
+	p.fields = fieldErrorsOf(err)
+
+	return p
+}
+
+// Error returns the detail of the problem
+func (p *problemError) Error() string {
+	return p.detail
+}
+
+// problemOf builds the problem of an error returned by a handler
+func problemOf(err error) *Problem {
+	var pe *problemError
+
+	if errors.As(err, &pe) {
+		return &Problem{Type: problemTypePrefix + pe.code, Title: pe.title, Status: pe.status, Detail: pe.detail, Code: pe.code, Errors: pe.fields}
+	}
+
+	status, detail := http.StatusInternalServerError, ""
+	var he *echo.HTTPError
+
+	if errors.As(err, &he) {
+		status = he.Code
+
+		if message, ok := he.Message.(string); ok {
+			detail = message
+		} else if he.Message != nil {
+			detail = fmt.Sprint(he.Message)
+		}
+	}
+
+	code, found := problemCodes[status]
+
+	if !found {
+		code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	}
+
+	if code == "" {
+		code = "error"
+	}
+
+	return &Problem{Type: problemTypePrefix + code, Title: http.StatusText(status), Status: status, Detail: detail, Code: code}
+}
+
+// problemErrorHandler writes the errors of the handlers as problem+json responses, the internal details of the
+// server errors are logged instead of returned
+func problemErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	problem := problemOf(err)
+	problem.Instance = c.Request().URL.Path
+
+	if problem.Status >= http.StatusInternalServerError {
+		log.Printf("%s %s failed: %v", c.Request().Method, c.Request().URL.Path, err)
+		problem.Detail = internalErrorDetail
+	}
+
+	if c.Request().Method == http.MethodHead {
+		if err := c.NoContent(problem.Status); err != nil {
+			log.Printf("Error response of %s not sent: %v", c.Request().URL.Path, err)
+		}
+
+		return
+	}
+
+	body, err := marshalResponse(c, problem)
+
+	if err == nil {
+		err = c.Blob(problem.Status, problemContentType, body)
+	}
+
+	if err != nil {
+		log.Printf("Error response of %s not sent: %v", c.Request().URL.Path, err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// quotaKeyPrefix prefixes the counters of the readings of a client per hour and per day.
+const quotaKeyPrefix = "quota:"
+
+// takeQuotaScript counts a reading in the hourly and daily counters of a client unless one of them is at its limit,
+// a limit of 0 isn't checked. Returns whether the reading is allowed and the readings counted in the hour and the day.
+var takeQuotaScript = redis.NewScript(`
+local hourly = tonumber(redis.call('GET', KEYS[1]) or '0')
+local daily = tonumber(redis.call('GET', KEYS[2]) or '0')
+local hourlyLimit = tonumber(ARGV[1])
+local dailyLimit = tonumber(ARGV[2])
+
+if (hourlyLimit > 0 and hourly >= hourlyLimit) or (dailyLimit > 0 and daily >= dailyLimit) then
+  return {0, hourly, daily}
+end
+
+hourly = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+daily = redis.call('INCR', KEYS[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+return {1, hourly, daily}
+`)
+
+// QuotaConfig limits the readings ingested per device or per API key in every hour and day (UTC), counted in Redis
+// so the quotas hold across the replicas of the API.
+type QuotaConfig struct {
+	QuotaLimits
+	Key       string                 `json:"key"`       // "device" (default) or "header:<name>" to count the readings per value of a header, e.g. an API key
+	Overrides map[string]QuotaLimits `json:"overrides"` // Limits of given devices or header values, instead of the default ones
+}
+
+// QuotaLimits are the readings accepted per hour and per day, no limit when 0.
+type QuotaLimits struct {
+	Hourly int `json:"hourly"`
+	Daily  int `json:"daily"`
+}
+
+// quotaLimiter rejects with 429 Too Many Requests the readings of the clients over their quota.
+type quotaLimiter struct {
+	registry *registry
+	mu       sync.RWMutex
+	config   QuotaConfig
+
+	normalizeDeviceId func(deviceId string) string
+}
+
+// newQuotaLimiter validates the quotas
+func newQuotaLimiter(config QuotaConfig, reg *registry, normalizeDeviceId func(deviceId string) string) (*quotaLimiter, error) {
+	config, err := validateQuota(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &quotaLimiter{registry: reg, config: config, normalizeDeviceId: normalizeDeviceId}, nil
+}
+
+// validateQuota validates the quotas and applies their defaults
+func validateQuota(config QuotaConfig) (QuotaConfig, error) {
+	if config.Hourly < 0 || config.Daily < 0 {
+		return config, fmt.Errorf("quotas %d per hour and %d per day must be positive", config.Hourly, config.Daily)
+	}
+
+	for client, limits := range config.Overrides {
+		if limits.Hourly < 0 || limits.Daily < 0 {
+			return config, fmt.Errorf("quotas %d per hour and %d per day of %s must be positive", limits.Hourly, limits.Daily, client)
+		}
+	}
+
+	if config.Key == "" {
+		config.Key = "device"
+	}
+
+	if config.Key != "device" && (!strings.HasPrefix(config.Key, "header:") || strings.TrimPrefix(config.Key, "header:") == "") {
+		return config, fmt.Errorf("key %q must be device or header:<name>", config.Key)
+	}
+
+	return config, nil
+}
+
+// update applies validated quotas
+func (q *quotaLimiter) update(config QuotaConfig) {
+	q.mu.Lock()
+	q.config = config
+	q.mu.Unlock()
+}
+
+// limitsOf returns the quotas of the client, its override or the default ones
+func (c *QuotaConfig) limitsOf(client string) QuotaLimits {
+	if limits, found := c.Overrides[client]; found {
+		return limits
+	}
+
+	return c.QuotaLimits
+}
+
+// middleware counts the reading of its device or key and rejects it over the quota, the body is kept for the handler.
+// The readings are let through when Redis fails.
+func (q *quotaLimiter) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		q.mu.RLock()
+		config := q.config
+		q.mu.RUnlock()
+
+		if config.Hourly == 0 && config.Daily == 0 && len(config.Overrides) == 0 {
+			return next(c)
+		}
+
+		var client string
+
+		if header := strings.TrimPrefix(config.Key, "header:"); header != config.Key {
+			client = c.Request().Header.Get(header)
+		} else {
+			body, err := io.ReadAll(c.Request().Body)
+
+			if err != nil {
+				return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to read the request body: %v", err))
+			}
+
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			client = requestDeviceId(c, body, q.normalizeDeviceId)
+		}
+
+		limits := config.limitsOf(client)
+
+		// The readings without a device are rejected by the validation, they aren't counted.
+		if client == "" || (limits.Hourly == 0 && limits.Daily == 0) {
+			return next(c)
+		}
+
+		now := time.Now().UTC()
+		allowed, hourly, daily, err := q.registry.TakeQuota(c.Request().Context(), config.Key+":"+client, limits, now)
+
+		if err != nil {
+			log.Printf("Quota of %s not checked: %v", client, err)
+			return next(c)
+		}
+
+		// The headers are the ones of the quota closest to its limit.
+		limit, used, reset, period := limits.Hourly, hourly, now.Truncate(time.Hour).Add(time.Hour), "hour"
+		nextDay := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+
+		if limits.Daily > 0 && (limits.Hourly == 0 || limits.Daily-daily < limits.Hourly-hourly) {
+			limit, used, reset, period = limits.Daily, daily, nextDay, "day"
+		}
+
+		remaining := limit - used
+
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		resetIn := int(reset.Sub(now).Round(time.Second) / time.Second)
+		c.Response().Header().Set("X-Quota-Limit", strconv.Itoa(limit))
+		c.Response().Header().Set("X-Quota-Remaining", strconv.Itoa(remaining))
+		c.Response().Header().Set("X-Quota-Reset", strconv.Itoa(resetIn))
+
+		if !allowed {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(resetIn))
+			log.Printf("Reading of %s rejected, quota of %d per %s exceeded", client, limit, period)
+			return newProblem(http.StatusTooManyRequests, "quota_exceeded", fmt.Sprintf("Quota of %d readings per %s of %s exceeded, retry in %v", limit, period, client, reset.Sub(now).Round(time.Second)))
+		}
+
+		return next(c)
+	}
+}
+
+// TakeQuota counts a reading of the client in its hour and day unless it is over one of the quotas, it reports whether
+// the reading is allowed and the readings counted in the hour and the day
+func (r *registry) TakeQuota(ctx context.Context, client string, limits QuotaLimits, now time.Time) (bool, int, int, error) {
+	hour := now.Truncate(time.Hour)
+	day := now.Truncate(24 * time.Hour)
+	keys := []string{
+		quotaKeyPrefix + client + ":hour:" + strconv.FormatInt(hour.Unix(), 10),
+		quotaKeyPrefix + client + ":day:" + strconv.FormatInt(day.Unix(), 10),
+	}
+	// The counters are kept a little past their period, for the requests of a replica with a late clock.
+	hourTTL := hour.Add(time.Hour + time.Minute).Sub(now).Milliseconds()
+	dayTTL := day.Add(24*time.Hour + time.Minute).Sub(now).Milliseconds()
+	result, err := takeQuotaScript.Run(ctx, r.rdb, keys, limits.Hourly, limits.Daily, hourTTL, dayTTL).Int64Slice()
+
+	if err != nil {
+		return false, 0, 0, fmt.Errorf("fatal error on counting the reading of %s in the cache: %v", client, err)
+	}
+
+	if len(result) != 3 {
+		return false, 0, 0, errors.New("fatal error on counting the reading in the cache: unexpected script result")
+	}
+
+	return result[0] == 1, int(result[1]), int(result[2]), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// rateLimitKeyPrefix prefixes the hash of the token bucket of a client.
+const rateLimitKeyPrefix = "rate-limit:"
+
+// takeTokenScript takes a token from the bucket of a client, refilled at the rate per second up to the burst.
+// The time of the Redis server is used so the replicas of the API share the same clock.
+// Returns whether the request is allowed, the tokens left and the milliseconds until the next token.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate / 1000)
+
+local allowed = 0
+local wait = 0
+
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, math.floor(tokens), wait}
+`)
+
+// RateLimitConfig limits the requests of every client, counted in Redis so the limit holds across the replicas of the API.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requests_per_second"` // Sustained rate allowed per client, no limit when 0
+	Burst             int     `json:"burst"`               // Requests allowed at once, the rounded up rate by default
+	Key               string  `json:"key"`                 // "ip" (default) or "header:<name>" to count the requests per value of a header, e.g. an API key
+}
+
+// rateLimiter rejects the requests of the clients over their rate with 429 Too Many Requests.
+type rateLimiter struct {
+	registry *registry
+	mu       sync.RWMutex
+	config   RateLimitConfig
+}
+
+// newRateLimiter validates the limits
+func newRateLimiter(config RateLimitConfig, reg *registry) (*rateLimiter, error) {
+	config, err := validateRateLimit(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimiter{registry: reg, config: config}, nil
+}
+
+// validateRateLimit validates the limits and applies their defaults
+func validateRateLimit(config RateLimitConfig) (RateLimitConfig, error) {
+	if config.RequestsPerSecond < 0 {
+		return config, fmt.Errorf("requests per second %g must be positive", config.RequestsPerSecond)
+	}
+
+	if config.Burst < 0 {
+		return config, fmt.Errorf("burst %d must be positive", config.Burst)
+	}
+
+	if config.Burst == 0 {
+		config.Burst = int(config.RequestsPerSecond + 0.999)
+	}
+
+	if config.Key == "" {
+		config.Key = "ip"
+	}
+
+	if config.Key != "ip" && (!strings.HasPrefix(config.Key, "header:") || strings.TrimPrefix(config.Key, "header:") == "") {
+		return config, fmt.Errorf("key %q must be ip or header:<name>", config.Key)
+	}
+
+	return config, nil
+}
+
+// update applies validated limits
+func (l *rateLimiter) update(config RateLimitConfig) {
+	l.mu.Lock()
+	l.config = config
+	l.mu.Unlock()
+}
+
+// middleware counts the request of its client and rejects it over the limit. The requests are let through when Redis fails.
+func (l *rateLimiter) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		l.mu.RLock()
+		config := l.config
+		l.mu.RUnlock()
+
+		if config.RequestsPerSecond == 0 {
+			return next(c)
+		}
+
+		client := c.RealIP()
+
+		if header := strings.TrimPrefix(config.Key, "header:"); header != config.Key {
+			client = c.Request().Header.Get(header)
+		}
+
+		allowed, remaining, wait, err := l.registry.TakeToken(c.Request().Context(), config.Key+":"+client, config.RequestsPerSecond, config.Burst)
+
+		if err != nil {
+			log.Printf("Rate limit of %s not checked: %v", client, err)
+			return next(c)
+		}
+
+		c.Response().Header().Set("X-RateLimit-Limit", strconv.Itoa(config.Burst))
+		c.Response().Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+
+		if !allowed {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			return newProblem(http.StatusTooManyRequests, "rate_limited", fmt.Sprintf("Rate limit of %g requests per second exceeded, retry in %v", config.RequestsPerSecond, wait))
+		}
+
+		return next(c)
+	}
+}
+
+// TakeToken takes a token from the bucket of the client, it reports whether the request is allowed, the tokens left
+// and the time until the next token when it isn't
+func (r *registry) TakeToken(ctx context.Context, client string, rate float64, burst int) (bool, int, time.Duration, error) {
+	result, err := takeTokenScript.Run(ctx, r.rdb, []string{rateLimitKeyPrefix + client}, rate, burst).Int64Slice()
+
+	if err != nil {
+		return false, 0, 0, fmt.Errorf("fatal error on counting the request of %s in the cache: %v", client, err)
+	}
+
+	if len(result) != 3 {
+		return false, 0, 0, errors.New("fatal error on counting the request in the cache: unexpected script result")
+	}
+
+	return result[0] == 1, int(result[1]), time.Duration(result[2]) * time.Millisecond, nil
+}
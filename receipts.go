@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// receiptKeyPrefix prefixes the Redis key holding the JSON of the receipt of a reading ingested asynchronously.
+	receiptKeyPrefix = "receipt:"
+	// defaultReceiptTTL is the time the receipts are kept without a receipt_ttl setting.
+	defaultReceiptTTL = 24 * time.Hour
+)
+
+const (
+	// receiptPending is the status of a reading waiting to be stored.
+	receiptPending = "pending"
+	// receiptStored is the status of a reading stored, or dropped as the duplicate of a stored one.
+	receiptStored = "stored"
+	// receiptFailed is the status of a reading that couldn't be stored.
+	receiptFailed = "failed"
+	// receiptDropped is the status of a reading left out by a stage of the pipeline, acknowledged without being stored.
+	receiptDropped = "dropped"
+)
+
+// Receipt is the delivery status of a reading acknowledged before being stored.
+type Receipt struct {
+	Id          string        `json:"receipt_id"`
+	DeviceId    string        `json:"device_id"`
+	Status      string        `json:"status"` // "pending", "stored", "dropped" or "failed"
+	ReceivedAt  string        `json:"received_at"`
+	CompletedAt string        `json:"completed_at,omitempty"` // Time the reading was stored or failed
+	Duplicate   bool          `json:"duplicate,omitempty"`    // Dropped as the duplicate of a reading stored already
+	Error       *ReceiptError `json:"error,omitempty"`
+}
+
+// ReceiptError is the cause of a failed reading, with the problem code the synchronous ingest would have returned.
+type ReceiptError struct {
+	Code   string       `json:"code"`
+	Detail string       `json:"detail"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// completeReceipt sets the status of the receipt from the outcome of the storage of its reading
+func completeReceipt(receipt *Receipt, err error) {
+	receipt.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	receipt.Status = receiptStored
+
+	switch {
+	case err == nil:
+	case errors.Is(err, errDuplicateReading):
+		receipt.Duplicate = true
+	case errors.Is(err, errDropReading):
+		receipt.Status = receiptDropped
+	case errors.Is(err, errInvalidSensorData):
+		// Rejected after the acknowledgement, e.g. by the late data policy.
+		receipt.Status = receiptFailed
+		receipt.Error = &ReceiptError{Code: "invalid_sensor_data", Detail: err.Error(), Errors: fieldErrorsOf(err)}
+	default:
+		// As for the synchronous ingest, the internal error is logged and not returned.
+		receipt.Status = receiptFailed
+		receipt.Error = &ReceiptError{Code: "internal_error", Detail: "The reading couldn't be stored, retry it"}
+	}
+}
+
+// SaveReceipt saves the receipt for the given time
+func (r *registry) SaveReceipt(ctx context.Context, receipt *Receipt, ttl time.Duration) error {
+	raw, err := json.Marshal(receipt)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on marshalling the receipt %s: %v", receipt.Id, err)
+	}
+
+	if err := r.rdb.Set(ctx, receiptKeyPrefix+receipt.Id, raw, ttl).Err(); err != nil {
+		return fmt.Errorf("fatal error on saving the receipt %s in the cache: %v", receipt.Id, err)
+	}
+
+	return nil
+}
+
+// Receipt returns the receipt of a reading ingested asynchronously
+func (r *registry) Receipt(ctx context.Context, id string) (*Receipt, error) {
+	raw, err := r.rdb.Get(ctx, receiptKeyPrefix+id).Bytes()
+
+	if err == redis.Nil {
+		return nil, fmt.Errorf("receipt %s %w", id, errNotFound)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the receipt %s from the cache: %v", id, err)
+	}
+
+	var receipt Receipt
+
+	if err := json.Unmarshal(raw, &receipt); err != nil {
+		return nil, fmt.Errorf("fatal error on reading the receipt %s from the cache: %v", id, err)
+	}
+
+	return &receipt, nil
+}
+
+// registerReceiptRoutes mounts the status lookup of the readings ingested asynchronously on the given group
+func registerReceiptRoutes(g *echo.Group, reg *registry) {
+	g.GET("/:receipt_id", func(c echo.Context) error {
+		receipt, err := reg.Receipt(c.Request().Context(), c.Param("receipt_id"))
+
+		if err != nil {
+			return registryHTTPError(err)
+		}
+
+		return c.JSON(http.StatusOK, receipt)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisConfig holds the connection settings of the main Redis and its read replicas, besides the address and the
+// password given by the flags.
+type RedisConfig struct {
+	Username  string         `json:"username"`  // ACL user of Redis 6 and later, the default user when empty
+	DB        int            `json:"db"`        // Index of the logical database, 0 by default
+	TLS       RedisTLSConfig `json:"tls"`       // TLS of the connections, required by most managed Redis
+	Namespace string         `json:"namespace"` // Prefix of the keys, "sdapi" stores them as "sdapi:<key>", to share the Redis with other applications
+}
+
+// RedisTLSConfig enables TLS to Redis, with a client certificate for the servers requiring mutual TLS.
+type RedisTLSConfig struct {
+	Enabled            bool   `json:"enabled"`
+	CAFile             string `json:"ca_file"`              // PEM bundle of the CAs verifying the server, the system ones when empty
+	CertFile           string `json:"cert_file"`            // PEM client certificate, along with its key_file
+	KeyFile            string `json:"key_file"`             // PEM key of the client certificate
+	ServerName         string `json:"server_name"`          // Name verified in the server certificate, the host of the address when empty
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Doesn't verify the server certificate, never in production
+}
+
+// options returns the client options of the Redis at the address, the files of the certificates are read once
+func (c RedisConfig) options(address, password string) (*redis.Options, error) {
+	if c.DB < 0 {
+		return nil, fmt.Errorf("Redis database %d must be positive", c.DB)
+	}
+
+	if err := validateNamespace(c.Namespace); err != nil {
+		return nil, err
+	}
+
+	options := &redis.Options{Addr: address, Username: c.Username, Password: password, DB: c.DB}
+
+	if !c.TLS.Enabled {
+		return options, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: c.TLS.ServerName, InsecureSkipVerify: c.TLS.InsecureSkipVerify}
+
+	if c.TLS.CAFile != "" {
+		pem, err := os.ReadFile(c.TLS.CAFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the Redis CA file: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Redis CA file %s has no PEM certificate", c.TLS.CAFile)
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return nil, errors.New("the Redis client certificate needs both a cert_file and a key_file")
+	}
+
+	if c.TLS.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the Redis client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	options.TLSConfig = config
+
+	return options, nil
+}
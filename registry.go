@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// idPattern restricts the ids of the entities managed through the API (groups, label keys...).
+var idPattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+var (
+	// errNotFound is returned when the requested entity doesn't exist.
+	errNotFound = errors.New("not found")
+	// errAlreadyExists is returned when creating an entity with an id in use.
+	errAlreadyExists = errors.New("already exists")
+)
+
+const (
+	// groupsKey is the Redis set holding the ids of all groups.
+	groupsKey = "groups"
+	// groupKeyPrefix prefixes the hash holding the attributes of a group.
+	groupKeyPrefix = "group:"
+	// groupMembersKeyPrefix prefixes the set of device ids assigned to a group.
+	groupMembersKeyPrefix = "group-members:"
+	// deviceGroupsKeyPrefix prefixes the set of group ids a device is assigned to.
+	deviceGroupsKeyPrefix = "device-groups:"
+	// labelsKeyPrefix prefixes the hash holding the labels of a device.
+	labelsKeyPrefix = "labels:"
+	// labeledDevicesKey is the Redis set holding the ids of the devices with labels.
+	labeledDevicesKey = "labeled-devices"
+	// deviceTypesKey is the Redis hash holding the type of the devices registered by an import.
+	deviceTypesKey = "device-types"
+)
+
+// Group is a named set of devices, such as a building or a production line.
+type Group struct {
+	Id      string   `json:"id"`
+	Name    string   `json:"name"`
+	Devices []string `json:"devices"`
+}
+
+// registry keeps the device metadata managed through the API in Redis.
+type registry struct {
+	rdb *redis.Client
+}
+
+// newRegistry creates a registry backed by the given Redis client
+func newRegistry(rdb *redis.Client) *registry {
+	return &registry{rdb: rdb}
+}
+
+// CreateGroup creates an empty group
+func (r *registry) CreateGroup(ctx context.Context, id, name string) error {
+	created, err := r.rdb.SAdd(ctx, groupsKey, id).Result()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on creating the group %s in the cache: %v", id, err)
+	}
+
+	if created == 0 {
+		return fmt.Errorf("group %s %w", id, errAlreadyExists)
+	}
+
+	if err := r.rdb.HSet(ctx, groupKeyPrefix+id, "name", name).Err(); err != nil {
+		return fmt.Errorf("fatal error on saving the group %s in the cache: %v", id, err)
+	}
+
+	return nil
+}
+
+// Group returns the group with its devices
+func (r *registry) Group(ctx context.Context, id string) (*Group, error) {
+	exists, err := r.rdb.SIsMember(ctx, groupsKey, id).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the group %s from the cache: %v", id, err)
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("group %s %w", id, errNotFound)
+	}
+
+	pipe := r.rdb.Pipeline()
+	name := pipe.HGet(ctx, groupKeyPrefix+id, "name")
+	members := pipe.SMembers(ctx, groupMembersKeyPrefix+id)
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("fatal error on retrieving the group %s from the cache: %v", id, err)
+	}
+
+	devices := members.Val()
+	sort.Strings(devices)
+
+	return &Group{Id: id, Name: name.Val(), Devices: devices}, nil
+}
+
+// Groups returns all the groups with their devices
+func (r *registry) Groups(ctx context.Context) ([]Group, error) {
+	ids, err := r.rdb.SMembers(ctx, groupsKey).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the groups from the cache: %v", err)
+	}
+
+	sort.Strings(ids)
+
+	groups := make([]Group, 0, len(ids))
+
+	for _, id := range ids {
+		group, err := r.Group(ctx, id)
+
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		groups = append(groups, *group)
+	}
+
+	return groups, nil
+}
+
+// DeleteGroup deletes the group and unassigns its devices
+func (r *registry) DeleteGroup(ctx context.Context, id string) error {
+	group, err := r.Group(ctx, id)
+
+	if err != nil {
+		return err
+	}
+
+	pipe := r.rdb.TxPipeline()
+	pipe.SRem(ctx, groupsKey, id)
+	pipe.Del(ctx, groupKeyPrefix+id, groupMembersKeyPrefix+id)
+
+	for _, deviceId := range group.Devices {
+		pipe.SRem(ctx, deviceGroupsKeyPrefix+deviceId, id)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on deleting the group %s from the cache: %v", id, err)
+	}
+
+	return nil
+}
+
+// AssignDevice adds the device to the group
+func (r *registry) AssignDevice(ctx context.Context, groupId, deviceId string) error {
+	if _, err := r.Group(ctx, groupId); err != nil {
+		return err
+	}
+
+	pipe := r.rdb.TxPipeline()
+	pipe.SAdd(ctx, groupMembersKeyPrefix+groupId, deviceId)
+	pipe.SAdd(ctx, deviceGroupsKeyPrefix+deviceId, groupId)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on assigning the device %s to the group %s in the cache: %v", deviceId, groupId, err)
+	}
+
+	return nil
+}
+
+// UnassignDevice removes the device from the group
+func (r *registry) UnassignDevice(ctx context.Context, groupId, deviceId string) error {
+	pipe := r.rdb.TxPipeline()
+	removed := pipe.SRem(ctx, groupMembersKeyPrefix+groupId, deviceId)
+	pipe.SRem(ctx, deviceGroupsKeyPrefix+deviceId, groupId)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on unassigning the device %s from the group %s in the cache: %v", deviceId, groupId, err)
+	}
+
+	if removed.Val() == 0 {
+		return fmt.Errorf("device %s in group %s %w", deviceId, groupId, errNotFound)
+	}
+
+	return nil
+}
+
+// DeviceGroups returns the ids of the groups the device is assigned to
+func (r *registry) DeviceGroups(ctx context.Context, deviceId string) ([]string, error) {
+	ids, err := r.rdb.SMembers(ctx, deviceGroupsKeyPrefix+deviceId).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the groups of device %s from the cache: %v", deviceId, err)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// Labels returns the labels of the device, empty when it has none
+func (r *registry) Labels(ctx context.Context, deviceId string) (map[string]string, error) {
+	labels, err := r.rdb.HGetAll(ctx, labelsKeyPrefix+deviceId).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the labels of device %s from the cache: %v", deviceId, err)
+	}
+
+	return labels, nil
+}
+
+// SetLabels replaces the labels of the device
+func (r *registry) SetLabels(ctx context.Context, deviceId string, labels map[string]string) error {
+	pipe := r.rdb.TxPipeline()
+	pipe.Del(ctx, labelsKeyPrefix+deviceId)
+
+	if len(labels) > 0 {
+		pipe.HSet(ctx, labelsKeyPrefix+deviceId, labels)
+		pipe.SAdd(ctx, labeledDevicesKey, deviceId)
+	} else {
+		pipe.SRem(ctx, labeledDevicesKey, deviceId)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on saving the labels of device %s in the cache: %v", deviceId, err)
+	}
+
+	return nil
+}
+
+// DeleteLabel removes a label from the device
+func (r *registry) DeleteLabel(ctx context.Context, deviceId, key string) error {
+	removed, err := r.rdb.HDel(ctx, labelsKeyPrefix+deviceId, key).Result()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on deleting the label %s of device %s from the cache: %v", key, deviceId, err)
+	}
+
+	if removed == 0 {
+		return fmt.Errorf("label %s of device %s %w", key, deviceId, errNotFound)
+	}
+
+	return nil
+}
+
+// LabeledDevices returns the labels of every device having at least one
+func (r *registry) LabeledDevices(ctx context.Context) (map[string]map[string]string, error) {
+	ids, err := r.rdb.SMembers(ctx, labeledDevicesKey).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the labeled devices from the cache: %v", err)
+	}
+
+	pipe := r.rdb.Pipeline()
+	cmds := make(map[string]*redis.MapStringStringCmd, len(ids))
+
+	for _, id := range ids {
+		cmds[id] = pipe.HGetAll(ctx, labelsKeyPrefix+id)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the device labels from the cache: %v", err)
+	}
+
+	devices := make(map[string]map[string]string, len(ids))
+
+	for id, cmd := range cmds {
+		if len(cmd.Val()) > 0 {
+			devices[id] = cmd.Val()
+		}
+	}
+
+	return devices, nil
+}
+
+// SelectDevices returns the ids of the known devices whose labels match the selector, sorted
+func (r *registry) SelectDevices(ctx context.Context, store Store, selector labelSelector) ([]string, error) {
+	labeled, err := r.LabeledDevices(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Devices that never reported can still be labeled or imported, devices without labels are only selected
+	// by selectors made of !=, notin and ! requirements.
+	reported, err := store.Devices(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	imported, err := r.DeviceTypes(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make(map[string]bool, len(reported)+len(labeled)+len(imported))
+
+	for id := range imported {
+		candidates[id] = true
+	}
+
+	for _, id := range reported {
+		candidates[id] = true
+	}
+
+	for id := range labeled {
+		candidates[id] = true
+	}
+
+	selected := []string{}
+
+	for id := range candidates {
+		if selector.matches(labeled[id]) {
+			selected = append(selected, id)
+		}
+	}
+
+	sort.Strings(selected)
+
+	return selected, nil
+}
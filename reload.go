@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+)
+
+// configReloader reloads the ingest rules from the configuration file on SIGHUP or through the admin endpoint.
+//
+// Only the device types, metric limits, payload transformations, derived fields, alert rules, rate limits and quotas are reloaded,
+// the other settings need a restart.
+type configReloader struct {
+	path    string
+	ing     *ingester
+	limiter *rateLimiter
+	quota   *quotaLimiter
+	mu      sync.Mutex
+}
+
+// newConfigReloader creates a reloader of the rules of the ingester, the rate limits and the quotas from the configuration file
+func newConfigReloader(path string, ing *ingester, limiter *rateLimiter, quota *quotaLimiter) *configReloader {
+	return &configReloader{path: path, ing: ing, limiter: limiter, quota: quota}
+}
+
+// reload reads the configuration file and applies its rules, the current ones are kept when it is invalid
+func (r *configReloader) reload() error {
+	if r.path == "" {
+		return errors.New("the server was started without a configuration file")
+	}
+
+	// Concurrent reloads would race to apply possibly different versions of the file.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config, err := loadConfig(r.path)
+
+	if err != nil {
+		return err
+	}
+
+	rateLimit, err := validateRateLimit(config.RateLimit)
+
+	if err != nil {
+		return fmt.Errorf("rate limit: %w", err)
+	}
+
+	quota, err := validateQuota(config.Quota)
+
+	if err != nil {
+		return fmt.Errorf("quota: %w", err)
+	}
+
+	if err := r.ing.reload(config); err != nil {
+		return err
+	}
+
+	r.limiter.update(rateLimit)
+	r.quota.update(quota)
+
+	log.Printf("Configuration reloaded from %s", r.path)
+
+	return nil
+}
+
+// watchSignals reloads the configuration on every SIGHUP
+func (r *configReloader) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if err := r.reload(); err != nil {
+			log.Printf("Configuration not reloaded: %v", err)
+		}
+	}
+}
+
+// registerReloadRoutes mounts the configuration reload endpoint on the given group
+func registerReloadRoutes(g *echo.Group, reloader *configReloader) {
+	g.POST("/reload", func(c echo.Context) error {
+		if err := reloader.reload(); err != nil {
+			return newProblem(http.StatusUnprocessableEntity, "invalid_configuration", err.Error())
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+}
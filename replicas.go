@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// defaultMaxStaleness is the replication lag tolerated on the replicas without a max_staleness setting.
+	defaultMaxStaleness = 10 * time.Second
+	// replicaCheckInterval is how often the replication lag of the replicas is checked.
+	replicaCheckInterval = 2 * time.Second
+)
+
+// ReadReplicasConfig routes the reads of the GET requests to Redis replicas, keeping the primary free for the writes.
+type ReadReplicasConfig struct {
+	Addresses    []string `json:"addresses"`     // Addresses of the replicas of the main Redis
+	Password     string   `json:"password"`      // Password of the replicas, the one of the main Redis by default
+	MaxStaleness Duration `json:"max_staleness"` // Replication lag tolerated, a replica lagging more is skipped. 10s by default
+}
+
+// ReplicaHealth is the replication state of a replica.
+type ReplicaHealth struct {
+	Address   string `json:"address"`
+	Usable    bool   `json:"usable"`               // Linked to its primary and lagging less than the max staleness
+	Lag       string `json:"lag,omitempty"`        // Time since the replica last heard from its primary
+	Error     string `json:"error,omitempty"`      // Error of the last check
+	CheckedAt string `json:"checked_at,omitempty"` // Time of the last check
+}
+
+// staleReadsKey marks in a context the reads that may be served by a replica.
+type staleReadsKey struct{}
+
+// allowStaleReads marks the reads made with the context as tolerant of the replication lag
+func allowStaleReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, staleReadsKey{}, true)
+}
+
+// staleReadsAllowed reports whether the reads made with the context may be served by a replica
+func staleReadsAllowed(ctx context.Context) bool {
+	allowed, _ := ctx.Value(staleReadsKey{}).(bool)
+	return allowed
+}
+
+// staleReadsMiddleware lets the reads of the GET requests be served by the replicas, the ingest always reads the primary
+func staleReadsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if method := c.Request().Method; method == http.MethodGet || method == http.MethodHead {
+			c.SetRequest(c.Request().WithContext(allowStaleReads(c.Request().Context())))
+		}
+
+		return next(c)
+	}
+}
+
+// replica is a Redis replica with its replication state.
+type replica struct {
+	rdb    *redis.Client
+	mu     sync.RWMutex
+	health ReplicaHealth
+}
+
+// usable reports whether the last check found the replica within the max staleness
+func (r *replica) usable() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.health.Usable
+}
+
+// replicaSet spreads the stale-tolerant reads over the replicas within the max staleness.
+type replicaSet struct {
+	replicas     []*replica
+	maxStaleness time.Duration
+	next         atomic.Uint32
+}
+
+// newReplicaSet connects to the replicas with the options and the namespace of their primary, they are only used once
+// checked
+func newReplicaSet(addresses []string, options redis.Options, namespace string, maxStaleness time.Duration) (*replicaSet, error) {
+	if maxStaleness < 0 {
+		return nil, fmt.Errorf("max staleness %v must be positive", maxStaleness)
+	}
+
+	if maxStaleness == 0 {
+		maxStaleness = defaultMaxStaleness
+	}
+
+	set := &replicaSet{maxStaleness: maxStaleness}
+
+	for _, address := range addresses {
+		if address == "" {
+			return nil, fmt.Errorf("replica addresses must not be empty")
+		}
+
+		replicaOptions := options
+		replicaOptions.Addr = address
+		set.replicas = append(set.replicas, &replica{
+			rdb:    newRedisClient(&replicaOptions, namespace),
+			health: ReplicaHealth{Address: address},
+		})
+	}
+
+	return set, nil
+}
+
+// pick returns the next usable replica in turn, nil when there is none
+func (s *replicaSet) pick() *redis.Client {
+	if s == nil {
+		return nil
+	}
+
+	start := s.next.Add(1)
+
+	for i := range s.replicas {
+		r := s.replicas[(int(start)+i)%len(s.replicas)]
+
+		if r.usable() {
+			return r.rdb
+		}
+	}
+
+	return nil
+}
+
+// check reads the replication state of every replica
+func (s *replicaSet) check(ctx context.Context) {
+	for _, r := range s.replicas {
+		lag, err := replicationLag(ctx, r.rdb)
+		usable := err == nil && lag <= s.maxStaleness
+
+		r.mu.Lock()
+		wasUsable := r.health.Usable
+		r.health.Usable = usable
+		r.health.CheckedAt = time.Now().UTC().Format(time.RFC3339)
+		r.health.Lag, r.health.Error = "", ""
+
+		if err != nil {
+			r.health.Error = err.Error()
+		} else {
+			r.health.Lag = lag.String()
+		}
+
+		r.mu.Unlock()
+
+		if wasUsable && !usable {
+			log.Printf("Replica %s skipped: lag %v, error %v", r.health.Address, lag, err)
+		} else if !wasUsable && usable {
+			log.Printf("Replica %s serving reads, lag %v", r.health.Address, lag)
+		}
+	}
+}
+
+// replicationLag returns the time since the replica last heard from its primary, from its INFO replication
+func replicationLag(ctx context.Context, rdb *redis.Client) (time.Duration, error) {
+	checkCtx, cancel := context.WithTimeout(ctx, replicaCheckInterval)
+	defer cancel()
+
+	info, err := rdb.Info(checkCtx, "replication").Result()
+
+	if err != nil {
+		return 0, err
+	}
+
+	fields := make(map[string]string)
+
+	for _, line := range strings.Split(info, "\n") {
+		if name, value, found := strings.Cut(strings.TrimSpace(line), ":"); found {
+			fields[name] = value
+		}
+	}
+
+	if fields["role"] != "slave" {
+		return 0, fmt.Errorf("role is %s, not a replica", fields["role"])
+	}
+
+	if fields["master_link_status"] != "up" {
+		return 0, fmt.Errorf("link to the primary is %s", fields["master_link_status"])
+	}
+
+	seconds, err := strconv.Atoi(fields["master_last_io_seconds_ago"])
+
+	if err != nil {
+		return 0, fmt.Errorf("unreadable master_last_io_seconds_ago %q", fields["master_last_io_seconds_ago"])
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// run checks the replicas until the context is done
+func (s *replicaSet) run(ctx context.Context) {
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		s.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthReport returns the state of every replica
+func (s *replicaSet) healthReport() []ReplicaHealth {
+	report := make([]ReplicaHealth, len(s.replicas))
+
+	for i, r := range s.replicas {
+		r.mu.RLock()
+		report[i] = r.health
+		r.mu.RUnlock()
+	}
+
+	return report
+}
+
+// registerReplicaRoutes mounts the replica state endpoint on the given group
+func registerReplicaRoutes(g *echo.Group, replicas *replicaSet) {
+	g.GET("/replicas", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, replicas.healthReport())
+	})
+}
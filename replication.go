@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// replicationQueueKeyPrefix prefixes the Redis list of the readings waiting to be forwarded to a target.
+	replicationQueueKeyPrefix = "replication:"
+	// replicationHeadKeyPrefix prefixes the Redis counter of the readings removed from the head of the queue of a
+	// target, the position of its first reading since the queue started.
+	replicationHeadKeyPrefix = "replication-head:"
+	// replicationLockKeyPrefix prefixes the Redis key of the replica of the API forwarding the readings of a target.
+	replicationLockKeyPrefix = "replication-lock:"
+	// defaultReplicationBuffer is the number of readings kept per target without a buffer setting.
+	defaultReplicationBuffer = 100000
+	// defaultReplicationBatchSize is the number of readings forwarded at once without a batch_size setting.
+	defaultReplicationBatchSize = 500
+	// defaultReplicationInterval is the time between two checks of the queues without an interval setting.
+	defaultReplicationInterval = time.Second
+	// maxReplicationBackoff bounds the time between two attempts to reach an unreachable target.
+	maxReplicationBackoff = time.Minute
+	// replicationLease is the time a replica of the API forwards the readings of a target before renewing its lock.
+	replicationLease = 30 * time.Second
+	// replicationTimeout bounds a request to a target.
+	replicationTimeout = 10 * time.Second
+	// maxReplicatedReadings bounds the readings of a replication request received.
+	maxReplicatedReadings = 10000
+	// replicationConflictsKey is the Redis sorted set of the conflicting readings resolved, scored by their detection
+	// time in milliseconds.
+	replicationConflictsKey = "replication-conflicts"
+	// maxReplicationConflicts is the number of the latest conflicts kept.
+	maxReplicationConflicts = 10000
+	// defaultConflictsLimit is the number of conflicts returned without a limit parameter.
+	defaultConflictsLimit = 100
+)
+
+// ReplicationConfig forwards the readings accepted here to remote instances of the API, e.g. from the regions to the
+// headquarters, buffered in Redis while a target is unreachable.
+type ReplicationConfig struct {
+	Region    string              `json:"region"`     // Name of this instance, sent with its readings
+	Targets   []ReplicationTarget `json:"targets"`    // Instances the readings are forwarded to, no replication when empty
+	Buffer    int                 `json:"buffer"`     // Readings kept per target while it is unreachable, 100000 by default, the oldest are dropped beyond
+	BatchSize int                 `json:"batch_size"` // Readings forwarded in a request, 500 by default
+	Interval  Duration            `json:"interval"`   // Time between two checks of the buffers, 1s by default
+	Secret    string              `json:"secret"`     // Secret shared with the regions replicating to this one, the replication endpoint is only mounted with it
+}
+
+// ReplicationTarget is a remote instance of the API the readings are forwarded to.
+type ReplicationTarget struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`    // Base URL of the instance, e.g. "https://hq.example.com"
+	Token  string `json:"token"`  // API token with the write scope, when the instance requires them
+	Secret string `json:"secret"` // Secret of the instance the requests are signed with
+}
+
+// ReplicationBatch is the body of a replication request, the readings of a region with their receive time.
+type ReplicationBatch struct {
+	Region   string       `json:"region"`
+	Readings []SensorData `json:"readings"`
+}
+
+// ReplicationResult is the outcome of a replication request received.
+type ReplicationResult struct {
+	Stored    int `json:"stored"`
+	Invalid   int `json:"invalid"`   // Readings failing the validation of the ingest, skipped
+	Conflicts int `json:"conflicts"` // Readings differing from the one stored at their time, the one received last is kept
+}
+
+// ReplicationConflict is a reading stored here and a different one replicated for the same device and time, resolved
+// by keeping the one the server received last.
+type ReplicationConflict struct {
+	DeviceId   string     `json:"device_id"`
+	Time       string     `json:"time"`
+	DetectedAt string     `json:"detected_at"`
+	Winner     string     `json:"winner"` // "local" or "replicated"
+	Local      SensorData `json:"local"`
+	Replicated SensorData `json:"replicated"`
+}
+
+// ReplicationStatus is the state of the forwarding of the readings to a target.
+type ReplicationStatus struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Queued     int64  `json:"queued"`  // Readings waiting to be forwarded, by every replica of the API
+	Sent       uint64 `json:"sent"`    // Readings forwarded by this replica since it started
+	Dropped    uint64 `json:"dropped"` // Oldest readings dropped by this replica as the buffer was full
+	Failures   uint64 `json:"failures"`
+	LastError  string `json:"last_error,omitempty"`
+	LastSentAt string `json:"last_sent_at,omitempty"`
+}
+
+// replicationTarget is a target with the counters of its forwarding.
+type replicationTarget struct {
+	ReplicationTarget
+	sent     atomic.Uint64
+	dropped  atomic.Uint64
+	failures atomic.Uint64
+
+	mu         sync.Mutex
+	lastError  string
+	lastSentAt string
+}
+
+// replicator queues the accepted readings for every target and forwards them in batches, a target unreachable gets
+// them once it is back.
+type replicator struct {
+	region    string
+	targets   []*replicationTarget
+	registry  *registry
+	buffer    int
+	batchSize int
+	interval  time.Duration
+	owner     string // Id of this replica of the API in the locks of the targets
+	client    *http.Client
+}
+
+// newReplicator validates the targets of the replication, nil when there is none
+func newReplicator(config ReplicationConfig, reg *registry) (*replicator, error) {
+	if config.Secret != "" && len(config.Secret) < minDeviceSecretLength {
+		return nil, fmt.Errorf("secret must be at least %d characters", minDeviceSecretLength)
+	}
+
+	if len(config.Targets) == 0 {
+		return nil, nil
+	}
+
+	if !idPattern.MatchString(config.Region) {
+		return nil, fmt.Errorf("region %q must be 1 to 64 letters, digits, '_', '.' or '-'", config.Region)
+	}
+
+	if config.Buffer < 0 || config.BatchSize < 0 || config.Interval < 0 {
+		return nil, fmt.Errorf("buffer %d, batch size %d and interval %v must be positive", config.Buffer, config.BatchSize, time.Duration(config.Interval))
+	}
+
+	if config.Buffer == 0 {
+		config.Buffer = defaultReplicationBuffer
+	}
+
+	if config.BatchSize == 0 {
+		config.BatchSize = defaultReplicationBatchSize
+	}
+
+	if config.Interval == 0 {
+		config.Interval = Duration(defaultReplicationInterval)
+	}
+
+	owner, err := newCommandId()
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := &replicator{
+		region:    config.Region,
+		registry:  reg,
+		buffer:    config.Buffer,
+		batchSize: config.BatchSize,
+		interval:  time.Duration(config.Interval),
+		owner:     owner,
+		client:    &http.Client{Timeout: replicationTimeout},
+	}
+	names := make(map[string]bool, len(config.Targets))
+
+	for _, target := range config.Targets {
+		if !idPattern.MatchString(target.Name) || names[target.Name] {
+			return nil, fmt.Errorf("target name %q must be unique and 1 to 64 letters, digits, '_', '.' or '-'", target.Name)
+		}
+
+		if !strings.HasPrefix(target.URL, "http://") && !strings.HasPrefix(target.URL, "https://") {
+			return nil, fmt.Errorf("target %s: URL %q must be an http or https URL", target.Name, target.URL)
+		}
+
+		if len(target.Secret) < minDeviceSecretLength {
+			return nil, fmt.Errorf("target %s: secret must be at least %d characters", target.Name, minDeviceSecretLength)
+		}
+
+		names[target.Name] = true
+		target.URL = strings.TrimSuffix(target.URL, "/")
+		r.targets = append(r.targets, &replicationTarget{ReplicationTarget: target})
+	}
+
+	return r, nil
+}
+
+// enqueue queues the stored reading for every target, a failure is logged and the reading isn't replicated
+func (r *replicator) enqueue(ctx context.Context, sensorData *SensorData) {
+	if r == nil {
+		return
+	}
+
+	raw, err := json.Marshal(sensorData)
+
+	if err != nil {
+		log.Printf("Reading of device %s not replicated: %v", sensorData.DeviceId, err)
+		return
+	}
+
+	for _, target := range r.targets {
+		dropped, err := r.registry.QueueReplication(ctx, target.Name, raw, r.buffer)
+
+		if err != nil {
+			log.Printf("Reading of device %s not replicated to %s: %v", sensorData.DeviceId, target.Name, err)
+			continue
+		}
+
+		target.dropped.Add(uint64(dropped))
+	}
+}
+
+// run forwards the queued readings of every target until the context is done
+func (r *replicator) run(ctx context.Context) {
+	for _, target := range r.targets {
+		go r.forward(ctx, target)
+	}
+}
+
+// forward sends the queued readings of the target in batches while this replica holds its lock, backing off while
+// the target is unreachable
+func (r *replicator) forward(ctx context.Context, target *replicationTarget) {
+	backoff := r.interval
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		sent, err := r.forwardBatches(ctx, target)
+
+		if err != nil {
+			if backoff *= 2; backoff > maxReplicationBackoff {
+				backoff = maxReplicationBackoff
+			}
+
+			target.failures.Add(1)
+			target.setError(err)
+			log.Printf("Readings not replicated to %s, retried in %v: %v", target.Name, backoff, err)
+			continue
+		}
+
+		if sent > 0 {
+			target.setError(nil)
+		}
+
+		backoff = r.interval
+	}
+}
+
+// forwardBatches sends the batches queued for the target until its queue is empty, it returns the number of readings
+// sent. Only the replica holding the lock of the target sends them, so they are sent once and in order.
+func (r *replicator) forwardBatches(ctx context.Context, target *replicationTarget) (int, error) {
+	locked, err := r.registry.LockReplication(ctx, target.Name, r.owner, replicationLease)
+
+	if err != nil || !locked {
+		return 0, err
+	}
+
+	sent := 0
+	deadline := time.Now().Add(replicationLease / 2)
+
+	for time.Now().Before(deadline) {
+		raws, head, err := r.registry.ReplicationBatch(ctx, target.Name, r.batchSize)
+
+		if err != nil || len(raws) == 0 {
+			return sent, err
+		}
+
+		if err := r.send(ctx, target, raws); err != nil {
+			return sent, err
+		}
+
+		// Removed once the target stored them, a replica stopped in between sends them again.
+		if err := r.registry.AckReplication(ctx, target.Name, head+int64(len(raws))); err != nil {
+			return sent, err
+		}
+
+		sent += len(raws)
+		target.sent.Add(uint64(len(raws)))
+	}
+
+	return sent, nil
+}
+
+// send posts a batch of readings to the replication endpoint of the target
+func (r *replicator) send(ctx context.Context, target *replicationTarget, raws []string) error {
+	readings := make([]json.RawMessage, len(raws))
+
+	for i, raw := range raws {
+		readings[i] = json.RawMessage(raw)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"region": r.region, "readings": readings})
+
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL+"/replication/readings", bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	// Signed like the payloads of the devices, with the secret of the target.
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	request.Header.Set(signatureTimestampHeader, timestamp)
+	request.Header.Set(signatureHeader, hex.EncodeToString(signPayload(target.Secret, timestamp, "", body)))
+
+	if target.Token != "" {
+		request.Header.Set(echo.HeaderAuthorization, "Bearer "+target.Token)
+	}
+
+	response, err := r.client.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", target.URL, response.Status)
+	}
+
+	return nil
+}
+
+// setError records the outcome of the last attempt to forward the readings of the target
+func (t *replicationTarget) setError(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		t.lastError = err.Error()
+		return
+	}
+
+	t.lastError = ""
+	t.lastSentAt = time.Now().UTC().Format(time.RFC3339)
+}
+
+// statuses returns the state of the forwarding to every target
+func (r *replicator) statuses(ctx context.Context) ([]ReplicationStatus, error) {
+	statuses := make([]ReplicationStatus, 0, len(r.targets))
+
+	for _, target := range r.targets {
+		queued, err := r.registry.ReplicationQueued(ctx, target.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		target.mu.Lock()
+		statuses = append(statuses, ReplicationStatus{
+			Name:       target.Name,
+			URL:        target.URL,
+			Queued:     queued,
+			Sent:       target.sent.Load(),
+			Dropped:    target.dropped.Load(),
+			Failures:   target.failures.Load(),
+			LastError:  target.lastError,
+			LastSentAt: target.lastSentAt,
+		})
+		target.mu.Unlock()
+	}
+
+	return statuses, nil
+}
+
+// replicate stores the readings received from another region once validated like the ingested ones, they aren't
+// forwarded, so two regions replicating to each other don't loop
+func (i *ingester) replicate(ctx context.Context, batch *ReplicationBatch) (*ReplicationResult, error) {
+	result := &ReplicationResult{}
+	rules := i.currentRules()
+	now := time.Now().UTC()
+
+	for n := range batch.Readings {
+		sensorData := &batch.Readings[n]
+
+		if err := checkSensorData(sensorData, rules); err != nil {
+			result.Invalid++
+			continue
+		}
+
+		// The receive time decides between conflicting readings, one missing or ahead of the server clock is
+		// received now.
+		receivedAt, err := time.Parse(time.RFC3339, sensorData.ReceivedAt)
+
+		if err != nil || receivedAt.After(now) {
+			receivedAt = now
+		}
+
+		sensorData.ReceivedAt = receivedAt.UTC().Format(time.RFC3339)
+
+		if sensorData.Region == "" {
+			sensorData.Region = batch.Region
+		}
+
+		stored, err := i.merge(ctx, sensorData)
+
+		if err != nil {
+			return result, err
+		}
+
+		if stored {
+			result.Stored++
+		} else {
+			result.Conflicts++
+		}
+	}
+
+	return result, nil
+}
+
+// merge stores the reading unless a different one received later is stored at its time already, the store compares
+// and replaces them at once. It returns whether the reading is stored, the conflicts are logged and recorded.
+func (i *ingester) merge(ctx context.Context, sensorData *SensorData) (bool, error) {
+	stored, local, err := i.store.Merge(ctx, sensorData)
+
+	if err != nil || local == nil || sameMeasurements(local, sensorData) {
+		return stored, err
+	}
+
+	conflict := &ReplicationConflict{
+		DeviceId:   sensorData.DeviceId,
+		Time:       sensorData.Time,
+		DetectedAt: time.Now().UTC().Format(time.RFC3339),
+		Winner:     "local",
+		Local:      *local,
+		Replicated: *sensorData,
+	}
+
+	if stored {
+		conflict.Winner = "replicated"
+	}
+
+	log.Printf("Conflicting readings of device %s at %s from regions %q and %q, the %s one kept", conflict.DeviceId, conflict.Time, local.Region, sensorData.Region, conflict.Winner)
+
+	if err := i.registry.RecordReplicationConflict(ctx, conflict); err != nil {
+		log.Printf("Conflicting readings of device %s not recorded: %v", conflict.DeviceId, err)
+	}
+
+	return stored, nil
+}
+
+// resolveMerge picks among the readings stored at the time of a merged one the one it is compared to, the one
+// received last, and tells whether the merged one is stored and whether it replaces them, a reading stored already as
+// it is stays
+func resolveMerge(existing []SensorData, sensorData *SensorData) (*SensorData, bool, bool) {
+	var local *SensorData
+
+	for n := range existing {
+		if sameReading(&existing[n], sensorData) {
+			// Replicated again after a failed acknowledgement.
+			return &existing[n], true, false
+		}
+
+		if local == nil || receivedLater(&existing[n], local) {
+			local = &existing[n]
+		}
+	}
+
+	if local != nil && receivedLater(local, sensorData) {
+		return local, false, false
+	}
+
+	return local, true, true
+}
+
+// receivedLater tells whether the reading wins over the other: received later by the server, by their receive times
+// stamped in UTC, or at the same second in the greater region, or with the greater JSON, so every region picks the
+// same one whatever the order it merges them in
+func receivedLater(sensorData, other *SensorData) bool {
+	if sensorData.ReceivedAt != other.ReceivedAt {
+		return sensorData.ReceivedAt > other.ReceivedAt
+	}
+
+	if sensorData.Region != other.Region {
+		return sensorData.Region > other.Region
+	}
+
+	raw, _ := appendSensorData(nil, sensorData)
+	otherRaw, _ := appendSensorData(nil, other)
+
+	return bytes.Compare(raw, otherRaw) > 0
+}
+
+// sameReading tells whether the two readings are stored as the same bytes
+func sameReading(sensorData, other *SensorData) bool {
+	raw, err := json.Marshal(sensorData)
+	otherRaw, otherErr := json.Marshal(other)
+
+	return err == nil && otherErr == nil && bytes.Equal(raw, otherRaw)
+}
+
+// sameMeasurements tells whether the two readings differ only by the way they were received, e.g. a retry received
+// by two regions, which isn't a conflict
+func sameMeasurements(sensorData, other *SensorData) bool {
+	first, second := *sensorData, *other
+	first.ReceivedAt, second.ReceivedAt = "", ""
+	first.Region, second.Region = "", ""
+	first.Duplicate, second.Duplicate = false, false
+
+	return sameReading(&first, &second)
+}
+
+// queueReplicationScript appends a reading to the queue of KEYS[1], drops the oldest ones beyond the buffer of
+// ARGV[2] and moves the head position of KEYS[2] past them, it returns the number dropped.
+var queueReplicationScript = redis.NewScript(`
+local dropped = redis.call('RPUSH', KEYS[1], ARGV[1]) - tonumber(ARGV[2])
+if dropped <= 0 then
+	return 0
+end
+redis.call('LTRIM', KEYS[1], dropped, -1)
+redis.call('INCRBY', KEYS[2], dropped)
+return dropped
+`)
+
+// ackReplicationScript removes from the queue of KEYS[1] the readings before the position of ARGV[1], those dropped
+// meanwhile aren't counted twice, and moves the head position of KEYS[2] past them.
+var ackReplicationScript = redis.NewScript(`
+local acked = tonumber(ARGV[1]) - tonumber(redis.call('GET', KEYS[2]) or '0')
+if acked <= 0 then
+	return 0
+end
+redis.call('LTRIM', KEYS[1], acked, -1)
+redis.call('INCRBY', KEYS[2], acked)
+return acked
+`)
+
+// renewReplicationLockScript extends the lock of KEYS[1] by ARGV[2] milliseconds when ARGV[1] holds it.
+var renewReplicationLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// QueueReplication appends the reading to the queue of the target, the oldest readings beyond the buffer are dropped
+// and their number returned
+func (r *registry) QueueReplication(ctx context.Context, target string, raw []byte, buffer int) (int64, error) {
+	keys := []string{replicationQueueKeyPrefix + target, replicationHeadKeyPrefix + target}
+	dropped, err := queueReplicationScript.Run(ctx, r.rdb, keys, raw, buffer).Int64()
+
+	if err != nil {
+		return 0, fmt.Errorf("fatal error on queueing a reading for %s in the cache: %v", target, err)
+	}
+
+	return dropped, nil
+}
+
+// LockReplication takes or renews the lock of the target for the owner, false when another replica holds it
+func (r *registry) LockReplication(ctx context.Context, target, owner string, lease time.Duration) (bool, error) {
+	key := replicationLockKeyPrefix + target
+	renewed, err := renewReplicationLockScript.Run(ctx, r.rdb, []string{key}, owner, lease.Milliseconds()).Int()
+
+	if err != nil {
+		return false, fmt.Errorf("fatal error on locking the replication of %s in the cache: %v", target, err)
+	}
+
+	if renewed == 1 {
+		return true, nil
+	}
+
+	locked, err := r.rdb.SetNX(ctx, key, owner, lease).Result()
+
+	if err != nil {
+		return false, fmt.Errorf("fatal error on locking the replication of %s in the cache: %v", target, err)
+	}
+
+	return locked, nil
+}
+
+// ReplicationBatch returns the oldest readings queued for the target, up to the size, with the position of the first
+// one to acknowledge them by
+func (r *registry) ReplicationBatch(ctx context.Context, target string, size int) ([]string, int64, error) {
+	pipe := r.rdb.TxPipeline()
+	head := pipe.Get(ctx, replicationHeadKeyPrefix+target)
+	raws := pipe.LRange(ctx, replicationQueueKeyPrefix+target, 0, int64(size)-1)
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, 0, fmt.Errorf("fatal error on retrieving the readings to replicate to %s from the cache: %v", target, err)
+	}
+
+	// No head position before the first reading dropped or acknowledged.
+	position, _ := head.Int64()
+
+	return raws.Val(), position, nil
+}
+
+// AckReplication removes the readings queued for the target before the position once sent, the readings queued
+// since are kept even when older ones were dropped as the buffer was full
+func (r *registry) AckReplication(ctx context.Context, target string, position int64) error {
+	keys := []string{replicationQueueKeyPrefix + target, replicationHeadKeyPrefix + target}
+
+	if err := ackReplicationScript.Run(ctx, r.rdb, keys, position).Err(); err != nil {
+		return fmt.Errorf("fatal error on removing the readings replicated to %s from the cache: %v", target, err)
+	}
+
+	return nil
+}
+
+// ReplicationQueued returns the number of readings queued for the target
+func (r *registry) ReplicationQueued(ctx context.Context, target string) (int64, error) {
+	queued, err := r.rdb.LLen(ctx, replicationQueueKeyPrefix+target).Result()
+
+	if err != nil {
+		return 0, fmt.Errorf("fatal error on retrieving the readings to replicate to %s from the cache: %v", target, err)
+	}
+
+	return queued, nil
+}
+
+// RecordReplicationConflict keeps the conflict among the latest ones
+func (r *registry) RecordReplicationConflict(ctx context.Context, conflict *ReplicationConflict) error {
+	raw, err := json.Marshal(conflict)
+
+	if err != nil {
+		return err
+	}
+
+	pipe := r.rdb.TxPipeline()
+	pipe.ZAdd(ctx, replicationConflictsKey, redis.Z{Score: float64(time.Now().UnixMilli()), Member: raw})
+	pipe.ZRemRangeByRank(ctx, replicationConflictsKey, 0, -maxReplicationConflicts-1)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on recording a replication conflict of device id %s in the cache: %v", conflict.DeviceId, err)
+	}
+
+	return nil
+}
+
+// ReplicationConflicts returns up to the limit of the latest conflicts, the latest first, only those of the device
+// when given
+func (r *registry) ReplicationConflicts(ctx context.Context, deviceId string, limit int) ([]ReplicationConflict, error) {
+	raws, err := r.rdb.ZRevRange(ctx, replicationConflictsKey, 0, -1).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the replication conflicts from the cache: %v", err)
+	}
+
+	conflicts := make([]ReplicationConflict, 0)
+
+	for _, raw := range raws {
+		if len(conflicts) == limit {
+			break
+		}
+
+		var conflict ReplicationConflict
+
+		if err := json.Unmarshal([]byte(raw), &conflict); err != nil {
+			return nil, fmt.Errorf("fatal error on reading a replication conflict from the cache: %v", err)
+		}
+
+		if deviceId == "" || conflict.DeviceId == deviceId {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+
+	return conflicts, nil
+}
+
+// replicationAuth rejects with 401 Unauthorized the replication requests without a valid signature of the secret
+// shared with the other regions, the body is kept for the handler
+func replicationAuth(secret string) echo.MiddlewareFunc {
+	verifier := &signatureVerifier{maxSkew: defaultMaxSignatureSkew}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			body, err := io.ReadAll(c.Request().Body)
+
+			if err != nil {
+				return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to read the request body: %v", err))
+			}
+
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+			if err := verifier.verify(c.Request().Header, body, secret); err != nil {
+				log.Printf("Replication request from %s rejected: %v", c.RealIP(), err)
+				return newProblem(http.StatusUnauthorized, "invalid_signature", err.Error())
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// registerReplicationRoutes mounts the endpoint receiving the readings of the other regions on the given group
+func registerReplicationRoutes(g *echo.Group, ing *ingester) {
+	g.POST("/readings", func(c echo.Context) error {
+		var batch ReplicationBatch
+
+		if err := c.Bind(&batch); err != nil {
+			return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to get the replicated readings from the request body: %v", err))
+		}
+
+		if !idPattern.MatchString(batch.Region) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Replication 'region' must be 1 to 64 letters, digits, '_', '.' or '-'")
+		}
+
+		if ing.replicas != nil && batch.Region == ing.replicas.region {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Readings of region %s can't be replicated to itself", batch.Region))
+		}
+
+		if len(batch.Readings) > maxReplicatedReadings {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("A replication request is limited to %d readings, got %d", maxReplicatedReadings, len(batch.Readings)))
+		}
+
+		result, err := ing.replicate(c.Request().Context(), &batch)
+
+		if err != nil {
+			return fmt.Errorf("readings of region %s not replicated: %w", batch.Region, err)
+		}
+
+		return c.JSON(http.StatusOK, result)
+	})
+}
+
+// registerReplicationAdminRoutes mounts the replication status endpoint, when the readings are replicated, and the
+// conflicts endpoint on the given group
+func registerReplicationAdminRoutes(g *echo.Group, ing *ingester) {
+	g.GET("/replication/conflicts", func(c echo.Context) error {
+		deviceId := c.QueryParam("device_id")
+		limit := defaultConflictsLimit
+
+		if raw := c.QueryParam("limit"); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+
+			if err != nil || parsed < 1 {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'limit' %s must be a positive number", raw))
+			}
+
+			limit = parsed
+		}
+
+		conflicts, err := ing.registry.ReplicationConflicts(c.Request().Context(), deviceId, limit)
+
+		if err != nil {
+			return registryHTTPError(err)
+		}
+
+		return c.JSON(http.StatusOK, conflicts)
+	})
+
+	if ing.replicas == nil {
+		return
+	}
+
+	g.GET("/replication", func(c echo.Context) error {
+		statuses, err := ing.replicas.statuses(c.Request().Context())
+
+		if err != nil {
+			return registryHTTPError(err)
+		}
+
+		return c.JSON(http.StatusOK, statuses)
+	})
+}
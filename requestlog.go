@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// defaultRequestLogMaxBody is the number of bytes of a body logged without a max_body_bytes setting.
+	defaultRequestLogMaxBody = 4096
+	// redactedValue replaces the value of the redacted headers.
+	redactedValue = "[REDACTED]"
+)
+
+// defaultRedactedHeaders are always redacted from the logged requests and responses.
+var defaultRedactedHeaders = []string{echo.HeaderAuthorization, echo.HeaderCookie, echo.HeaderSetCookie, "X-Api-Key", "Proxy-Authorization"}
+
+// RequestLogConfig sets the logging of the full requests and responses, for debugging the payloads of some devices.
+//
+// The settings can be changed at runtime through PUT /admin/request-log.
+type RequestLogConfig struct {
+	Enabled       bool     `json:"enabled"`        // Logs the requests and responses
+	SampleRate    *float64 `json:"sample_rate"`    // Fraction of the requests logged, 1 by default
+	Devices       []string `json:"devices"`        // Devices whose requests are logged, all when empty
+	RedactHeaders []string `json:"redact_headers"` // Headers redacted on top of Authorization, Cookie, Set-Cookie, X-Api-Key and Proxy-Authorization
+	MaxBodyBytes  int      `json:"max_body_bytes"` // Bytes of a body logged, 4096 by default
+}
+
+// requestLogEntry is the logged exchange of a request and its response.
+type requestLogEntry struct {
+	Method          string              `json:"method"`
+	Path            string              `json:"path"`
+	Query           string              `json:"query,omitempty"`
+	DeviceId        string              `json:"device_id,omitempty"`
+	Status          int                 `json:"status"`
+	Latency         string              `json:"latency"`
+	RequestHeaders  map[string][]string `json:"request_headers"`
+	RequestBody     string              `json:"request_body,omitempty"`
+	ResponseHeaders map[string][]string `json:"response_headers"`
+	ResponseBody    string              `json:"response_body,omitempty"`
+	Truncated       bool                `json:"truncated,omitempty"` // Set when a body is longer than the max body bytes
+}
+
+// requestLogger logs the sampled requests and responses with their sensitive headers redacted.
+type requestLogger struct {
+	mu       sync.RWMutex
+	config   RequestLogConfig
+	devices  map[string]bool
+	redacted map[string]bool
+
+	normalizeDeviceId func(deviceId string) string
+}
+
+// newRequestLogger validates the settings of the request logging
+func newRequestLogger(config RequestLogConfig, normalizeDeviceId func(deviceId string) string) (*requestLogger, error) {
+	l := &requestLogger{normalizeDeviceId: normalizeDeviceId}
+
+	if err := l.update(config); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// update validates and applies new settings
+func (l *requestLogger) update(config RequestLogConfig) error {
+	if config.SampleRate == nil {
+		config.SampleRate = floatPtr(1)
+	}
+
+	if *config.SampleRate < 0 || *config.SampleRate > 1 {
+		return fmt.Errorf("sample rate %g must be between 0 and 1", *config.SampleRate)
+	}
+
+	if config.MaxBodyBytes < 0 {
+		return fmt.Errorf("max body bytes %d must be positive", config.MaxBodyBytes)
+	}
+
+	if config.MaxBodyBytes == 0 {
+		config.MaxBodyBytes = defaultRequestLogMaxBody
+	}
+
+	var devices map[string]bool
+
+	if len(config.Devices) > 0 {
+		devices = make(map[string]bool, len(config.Devices))
+
+		for _, deviceId := range config.Devices {
+			devices[deviceId] = true
+		}
+	}
+
+	redacted := make(map[string]bool, len(defaultRedactedHeaders)+len(config.RedactHeaders))
+
+	for _, header := range append(append([]string(nil), defaultRedactedHeaders...), config.RedactHeaders...) {
+		redacted[http.CanonicalHeaderKey(header)] = true
+	}
+
+	l.mu.Lock()
+	l.config, l.devices, l.redacted = config, devices, redacted
+	l.mu.Unlock()
+
+	return nil
+}
+
+// settings returns the current settings
+func (l *requestLogger) settings() RequestLogConfig {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.config
+}
+
+// middleware logs the exchanges selected by the current settings
+func (l *requestLogger) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		l.mu.RLock()
+		config, devices, redacted := l.config, l.devices, l.redacted
+		l.mu.RUnlock()
+
+		if !config.Enabled || rand.Float64() >= *config.SampleRate {
+			return next(c)
+		}
+
+		request := c.Request()
+		var body []byte
+
+		if request.Body != nil {
+			var err error
+
+			if body, err = io.ReadAll(request.Body); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to read the request body: %v", err))
+			}
+
+			request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		deviceId := requestDeviceId(c, body, l.normalizeDeviceId)
+
+		if devices != nil && !devices[deviceId] {
+			return next(c)
+		}
+
+		recorder := &bodyRecorder{ResponseWriter: c.Response().Writer, limit: config.MaxBodyBytes}
+		c.Response().Writer = recorder
+		start := time.Now()
+
+		err := next(c)
+
+		// The error response is written here so it is recorded too, the error handler skips the committed responses afterwards.
+		if err != nil {
+			c.Error(err)
+		}
+
+		entry := requestLogEntry{
+			Method:          request.Method,
+			Path:            request.URL.Path,
+			Query:           request.URL.RawQuery,
+			DeviceId:        deviceId,
+			Status:          c.Response().Status,
+			Latency:         time.Since(start).String(),
+			RequestHeaders:  redactHeaders(request.Header, redacted),
+			ResponseHeaders: redactHeaders(c.Response().Header(), redacted),
+			ResponseBody:    recorder.body.String(),
+			Truncated:       recorder.truncated,
+		}
+
+		if len(body) > config.MaxBodyBytes {
+			body, entry.Truncated = body[:config.MaxBodyBytes], true
+		}
+
+		entry.RequestBody = string(body)
+
+		if logged, err := json.Marshal(entry); err == nil {
+			log.Printf("HTTP exchange: %s", logged)
+		}
+
+		return err
+	}
+}
+
+// requestDeviceId returns the device of the request from its route or the device_id of its JSON body, empty if unknown.
+// The id is normalized as by the ingest, so " TH-01" is the device th-01 its readings are stored under.
+func requestDeviceId(c echo.Context, body []byte, normalize func(deviceId string) string) string {
+	if deviceId := routeDeviceId(c); deviceId != "" {
+		return normalize(deviceId)
+	}
+
+	var payload struct {
+		DeviceId string `json:"device_id"`
+	}
+
+	if len(body) > 0 && json.Unmarshal(body, &payload) == nil {
+		return normalize(payload.DeviceId)
+	}
+
+	return ""
+}
+
+// routeDeviceId returns the device of the request from its id parameter, empty for the routes not about a device
+func routeDeviceId(c echo.Context) string {
+	if c.Path() == "/getDataById" {
+		return c.QueryParam("id")
+	}
+
+	if strings.HasPrefix(c.Path(), "/data/:id") || strings.HasPrefix(c.Path(), "/devices/:id") {
+		return c.Param("id")
+	}
+
+	return ""
+}
+
+// redactHeaders copies the headers with the values of the sensitive ones redacted
+func redactHeaders(headers http.Header, redacted map[string]bool) map[string][]string {
+	copied := make(map[string][]string, len(headers))
+
+	for name, values := range headers {
+		if redacted[http.CanonicalHeaderKey(name)] {
+			copied[name] = []string{redactedValue}
+			continue
+		}
+
+		copied[name] = values
+	}
+
+	return copied
+}
+
+// bodyRecorder keeps the first bytes of a response body while writing it.
+type bodyRecorder struct {
+	http.ResponseWriter
+	body      bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Write records the start of the body and writes it
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	if room := r.limit - r.body.Len(); room > 0 {
+		if len(b) > room {
+			r.body.Write(b[:room])
+			r.truncated = true
+		} else {
+			r.body.Write(b)
+		}
+	} else if len(b) > 0 {
+		r.truncated = true
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying writer, for the long-polled responses
+func (r *bodyRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// registerRequestLogRoutes mounts the endpoints reading and changing the request logging settings on the given group
+func registerRequestLogRoutes(g *echo.Group, logger *requestLogger) {
+	g.GET("/request-log", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, logger.settings())
+	})
+	g.PUT("/request-log", func(c echo.Context) error {
+		var config RequestLogConfig
+
+		if err := c.Bind(&config); err != nil {
+			return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to get the settings from the request body: %v", err)).withFields(err)
+		}
+
+		if err := logger.update(config); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		log.Printf("Request logging settings changed: enabled %t, sample rate %g, devices %v", config.Enabled, *logger.settings().SampleRate, config.Devices)
+
+		return c.JSON(http.StatusOK, logger.settings())
+	})
+}
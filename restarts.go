@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// restartsKeyPrefix prefixes the hash tracking the uptime and the restarts of a device.
+	restartsKeyPrefix = "restarts:"
+	// restartCountsKey is the Redis sorted set of the devices scored by their number of restarts.
+	restartCountsKey = "restart-counts"
+	// defaultRestartsLimit is the number of devices listed by the restart ranking by default.
+	defaultRestartsLimit = 10
+)
+
+// trackUptimeScript compares the uptime of a reading with the one of the previous reading of the device,
+// a lower uptime counts a restart. Readings older than the last one tracked are ignored.
+var trackUptimeScript = redis.NewScript(`
+local time = tonumber(ARGV[2])
+local uptime = tonumber(ARGV[3])
+local lastTime = tonumber(redis.call('HGET', KEYS[1], 'time_ms'))
+local lastUptime = tonumber(redis.call('HGET', KEYS[1], 'uptime'))
+
+if lastTime and lastTime >= time then
+  return 0
+end
+
+redis.call('HSET', KEYS[1], 'time_ms', ARGV[2], 'uptime', ARGV[3])
+
+if lastUptime and uptime < lastUptime then
+  redis.call('HINCRBY', KEYS[1], 'count', 1)
+  redis.call('HSET', KEYS[1], 'last_restart_ms', tostring(time - uptime * 1000))
+  redis.call('ZINCRBY', KEYS[2], 1, ARGV[1])
+  return 1
+end
+
+return 0
+`)
+
+// Restarts counts the restarts of a device detected from its uptime going down.
+type Restarts struct {
+	DeviceId      string `json:"device_id"`
+	Restarts      int64  `json:"restarts"`
+	LastRestartAt string `json:"last_restart_at,omitempty"` // Time of the last restart, the time of the reading minus its uptime
+}
+
+// TrackUptime records the uptime of the reading and reports whether the device restarted since its previous reading
+func (r *registry) TrackUptime(ctx context.Context, deviceId string, timestamp time.Time, uptime int) (bool, error) {
+	keys := []string{restartsKeyPrefix + deviceId, restartCountsKey}
+	restarted, err := trackUptimeScript.Run(ctx, r.rdb, keys, deviceId, timestamp.UnixMilli(), uptime).Int()
+
+	if err != nil {
+		return false, fmt.Errorf("fatal error on tracking the uptime of device %s in the cache: %v", deviceId, err)
+	}
+
+	return restarted == 1, nil
+}
+
+// Restarts returns the restarts of the device, zero when none was detected
+func (r *registry) Restarts(ctx context.Context, deviceId string) (*Restarts, error) {
+	fields, err := r.rdb.HGetAll(ctx, restartsKeyPrefix+deviceId).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the restarts of device %s from the cache: %v", deviceId, err)
+	}
+
+	restarts := &Restarts{DeviceId: deviceId}
+	restarts.Restarts, _ = strconv.ParseInt(fields["count"], 10, 64)
+
+	if lastRestart, err := strconv.ParseInt(fields["last_restart_ms"], 10, 64); err == nil {
+		restarts.LastRestartAt = time.UnixMilli(lastRestart).UTC().Format(time.RFC3339)
+	}
+
+	return restarts, nil
+}
+
+// MostRestarting returns the devices with the most restarts, most first
+func (r *registry) MostRestarting(ctx context.Context, limit int) ([]Restarts, error) {
+	ranked, err := r.rdb.ZRevRangeWithScores(ctx, restartCountsKey, 0, int64(limit-1)).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the restart ranking from the cache: %v", err)
+	}
+
+	devices := make([]Restarts, 0, len(ranked))
+
+	for _, entry := range ranked {
+		restarts, err := r.Restarts(ctx, entry.Member.(string))
+
+		if err != nil {
+			return nil, err
+		}
+
+		devices = append(devices, *restarts)
+	}
+
+	return devices, nil
+}
+
+// registerRestartRoutes mounts the fleet-wide restart ranking on the given group
+func registerRestartRoutes(g *echo.Group, reg *registry) {
+	g.GET("", func(c echo.Context) error {
+		return listMostRestarting(c, reg)
+	})
+}
+
+// listMostRestarting returns the devices restarting the most, limited by the limit query parameter
+func listMostRestarting(c echo.Context, reg *registry) error {
+	limit := defaultRestartsLimit
+
+	if raw := c.QueryParam("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+
+		if err != nil || parsed < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'limit' %s must be a positive number", raw))
+		}
+
+		limit = parsed
+	}
+
+	devices, err := reg.MostRestarting(c.Request().Context(), limit)
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, devices)
+}
+
+// getRestarts returns the restarts of the device
+func getRestarts(c echo.Context, reg *registry) error {
+	restarts, err := reg.Restarts(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, restarts)
+}
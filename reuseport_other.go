@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort isn't supported on this platform, the restarts are handed over by the service manager
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on this platform")
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePort lets a new process of the API listen on the port of the running one, the kernel spreads the connections
+// over both until the old one stops
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+
+	err := conn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
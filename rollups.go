@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// rollupKeyPrefix prefixes the per-rollup, group and interval hash of the running sums of the values.
+	rollupKeyPrefix = "rollup:"
+	// rollupGroupsKeyPrefix prefixes the set of the groups a rollup has values for.
+	rollupGroupsKeyPrefix = "rollup-groups:"
+	// maxRollupPoints bounds the number of intervals per group a rollup query can return.
+	maxRollupPoints = 10000
+)
+
+// RollupConfig defines a continuous query maintained incrementally at ingest, e.g. the hourly temperature per device type.
+type RollupConfig struct {
+	Name      string   `json:"name"`      // Name of the rollup in the query endpoint
+	Metric    string   `json:"metric"`    // Measurement rolled up, temp by default
+	GroupBy   string   `json:"group_by"`  // "device_type", "device_id", "label:<key>", or empty for all the readings together
+	Interval  Duration `json:"interval"`  // Length of the intervals, 1 hour by default
+	Retention Duration `json:"retention"` // How long the intervals are kept, 30 days by default
+}
+
+// RollupPoint is the summary of the values of an interval of a rollup.
+type RollupPoint struct {
+	Time string `json:"time"` // Start of the interval
+	*Aggregate
+}
+
+// rollupReport is the series of a rollup over a time range, by group.
+type rollupReport struct {
+	RollupConfig
+	From   time.Time                `json:"from"`
+	To     time.Time                `json:"to"`
+	Series map[string][]RollupPoint `json:"series"` // Points of every group, oldest first, without the empty intervals
+}
+
+// rollup is a validated continuous query.
+type rollup struct {
+	RollupConfig
+	labelKey string
+}
+
+// rollups maintains the configured continuous queries at ingest.
+type rollups struct {
+	rollups  []*rollup
+	registry *registry
+}
+
+// newRollups validates the continuous queries and applies their defaults
+func newRollups(configs []RollupConfig, reg *registry) (*rollups, error) {
+	r := &rollups{registry: reg}
+	names := make(map[string]bool)
+
+	for _, config := range configs {
+		if !idPattern.MatchString(config.Name) {
+			return nil, fmt.Errorf("rollup name %q must be 1 to 64 letters, digits, '_', '.' or '-'", config.Name)
+		}
+
+		if names[config.Name] {
+			return nil, fmt.Errorf("rollup %s is defined twice", config.Name)
+		}
+
+		names[config.Name] = true
+
+		if config.Metric == "" {
+			config.Metric = "temp"
+		}
+
+		if !metricNamePattern.MatchString(config.Metric) {
+			return nil, fmt.Errorf("metric name %q of rollup %s is invalid", config.Metric, config.Name)
+		}
+
+		if config.Interval == 0 {
+			config.Interval = Duration(time.Hour)
+		}
+
+		if config.Interval < Duration(time.Minute) {
+			return nil, fmt.Errorf("interval of rollup %s must be at least 1 minute", config.Name)
+		}
+
+		if config.Retention <= 0 {
+			config.Retention = Duration(30 * 24 * time.Hour)
+		}
+
+		compiled := &rollup{RollupConfig: config}
+
+		switch {
+		case config.GroupBy == "" || config.GroupBy == "device_type" || config.GroupBy == "device_id":
+		case strings.HasPrefix(config.GroupBy, "label:") && idPattern.MatchString(strings.TrimPrefix(config.GroupBy, "label:")):
+			compiled.labelKey = strings.TrimPrefix(config.GroupBy, "label:")
+		default:
+			return nil, fmt.Errorf("group_by %q of rollup %s must be device_type, device_id or label:<key>", config.GroupBy, config.Name)
+		}
+
+		r.rollups = append(r.rollups, compiled)
+	}
+
+	return r, nil
+}
+
+// enabled reports whether at least one rollup is configured
+func (r *rollups) enabled() bool {
+	return r != nil && len(r.rollups) > 0
+}
+
+// find returns the rollup with the given name
+func (r *rollups) find(name string) *rollup {
+	for _, rollup := range r.rollups {
+		if rollup.Name == name {
+			return rollup
+		}
+	}
+
+	return nil
+}
+
+// record adds the reading to the intervals of every rollup of its measurement
+func (r *rollups) record(ctx context.Context, sensorData *SensorData) error {
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return err
+	}
+
+	measurements := sensorData.Measurements()
+	var labels map[string]string
+
+	for _, rollup := range r.rollups {
+		value, found := measurements[rollup.Metric]
+
+		if !found {
+			continue
+		}
+
+		group := "all"
+
+		switch {
+		case rollup.GroupBy == "device_type":
+			group = sensorData.DeviceType
+		case rollup.GroupBy == "device_id":
+			group = sensorData.DeviceId
+		case rollup.labelKey != "":
+			if labels == nil {
+				if labels, err = r.registry.Labels(ctx, sensorData.DeviceId); err != nil {
+					return err
+				}
+			}
+
+			// The readings of the devices without the label are left out of the rollup.
+			if group = labels[rollup.labelKey]; group == "" {
+				continue
+			}
+		}
+
+		if err := r.registry.AddToRollup(ctx, rollup, group, timestamp, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollupKey returns the key of the running sums of the group of the rollup for the interval starting at the given time
+func rollupKey(rollup *rollup, group string, interval time.Time) string {
+	return rollupKeyPrefix + rollup.Name + ":" + group + ":" + strconv.FormatInt(interval.Unix(), 10)
+}
+
+// AddToRollup adds the value to the running sums of the group of the rollup for the interval of the timestamp
+func (r *registry) AddToRollup(ctx context.Context, rollup *rollup, group string, timestamp time.Time, value float64) error {
+	interval := timestamp.Truncate(time.Duration(rollup.Interval))
+	ttl := time.Until(interval.Add(time.Duration(rollup.Retention + rollup.Interval)))
+
+	// Readings older than the retention are left out.
+	if ttl <= 0 {
+		return nil
+	}
+
+	if err := r.addRunningSums(ctx, rollupKey(rollup, group, interval), value, ttl); err != nil {
+		return fmt.Errorf("fatal error on updating the rollup %s of %s in the cache: %v", rollup.Name, group, err)
+	}
+
+	if err := r.rdb.SAdd(ctx, rollupGroupsKeyPrefix+rollup.Name, group).Err(); err != nil {
+		return fmt.Errorf("fatal error on updating the groups of the rollup %s in the cache: %v", rollup.Name, err)
+	}
+
+	return nil
+}
+
+// RollupSeries returns the points of the groups of the rollup within [from, to], all the groups when none is given
+func (r *registry) RollupSeries(ctx context.Context, rollup *rollup, groups []string, from, to time.Time) (map[string][]RollupPoint, error) {
+	if len(groups) == 0 {
+		var err error
+
+		if groups, err = r.rdb.SMembers(ctx, rollupGroupsKeyPrefix+rollup.Name).Result(); err != nil {
+			return nil, fmt.Errorf("fatal error on retrieving the groups of the rollup %s from the cache: %v", rollup.Name, err)
+		}
+	}
+
+	sort.Strings(groups)
+	var intervals []time.Time
+
+	for interval := from.Truncate(time.Duration(rollup.Interval)); !interval.After(to); interval = interval.Add(time.Duration(rollup.Interval)) {
+		intervals = append(intervals, interval)
+	}
+
+	pipe := r.rdb.Pipeline()
+	cmds := make(map[string][]*redis.MapStringStringCmd, len(groups))
+
+	for _, group := range groups {
+		for _, interval := range intervals {
+			cmds[group] = append(cmds[group], pipe.HGetAll(ctx, rollupKey(rollup, group, interval)))
+		}
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the rollup %s from the cache: %v", rollup.Name, err)
+	}
+
+	series := make(map[string][]RollupPoint, len(groups))
+
+	for _, group := range groups {
+		points := []RollupPoint{}
+
+		for i, cmd := range cmds[group] {
+			sums := newRunningSums()
+			sums.merge(cmd.Val())
+
+			if summary := sums.aggregate(); summary != nil {
+				points = append(points, RollupPoint{Time: intervals[i].UTC().Format(time.RFC3339), Aggregate: summary})
+			}
+		}
+
+		series[group] = points
+	}
+
+	return series, nil
+}
+
+// registerRollupRoutes mounts the rollup endpoints on the given group
+func registerRollupRoutes(g *echo.Group, reg *registry, r *rollups) {
+	g.GET("", func(c echo.Context) error {
+		return listRollups(c, r)
+	})
+	g.GET("/:name", func(c echo.Context) error {
+		return getRollup(c, reg, r)
+	})
+}
+
+// listRollups returns the definitions of the rollups
+func listRollups(c echo.Context, r *rollups) error {
+	configs := []RollupConfig{}
+
+	for _, rollup := range r.rollups {
+		configs = append(configs, rollup.RollupConfig)
+	}
+
+	return c.JSON(http.StatusOK, configs)
+}
+
+// getRollup returns the series of the rollup over the time range, for the groups of the group query parameters or all of them
+func getRollup(c echo.Context, reg *registry, r *rollups) error {
+	rollup := r.find(c.Param("name"))
+
+	if rollup == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Rollup %s is not defined", c.Param("name")))
+	}
+
+	from, to, err := parseTimeRange(c, defaultQueryWindow)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if to.Sub(from)/time.Duration(rollup.Interval) > maxRollupPoints {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The range spans more than %d intervals of %v", maxRollupPoints, time.Duration(rollup.Interval)))
+	}
+
+	series, err := reg.RollupSeries(c.Request().Context(), rollup, c.QueryParams()["group"], from, to)
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, rollupReport{RollupConfig: rollup.RollupConfig, From: from, To: to, Series: series})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// SchemaConfig attaches a JSON Schema to the payloads of a device type, e.g.
+//
+//	{ "schema": { "type": "object", "required": ["temp"], "additionalProperties": false, "properties": { ... } } }
+//
+// The raw body is checked before decoding, so the fields unknown to the API are reported rather than dropped.
+type SchemaConfig struct {
+	Schema json.RawMessage `json:"schema"` // Inline schema
+	File   string          `json:"file"`   // Schema file, used when schema is empty, its relative $refs are resolved from its directory
+}
+
+// schemaValidator checks the payloads against the JSON Schema of their device type.
+type schemaValidator struct {
+	schemas map[string]*jsonschema.Schema
+}
+
+// newSchemaValidator compiles the schemas of the device types, nil without schemas
+func newSchemaValidator(configs map[string]SchemaConfig) (*schemaValidator, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	compiler := jsonschema.NewCompiler()
+	v := &schemaValidator{schemas: make(map[string]*jsonschema.Schema, len(configs))}
+
+	for deviceType, config := range configs {
+		location := config.File
+
+		if len(config.Schema) > 0 {
+			location = "inline:///" + url.PathEscape(deviceType) + ".json"
+
+			if err := compiler.AddResource(location, bytes.NewReader(config.Schema)); err != nil {
+				return nil, fmt.Errorf("schema of device type %s: %w", deviceType, err)
+			}
+		}
+
+		if location == "" {
+			return nil, fmt.Errorf("schema of device type %s needs a schema or a file", deviceType)
+		}
+
+		schema, err := compiler.Compile(location)
+
+		if err != nil {
+			return nil, fmt.Errorf("schema of device type %s: %w", deviceType, err)
+		}
+
+		v.schemas[deviceType] = schema
+	}
+
+	return v, nil
+}
+
+// check validates the body of the request against the schema of its device type, the body is kept for the binding.
+// A body that isn't JSON or of a device type without schema passes, the decoding and the validation reject it.
+func (v *schemaValidator) check(c echo.Context) error {
+	if v == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+
+	if err != nil {
+		return err
+	}
+
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+	return v.validate(body)
+}
+
+// validate checks the payload against the schema of its device type, every violation is reported
+func (v *schemaValidator) validate(body []byte) error {
+	var payload interface{}
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil
+	}
+
+	object, _ := payload.(map[string]interface{})
+	deviceType, _ := object["device_type"].(string)
+	schema := v.schemas[deviceType]
+
+	if schema == nil {
+		return nil
+	}
+
+	var validationError *jsonschema.ValidationError
+
+	if err := schema.Validate(payload); !errors.As(err, &validationError) {
+		return err
+	}
+
+	var errs fieldErrors
+	addSchemaViolations(&errs, validationError, payload)
+
+	return errs.err()
+}
+
+// addSchemaViolations adds the violations at the leaves of the validation error, the keyword they break is the constraint
+func addSchemaViolations(errs *fieldErrors, validationError *jsonschema.ValidationError, payload interface{}) {
+	if len(validationError.Causes) > 0 {
+		for _, cause := range validationError.Causes {
+			addSchemaViolations(errs, cause, payload)
+		}
+
+		return
+	}
+
+	pointer := splitJSONPointer(validationError.InstanceLocation)
+	keywords := splitJSONPointer(validationError.KeywordLocation)
+	field := strings.Join(pointer, ".")
+	constraint := "schema"
+
+	if len(keywords) > 0 {
+		constraint = keywords[len(keywords)-1]
+	}
+
+	// The value of a broken object or array, e.g. with a missing property, is left out.
+	value := valueAt(payload, pointer)
+
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		value = nil
+	}
+
+	if field == "" {
+		errs.add(field, constraint, value, "payload: %s", validationError.Message)
+		return
+	}
+
+	errs.add(field, constraint, value, "%s: %s", field, validationError.Message)
+}
+
+// splitJSONPointer returns the unescaped tokens of the JSON pointer, none for the root
+func splitJSONPointer(pointer string) []string {
+	if pointer == "" || pointer == "/" {
+		return nil
+	}
+
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens
+}
+
+// valueAt returns the value of the decoded payload at the tokens of a JSON pointer, nil when missing
+func valueAt(value interface{}, pointer []string) interface{} {
+	for _, token := range pointer {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			value = node[token]
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+
+			if err != nil || index < 0 || index >= len(node) {
+				return nil
+			}
+
+			value = node[index]
+		default:
+			return nil
+		}
+	}
+
+	return value
+}
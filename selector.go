@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// labelValuePattern restricts the values of the device labels, the keys follow idPattern.
+var labelValuePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{0,64}$`)
+
+// selectorOperator is the comparison of a selector requirement.
+type selectorOperator string
+
+const (
+	selectorEquals    selectorOperator = "="
+	selectorNotEquals selectorOperator = "!="
+	selectorIn        selectorOperator = "in"
+	selectorNotIn     selectorOperator = "notin"
+	selectorExists    selectorOperator = "exists"
+	selectorNotExists selectorOperator = "!"
+)
+
+// selectorRequirement is a single condition on a label.
+type selectorRequirement struct {
+	key      string
+	operator selectorOperator
+	values   []string
+}
+
+// labelSelector selects devices by their labels, all its requirements must match.
+//
+// The syntax follows the Kubernetes label selectors, requirements are separated by commas:
+//
+//	env=prod,zone!=north,tier in (gold,silver),site notin (lab),calibrated,!decommissioned
+type labelSelector []selectorRequirement
+
+// parseSelector parses a label selector, the empty selector matches every device
+func parseSelector(raw string) (labelSelector, error) {
+	var selector labelSelector
+
+	for _, part := range splitSelector(raw) {
+		part = strings.TrimSpace(part)
+
+		if part == "" {
+			continue
+		}
+
+		requirement, err := parseRequirement(part)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector requirement %q: %v", part, err)
+		}
+
+		selector = append(selector, requirement)
+	}
+
+	return selector, nil
+}
+
+// splitSelector splits the selector on the commas outside of parentheses
+func splitSelector(raw string) []string {
+	var parts []string
+	depth, start := 0, 0
+
+	for i, r := range raw {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, raw[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, raw[start:])
+}
+
+// parseRequirement parses one requirement of a selector
+func parseRequirement(part string) (selectorRequirement, error) {
+	var requirement selectorRequirement
+
+	switch {
+	case strings.HasPrefix(part, "!") && !strings.Contains(part, "="):
+		requirement = selectorRequirement{key: strings.TrimSpace(part[1:]), operator: selectorNotExists}
+	case strings.Contains(part, "!="):
+		key, value, _ := strings.Cut(part, "!=")
+		requirement = selectorRequirement{key: strings.TrimSpace(key), operator: selectorNotEquals, values: []string{strings.TrimSpace(value)}}
+	case strings.Contains(part, "=="):
+		key, value, _ := strings.Cut(part, "==")
+		requirement = selectorRequirement{key: strings.TrimSpace(key), operator: selectorEquals, values: []string{strings.TrimSpace(value)}}
+	case strings.Contains(part, "="):
+		key, value, _ := strings.Cut(part, "=")
+		requirement = selectorRequirement{key: strings.TrimSpace(key), operator: selectorEquals, values: []string{strings.TrimSpace(value)}}
+	case strings.HasSuffix(part, ")"):
+		fields := strings.SplitN(part, "(", 2)
+		head := strings.Fields(fields[0])
+
+		if len(head) != 2 || (head[1] != string(selectorIn) && head[1] != string(selectorNotIn)) {
+			return requirement, fmt.Errorf("expected 'key in (values)' or 'key notin (values)'")
+		}
+
+		requirement = selectorRequirement{key: head[0], operator: selectorOperator(head[1])}
+
+		for _, value := range strings.Split(strings.TrimSuffix(fields[1], ")"), ",") {
+			requirement.values = append(requirement.values, strings.TrimSpace(value))
+		}
+	default:
+		requirement = selectorRequirement{key: part, operator: selectorExists}
+	}
+
+	if !idPattern.MatchString(requirement.key) {
+		return requirement, fmt.Errorf("label key %q is invalid", requirement.key)
+	}
+
+	for _, value := range requirement.values {
+		if !labelValuePattern.MatchString(value) {
+			return requirement, fmt.Errorf("label value %q is invalid", value)
+		}
+	}
+
+	return requirement, nil
+}
+
+// matches reports whether the labels satisfy every requirement of the selector
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		if !requirement.matches(labels) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matches reports whether the labels satisfy the requirement, a missing label only satisfies !=, notin and !
+func (r selectorRequirement) matches(labels map[string]string) bool {
+	value, found := labels[r.key]
+
+	switch r.operator {
+	case selectorExists:
+		return found
+	case selectorNotExists:
+		return !found
+	case selectorEquals, selectorIn:
+		return found && contains(r.values, value)
+	case selectorNotEquals, selectorNotIn:
+		return !found || !contains(r.values, value)
+	}
+
+	return false
+}
+
+// contains reports whether the value is one of the values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
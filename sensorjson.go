@@ -0,0 +1,1004 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// hexDigits are the digits of the \u escapes of the JSON strings.
+const hexDigits = "0123456789abcdef"
+
+// jsonBufferPool recycles the buffers of the ingested payloads and of the readings encoded for Redis, the ingest
+// hot loop doesn't allocate a buffer per reading.
+var jsonBufferPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// getJSONBuffer returns a buffer of the pool, to be put back with putJSONBuffer once its bytes aren't used
+func getJSONBuffer() *[]byte {
+	return jsonBufferPool.Get().(*[]byte)
+}
+
+// putJSONBuffer puts the buffer back in the pool with its grown capacity, the oversized ones are left to the garbage collector
+func putJSONBuffer(buf *[]byte, grown []byte) {
+	if cap(grown) <= 64*1024 {
+		*buf = grown[:0]
+		jsonBufferPool.Put(buf)
+	}
+}
+
+// sensorDataField is a JSON field of SensorData.
+type sensorDataField struct {
+	name     string
+	index    int  // Index of the field in SensorData
+	required bool // Fields without omitempty, required by the strict decoding, but the time stamped at ingest when missing
+}
+
+// sensorDataFields are the JSON fields of SensorData in their declaration order.
+var sensorDataFields = func() []sensorDataField {
+	t := reflect.TypeOf(SensorData{})
+	fields := make([]sensorDataField, 0, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		name, options, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, sensorDataField{name: name, index: i, required: options != "omitempty" && name != "time"})
+	}
+
+	return fields
+}()
+
+// decodeSensorData reads the JSON reading of the request body through a pooled buffer, without the reflection of
+// echo over the path and query parameters. The other content types are bound by echo. The strict decoding rejects
+// the JSON readings with unknown fields or without a required field.
+func decodeSensorData(c echo.Context, sensorData *SensorData, strict bool) error {
+	request := c.Request()
+
+	if !strings.HasPrefix(request.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return c.Bind(sensorData)
+	}
+
+	pooled := getJSONBuffer()
+	body := bytes.NewBuffer((*pooled)[:0])
+	_, err := body.ReadFrom(request.Body)
+	defer putJSONBuffer(pooled, body.Bytes())
+
+	if err != nil {
+		return err
+	}
+
+	// An empty body is bound to the zero reading as by echo, it is rejected by the validation.
+	if body.Len() == 0 {
+		return decodeSensorDataJSON([]byte("{}"), sensorData, strict)
+	}
+
+	return decodeSensorDataJSON(body.Bytes(), sensorData, strict)
+}
+
+// maxJSONDepth is the deepest nesting of the JSON values accepted in a reading, the one of encoding/json.
+const maxJSONDepth = 10000
+
+// jsonSyntaxError reports a reading that isn't valid JSON, with the offset of the byte where its decoding failed.
+type jsonSyntaxError struct {
+	msg    string
+	Offset int64
+}
+
+// Error returns the message of the syntax error, the one of encoding/json
+func (e *jsonSyntaxError) Error() string {
+	return e.msg
+}
+
+// sensorDataDecoder decodes a JSON reading in a single pass over its bytes, without reflection. It follows the rules
+// of encoding/json: the names are matched case insensitively, a null leaves a field unchanged and the first value of
+// a wrong type is reported once the rest of the reading is decoded.
+type sensorDataDecoder struct {
+	data    []byte
+	pos     int
+	strict  bool
+	scratch []byte // Unescaped bytes of the last string, overwritten by the next one
+
+	typeError *json.UnmarshalTypeError
+	found     uint64   // Fields of SensorData found by their exact name, by index
+	unknown   []string // Names unknown to SensorData, by the strict decoding
+}
+
+// decodeSensorDataJSON decodes the JSON reading into the sensor data. The strict decoding rejects the JSON object
+// with a field unknown to SensorData, e.g. a misspelled "temprature", or without one of its required fields, every
+// such field is reported. The names are matched exactly, unlike the case insensitive decoding.
+func decodeSensorDataJSON(data []byte, sensorData *SensorData, strict bool) error {
+	d := &sensorDataDecoder{data: data, strict: strict}
+	d.skipSpace()
+	var err error
+
+	switch d.peek() {
+	case '{':
+		err = d.object(1, func(key []byte) error {
+			return d.field(key, sensorData)
+		})
+	case 'n':
+		err = d.literal("null")
+	default:
+		// A body that isn't a JSON object is left to the type check, as by encoding/json.
+		strict = false
+		err = d.mismatch("", "", reflect.TypeOf(SensorData{}), 0)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if d.skipSpace(); d.pos < len(d.data) {
+		return d.invalidCharacter("after top-level value")
+	}
+
+	if strict {
+		if err := d.strictErr(); err != nil {
+			return err
+		}
+	}
+
+	if d.typeError != nil {
+		return d.typeError
+	}
+
+	return nil
+}
+
+// field decodes the value of a field of the reading, the unknown ones are skipped
+func (d *sensorDataDecoder) field(key []byte, s *SensorData) error {
+	index := -1
+
+	for _, field := range sensorDataFields {
+		if string(key) == field.name {
+			index = field.index
+			d.found |= 1 << index
+
+			break
+		}
+	}
+
+	if index < 0 && d.strict {
+		d.unknown = append(d.unknown, string(key))
+	}
+
+	if index < 0 && !d.strict {
+		for _, field := range sensorDataFields {
+			if bytes.EqualFold(key, []byte(field.name)) {
+				index = field.index
+
+				break
+			}
+		}
+	}
+
+	if index < 0 {
+		return d.skip(1)
+	}
+
+	switch name := sensorDataFields[index].name; name {
+	case "time":
+		return d.string(name, &s.Time)
+	case "device_id":
+		return d.string(name, &s.DeviceId)
+	case "device_type":
+		return d.string(name, &s.DeviceType)
+	case "uptime":
+		return d.int(name, &s.Uptime)
+	case "temp":
+		return d.float32(name, &s.Temp)
+	case "humidity":
+		return d.optionalFloat32(name, &s.Humidity)
+	case "pressure":
+		return d.optionalFloat32(name, &s.Pressure)
+	case "battery_voltage":
+		return d.optionalFloat32(name, &s.BatteryVoltage)
+	case "metrics":
+		return d.values(name, &s.Metrics)
+	case "firmware":
+		return d.string(name, &s.Firmware)
+	case "received_at":
+		return d.string(name, &s.ReceivedAt)
+	case "device_time":
+		return d.string(name, &s.DeviceTime)
+	case "duplicate":
+		return d.bool(name, &s.Duplicate)
+	case "region":
+		return d.string(name, &s.Region)
+	case "derived":
+		return d.values(name, &s.Derived)
+	}
+
+	return fmt.Errorf("field %s of the sensor data has no decoder", sensorDataFields[index].name)
+}
+
+// strictErr returns the errors of the fields unknown or missing of the strict decoding
+func (d *sensorDataDecoder) strictErr() error {
+	var errs fieldErrors
+
+	for _, field := range sensorDataFields {
+		if field.required && d.found&(1<<field.index) == 0 {
+			errs.add(field.name, "required", nil, "%s is required", field.name)
+		}
+	}
+
+	sort.Strings(d.unknown)
+
+	for i, name := range d.unknown {
+		if i == 0 || name != d.unknown[i-1] {
+			errs.add(name, "unknown_field", nil, "%s is not a field of the sensor data", name)
+		}
+	}
+
+	return errs.err()
+}
+
+// string decodes a JSON string, a null leaves the value unchanged
+func (d *sensorDataDecoder) string(field string, value *string) error {
+	switch d.peek() {
+	case '"':
+		s, err := d.stringBytes()
+
+		if err != nil {
+			return err
+		}
+
+		*value = string(s)
+
+		return nil
+	case 'n':
+		return d.literal("null")
+	}
+
+	return d.mismatch(field, "", reflect.TypeOf(""), 1)
+}
+
+// bool decodes a JSON boolean, a null leaves the value unchanged
+func (d *sensorDataDecoder) bool(field string, value *bool) error {
+	switch d.peek() {
+	case 't':
+		*value = true
+		return d.literal("true")
+	case 'f':
+		*value = false
+		return d.literal("false")
+	case 'n':
+		return d.literal("null")
+	}
+
+	return d.mismatch(field, "", reflect.TypeOf(false), 1)
+}
+
+// int decodes a JSON integer, a null leaves the value unchanged
+func (d *sensorDataDecoder) int(field string, value *int) error {
+	if c := d.peek(); c != '-' && !isJSONDigit(c) {
+		return d.nullOrMismatch(field, "", reflect.TypeOf(0))
+	}
+
+	offset := d.pos
+	literal, err := d.number()
+
+	if err != nil {
+		return err
+	}
+
+	n, err := strconv.ParseInt(string(literal), 10, strconv.IntSize)
+
+	if err != nil {
+		d.typeMismatch(field, "", "number "+string(literal), reflect.TypeOf(0), offset)
+		return nil
+	}
+
+	*value = int(n)
+
+	return nil
+}
+
+// float32 decodes a JSON number, a null leaves the value unchanged
+func (d *sensorDataDecoder) float32(field string, value *float32) error {
+	f, ok, err := d.float(field, "", 32)
+
+	if ok {
+		*value = float32(f)
+	}
+
+	return err
+}
+
+// optionalFloat32 decodes a JSON number of an optional measurement, a null unsets it
+func (d *sensorDataDecoder) optionalFloat32(field string, value **float32) error {
+	if d.peek() == 'n' {
+		*value = nil
+		return d.literal("null")
+	}
+
+	f, ok, err := d.float(field, "", 32)
+
+	if ok {
+		v := float32(f)
+		*value = &v
+	}
+
+	return err
+}
+
+// values decodes a JSON object of numbers by name, e.g. the metrics, a null unsets it
+func (d *sensorDataDecoder) values(field string, values *map[string]float64) error {
+	switch d.peek() {
+	case '{':
+	case 'n':
+		*values = nil
+		return d.literal("null")
+	default:
+		return d.mismatch(field, "", reflect.TypeOf(*values), 1)
+	}
+
+	if *values == nil {
+		*values = make(map[string]float64)
+	}
+
+	return d.object(2, func(key []byte) error {
+		name := string(key)
+
+		// A null or a value of another type is stored as a zero as by encoding/json.
+		f, _, err := d.float(field, name, 64)
+		(*values)[name] = f
+
+		return err
+	})
+}
+
+// float decodes a JSON number as a float of the bits, ok is false for a null or a value of another type, which is
+// skipped
+func (d *sensorDataDecoder) float(field, key string, bits int) (f float64, ok bool, err error) {
+	t := reflect.TypeOf(float64(0))
+
+	if bits == 32 {
+		t = reflect.TypeOf(float32(0))
+	}
+
+	if c := d.peek(); c != '-' && !isJSONDigit(c) {
+		return 0, false, d.nullOrMismatch(field, key, t)
+	}
+
+	offset := d.pos
+	literal, err := d.number()
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	if f, err = strconv.ParseFloat(string(literal), bits); err != nil {
+		d.typeMismatch(field, key, "number "+string(literal), t, offset)
+		return 0, false, nil
+	}
+
+	return f, true, nil
+}
+
+// nullOrMismatch consumes a null, or skips a value of another type than the one of the field
+func (d *sensorDataDecoder) nullOrMismatch(field, key string, t reflect.Type) error {
+	if d.peek() == 'n' {
+		return d.literal("null")
+	}
+
+	depth := 1
+
+	if key != "" {
+		depth = 2
+	}
+
+	return d.mismatch(field, key, t, depth)
+}
+
+// mismatch records the type error of the value at the position, then skips it
+func (d *sensorDataDecoder) mismatch(field, key string, t reflect.Type, depth int) error {
+	offset := d.pos
+	value := "number"
+
+	switch d.peek() {
+	case '{':
+		value = "object"
+	case '[':
+		value = "array"
+	case '"':
+		value = "string"
+	case 't', 'f':
+		value = "bool"
+	}
+
+	if err := d.skip(depth); err != nil {
+		return err
+	}
+
+	d.typeMismatch(field, key, value, t, offset)
+
+	return nil
+}
+
+// typeMismatch records the type error of a value unless an earlier value had one
+func (d *sensorDataDecoder) typeMismatch(field, key, value string, t reflect.Type, offset int) {
+	if d.typeError != nil {
+		return
+	}
+
+	d.typeError = &json.UnmarshalTypeError{Value: value, Type: t, Offset: int64(offset)}
+
+	if field != "" {
+		d.typeError.Struct, d.typeError.Field = "SensorData", field
+	}
+
+	if key != "" {
+		d.typeError.Field += "." + key
+	}
+}
+
+// object calls decode with the key of every member of the JSON object at the position, to decode or skip its value
+func (d *sensorDataDecoder) object(depth int, decode func(key []byte) error) error {
+	if depth > maxJSONDepth {
+		return d.syntaxError("exceeded max depth")
+	}
+
+	d.pos++
+
+	if d.skipSpace(); d.peek() == '}' {
+		d.pos++
+		return nil
+	}
+
+	for {
+		if d.peek() != '"' {
+			return d.invalidCharacter("looking for beginning of object key string")
+		}
+
+		key, err := d.stringBytes()
+
+		if err != nil {
+			return err
+		}
+
+		if d.skipSpace(); d.peek() != ':' {
+			return d.invalidCharacter("after object key")
+		}
+
+		d.pos++
+		d.skipSpace()
+
+		if err := decode(key); err != nil {
+			return err
+		}
+
+		switch d.skipSpace(); d.peek() {
+		case ',':
+			d.pos++
+			d.skipSpace()
+		case '}':
+			d.pos++
+			return nil
+		default:
+			return d.invalidCharacter("after object key:value pair")
+		}
+	}
+}
+
+// skip consumes the JSON value at the position, checking its syntax
+func (d *sensorDataDecoder) skip(depth int) error {
+	switch c := d.peek(); {
+	case c == '{':
+		return d.object(depth+1, func([]byte) error {
+			return d.skip(depth + 1)
+		})
+	case c == '[':
+		return d.skipArray(depth + 1)
+	case c == '"':
+		_, err := d.stringBytes()
+		return err
+	case c == 't':
+		return d.literal("true")
+	case c == 'f':
+		return d.literal("false")
+	case c == 'n':
+		return d.literal("null")
+	case c == '-' || isJSONDigit(c):
+		_, err := d.number()
+		return err
+	}
+
+	return d.invalidCharacter("looking for beginning of value")
+}
+
+// skipArray consumes the JSON array at the position, checking its syntax
+func (d *sensorDataDecoder) skipArray(depth int) error {
+	if depth > maxJSONDepth {
+		return d.syntaxError("exceeded max depth")
+	}
+
+	d.pos++
+
+	if d.skipSpace(); d.peek() == ']' {
+		d.pos++
+		return nil
+	}
+
+	for {
+		if err := d.skip(depth); err != nil {
+			return err
+		}
+
+		switch d.skipSpace(); d.peek() {
+		case ',':
+			d.pos++
+			d.skipSpace()
+		case ']':
+			d.pos++
+			return nil
+		default:
+			return d.invalidCharacter("after array element")
+		}
+	}
+}
+
+// literal consumes the literal true, false or null at the position
+func (d *sensorDataDecoder) literal(word string) error {
+	for i := 1; i < len(word); i++ {
+		if d.pos+i >= len(d.data) || d.data[d.pos+i] != word[i] {
+			d.pos += i
+			return d.invalidCharacter(fmt.Sprintf("in literal %s (expecting %s)", word, quoteJSONCharacter(word[i])))
+		}
+	}
+
+	d.pos += len(word)
+
+	return nil
+}
+
+// number consumes the JSON number at the position and returns its literal
+func (d *sensorDataDecoder) number() ([]byte, error) {
+	start := d.pos
+
+	if d.peek() == '-' {
+		d.pos++
+	}
+
+	switch c := d.peek(); {
+	case c == '0':
+		d.pos++
+	case c >= '1' && c <= '9':
+		d.digits()
+	default:
+		return nil, d.invalidCharacter("in numeric literal")
+	}
+
+	if d.peek() == '.' {
+		if d.pos++; !isJSONDigit(d.peek()) {
+			return nil, d.invalidCharacter("after decimal point in numeric literal")
+		}
+
+		d.digits()
+	}
+
+	if c := d.peek(); c == 'e' || c == 'E' {
+		if d.pos++; d.peek() == '+' || d.peek() == '-' {
+			d.pos++
+		}
+
+		if !isJSONDigit(d.peek()) {
+			return nil, d.invalidCharacter("in exponent of numeric literal")
+		}
+
+		d.digits()
+	}
+
+	return d.data[start:d.pos], nil
+}
+
+// digits consumes the decimal digits at the position
+func (d *sensorDataDecoder) digits() {
+	for d.pos < len(d.data) && isJSONDigit(d.data[d.pos]) {
+		d.pos++
+	}
+}
+
+// stringBytes consumes the JSON string at the position and returns its unescaped bytes, valid until the next string.
+// The strings without escapes nor multi-byte characters aren't copied.
+func (d *sensorDataDecoder) stringBytes() ([]byte, error) {
+	d.pos++
+	start := d.pos
+
+	for d.pos < len(d.data) {
+		c := d.data[d.pos]
+
+		if c == '"' {
+			d.pos++
+			return d.data[start : d.pos-1], nil
+		}
+
+		if c == '\\' || c < 0x20 || c >= utf8.RuneSelf {
+			break
+		}
+
+		d.pos++
+	}
+
+	d.scratch = append(d.scratch[:0], d.data[start:d.pos]...)
+
+	for d.pos < len(d.data) {
+		switch c := d.data[d.pos]; {
+		case c == '"':
+			d.pos++
+			return d.scratch, nil
+		case c == '\\':
+			if err := d.escape(); err != nil {
+				return nil, err
+			}
+		case c < 0x20:
+			return nil, d.invalidCharacter("in string literal")
+		case c < utf8.RuneSelf:
+			d.scratch = append(d.scratch, c)
+			d.pos++
+		default:
+			// The invalid UTF-8 bytes are replaced as by encoding/json.
+			r, size := utf8.DecodeRune(d.data[d.pos:])
+			d.scratch = utf8.AppendRune(d.scratch, r)
+			d.pos += size
+		}
+	}
+
+	return nil, d.invalidCharacter("in string literal")
+}
+
+// escape appends the character of the string escape at the position to the scratch buffer
+func (d *sensorDataDecoder) escape() error {
+	d.pos++
+
+	switch c := d.peek(); c {
+	case '"', '\\', '/':
+		d.scratch = append(d.scratch, c)
+	case 'b':
+		d.scratch = append(d.scratch, '\b')
+	case 'f':
+		d.scratch = append(d.scratch, '\f')
+	case 'n':
+		d.scratch = append(d.scratch, '\n')
+	case 'r':
+		d.scratch = append(d.scratch, '\r')
+	case 't':
+		d.scratch = append(d.scratch, '\t')
+	case 'u':
+		r, err := d.hexRune()
+
+		if err != nil {
+			return err
+		}
+
+		// A surrogate half is decoded with the escape of the next one, a lone half is replaced as by encoding/json.
+		if utf16.IsSurrogate(r) {
+			low := rune(-1)
+
+			if next := d.data[d.pos+1:]; len(next) >= 6 && next[0] == '\\' && next[1] == 'u' {
+				low = parseJSONHex(next[2:6])
+			}
+
+			if r = utf16.DecodeRune(r, low); r != utf8.RuneError {
+				d.pos += 6
+			}
+		}
+
+		d.scratch = utf8.AppendRune(d.scratch, r)
+	default:
+		return d.invalidCharacter("in string escape code")
+	}
+
+	d.pos++
+
+	return nil
+}
+
+// hexRune consumes the 4 hexadecimal digits of the \u escape at the position, which is left on the last one
+func (d *sensorDataDecoder) hexRune() (rune, error) {
+	var r rune
+
+	for i := 0; i < 4; i++ {
+		digit := rune(-1)
+
+		if d.pos++; d.pos < len(d.data) {
+			digit = parseJSONHex(d.data[d.pos : d.pos+1])
+		}
+
+		if digit < 0 {
+			return 0, d.invalidCharacter(`in \u hexadecimal character escape`)
+		}
+
+		r = r<<4 | digit
+	}
+
+	return r, nil
+}
+
+// peek returns the byte at the position, 0 at the end of the data
+func (d *sensorDataDecoder) peek() byte {
+	if d.pos < len(d.data) {
+		return d.data[d.pos]
+	}
+
+	return 0
+}
+
+// skipSpace moves the position past the JSON whitespace
+func (d *sensorDataDecoder) skipSpace() {
+	for d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case ' ', '\t', '\n', '\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+// invalidCharacter returns the syntax error of the byte at the position in the context, worded as by encoding/json
+func (d *sensorDataDecoder) invalidCharacter(context string) error {
+	if d.pos >= len(d.data) {
+		return d.syntaxError("unexpected end of JSON input")
+	}
+
+	return d.syntaxError("invalid character " + quoteJSONCharacter(d.data[d.pos]) + " " + context)
+}
+
+// syntaxError returns the syntax error at the position
+func (d *sensorDataDecoder) syntaxError(msg string) error {
+	return &jsonSyntaxError{msg: msg, Offset: int64(d.pos)}
+}
+
+// quoteJSONCharacter quotes the character of a syntax error as encoding/json does
+func quoteJSONCharacter(c byte) string {
+	switch c {
+	case '\'':
+		return `'\''`
+	case '"':
+		return `'"'`
+	}
+
+	quoted := strconv.Quote(string(rune(c)))
+
+	return "'" + quoted[1:len(quoted)-1] + "'"
+}
+
+// isJSONDigit reports whether the byte is a decimal digit
+func isJSONDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parseJSONHex returns the value of the hexadecimal digits, -1 when one isn't or there are none
+func parseJSONHex(digits []byte) rune {
+	if len(digits) == 0 {
+		return -1
+	}
+
+	var r rune
+
+	for _, c := range digits {
+		switch {
+		case c >= '0' && c <= '9':
+			r = r<<4 | rune(c-'0')
+		case c >= 'a' && c <= 'f':
+			r = r<<4 | rune(c-'a'+10)
+		case c >= 'A' && c <= 'F':
+			r = r<<4 | rune(c-'A'+10)
+		default:
+			return -1
+		}
+	}
+
+	return r
+}
+
+// appendSensorData appends the JSON of the reading to the buffer, the same bytes as json.Marshal without its
+// reflection. It must follow the fields of SensorData and their omitempty tags.
+func appendSensorData(b []byte, s *SensorData) ([]byte, error) {
+	var err error
+
+	b = append(b, `{"time":`...)
+	b = appendJSONString(b, s.Time)
+	b = append(b, `,"device_id":`...)
+	b = appendJSONString(b, s.DeviceId)
+	b = append(b, `,"device_type":`...)
+	b = appendJSONString(b, s.DeviceType)
+	b = append(b, `,"uptime":`...)
+	b = strconv.AppendInt(b, int64(s.Uptime), 10)
+	b = append(b, `,"temp":`...)
+
+	if b, err = appendJSONFloat(b, float64(s.Temp), 32); err != nil {
+		return nil, err
+	}
+
+	for _, field := range []struct {
+		name  string
+		value *float32
+	}{
+		{`,"humidity":`, s.Humidity},
+		{`,"pressure":`, s.Pressure},
+		{`,"battery_voltage":`, s.BatteryVoltage},
+	} {
+		if field.value == nil {
+			continue
+		}
+
+		b = append(b, field.name...)
+
+		if b, err = appendJSONFloat(b, float64(*field.value), 32); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.Metrics) > 0 {
+		b = append(b, `,"metrics":`...)
+
+		if b, err = appendJSONValues(b, s.Metrics); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{`,"firmware":`, s.Firmware},
+		{`,"received_at":`, s.ReceivedAt},
+		{`,"device_time":`, s.DeviceTime},
+	} {
+		if field.value != "" {
+			b = append(b, field.name...)
+			b = appendJSONString(b, field.value)
+		}
+	}
+
+	if s.Duplicate {
+		b = append(b, `,"duplicate":true`...)
+	}
+
+	if s.Region != "" {
+		b = append(b, `,"region":`...)
+		b = appendJSONString(b, s.Region)
+	}
+
+	if len(s.Derived) > 0 {
+		b = append(b, `,"derived":`...)
+
+		if b, err = appendJSONValues(b, s.Derived); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(b, '}'), nil
+}
+
+// appendJSONValues appends the values as a JSON object sorted by name, as json.Marshal does
+func appendJSONValues(b []byte, values map[string]float64) ([]byte, error) {
+	names := make([]string, 0, len(values))
+
+	for name := range values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	b = append(b, '{')
+
+	for i, name := range names {
+		if i > 0 {
+			b = append(b, ',')
+		}
+
+		b = appendJSONString(b, name)
+		b = append(b, ':')
+
+		var err error
+
+		if b, err = appendJSONFloat(b, values[name], 64); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(b, '}'), nil
+}
+
+// appendJSONFloat appends the number as json.Marshal does, in the exponent format only for the very small or large ones
+func appendJSONFloat(b []byte, f float64, bits int) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, fmt.Errorf("json: unsupported value: %s", strconv.FormatFloat(f, 'g', -1, bits))
+	}
+
+	format := byte('f')
+
+	if abs := math.Abs(f); abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			format = 'e'
+		}
+	}
+
+	b = strconv.AppendFloat(b, f, format, -1, bits)
+
+	// The two digit exponents are shortened, 1e-07 is written 1e-7.
+	if format == 'e' {
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+
+	return b, nil
+}
+
+// appendJSONString appends the quoted string with the escapes of json.Marshal, HTML characters included
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+
+			b = append(b, s[start:i]...)
+
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\b':
+				b = append(b, '\\', 'b')
+			case '\f':
+				b = append(b, '\\', 'f')
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			}
+
+			i++
+			start = i
+
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, "\ufffd"...)
+			i += size
+			start = i
+
+			continue
+		}
+
+		// The line and paragraph separators are escaped for the JavaScript readers.
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+
+			continue
+		}
+
+		i += size
+	}
+
+	b = append(b, s[start:]...)
+
+	return append(b, '"')
+}
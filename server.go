@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	// defaultServerAddress is the TCP address the API listens on without an address setting.
+	defaultServerAddress = ":8080"
+	// defaultReadHeaderTimeout bounds the time to read the headers of a request, closing the slowloris connections.
+	defaultReadHeaderTimeout = 10 * time.Second
+	// defaultReadTimeout bounds the time to read a whole request.
+	defaultReadTimeout = 30 * time.Second
+	// defaultWriteTimeout bounds the time to write a response, longer than the long-polling of the commands.
+	defaultWriteTimeout = maxCommandWait + 30*time.Second
+	// defaultIdleTimeout closes the keep-alive connections idle for longer.
+	defaultIdleTimeout = 120 * time.Second
+	// defaultTCPKeepAlive is the period of the TCP keep-alive probes detecting the connections of the vanished clients.
+	defaultTCPKeepAlive = 30 * time.Second
+	// shutdownTimeout bounds the time the requests in progress are given to complete on shutdown.
+	shutdownTimeout = 30 * time.Second
+	// defaultUnixSocketMode lets the group of the API, e.g. the one of the reverse proxy, connect to the Unix socket.
+	defaultUnixSocketMode = "0660"
+)
+
+// ServerConfig tunes the HTTP server of the API.
+type ServerConfig struct {
+	Address           string   `json:"address"`             // TCP address listened on, ":8080" by default unless listening on a Unix socket only
+	UnixSocket        string   `json:"unix_socket"`         // Path of a Unix socket listened on, for a local reverse proxy
+	UnixSocketMode    string   `json:"unix_socket_mode"`    // Permissions of the Unix socket in octal, "0660" by default
+	AdminAddress      string   `json:"admin_address"`       // TCP address of the /admin routes, e.g. "127.0.0.1:9090". On the main address when empty
+	ReadHeaderTimeout Duration `json:"read_header_timeout"` // Time to read the headers of a request, 10s by default
+	ReadTimeout       Duration `json:"read_timeout"`        // Time to read a whole request, 30s by default
+	WriteTimeout      Duration `json:"write_timeout"`       // Time to write a response, 90s by default. Must exceed the wait of the long-polled commands
+	IdleTimeout       Duration `json:"idle_timeout"`        // Time an idle keep-alive connection is kept open, 120s by default
+	MaxHeaderBytes    int      `json:"max_header_bytes"`    // Size of the headers of a request, 1 MB by default
+	HTTP2             bool     `json:"http2"`               // Serves cleartext HTTP/2 (h2c) besides HTTP/1.1
+	KeepAlives        *bool    `json:"keep_alives"`         // Keeps the connections open between the requests, true by default
+	TCPKeepAlive      Duration `json:"tcp_keep_alive"`      // Period of the TCP keep-alive probes, 30s by default
+	ReusePort         bool     `json:"reuse_port"`          // Lets the new version of the API listen on the port before the old one stops
+}
+
+// withDefaults validates the settings of the server and applies their defaults
+func (config ServerConfig) withDefaults() (ServerConfig, error) {
+	for name, value := range map[string]Duration{
+		"read header timeout": config.ReadHeaderTimeout,
+		"read timeout":        config.ReadTimeout,
+		"write timeout":       config.WriteTimeout,
+		"idle timeout":        config.IdleTimeout,
+		"tcp keep alive":      config.TCPKeepAlive,
+	} {
+		if value < 0 {
+			return config, fmt.Errorf("%s %v must be positive", name, time.Duration(value))
+		}
+	}
+
+	if config.MaxHeaderBytes < 0 {
+		return config, fmt.Errorf("max header bytes %d must be positive", config.MaxHeaderBytes)
+	}
+
+	if config.Address == "" && config.UnixSocket == "" {
+		config.Address = defaultServerAddress
+	}
+
+	if config.UnixSocketMode == "" {
+		config.UnixSocketMode = defaultUnixSocketMode
+	}
+
+	if _, err := strconv.ParseUint(config.UnixSocketMode, 8, 32); err != nil {
+		return config, fmt.Errorf("unix socket mode %q must be octal permissions such as \"0660\"", config.UnixSocketMode)
+	}
+
+	for _, setting := range []struct {
+		value    *Duration
+		fallback time.Duration
+	}{
+		{&config.ReadHeaderTimeout, defaultReadHeaderTimeout},
+		{&config.ReadTimeout, defaultReadTimeout},
+		{&config.WriteTimeout, defaultWriteTimeout},
+		{&config.IdleTimeout, defaultIdleTimeout},
+		{&config.TCPKeepAlive, defaultTCPKeepAlive},
+	} {
+		if *setting.value == 0 {
+			*setting.value = Duration(setting.fallback)
+		}
+	}
+
+	if config.MaxHeaderBytes == 0 {
+		config.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+
+	if config.KeepAlives == nil {
+		keepAlives := true
+		config.KeepAlives = &keepAlives
+	}
+
+	return config, nil
+}
+
+// newHTTPServer builds the server of the handler with the timeouts and limits of the configuration
+func newHTTPServer(config ServerConfig, handler http.Handler) *http.Server {
+	if config.HTTP2 {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: time.Duration(config.IdleTimeout)})
+	}
+
+	server := &http.Server{
+		Addr:              config.Address,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(config.ReadTimeout),
+		WriteTimeout:      time.Duration(config.WriteTimeout),
+		IdleTimeout:       time.Duration(config.IdleTimeout),
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+
+	server.SetKeepAlivesEnabled(*config.KeepAlives)
+
+	return server
+}
+
+// listen opens the TCP listener and the Unix socket of the server, the TCP connections are probed so the dead clients are dropped.
+// The sockets passed by systemd socket activation replace them.
+func listen(config ServerConfig) ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+
+	if config.Address != "" {
+		listener, err := listenTCP(config.Address, config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	if config.UnixSocket != "" {
+		listener, err := listenUnix(config.UnixSocket, config.UnixSocketMode)
+
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// listenTCP listens on the TCP address with the keep-alive probes and port sharing of the configuration
+func listenTCP(address string, config ServerConfig) (net.Listener, error) {
+	listenConfig := net.ListenConfig{KeepAlive: time.Duration(config.TCPKeepAlive)}
+
+	if config.ReusePort {
+		listenConfig.Control = reusePort
+	}
+
+	listener, err := listenConfig.Listen(context.Background(), "tcp", address)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+
+	return listener, nil
+}
+
+// listenUnix listens on the Unix socket, replacing the socket left by a previous run
+func listenUnix(path, mode string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("failed to listen on %s: the file exists and isn't a socket", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove the stale socket %s: %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+
+	// The socket is left on close, it may be the one of the new process of a restart by now.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	perm, _ := strconv.ParseUint(mode, 8, 32)
+
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set the permissions of %s: %w", path, err)
+	}
+
+	return listener, nil
+}
+
+// closeListeners closes the listeners opened before a failure
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+// serve serves the requests of all the listeners until one of them fails or the shutdown channel is closed, the
+// requests in progress are then completed within the shutdown timeout
+func serve(server *http.Server, listeners []net.Listener, shutdown <-chan struct{}) error {
+	errs := make(chan error, len(listeners))
+
+	for _, listener := range listeners {
+		log.Printf("HTTP server listening on %s %s", listener.Addr().Network(), listener.Addr())
+
+		go func(listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+
+	if err := notifySystemd("READY=1"); err != nil {
+		log.Printf("Readiness not notified: %v", err)
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-shutdown:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	log.Printf("HTTP server shutting down")
+
+	return server.Shutdown(ctx)
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import "log"
+
+// runningAsService reports whether the process was started by the Windows service control manager, never elsewhere
+func runningAsService() bool {
+	return false
+}
+
+// runService only runs under Windows
+func runService() {}
+
+// runServiceCommand only manages a Windows service, the API is run under systemd elsewhere
+func runServiceCommand(args []string) {
+	log.Fatalf("The service command manages the Windows service, run the API as a systemd service on Linux, see the readme")
+}
@@ -0,0 +1,234 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	// serviceName is the name of the Windows service and of its event log source.
+	serviceName = "SensorDataAPI"
+	// serviceDisplayName is the name of the service in the services console.
+	serviceDisplayName = "Sensor Data API"
+	// serviceControlTimeout bounds the wait for the service to start or stop.
+	serviceControlTimeout = 30 * time.Second
+)
+
+// runningAsService reports whether the process was started by the service control manager
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+
+	return err == nil && isService
+}
+
+// runService runs the API under the service control manager, logging to the Windows event log
+func runService() {
+	if events, err := eventlog.Open(serviceName); err == nil {
+		defer events.Close()
+		log.SetOutput(eventLogWriter{events})
+	}
+
+	if err := svc.Run(serviceName, apiService{}); err != nil {
+		log.Fatalf("Failed to run the %s service: %v", serviceName, err)
+	}
+}
+
+// apiService handles the requests of the service control manager.
+type apiService struct{}
+
+// Execute serves the API until the service is stopped or the API fails
+func (apiService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	shutdown := make(chan struct{})
+	done := make(chan error, 1)
+
+	go func() {
+		done <- runAPI(shutdown)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(shutdown)
+
+				if err := <-done; err != nil {
+					log.Printf("API stopped: %v", err)
+				}
+
+				return false, 0
+			}
+		case err := <-done:
+			log.Printf("API stopped: %v", err)
+			return false, 1
+		}
+	}
+}
+
+// eventLogWriter writes the log lines to the Windows event log.
+type eventLogWriter struct {
+	events *eventlog.Log
+}
+
+// Write logs the line as an information event
+func (w eventLogWriter) Write(line []byte) (int, error) {
+	return len(line), w.events.Info(1, strings.TrimSpace(string(line)))
+}
+
+// runServiceCommand installs, uninstalls, starts or stops the Windows service, e.g.
+// sensor-api service install --redis-url localhost:6379 --config C:\sensor-api\config.json
+func runServiceCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: %s service install|uninstall|start|stop [flags of the API]", filepath.Base(os.Args[0]))
+	}
+
+	var err error
+
+	switch args[0] {
+	case "install":
+		err = installService(args[1:])
+	case "uninstall":
+		err = uninstallService()
+	case "start":
+		err = controlService(func(service *mgr.Service) error { return service.Start() }, svc.Running)
+	case "stop":
+		err = controlService(func(service *mgr.Service) error {
+			_, err := service.Control(svc.Stop)
+			return err
+		}, svc.Stopped)
+	default:
+		err = fmt.Errorf("unknown service command %s, expected install, uninstall, start or stop", args[0])
+	}
+
+	if err != nil {
+		log.Fatalf("Failed to %s the %s service: %v", args[0], serviceName, err)
+	}
+
+	log.Printf("Service %s: %s done", serviceName, args[0])
+}
+
+// installService registers the service started automatically with the flags of the API, and its event log source
+func installService(args []string) error {
+	exe, err := os.Executable()
+
+	if err != nil {
+		return err
+	}
+
+	manager, err := mgr.Connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer manager.Disconnect()
+
+	if service, err := manager.OpenService(serviceName); err == nil {
+		service.Close()
+		return fmt.Errorf("the service is installed already")
+	}
+
+	service, err := manager.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: "Ingests and serves the readings of the sensors",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer service.Close()
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		service.Delete()
+		return fmt.Errorf("failed to install the event log source: %w", err)
+	}
+
+	return nil
+}
+
+// uninstallService removes the service and its event log source
+func uninstallService() error {
+	manager, err := mgr.Connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer manager.Disconnect()
+
+	service, err := manager.OpenService(serviceName)
+
+	if err != nil {
+		return fmt.Errorf("the service isn't installed")
+	}
+
+	defer service.Close()
+
+	if err := service.Delete(); err != nil {
+		return err
+	}
+
+	return eventlog.Remove(serviceName)
+}
+
+// controlService sends the control to the service and waits for it to reach the expected state
+func controlService(control func(service *mgr.Service) error, expected svc.State) error {
+	manager, err := mgr.Connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer manager.Disconnect()
+
+	service, err := manager.OpenService(serviceName)
+
+	if err != nil {
+		return fmt.Errorf("the service isn't installed")
+	}
+
+	defer service.Close()
+
+	if err := control(service); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(serviceControlTimeout)
+
+	for {
+		status, err := service.Query()
+
+		if err != nil {
+			return err
+		}
+
+		if status.State == expected {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the service didn't reach the expected state within %v", serviceControlTimeout)
+		}
+
+		time.Sleep(300 * time.Millisecond)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// shadowKeyPrefix prefixes the hash holding the desired and reported state of a device.
+	shadowKeyPrefix = "shadow:"
+	// shadowsKey is the Redis set holding the ids of the devices with a shadow.
+	shadowsKey = "shadows"
+	// shadowUpdateAttempts bounds the retries of a shadow update racing with another one.
+	shadowUpdateAttempts = 5
+)
+
+// ShadowDelta is a setting whose reported value differs from the desired one.
+type ShadowDelta struct {
+	Desired  interface{} `json:"desired"`
+	Reported interface{} `json:"reported"` // null when the device never reported the setting
+}
+
+// Shadow is the desired and reported configuration of a device, such as its sampling interval or thresholds.
+type Shadow struct {
+	DeviceId   string                 `json:"device_id"`
+	Desired    map[string]interface{} `json:"desired"`               // Configuration set by the operators
+	Reported   map[string]interface{} `json:"reported"`              // Configuration reported by the device
+	DesiredAt  string                 `json:"desired_at,omitempty"`  // Last change of the desired configuration
+	ReportedAt string                 `json:"reported_at,omitempty"` // Last report of the device
+	Delta      map[string]ShadowDelta `json:"delta"`                 // Desired settings not applied by the device yet
+}
+
+// shadowSide is one half of the shadow, either "desired" or "reported".
+type shadowSide string
+
+const (
+	shadowDesired  shadowSide = "desired"
+	shadowReported shadowSide = "reported"
+)
+
+// Shadow returns the shadow of the device, empty if it has none
+func (r *registry) Shadow(ctx context.Context, deviceId string) (*Shadow, error) {
+	fields, err := r.rdb.HGetAll(ctx, shadowKeyPrefix+deviceId).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the shadow of device %s from the cache: %v", deviceId, err)
+	}
+
+	shadow, err := decodeShadow(deviceId, fields)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on reading the shadow of device %s from cache: %v", deviceId, err)
+	}
+
+	return shadow, nil
+}
+
+// UpdateShadow replaces or merges one side of the shadow of the device, a null value removes a setting when merging
+func (r *registry) UpdateShadow(ctx context.Context, deviceId string, side shadowSide, state map[string]interface{}, merge bool) (*Shadow, error) {
+	key := shadowKeyPrefix + deviceId
+	var shadow *Shadow
+
+	update := func(tx *redis.Tx) error {
+		fields, err := tx.HGetAll(ctx, key).Result()
+
+		if err != nil {
+			return err
+		}
+
+		if shadow, err = decodeShadow(deviceId, fields); err != nil {
+			return err
+		}
+
+		current := shadow.Desired
+
+		if side == shadowReported {
+			current = shadow.Reported
+		}
+
+		if !merge {
+			current = make(map[string]interface{})
+		}
+
+		for name, value := range state {
+			if value == nil {
+				delete(current, name)
+			} else {
+				current[name] = value
+			}
+		}
+
+		raw, err := json.Marshal(current)
+
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339)
+
+		if side == shadowReported {
+			shadow.Reported, shadow.ReportedAt = current, now
+		} else {
+			shadow.Desired, shadow.DesiredAt = current, now
+		}
+
+		shadow.Delta = shadowDelta(shadow.Desired, shadow.Reported)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, string(side), raw, string(side)+"_at", now)
+			pipe.SAdd(ctx, shadowsKey, deviceId)
+			return nil
+		})
+
+		return err
+	}
+
+	for attempt := 0; attempt < shadowUpdateAttempts; attempt++ {
+		err := r.rdb.Watch(ctx, update, key)
+
+		if err == redis.TxFailedErr {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("fatal error on saving the shadow of device %s in the cache: %v", deviceId, err)
+		}
+
+		return shadow, nil
+	}
+
+	return nil, fmt.Errorf("fatal error on saving the shadow of device %s in the cache: too many concurrent updates", deviceId)
+}
+
+// OutOfSyncShadows returns the shadows of the devices with desired settings not applied, by device id
+func (r *registry) OutOfSyncShadows(ctx context.Context) ([]Shadow, error) {
+	ids, err := r.rdb.SMembers(ctx, shadowsKey).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the devices with a shadow from the cache: %v", err)
+	}
+
+	sort.Strings(ids)
+	pipe := r.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, shadowKeyPrefix+id)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the device shadows from the cache: %v", err)
+	}
+
+	shadows := []Shadow{}
+
+	for i, id := range ids {
+		shadow, err := decodeShadow(id, cmds[i].Val())
+
+		if err != nil {
+			return nil, fmt.Errorf("fatal error on reading the shadow of device %s from cache: %v", id, err)
+		}
+
+		if len(shadow.Delta) > 0 {
+			shadows = append(shadows, *shadow)
+		}
+	}
+
+	return shadows, nil
+}
+
+// decodeShadow builds the shadow of the device from its hash fields
+func decodeShadow(deviceId string, fields map[string]string) (*Shadow, error) {
+	shadow := &Shadow{
+		DeviceId:   deviceId,
+		Desired:    make(map[string]interface{}),
+		Reported:   make(map[string]interface{}),
+		DesiredAt:  fields["desired_at"],
+		ReportedAt: fields["reported_at"],
+	}
+
+	if raw := fields[string(shadowDesired)]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &shadow.Desired); err != nil {
+			return nil, err
+		}
+	}
+
+	if raw := fields[string(shadowReported)]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &shadow.Reported); err != nil {
+			return nil, err
+		}
+	}
+
+	shadow.Delta = shadowDelta(shadow.Desired, shadow.Reported)
+
+	return shadow, nil
+}
+
+// shadowDelta returns the desired settings whose reported value differs
+func shadowDelta(desired, reported map[string]interface{}) map[string]ShadowDelta {
+	delta := make(map[string]ShadowDelta)
+
+	for name, value := range desired {
+		if !reflect.DeepEqual(value, reported[name]) {
+			delta[name] = ShadowDelta{Desired: value, Reported: reported[name]}
+		}
+	}
+
+	return delta
+}
+
+// registerShadowRoutes mounts the fleet-wide shadow endpoints on the given group
+func registerShadowRoutes(g *echo.Group, reg *registry) {
+	g.GET("/out-of-sync", func(c echo.Context) error {
+		return getOutOfSyncShadows(c, reg)
+	})
+}
+
+// getOutOfSyncShadows lists the shadows of the devices with desired settings not applied
+func getOutOfSyncShadows(c echo.Context, reg *registry) error {
+	shadows, err := reg.OutOfSyncShadows(c.Request().Context())
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, shadows)
+}
+
+// getShadow returns the shadow of the device with its delta
+func getShadow(c echo.Context, reg *registry) error {
+	shadow, err := reg.Shadow(c.Request().Context(), c.Param("id"))
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, shadow)
+}
+
+// updateShadow replaces (PUT) or merges (PATCH) one side of the shadow of the device with the request body
+func updateShadow(c echo.Context, reg *registry, side shadowSide) error {
+	var state map[string]interface{}
+
+	// The body is decoded directly, binding a map would also pick up the path parameters.
+	if err := json.NewDecoder(c.Request().Body).Decode(&state); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to get the %s state from the request body: %v", side, err))
+	}
+
+	for name := range state {
+		if !idPattern.MatchString(name) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Setting name %q must be 1 to 64 letters, digits, '_', '.' or '-'", name))
+		}
+	}
+
+	merge := c.Request().Method == http.MethodPatch
+	shadow, err := reg.UpdateShadow(c.Request().Context(), c.Param("id"), side, state, merge)
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, shadow)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// shardVirtualNodes is the number of points of every shard on the hash ring, spreading the devices evenly.
+	shardVirtualNodes = 160
+	// shardCheckInterval is how often the health of the shards is checked.
+	shardCheckInterval = 5 * time.Second
+	// shardCheckTimeout bounds the health check of a shard.
+	shardCheckTimeout = 2 * time.Second
+)
+
+// errShardDown rejects the operations on a shard failing its health checks.
+var errShardDown = errors.New("shard is down")
+
+// ShardConfig is a Redis instance holding the readings of a part of the devices.
+type ShardConfig struct {
+	Name     string   `json:"name"`     // Name of the shard on the hash ring, its address by default. Renaming a shard moves its devices
+	Address  string   `json:"address"`  // Address of the Redis instance, e.g. "redis-2:6379"
+	Password string   `json:"password"` // Password of the Redis instance
+	Replicas []string `json:"replicas"` // Addresses of the replicas of the shard serving the reads of the GET requests
+}
+
+// ShardHealth is the health of a shard.
+type ShardHealth struct {
+	Name      string          `json:"name"`
+	Address   string          `json:"address"`
+	Healthy   bool            `json:"healthy"`
+	Error     string          `json:"error,omitempty"`      // Error of the last failed health check
+	CheckedAt string          `json:"checked_at,omitempty"` // Time of the last health check
+	Devices   int64           `json:"devices"`              // Devices stored on the shard, as of the last health check
+	Replicas  []ReplicaHealth `json:"replicas,omitempty"`   // Replication state of the replicas of the shard
+}
+
+// shard is a Redis instance of the sharded store with its health.
+type shard struct {
+	config ShardConfig
+	store  *redisStore
+	mu     sync.RWMutex
+	health ShardHealth
+}
+
+// healthy reports whether the last health check of the shard succeeded
+func (s *shard) healthy() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.health.Healthy
+}
+
+// ringPoint is a virtual node of a shard on the hash ring.
+type ringPoint struct {
+	hash  uint32
+	shard *shard
+}
+
+// shardedStore spreads the devices over several Redis instances with consistent hashing, so adding a shard only moves
+// the devices of the part of the ring it takes over. All the readings of a device are on the same shard.
+type shardedStore struct {
+	shards []*shard
+	ring   []ringPoint
+}
+
+// newShardedStore connects to the shards and their replicas with the user, database, TLS and namespace of the main
+// Redis, and builds the hash ring
+func newShardedStore(configs []ShardConfig, redisConfig RedisConfig, maxStaleness time.Duration) (*shardedStore, error) {
+	s := &shardedStore{}
+	names := make(map[string]bool, len(configs))
+
+	for _, config := range configs {
+		if config.Address == "" {
+			return nil, errors.New("every shard must have an address")
+		}
+
+		if config.Name == "" {
+			config.Name = config.Address
+		}
+
+		if names[config.Name] {
+			return nil, fmt.Errorf("shard %s is defined twice", config.Name)
+		}
+
+		names[config.Name] = true
+
+		options, err := redisConfig.options(config.Address, config.Password)
+
+		if err != nil {
+			return nil, fmt.Errorf("shard %s: %w", config.Name, err)
+		}
+
+		// A shard down at startup is only reported by its health, the others keep serving their devices.
+		rdb := newRedisClient(options, redisConfig.Namespace)
+		sh := &shard{config: config, store: newRedisStore(rdb), health: ShardHealth{Name: config.Name, Address: config.Address, Healthy: true}}
+
+		if len(config.Replicas) > 0 {
+			replicas, err := newReplicaSet(config.Replicas, *options, redisConfig.Namespace, maxStaleness)
+
+			if err != nil {
+				return nil, fmt.Errorf("replicas of shard %s: %w", config.Name, err)
+			}
+
+			sh.store.replicas = replicas
+		}
+
+		s.shards = append(s.shards, sh)
+
+		for i := 0; i < shardVirtualNodes; i++ {
+			s.ring = append(s.ring, ringPoint{hash: crc32.ChecksumIEEE([]byte(config.Name + "#" + strconv.Itoa(i))), shard: sh})
+		}
+	}
+
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+
+	return s, nil
+}
+
+// shardOf returns the shard of the device, the first point of the ring at or after the hash of its id
+func (s *shardedStore) shardOf(deviceId string) *shard {
+	hash := crc32.ChecksumIEEE([]byte(deviceId))
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= hash })
+
+	if i == len(s.ring) {
+		i = 0
+	}
+
+	return s.ring[i].shard
+}
+
+// storeOf returns the store of the shard of the device, failing fast when the shard is down
+func (s *shardedStore) storeOf(deviceId string) (*redisStore, error) {
+	sh := s.shardOf(deviceId)
+
+	if !sh.healthy() {
+		return nil, fmt.Errorf("%w: %s holding device %s", errShardDown, sh.config.Name, deviceId)
+	}
+
+	return sh.store, nil
+}
+
+// Save stores the reading on the shard of its device
+func (s *shardedStore) Save(ctx context.Context, sensorData *SensorData) error {
+	store, err := s.storeOf(sensorData.DeviceId)
+
+	if err != nil {
+		return err
+	}
+
+	return store.Save(ctx, sensorData)
+}
+
+// Latest returns the last reading of the device from its shard
+func (s *shardedStore) Latest(ctx context.Context, deviceId string) (*SensorData, error) {
+	store, err := s.storeOf(deviceId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Latest(ctx, deviceId)
+}
+
+// Range returns the readings of the device within [from, to] from its shard
+func (s *shardedStore) Range(ctx context.Context, deviceId string, from, to time.Time) ([]SensorData, error) {
+	store, err := s.storeOf(deviceId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Range(ctx, deviceId, from, to)
+}
+
+// Merge merges the reading on the shard of its device
+func (s *shardedStore) Merge(ctx context.Context, sensorData *SensorData) (bool, *SensorData, error) {
+	store, err := s.storeOf(sensorData.DeviceId)
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	return store.Merge(ctx, sensorData)
+}
+
+// Devices returns the devices of all the shards, the devices of the shards down are left out
+func (s *shardedStore) Devices(ctx context.Context) ([]string, error) {
+	var ids []string
+
+	for _, sh := range s.shards {
+		if !sh.healthy() {
+			continue
+		}
+
+		shardIds, err := sh.store.Devices(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, shardIds...)
+	}
+
+	return ids, nil
+}
+
+// MetricRange returns the values of the measurement of the device within [from, to] from its shard
+func (s *shardedStore) MetricRange(ctx context.Context, deviceId, metric string, from, to time.Time) ([]MetricPoint, error) {
+	store, err := s.storeOf(deviceId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return store.MetricRange(ctx, deviceId, metric, from, to)
+}
+
+// Metrics returns the measurement names of the device from its shard
+func (s *shardedStore) Metrics(ctx context.Context, deviceId string) ([]string, error) {
+	store, err := s.storeOf(deviceId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Metrics(ctx, deviceId)
+}
+
+// checkHealth pings every shard and counts its devices
+func (s *shardedStore) checkHealth(ctx context.Context) {
+	for _, sh := range s.shards {
+		checkCtx, cancel := context.WithTimeout(ctx, shardCheckTimeout)
+		devices, err := sh.store.rdb.SCard(checkCtx, devicesKey).Result()
+		cancel()
+
+		sh.mu.Lock()
+		wasHealthy := sh.health.Healthy
+		sh.health.Healthy = err == nil
+		sh.health.CheckedAt = time.Now().UTC().Format(time.RFC3339)
+		sh.health.Error = ""
+
+		if err != nil {
+			sh.health.Error = err.Error()
+		} else {
+			sh.health.Devices = devices
+		}
+
+		sh.mu.Unlock()
+
+		if wasHealthy && err != nil {
+			log.Printf("Shard %s is down: %v", sh.config.Name, err)
+		} else if !wasHealthy && err == nil {
+			log.Printf("Shard %s is back up", sh.config.Name)
+		}
+	}
+}
+
+// run checks the health of the shards until the context is done, and the replicas of the shards
+func (s *shardedStore) run(ctx context.Context) {
+	for _, sh := range s.shards {
+		if sh.store.replicas != nil {
+			go sh.store.replicas.run(ctx)
+		}
+	}
+
+	ticker := time.NewTicker(shardCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		s.checkHealth(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthReport returns the health of every shard in configuration order
+func (s *shardedStore) healthReport() []ShardHealth {
+	report := make([]ShardHealth, len(s.shards))
+
+	for i, sh := range s.shards {
+		sh.mu.RLock()
+		report[i] = sh.health
+		sh.mu.RUnlock()
+
+		if sh.store.replicas != nil {
+			report[i].Replicas = sh.store.replicas.healthReport()
+		}
+	}
+
+	return report
+}
+
+// registerShardRoutes mounts the shard endpoints on the given group
+func registerShardRoutes(g *echo.Group, store *shardedStore) {
+	g.GET("/shards", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, store.healthReport())
+	})
+	g.GET("/shards/device/:id", func(c echo.Context) error {
+		sh := store.shardOf(c.Param("id"))
+
+		return c.JSON(http.StatusOK, map[string]string{"device_id": c.Param("id"), "shard": sh.config.Name})
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// deviceSecretsKey is the Redis hash holding the shared secret of the devices signing their payloads.
+	deviceSecretsKey = "device-secrets"
+	// signatureHeader carries the hex HMAC-SHA256 of the signed string.
+	signatureHeader = "X-Signature"
+	// signatureTimestampHeader carries the Unix time in seconds the payload was signed at.
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	// signatureNonceHeader carries the optional unique value of a signed payload, signed with it.
+	signatureNonceHeader = "X-Signature-Nonce"
+	// signatureNonceKeyPrefix prefixes the keys of the nonces seen within the freshness window, per device.
+	signatureNonceKeyPrefix = "signature-nonce:"
+	// maxNonceLength bounds the nonces kept in Redis.
+	maxNonceLength = 128
+	// defaultMaxSignatureSkew is the age and the advance of the signatures tolerated without a max_skew setting.
+	defaultMaxSignatureSkew = 5 * time.Minute
+	// minDeviceSecretLength rejects the secrets too short to resist guessing.
+	minDeviceSecretLength = 16
+)
+
+// SigningConfig checks the HMAC signature of the payloads ingested by the devices with a shared secret.
+type SigningConfig struct {
+	Enabled  bool     `json:"enabled"`  // Checks the signature of the devices with a secret
+	Required bool     `json:"required"` // Rejects the payloads of the devices without a secret, only the devices with one are checked otherwise
+	MaxSkew  Duration `json:"max_skew"` // Gap tolerated between the signature timestamp and the server clock, 5m by default
+
+	RejectReplays bool `json:"reject_replays"` // Rejects a signed payload received twice within the freshness window
+}
+
+// deviceSecretRequest is the body setting the secret of a device.
+type deviceSecretRequest struct {
+	Secret string `json:"secret"`
+}
+
+// signatureVerifier rejects with 401 Unauthorized the ingested payloads without a valid signature of their device.
+type signatureVerifier struct {
+	registry      *registry
+	required      bool
+	maxSkew       time.Duration
+	rejectReplays bool
+
+	normalizeDeviceId func(deviceId string) string
+}
+
+// newSignatureVerifier validates the signing settings, nil when disabled
+func newSignatureVerifier(config SigningConfig, reg *registry, normalizeDeviceId func(deviceId string) string) (*signatureVerifier, error) {
+	if !config.Enabled && !config.Required {
+		return nil, nil
+	}
+
+	maxSkew := time.Duration(config.MaxSkew)
+
+	if maxSkew < 0 {
+		return nil, fmt.Errorf("max skew %v must be positive", maxSkew)
+	}
+
+	if maxSkew == 0 {
+		maxSkew = defaultMaxSignatureSkew
+	}
+
+	return &signatureVerifier{
+		registry:          reg,
+		required:          config.Required,
+		maxSkew:           maxSkew,
+		rejectReplays:     config.RejectReplays,
+		normalizeDeviceId: normalizeDeviceId,
+	}, nil
+}
+
+// middleware checks the signature of the payload against the secret of its device, the body is kept for the handler
+func (v *signatureVerifier) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body, err := io.ReadAll(c.Request().Body)
+
+		if err != nil {
+			return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to read the request body: %v", err))
+		}
+
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		deviceId := requestDeviceId(c, body, v.normalizeDeviceId)
+		secret, err := v.registry.DeviceSecret(c.Request().Context(), deviceId)
+
+		if err != nil {
+			return registryHTTPError(err)
+		}
+
+		if secret == "" {
+			if v.required {
+				return newProblem(http.StatusUnauthorized, "invalid_signature", fmt.Sprintf("Device %q has no secret to sign its payloads with", deviceId))
+			}
+
+			return next(c)
+		}
+
+		if err := v.verify(c.Request().Header, body, secret); err != nil {
+			log.Printf("Payload of device %s rejected: %v", deviceId, err)
+			return newProblem(http.StatusUnauthorized, "invalid_signature", err.Error())
+		}
+
+		if !v.rejectReplays {
+			return next(c)
+		}
+
+		// The signature identifies the payloads signed without a nonce, decoded so its upper and lower case hex
+		// spellings are the same payload.
+		nonce := c.Request().Header.Get(signatureNonceHeader)
+
+		if nonce == "" {
+			signature, _ := hex.DecodeString(c.Request().Header.Get(signatureHeader))
+			nonce = hex.EncodeToString(signature)
+		}
+
+		// A nonce is remembered for twice the skew, the time its timestamp is accepted either way of the server time.
+		fresh, err := v.registry.UseNonce(c.Request().Context(), deviceId, nonce, 2*v.maxSkew)
+
+		if err != nil {
+			return registryHTTPError(err)
+		}
+
+		if !fresh {
+			log.Printf("Replayed payload of device %s rejected, nonce %s", deviceId, nonce)
+			return newProblem(http.StatusUnauthorized, "replayed_payload", "The signed payload was received already")
+		}
+
+		return next(c)
+	}
+}
+
+// verify checks the signature of the body and the freshness of its timestamp
+func (v *signatureVerifier) verify(header http.Header, body []byte, secret string) error {
+	timestamp := header.Get(signatureTimestampHeader)
+	nonce := header.Get(signatureNonceHeader)
+	signature, err := hex.DecodeString(header.Get(signatureHeader))
+
+	if timestamp == "" || err != nil || len(signature) == 0 {
+		return fmt.Errorf("the %s and %s headers must carry the hex HMAC-SHA256 of the payload and its Unix time", signatureHeader, signatureTimestampHeader)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil {
+		return fmt.Errorf("%s %q must be a Unix time in seconds", signatureTimestampHeader, timestamp)
+	}
+
+	if len(nonce) > maxNonceLength {
+		return fmt.Errorf("%s must be at most %d characters", signatureNonceHeader, maxNonceLength)
+	}
+
+	if skew := time.Since(time.Unix(seconds, 0)); skew > v.maxSkew || skew < -v.maxSkew {
+		return fmt.Errorf("signature timestamp %s is %v away from the server time, more than %v", timestamp, skew.Round(time.Second), v.maxSkew)
+	}
+
+	if !hmac.Equal(signature, signPayload(secret, timestamp, nonce, body)) {
+		return fmt.Errorf("signature doesn't match the payload")
+	}
+
+	return nil
+}
+
+// signPayload returns the HMAC-SHA256 of "<timestamp>.<body>", or "<timestamp>.<nonce>.<body>" with a nonce, with the
+// secret of the device
+func signPayload(secret, timestamp, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+
+	if nonce != "" {
+		mac.Write([]byte(nonce + "."))
+	}
+
+	mac.Write(body)
+
+	return mac.Sum(nil)
+}
+
+// UseNonce records the nonce of the device for the given time, it reports false when it was recorded already
+func (r *registry) UseNonce(ctx context.Context, deviceId, nonce string, ttl time.Duration) (bool, error) {
+	fresh, err := r.rdb.SetNX(ctx, signatureNonceKeyPrefix+deviceId+":"+nonce, 1, ttl).Result()
+
+	if err != nil {
+		return false, fmt.Errorf("fatal error on saving the nonce of device %s in the cache: %v", deviceId, err)
+	}
+
+	return fresh, nil
+}
+
+// SetDeviceSecret sets the secret the device signs its payloads with
+func (r *registry) SetDeviceSecret(ctx context.Context, deviceId, secret string) error {
+	if err := r.rdb.HSet(ctx, deviceSecretsKey, deviceId, secret).Err(); err != nil {
+		return fmt.Errorf("fatal error on saving the secret of device %s in the cache: %v", deviceId, err)
+	}
+
+	return nil
+}
+
+// DeleteDeviceSecret removes the secret of the device, its payloads are no longer checked
+func (r *registry) DeleteDeviceSecret(ctx context.Context, deviceId string) error {
+	deleted, err := r.rdb.HDel(ctx, deviceSecretsKey, deviceId).Result()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on deleting the secret of device %s from the cache: %v", deviceId, err)
+	}
+
+	if deleted == 0 {
+		return fmt.Errorf("secret of device %s %w", deviceId, errNotFound)
+	}
+
+	return nil
+}
+
+// DeviceSecret returns the secret of the device, empty when it has none
+func (r *registry) DeviceSecret(ctx context.Context, deviceId string) (string, error) {
+	secret, err := r.rdb.HGet(ctx, deviceSecretsKey, deviceId).Result()
+
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("fatal error on retrieving the secret of device %s from the cache: %v", deviceId, err)
+	}
+
+	return secret, nil
+}
+
+// registerSecretRoutes mounts the device secret endpoints on the given group, the secrets are never returned
+func registerSecretRoutes(g *echo.Group, reg *registry) {
+	g.PUT("/devices/:id/secret", func(c echo.Context) error {
+		return putDeviceSecret(c, reg)
+	})
+	g.DELETE("/devices/:id/secret", func(c echo.Context) error {
+		if err := reg.DeleteDeviceSecret(c.Request().Context(), c.Param("id")); err != nil {
+			return registryHTTPError(err)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+}
+
+// putDeviceSecret sets the secret of the device
+func putDeviceSecret(c echo.Context, reg *registry) error {
+	deviceId := c.Param("id")
+
+	if !idPattern.MatchString(deviceId) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Device 'id' must be 1 to 64 letters, digits, '_', '.' or '-'")
+	}
+
+	var request deviceSecretRequest
+
+	if err := c.Bind(&request); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to get the secret from the request body: %v", err)).withFields(err)
+	}
+
+	if len(request.Secret) < minDeviceSecretLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'secret' must be at least %d characters", minDeviceSecretLength))
+	}
+
+	if err := reg.SetDeviceSecret(c.Request().Context(), deviceId, request.Secret); err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
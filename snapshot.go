@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// snapshotKey is the Redis key holding the JSON of the snapshot in progress, shared by the replicas.
+	snapshotKey = "snapshot"
+	// snapshotWritesKeyPrefix prefixes the hash of the readings of a device written during a snapshot,
+	// "<snapshot>:<device>", with the reading replaced at their time, empty when there was none.
+	snapshotWritesKeyPrefix = "snapshot-writes:"
+	// snapshotRefreshInterval is how often the replicas look for a snapshot in progress.
+	snapshotRefreshInterval = time.Second
+	// snapshotGrace is the time between the start of a snapshot and its marker, every replica has seen it by then.
+	snapshotGrace = 3 * snapshotRefreshInterval
+	// snapshotLease is the time a snapshot stays in progress without its export renewing it, e.g. after a crash.
+	snapshotLease = time.Minute
+	// snapshotWritesTTL bounds the time the writes recorded during a snapshot are kept.
+	snapshotWritesTTL = 24 * time.Hour
+	// snapshotReadingsTrailer is the HTTP trailer with the number of readings exported, missing from a cut export.
+	snapshotReadingsTrailer = "X-Snapshot-Readings"
+)
+
+// endSnapshotScript deletes the snapshot in progress when it is still the given one.
+var endSnapshotScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// SnapshotConfig enables the consistent exports of the readings while the ingest goes on.
+type SnapshotConfig struct {
+	Enabled bool `json:"enabled"` // Records the writes overlapping a snapshot and mounts GET /admin/snapshot
+}
+
+// snapshot is an export in progress, it holds the readings stored before its marker.
+type snapshot struct {
+	Id     string `json:"id"`
+	Marker int64  `json:"marker"` // Unix milliseconds
+}
+
+// snapshotStore records the readings saved after the marker of a snapshot in progress, and the readings they
+// replace: the export leaves the former out and restores the latter, it sees the readings as of the marker.
+type snapshotStore struct {
+	Store
+	registry *registry
+	mu       sync.RWMutex
+	active   *snapshot
+}
+
+// newSnapshotStore records the writes overlapping the snapshots of the given store
+func newSnapshotStore(store Store, reg *registry) *snapshotStore {
+	return &snapshotStore{Store: store, registry: reg}
+}
+
+// current returns the snapshot in progress, nil when there is none
+func (s *snapshotStore) current() *snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.active
+}
+
+// setCurrent changes the snapshot in progress
+func (s *snapshotStore) setCurrent(active *snapshot) {
+	s.mu.Lock()
+	s.active = active
+	s.mu.Unlock()
+}
+
+// Save records the reading and the one it replaces during a snapshot, before saving it: a reading the export
+// reads is always recorded already. The save fails when it can't be recorded, the snapshot would miss it.
+func (s *snapshotStore) Save(ctx context.Context, sensorData *SensorData) error {
+	if active := s.current(); active != nil && time.Now().UnixMilli() >= active.Marker {
+		if err := s.record(ctx, active, sensorData); err != nil {
+			return err
+		}
+	}
+
+	return s.Store.Save(ctx, sensorData)
+}
+
+// Merge records the reading and the ones it may replace during a snapshot before merging it, as Save does
+func (s *snapshotStore) Merge(ctx context.Context, sensorData *SensorData) (bool, *SensorData, error) {
+	if active := s.current(); active != nil && time.Now().UnixMilli() >= active.Marker {
+		if err := s.record(ctx, active, sensorData); err != nil {
+			return false, nil, err
+		}
+	}
+
+	return s.Store.Merge(ctx, sensorData)
+}
+
+// record keeps the reading stored at the time of the given one, the first time the time is written
+func (s *snapshotStore) record(ctx context.Context, active *snapshot, sensorData *SensorData) error {
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return err
+	}
+
+	replaced, err := s.Store.Range(ctx, sensorData.DeviceId, timestamp, timestamp)
+
+	if err != nil {
+		return err
+	}
+
+	var previous []byte
+
+	if len(replaced) > 0 {
+		if previous, err = json.Marshal(replaced[len(replaced)-1]); err != nil {
+			return err
+		}
+	}
+
+	return s.registry.RecordSnapshotWrite(ctx, active, sensorData.DeviceId, timestamp, previous)
+}
+
+// run picks up the snapshots started by the other replicas until the context is done
+func (s *snapshotStore) run(ctx context.Context) {
+	ticker := time.NewTicker(snapshotRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		active, err := s.registry.Snapshot(ctx)
+
+		if err != nil {
+			log.Printf("Snapshot in progress not refreshed: %v", err)
+		} else {
+			s.setCurrent(active)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// StartSnapshot starts a snapshot with the given marker, errAlreadyExists when another one is in progress
+func (r *registry) StartSnapshot(ctx context.Context, marker time.Time) (*snapshot, error) {
+	active := &snapshot{Id: strconv.FormatInt(time.Now().UnixNano(), 36), Marker: marker.UnixMilli()}
+	raw, err := json.Marshal(active)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on marshalling the snapshot: %v", err)
+	}
+
+	started, err := r.rdb.SetNX(ctx, snapshotKey, raw, snapshotLease).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on starting the snapshot in the cache: %v", err)
+	}
+
+	if !started {
+		return nil, fmt.Errorf("snapshot in progress %w", errAlreadyExists)
+	}
+
+	return active, nil
+}
+
+// RenewSnapshot keeps the snapshot in progress for another lease
+func (r *registry) RenewSnapshot(ctx context.Context) error {
+	if err := r.rdb.Expire(ctx, snapshotKey, snapshotLease).Err(); err != nil {
+		return fmt.Errorf("fatal error on renewing the snapshot in the cache: %v", err)
+	}
+
+	return nil
+}
+
+// EndSnapshot ends the snapshot when it is still in progress and deletes the writes recorded during it
+func (r *registry) EndSnapshot(ctx context.Context, active *snapshot) error {
+	raw, err := json.Marshal(active)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on marshalling the snapshot: %v", err)
+	}
+
+	if err := endSnapshotScript.Run(ctx, r.rdb, []string{snapshotKey}, raw).Err(); err != nil {
+		return fmt.Errorf("fatal error on ending the snapshot in the cache: %v", err)
+	}
+
+	iter := r.rdb.Scan(ctx, 0, snapshotWritesKeyPrefix+active.Id+":*", 1000).Iterator()
+
+	for iter.Next(ctx) {
+		if err := r.rdb.Del(ctx, iter.Val()).Err(); err != nil {
+			return fmt.Errorf("fatal error on deleting the writes of the snapshot from the cache: %v", err)
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("fatal error on listing the writes of the snapshot in the cache: %v", err)
+	}
+
+	return nil
+}
+
+// Snapshot returns the snapshot in progress, nil when there is none
+func (r *registry) Snapshot(ctx context.Context) (*snapshot, error) {
+	raw, err := r.rdb.Get(ctx, snapshotKey).Bytes()
+
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the snapshot from the cache: %v", err)
+	}
+
+	var active snapshot
+
+	if err := json.Unmarshal(raw, &active); err != nil {
+		return nil, fmt.Errorf("fatal error on reading the snapshot from the cache: %v", err)
+	}
+
+	return &active, nil
+}
+
+// RecordSnapshotWrite records the write of the device at the given time during the snapshot with the reading it
+// replaces, nil when none. Only the first write of a time is recorded, the reading stored at the marker.
+func (r *registry) RecordSnapshotWrite(ctx context.Context, active *snapshot, deviceId string, timestamp time.Time, previous []byte) error {
+	key := snapshotWritesKeyPrefix + active.Id + ":" + deviceId
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(ctx, key, strconv.FormatInt(timestamp.UnixMilli(), 10), previous)
+		pipe.Expire(ctx, key, snapshotWritesTTL)
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("fatal error on recording the write of device %s for the snapshot in the cache: %v", deviceId, err)
+	}
+
+	return nil
+}
+
+// SnapshotWrites returns the readings replaced by the writes of the device during the snapshot by their Unix
+// milliseconds, empty for a reading that didn't exist at the marker
+func (r *registry) SnapshotWrites(ctx context.Context, active *snapshot, deviceId string) (map[string]string, error) {
+	writes, err := r.rdb.HGetAll(ctx, snapshotWritesKeyPrefix+active.Id+":"+deviceId).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the writes of device %s for the snapshot from the cache: %v", deviceId, err)
+	}
+
+	return writes, nil
+}
+
+// registerSnapshotRoutes mounts the snapshot export on the given group
+func registerSnapshotRoutes(g *echo.Group, store *snapshotStore) {
+	g.GET("/snapshot", func(c echo.Context) error {
+		return exportSnapshot(c, store)
+	})
+}
+
+// exportSnapshot streams the readings of every device as of the marker of a new snapshot, a JSON reading per line
+// ordered by device and time, while the ingest goes on
+func exportSnapshot(c echo.Context, store *snapshotStore) error {
+	ctx := c.Request().Context()
+	active, err := store.registry.StartSnapshot(ctx, time.Now().Add(snapshotGrace))
+
+	if errors.Is(err, errAlreadyExists) {
+		return newProblem(http.StatusConflict, "snapshot_in_progress", "Another snapshot is being exported, retry once it is done")
+	}
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	store.setCurrent(active)
+	done := make(chan struct{})
+
+	defer func() {
+		close(done)
+
+		if err := store.registry.EndSnapshot(context.Background(), active); err != nil {
+			log.Printf("Snapshot %s not ended: %v", active.Id, err)
+		}
+
+		store.setCurrent(nil)
+	}()
+
+	go renewSnapshot(store.registry, done)
+
+	// Every replica records its writes from the marker on, it has seen the snapshot by then.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(time.UnixMilli(active.Marker))):
+	}
+
+	ids, err := store.Devices(ctx)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Couldn't list the devices. %v", err))
+	}
+
+	sort.Strings(ids)
+	marker := time.UnixMilli(active.Marker).UTC()
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	response.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"snapshot-%s.ndjson\"", marker.Format("20060102T150405Z")))
+	response.Header().Set("X-Snapshot-Marker", marker.Format(time.RFC3339Nano))
+	response.Header().Set("Trailer", snapshotReadingsTrailer)
+	response.WriteHeader(http.StatusOK)
+
+	exported := 0
+
+	for _, deviceId := range ids {
+		// The writes are read after the history, every reading of the history written after the marker is in them.
+		history, err := store.Store.Range(ctx, deviceId, time.UnixMilli(0), time.Now().AddDate(100, 0, 0))
+
+		if err != nil {
+			return fmt.Errorf("snapshot %s of device %s: %w", active.Id, deviceId, err)
+		}
+
+		writes, err := store.registry.SnapshotWrites(ctx, active, deviceId)
+
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", active.Id, err)
+		}
+
+		for i := range history {
+			timestamp, _ := history[i].Timestamp()
+			replaced, written := writes[strconv.FormatInt(timestamp.UnixMilli(), 10)]
+
+			var line []byte
+
+			switch {
+			case !written:
+				line, err = marshalResponse(c, &history[i])
+			case replaced != "":
+				line, err = marshalResponse(c, json.RawMessage(replaced))
+			default:
+				continue
+			}
+
+			if err == nil {
+				_, err = response.Write(append(line, '\n'))
+			}
+
+			if err != nil {
+				return err
+			}
+
+			exported++
+		}
+
+		response.Flush()
+	}
+
+	response.Header().Set(snapshotReadingsTrailer, strconv.Itoa(exported))
+	log.Printf("Snapshot %s exported, %d readings of %d devices as of %s", active.Id, exported, len(ids), marker.Format(time.RFC3339))
+
+	return nil
+}
+
+// renewSnapshot renews the lease of the snapshot until done
+func renewSnapshot(reg *registry, done <-chan struct{}) {
+	ticker := time.NewTicker(snapshotLease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := reg.RenewSnapshot(context.Background()); err != nil {
+				log.Printf("Snapshot not renewed: %v", err)
+			}
+		}
+	}
+}
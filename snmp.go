@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// sysUpTimeOID is the standard SNMP uptime of the agent in hundredths of a second.
+const sysUpTimeOID = "1.3.6.1.2.1.1.3.0"
+
+// SNMPConfig configures the collector polling sensors that only speak SNMP.
+type SNMPConfig struct {
+	Interval Duration     `json:"interval"` // Polling interval of the targets, 1 minute by default
+	Timeout  Duration     `json:"timeout"`  // Timeout of a single poll, 5 seconds by default
+	Targets  []SNMPTarget `json:"targets"`  // Agents to poll, the collector is disabled when empty
+}
+
+// SNMPTarget maps the OIDs of an SNMP agent into the sensor data of a device.
+type SNMPTarget struct {
+	Host       string   `json:"host"`        // Address of the agent
+	Port       uint16   `json:"port"`        // Port of the agent, 161 by default
+	Community  string   `json:"community"`   // Community string, "public" by default
+	Version    string   `json:"version"`     // SNMP version, "1" or "2c" (default)
+	DeviceId   string   `json:"device_id"`   // Device id the readings are stored under
+	DeviceType string   `json:"device_type"` // Device type of the readings
+	TempOID    string   `json:"temp_oid"`    // OID of the temperature
+	TempScale  float64  `json:"temp_scale"`  // Factor applied to the polled temperature, 1 by default
+	UptimeOID  string   `json:"uptime_oid"`  // OID of the uptime, sysUpTime by default
+	Interval   Duration `json:"interval"`    // Overrides the collector polling interval
+}
+
+// snmpCollector polls the configured SNMP targets and ingests their readings.
+type snmpCollector struct {
+	config SNMPConfig
+	ing    *ingester
+}
+
+// newSNMPCollector validates the configuration and applies its defaults
+func newSNMPCollector(config SNMPConfig, ing *ingester) (*snmpCollector, error) {
+	if config.Interval <= 0 {
+		config.Interval = Duration(time.Minute)
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = Duration(5 * time.Second)
+	}
+
+	targets := make([]SNMPTarget, len(config.Targets))
+
+	for i, target := range config.Targets {
+		if target.Host == "" || target.DeviceId == "" || target.TempOID == "" {
+			return nil, fmt.Errorf("snmp target %d must have a host, a device_id and a temp_oid", i)
+		}
+
+		if target.Version != "" && target.Version != "1" && target.Version != "2c" {
+			return nil, fmt.Errorf("snmp target %s has unsupported version %s", target.DeviceId, target.Version)
+		}
+
+		if target.Port == 0 {
+			target.Port = 161
+		}
+
+		if target.Community == "" {
+			target.Community = "public"
+		}
+
+		if target.TempScale == 0 {
+			target.TempScale = 1
+		}
+
+		if target.UptimeOID == "" {
+			target.UptimeOID = sysUpTimeOID
+		}
+
+		if target.Interval <= 0 {
+			target.Interval = config.Interval
+		}
+
+		targets[i] = target
+	}
+
+	config.Targets = targets
+
+	return &snmpCollector{config: config, ing: ing}, nil
+}
+
+// run polls every target on its interval until the context is cancelled
+func (c *snmpCollector) run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, target := range c.config.Targets {
+		wg.Add(1)
+
+		go func(target SNMPTarget) {
+			defer wg.Done()
+
+			pollOnInterval(ctx, time.Duration(target.Interval), "SNMP poll of device "+target.DeviceId, func(ctx context.Context) error {
+				return c.poll(ctx, target)
+			})
+		}(target)
+	}
+
+	wg.Wait()
+}
+
+// poll reads the target OIDs and ingests them as a reading
+func (c *snmpCollector) poll(ctx context.Context, target SNMPTarget) error {
+	client := &gosnmp.GoSNMP{
+		Target:    target.Host,
+		Port:      target.Port,
+		Community: target.Community,
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Duration(c.config.Timeout),
+		Retries:   1,
+		Context:   ctx,
+	}
+
+	if target.Version == "1" {
+		client.Version = gosnmp.Version1
+	}
+
+	if err := client.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", target.Host, err)
+	}
+
+	defer client.Close()
+
+	result, err := client.Get([]string{target.TempOID, target.UptimeOID})
+
+	if err != nil {
+		return fmt.Errorf("failed to get the OIDs from %s: %w", target.Host, err)
+	}
+
+	sensorData := &SensorData{
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		DeviceId:   target.DeviceId,
+		DeviceType: target.DeviceType,
+	}
+	foundTemp := false
+
+	for _, variable := range result.Variables {
+		oid := strings.TrimPrefix(variable.Name, ".")
+
+		switch oid {
+		case strings.TrimPrefix(target.TempOID, "."):
+			temp, err := snmpFloat(variable)
+
+			if err != nil {
+				return fmt.Errorf("temperature OID %s: %w", oid, err)
+			}
+
+			sensorData.Temp = float32(temp * target.TempScale)
+			foundTemp = true
+		case strings.TrimPrefix(target.UptimeOID, "."):
+			uptime, err := snmpFloat(variable)
+
+			if err != nil {
+				return fmt.Errorf("uptime OID %s: %w", oid, err)
+			}
+
+			if variable.Type == gosnmp.TimeTicks {
+				uptime /= 100
+			}
+
+			sensorData.Uptime = int(uptime)
+		}
+	}
+
+	if !foundTemp {
+		return fmt.Errorf("agent %s did not return the temperature OID %s", target.Host, target.TempOID)
+	}
+
+	return c.ing.ingest(ctx, sensorData)
+}
+
+// snmpFloat converts a numeric or numeric string SNMP value into a float
+func snmpFloat(variable gosnmp.SnmpPDU) (float64, error) {
+	switch value := variable.Value.(type) {
+	case float32:
+		return float64(value), nil
+	case float64:
+		return value, nil
+	case []byte:
+		return strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(value), 64)
+	}
+
+	switch variable.Type {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Counter64, gosnmp.Uinteger32:
+		value, _ := new(big.Float).SetInt(gosnmp.ToBigInt(variable.Value)).Float64()
+		return value, nil
+	}
+
+	return 0, fmt.Errorf("value of type %v is not numeric", variable.Type)
+}
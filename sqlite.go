@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the tables of the readings, the unique indexes make a reading saved twice stored once as in Redis.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS readings (device_id TEXT NOT NULL, time_ms INTEGER NOT NULL, data TEXT NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS readings_device_time ON readings (device_id, time_ms, data);
+CREATE TABLE IF NOT EXISTS latest (device_id TEXT PRIMARY KEY, time_ms INTEGER NOT NULL, data TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS metrics (device_id TEXT NOT NULL, metric TEXT NOT NULL, time_ms INTEGER NOT NULL, value REAL NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS metrics_device_metric_time ON metrics (device_id, metric, time_ms, value);
+`
+
+// sqliteStore keeps the readings in an embedded SQLite database, for the single node deployments without Redis.
+// The latest table holds the latest reading of every device and lists the devices.
+type sqliteStore struct {
+	db     *sql.DB
+	merges sync.Mutex // Serializes the merges, a transaction reading before it writes fails when another write commits in between
+}
+
+// newSQLiteStore opens the database file, created with its tables when missing
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	if path == "" {
+		return nil, errors.New("the sqlite backend needs the path of its database file")
+	}
+
+	// The WAL journal lets the reads run along the writes, the busy timeout makes a write wait for the one in progress.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)")
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the database %s: %w", path, err)
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create the tables of the database %s: %w", path, err)
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+// Save stores the reading in the history of the device and makes it its latest one unless a later one is stored
+func (s *sqliteStore) Save(ctx context.Context, sensorData *SensorData) error {
+	pooled := getJSONBuffer()
+	dataToSave, err := appendSensorData((*pooled)[:0], sensorData)
+	defer putJSONBuffer(pooled, dataToSave)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on marshalling the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on reading the time of the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on saving the device id %s data in the database: %v", sensorData.DeviceId, err)
+	}
+
+	defer tx.Rollback()
+
+	// The reading is stored with its measurements or not at all.
+	err = insertSQLiteReading(ctx, tx, sensorData, timestamp.UnixMilli(), string(dataToSave))
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		return fmt.Errorf("fatal error on saving the device id %s data in the database: %v", sensorData.DeviceId, err)
+	}
+
+	return nil
+}
+
+// insertSQLiteReading inserts the reading with its measurements in the transaction, as the latest one of its device
+// unless a later one is stored
+func insertSQLiteReading(ctx context.Context, tx *sql.Tx, sensorData *SensorData, millis int64, data string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO latest (device_id, time_ms, data) VALUES (?, ?, ?)
+		ON CONFLICT (device_id) DO UPDATE SET time_ms = excluded.time_ms, data = excluded.data WHERE excluded.time_ms >= latest.time_ms`,
+		sensorData.DeviceId, millis, data)
+
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO readings (device_id, time_ms, data) VALUES (?, ?, ?)`, sensorData.DeviceId, millis, data)
+	}
+
+	for name, value := range sensorData.Measurements() {
+		if err != nil {
+			break
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO metrics (device_id, metric, time_ms, value) VALUES (?, ?, ?, ?)`, sensorData.DeviceId, name, millis, value)
+	}
+
+	return err
+}
+
+// Merge stores the reading in place of the ones at its time unless one was received later, in a single transaction
+func (s *sqliteStore) Merge(ctx context.Context, sensorData *SensorData) (bool, *SensorData, error) {
+	dataToSave, err := appendSensorData(nil, sensorData)
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on marshalling the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on reading the time of the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	s.merges.Lock()
+	defer s.merges.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on merging the device id %s data in the database: %v", sensorData.DeviceId, err)
+	}
+
+	defer tx.Rollback()
+	millis := timestamp.UnixMilli()
+	existing, err := scanSQLiteReadings(tx.QueryContext(ctx, `SELECT data FROM readings WHERE device_id = ? AND time_ms = ? ORDER BY data`, sensorData.DeviceId, millis))
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on merging the device id %s data in the database: %v", sensorData.DeviceId, err)
+	}
+
+	local, stored, replace := resolveMerge(existing, sensorData)
+
+	if !replace {
+		return stored, local, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM readings WHERE device_id = ? AND time_ms = ?`, sensorData.DeviceId, millis)
+
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM metrics WHERE device_id = ? AND time_ms = ?`, sensorData.DeviceId, millis)
+	}
+
+	if err == nil {
+		err = insertSQLiteReading(ctx, tx, sensorData, millis, string(dataToSave))
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on merging the device id %s data in the database: %v", sensorData.DeviceId, err)
+	}
+
+	return true, local, nil
+}
+
+// Latest retrieves the last sensor data of the device
+func (s *sqliteStore) Latest(ctx context.Context, id string) (*SensorData, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM latest WHERE device_id = ?`, id).Scan(&data)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("sensor data for device id with %s %w", id, errNotFound)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the sensor data for device id %s from the database: %v", id, err)
+	}
+
+	var sensorData SensorData
+
+	if err := json.Unmarshal([]byte(data), &sensorData); err != nil {
+		return nil, fmt.Errorf("fatal error on reading the sensor data for device id %s from the database: %v", id, err)
+	}
+
+	return &sensorData, nil
+}
+
+// Range retrieves the sensor data history of the device between from and to
+func (s *sqliteStore) Range(ctx context.Context, id string, from, to time.Time) ([]SensorData, error) {
+	history, err := scanSQLiteReadings(s.db.QueryContext(ctx, `SELECT data FROM readings WHERE device_id = ? AND time_ms BETWEEN ? AND ? ORDER BY time_ms, data`,
+		id, from.UnixMilli(), to.UnixMilli()))
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the sensor data history for device id %s from the database: %v", id, err)
+	}
+
+	return history, nil
+}
+
+// scanSQLiteReadings decodes the readings of the rows of a query of their data
+func scanSQLiteReadings(rows *sql.Rows, err error) ([]SensorData, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	history := []SensorData{}
+
+	for rows.Next() {
+		var data string
+		var sensorData SensorData
+
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(data), &sensorData); err != nil {
+			return nil, err
+		}
+
+		history = append(history, sensorData)
+	}
+
+	return history, rows.Err()
+}
+
+// deleteDevice deletes the latest reading, the history and the measurements of the device
+func (s *sqliteStore) deleteDevice(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on deleting the data of device %s from the database: %v", id, err)
+	}
+
+	defer tx.Rollback()
+
+	for _, table := range []string{"readings", "metrics", "latest"} {
+		if _, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE device_id = ?`, id); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		return fmt.Errorf("fatal error on deleting the data of device %s from the database: %v", id, err)
+	}
+
+	return nil
+}
+
+// Devices lists the ids of all devices with a reading
+func (s *sqliteStore) Devices(ctx context.Context) ([]string, error) {
+	ids, err := s.strings(ctx, `SELECT device_id FROM latest`)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the device ids from the database: %v", err)
+	}
+
+	return ids, nil
+}
+
+// MetricRange retrieves the values of a measurement of the device between from and to
+func (s *sqliteStore) MetricRange(ctx context.Context, id, metric string, from, to time.Time) ([]MetricPoint, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT time_ms, value FROM metrics WHERE device_id = ? AND metric = ? AND time_ms BETWEEN ? AND ? ORDER BY time_ms, value`,
+		id, metric, from.UnixMilli(), to.UnixMilli())
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the %s history for device id %s from the database: %v", metric, id, err)
+	}
+
+	defer rows.Close()
+	points := []MetricPoint{}
+
+	for rows.Next() {
+		var millis int64
+		var value float64
+
+		if err := rows.Scan(&millis, &value); err != nil {
+			return nil, fmt.Errorf("fatal error on retrieving the %s history for device id %s from the database: %v", metric, id, err)
+		}
+
+		points = append(points, MetricPoint{Time: time.UnixMilli(millis).UTC().Format(time.RFC3339), Value: value})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the %s history for device id %s from the database: %v", metric, id, err)
+	}
+
+	return points, nil
+}
+
+// Metrics lists the names of the measurements reported by the device
+func (s *sqliteStore) Metrics(ctx context.Context, id string) ([]string, error) {
+	names, err := s.strings(ctx, `SELECT DISTINCT metric FROM metrics WHERE device_id = ?`, id)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the metric names of device id %s from the database: %v", id, err)
+	}
+
+	return names, nil
+}
+
+// strings runs a query of a single text column
+func (s *sqliteStore) strings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	values := []string{}
+
+	for rows.Next() {
+		var value string
+
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// statsKeyPrefix prefixes the per-device, measurement and minute hash of the running sums of the values.
+	statsKeyPrefix = "stats:"
+	// statsBucket is the resolution of the rolling statistics.
+	statsBucket = time.Minute
+	// maxStatsWindow is the longest window of the rolling statistics, the buckets expire after it.
+	maxStatsWindow = 24 * time.Hour
+	// defaultStatsWindow is the window of the rolling statistics without a window parameter.
+	defaultStatsWindow = time.Hour
+)
+
+// addStatsScript adds a value to the running sums (count, sum, sum of squares, min and max) of a bucket hash.
+var addStatsScript = redis.NewScript(`
+local value = tonumber(ARGV[1])
+redis.call('HINCRBY', KEYS[1], 'count', 1)
+redis.call('HINCRBYFLOAT', KEYS[1], 'sum', ARGV[1])
+redis.call('HINCRBYFLOAT', KEYS[1], 'sumsq', ARGV[2])
+
+local min = tonumber(redis.call('HGET', KEYS[1], 'min'))
+local max = tonumber(redis.call('HGET', KEYS[1], 'max'))
+
+if not min or value < min then
+  redis.call('HSET', KEYS[1], 'min', ARGV[1])
+end
+
+if not max or value > max then
+  redis.call('HSET', KEYS[1], 'max', ARGV[1])
+end
+
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 0
+`)
+
+// RollingStatsConfig selects the measurements whose rolling statistics are maintained at ingest.
+type RollingStatsConfig struct {
+	Metrics []string `json:"metrics"` // Measurements with rolling statistics, ["temp"] by default
+}
+
+// rollingStats is the statistics of a measurement of a device over the window ending now.
+type rollingStats struct {
+	DeviceId string     `json:"device_id"`
+	Metric   string     `json:"metric"`
+	Window   string     `json:"window"`
+	From     time.Time  `json:"from"`
+	To       time.Time  `json:"to"`
+	Stats    *Aggregate `json:"stats"` // null without values in the window
+}
+
+// statsKey returns the key of the bucket of the measurement of the device starting at the given time
+func statsKey(deviceId, metric string, bucket time.Time) string {
+	return statsKeyPrefix + deviceId + ":" + metric + ":" + strconv.FormatInt(bucket.Unix()/int64(statsBucket/time.Second), 10)
+}
+
+// AddStats adds the value of a measurement of the device to the running sums of its bucket
+func (r *registry) AddStats(ctx context.Context, deviceId, metric string, timestamp time.Time, value float64) error {
+	bucket := timestamp.Truncate(statsBucket)
+	ttl := time.Until(bucket.Add(maxStatsWindow + statsBucket))
+
+	// Readings too old to fall in any window are left out.
+	if ttl <= 0 {
+		return nil
+	}
+
+	if err := r.addRunningSums(ctx, statsKey(deviceId, metric, bucket), value, ttl); err != nil {
+		return fmt.Errorf("fatal error on updating the %s statistics of device %s in the cache: %v", metric, deviceId, err)
+	}
+
+	return nil
+}
+
+// addRunningSums adds the value to the running sums of the bucket hash and sets its expiry
+func (r *registry) addRunningSums(ctx context.Context, key string, value float64, ttl time.Duration) error {
+	if err := addStatsScript.Run(ctx, r.rdb, []string{key}, value, value*value, ttl.Milliseconds()).Err(); err != nil && err != redis.Nil {
+		return err
+	}
+
+	return nil
+}
+
+// RollingStats combines the buckets of the measurement of the device within [from, to]
+func (r *registry) RollingStats(ctx context.Context, deviceId, metric string, from, to time.Time) (*Aggregate, error) {
+	pipe := r.rdb.Pipeline()
+	var cmds []*redis.MapStringStringCmd
+
+	for bucket := from.Truncate(statsBucket); !bucket.After(to); bucket = bucket.Add(statsBucket) {
+		cmds = append(cmds, pipe.HGetAll(ctx, statsKey(deviceId, metric, bucket)))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the %s statistics of device %s from the cache: %v", metric, deviceId, err)
+	}
+
+	sums := newRunningSums()
+
+	for _, cmd := range cmds {
+		sums.merge(cmd.Val())
+	}
+
+	return sums.aggregate(), nil
+}
+
+// runningSums accumulates the bucket hashes maintained by addStatsScript.
+type runningSums struct {
+	count      int
+	sum        float64
+	sumSquares float64
+	min        float64
+	max        float64
+}
+
+// newRunningSums creates empty running sums
+func newRunningSums() *runningSums {
+	return &runningSums{min: math.Inf(1), max: math.Inf(-1)}
+}
+
+// merge adds the running sums of a bucket hash, an empty hash is ignored
+func (s *runningSums) merge(fields map[string]string) {
+	if len(fields) == 0 {
+		return
+	}
+
+	count, _ := strconv.Atoi(fields["count"])
+	sum, _ := strconv.ParseFloat(fields["sum"], 64)
+	sumSquares, _ := strconv.ParseFloat(fields["sumsq"], 64)
+	min, _ := strconv.ParseFloat(fields["min"], 64)
+	max, _ := strconv.ParseFloat(fields["max"], 64)
+
+	s.count += count
+	s.sum += sum
+	s.sumSquares += sumSquares
+	s.min = math.Min(s.min, min)
+	s.max = math.Max(s.max, max)
+}
+
+// aggregate summarizes the values added, nil when there are none
+func (s *runningSums) aggregate() *Aggregate {
+	if s.count == 0 {
+		return nil
+	}
+
+	avg := s.sum / float64(s.count)
+
+	return &Aggregate{
+		Count:  s.count,
+		Min:    s.min,
+		Max:    s.max,
+		Avg:    avg,
+		Stddev: math.Sqrt(math.Max(s.sumSquares/float64(s.count)-avg*avg, 0)),
+	}
+}
+
+// statsRecorder maintains the rolling statistics of the configured measurements at ingest.
+type statsRecorder struct {
+	metrics  []string
+	registry *registry
+}
+
+// newStatsRecorder validates the configuration and applies its defaults
+func newStatsRecorder(config RollingStatsConfig, reg *registry) (*statsRecorder, error) {
+	if config.Metrics == nil {
+		config.Metrics = []string{"temp"}
+	}
+
+	for _, metric := range config.Metrics {
+		if !metricNamePattern.MatchString(metric) {
+			return nil, fmt.Errorf("metric name %q is invalid", metric)
+		}
+	}
+
+	return &statsRecorder{metrics: config.Metrics, registry: reg}, nil
+}
+
+// record adds the configured measurements of the reading to the rolling statistics of its device
+func (s *statsRecorder) record(ctx context.Context, sensorData *SensorData) error {
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return err
+	}
+
+	measurements := sensorData.Measurements()
+
+	for _, metric := range s.metrics {
+		value, found := measurements[metric]
+
+		if !found {
+			continue
+		}
+
+		if err := s.registry.AddStats(ctx, sensorData.DeviceId, metric, timestamp, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getRollingStats returns the statistics of a measurement (temp by default) of the device over the window ending now
+func getRollingStats(c echo.Context, reg *registry) error {
+	deviceId := c.Param("id")
+	metric := c.QueryParam("metric")
+
+	if metric == "" {
+		metric = "temp"
+	}
+
+	if !metricNamePattern.MatchString(metric) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Metric name %q is invalid", metric))
+	}
+
+	window := defaultStatsWindow
+
+	if raw := c.QueryParam("window"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+
+		if err != nil || parsed < statsBucket || parsed > maxStatsWindow {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'window' %s must be a duration between %v and %v", raw, statsBucket, maxStatsWindow))
+		}
+
+		window = parsed
+	}
+
+	to := time.Now().UTC()
+	from := to.Add(-window)
+	stats, err := reg.RollingStats(c.Request().Context(), deviceId, metric, from, to)
+
+	if err != nil {
+		return registryHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, rollingStats{DeviceId: deviceId, Metric: metric, Window: window.String(), From: from, To: to, Stats: stats})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/labstack/echo/v4"
+)
+
+// defaultStatsDPrefix prefixes the metric names without a prefix setting.
+const defaultStatsDPrefix = "sensor_api."
+
+// StatsDConfig emits the request and ingest metrics to a StatsD server or a Datadog agent.
+type StatsDConfig struct {
+	Address   string   `json:"address"`   // host:port of the StatsD server or the Datadog agent, e.g. "127.0.0.1:8125", no metrics when empty
+	Prefix    string   `json:"prefix"`    // Prefix of the metric names, "sensor_api." by default
+	DogStatsD bool     `json:"dogstatsd"` // Tags the metrics in the DogStatsD format, plain StatsD servers don't accept the tags
+	Tags      []string `json:"tags"`      // Tags of every metric with dogstatsd, e.g. "env:prod"
+}
+
+// statsdSink emits the metrics without waiting, the metrics lost on the way aren't retried.
+type statsdSink struct {
+	client *statsd.Client
+	tagged bool
+}
+
+// newStatsDSink connects to the StatsD server, nil without an address
+func newStatsDSink(config StatsDConfig) (*statsdSink, error) {
+	if config.Address == "" {
+		return nil, nil
+	}
+
+	prefix := config.Prefix
+
+	if prefix == "" {
+		prefix = defaultStatsDPrefix
+	}
+
+	options := []statsd.Option{statsd.WithNamespace(prefix)}
+
+	if config.DogStatsD {
+		options = append(options, statsd.WithTags(config.Tags))
+	} else if len(config.Tags) > 0 {
+		return nil, fmt.Errorf("tags need dogstatsd")
+	}
+
+	client, err := statsd.New(config.Address, options...)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the StatsD client of %s: %w", config.Address, err)
+	}
+
+	return &statsdSink{client: client, tagged: config.DogStatsD}, nil
+}
+
+// tags returns the tags of a metric, none for a plain StatsD server
+func (s *statsdSink) tags(tags ...string) []string {
+	if !s.tagged {
+		return nil
+	}
+
+	return tags
+}
+
+// middleware counts the requests and the error responses and times them by route
+func (s *statsdSink) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		// The error response is written here so its status is counted.
+		if err != nil {
+			c.Error(err)
+		}
+
+		status := c.Response().Status
+		tags := s.tags("method:"+c.Request().Method, "route:"+c.Path(), "status:"+strconv.Itoa(status))
+		s.emit(s.client.Incr("requests", tags, 1))
+		s.emit(s.client.Timing("request.duration", time.Since(start), tags, 1))
+
+		if status >= 400 {
+			s.emit(s.client.Incr("errors", tags, 1))
+		}
+
+		return err
+	}
+}
+
+// recordIngest counts the stored reading and times the lag between its time and its reception, the readings without
+// a time of their own have no lag
+func (s *statsdSink) recordIngest(sensorData *SensorData, receivedAt time.Time, reportedTime bool) {
+	if s == nil {
+		return
+	}
+
+	tags := s.tags("device_type:" + sensorData.DeviceType)
+	s.emit(s.client.Incr("ingest.readings", tags, 1))
+
+	if timestamp, err := sensorData.Timestamp(); err == nil && reportedTime {
+		s.emit(s.client.Timing("ingest.lag", receivedAt.Sub(timestamp), tags, 1))
+	}
+}
+
+// emit logs the metric not emitted, e.g. with the buffer of the client full
+func (s *statsdSink) emit(err error) {
+	if err != nil {
+		log.Printf("StatsD metric not emitted: %v", err)
+	}
+}
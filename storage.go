@@ -0,0 +1,30 @@
+package main
+
+import "fmt"
+
+// StorageConfig selects the backend storing the readings, the groups, labels, alerts and other metadata stay in Redis.
+type StorageConfig struct {
+	Backend    string           `json:"backend"`    // "redis" (default), "sqlite", "bolt" or "clickhouse"
+	Path       string           `json:"path"`       // Database file of the sqlite and bolt backends
+	ClickHouse ClickHouseConfig `json:"clickhouse"` // Server of the clickhouse backend
+	DualWrite  *DualWriteConfig `json:"dual_write"` // Secondary backend written along this one during a migration
+}
+
+// inRedis reports whether the readings are stored in Redis
+func (c StorageConfig) inRedis() bool {
+	return c.Backend == "" || c.Backend == "redis"
+}
+
+// newBackendStore opens the store of the readings of a backend other than Redis
+func newBackendStore(config StorageConfig) (Store, error) {
+	switch config.Backend {
+	case "sqlite":
+		return newSQLiteStore(config.Path)
+	case "bolt":
+		return newBoltStore(config.Path)
+	case "clickhouse":
+		return newClickHouseStore(config.ClickHouse)
+	default:
+		return nil, fmt.Errorf("unknown backend %q, expected redis, sqlite, bolt or clickhouse", config.Backend)
+	}
+}
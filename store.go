@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Store persists sensor readings and serves them back by device.
+type Store interface {
+	// Save appends the reading to the device history at its time and makes it the latest one of its device,
+	// unless a reading with a later time is stored already.
+	Save(ctx context.Context, sensorData *SensorData) error
+	// Latest returns the last reading saved for the device.
+	Latest(ctx context.Context, deviceId string) (*SensorData, error)
+	// Range returns the device readings timestamped within [from, to], oldest first.
+	Range(ctx context.Context, deviceId string, from, to time.Time) ([]SensorData, error)
+	// Merge saves the reading in place of the ones timestamped at its time unless one of them was received later,
+	// in a single step no other write of the device interleaves with. It returns whether the reading is stored and
+	// the one it was compared to, nil when none was stored at its time.
+	Merge(ctx context.Context, sensorData *SensorData) (bool, *SensorData, error)
+	// Devices returns the ids of all devices that have reported at least once.
+	Devices(ctx context.Context) ([]string, error)
+	// MetricRange returns the values of a measurement of the device timestamped within [from, to], oldest first.
+	MetricRange(ctx context.Context, deviceId, metric string, from, to time.Time) ([]MetricPoint, error)
+	// Metrics returns the names of the measurements the device has reported.
+	Metrics(ctx context.Context, deviceId string) ([]string, error)
+}
+
+const (
+	// devicesKey is the Redis set holding the ids of all known devices.
+	devicesKey = "devices"
+	// historyKeyPrefix prefixes the per-device sorted set of readings scored by their timestamp in milliseconds.
+	historyKeyPrefix = "history:"
+	// metricKeyPrefix prefixes the per-device and measurement sorted set of "<milliseconds>:<value>" scored by timestamp.
+	metricKeyPrefix = "metric:"
+	// metricsKeyPrefix prefixes the per-device set of the measurement names it reported.
+	metricsKeyPrefix = "metrics:"
+	// latestTimesKey is the Redis hash holding the time in milliseconds of the latest reading of every device.
+	latestTimesKey = "latest-times"
+	// latestKeyPrefix prefixes the Redis key holding the JSON of the latest reading of a device.
+	latestKeyPrefix = "latest:"
+	// latestKeysMigratedKey marks the Redis whose latest readings were moved from the bare device ids to their key.
+	latestKeysMigratedKey = "latest-keys-migrated"
+)
+
+// setLatestScript replaces the latest reading of a device unless the stored one is more recent,
+// so readings arriving out of order don't hide the last known state.
+var setLatestScript = redis.NewScript(`
+local current = tonumber(redis.call('HGET', KEYS[2], ARGV[1]))
+
+if current and current > tonumber(ARGV[2]) then
+  return 0
+end
+
+redis.call('SET', KEYS[1], ARGV[3])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+// mergeScript stores the reading of ARGV[3] at the time of ARGV[2] in the history of KEYS[1] in place of the ones
+// stored at that time, unless one wins over it as receivedLater tells: received after ARGV[4], or at the same time in
+// a region greater than ARGV[5], or with a greater JSON. It then makes it the latest one as setLatestScript does. Its
+// measurements, the name and member pairs from ARGV[6], are stored under the prefix of KEYS[6] and listed in KEYS[5].
+// It returns 1 when the reading is stored, 0 otherwise, with the stored reading it was compared to. The strings are
+// compared byte by byte, the comparison operators of Lua depend on the locale of the server.
+var mergeScript = redis.NewScript(`
+local function greater(a, b)
+  for i = 1, math.min(#a, #b) do
+    local x, y = string.byte(a, i), string.byte(b, i)
+
+    if x ~= y then
+      return x > y
+    end
+  end
+
+  return #a > #b
+end
+
+local function wins(a, b)
+  if a.at ~= b.at then
+    return greater(a.at, b.at)
+  end
+
+  if a.region ~= b.region then
+    return greater(a.region, b.region)
+  end
+
+  return greater(a.member, b.member)
+end
+
+local existing = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[2], ARGV[2])
+local winner = nil
+
+for _, member in ipairs(existing) do
+  if member == ARGV[3] then
+    return {1, member}
+  end
+
+  local ok, reading = pcall(cjson.decode, member)
+  local stored = {at = '', region = '', member = member}
+
+  if ok and type(reading) == 'table' then
+    if type(reading.received_at) == 'string' then
+      stored.at = reading.received_at
+    end
+
+    if type(reading.region) == 'string' then
+      stored.region = reading.region
+    end
+  end
+
+  if winner == nil or wins(stored, winner) then
+    winner = stored
+  end
+end
+
+if winner ~= nil and wins(winner, {at = ARGV[4], region = ARGV[5], member = ARGV[3]}) then
+  return {0, winner.member}
+end
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], ARGV[2], ARGV[2])
+
+for _, name in ipairs(redis.call('SMEMBERS', KEYS[5])) do
+  redis.call('ZREMRANGEBYSCORE', KEYS[6] .. name, ARGV[2], ARGV[2])
+end
+
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+redis.call('SADD', KEYS[4], ARGV[1])
+
+for n = 6, #ARGV, 2 do
+  redis.call('ZADD', KEYS[6] .. ARGV[n], ARGV[2], ARGV[n + 1])
+  redis.call('SADD', KEYS[5], ARGV[n])
+end
+
+local current = tonumber(redis.call('HGET', KEYS[3], ARGV[1]))
+
+if not current or current <= tonumber(ARGV[2]) then
+  redis.call('SET', KEYS[2], ARGV[3])
+  redis.call('HSET', KEYS[3], ARGV[1], ARGV[2])
+end
+
+return {1, winner and winner.member or ''}
+`)
+
+// redisStore keeps the latest reading of a device under its latest key and the full history in a sorted set.
+type redisStore struct {
+	rdb      *redis.Client
+	replicas *replicaSet // Replicas serving the reads tolerant of the replication lag, if any
+}
+
+// newRedisStore creates a Store backed by the given Redis client
+func newRedisStore(rdb *redis.Client) *redisStore {
+	return &redisStore{rdb: rdb}
+}
+
+// reader returns the client of a read, a replica when the context tolerates stale reads and one is usable
+func (s *redisStore) reader(ctx context.Context) *redis.Client {
+	if staleReadsAllowed(ctx) {
+		if replica := s.replicas.pick(); replica != nil {
+			return replica
+		}
+	}
+
+	return s.rdb
+}
+
+// Save serializes the sensor data and stores it in Redis
+func (s *redisStore) Save(ctx context.Context, sensorData *SensorData) error {
+	pooled := getJSONBuffer()
+	dataToSave, err := appendSensorData((*pooled)[:0], sensorData)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on marshalling the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return fmt.Errorf("fatal error on reading the time of the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	pipe := s.rdb.TxPipeline()
+	setLatestScript.Eval(ctx, pipe, []string{latestKeyPrefix + sensorData.DeviceId, latestTimesKey}, sensorData.DeviceId, timestamp.UnixMilli(), dataToSave)
+	pipe.ZAdd(ctx, historyKeyPrefix+sensorData.DeviceId, redis.Z{Score: float64(timestamp.UnixMilli()), Member: dataToSave})
+	pipe.SAdd(ctx, devicesKey, sensorData.DeviceId)
+
+	for name, value := range sensorData.Measurements() {
+		member := strconv.FormatInt(timestamp.UnixMilli(), 10) + ":" + strconv.FormatFloat(value, 'g', -1, 64)
+		pipe.ZAdd(ctx, metricKey(sensorData.DeviceId, name), redis.Z{Score: float64(timestamp.UnixMilli()), Member: member})
+		pipe.SAdd(ctx, metricsKeyPrefix+sensorData.DeviceId, name)
+	}
+
+	_, err = pipe.Exec(ctx)
+	putJSONBuffer(pooled, dataToSave)
+
+	if err != nil {
+		return fmt.Errorf("fatal error on saving the device id %s data in the cache: %v", sensorData.DeviceId, err)
+	}
+
+	return nil
+}
+
+// migrateLatestKeys moves the latest readings stored under the bare device ids by the previous versions to their
+// latest key, once per Redis, it returns the number moved. A key is only moved when it holds a reading of its device,
+// the keys of the API named like a device are left alone.
+func (s *redisStore) migrateLatestKeys(ctx context.Context) (int, error) {
+	done, err := s.rdb.Exists(ctx, latestKeysMigratedKey).Result()
+
+	if err != nil || done == 1 {
+		return 0, err
+	}
+
+	moved := 0
+	iter := s.rdb.SScan(ctx, devicesKey, 0, "", 1000).Iterator()
+
+	for iter.Next(ctx) {
+		id := iter.Val()
+		raw, err := s.rdb.Get(ctx, id).Bytes()
+
+		if err == redis.Nil || err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			continue
+		}
+
+		if err != nil {
+			return moved, err
+		}
+
+		var sensorData SensorData
+
+		if json.Unmarshal(raw, &sensorData) != nil || sensorData.DeviceId != id {
+			continue
+		}
+
+		renamed, err := s.rdb.RenameNX(ctx, id, latestKeyPrefix+id).Result()
+
+		if err != nil && !strings.HasPrefix(err.Error(), "ERR no such key") {
+			return moved, err
+		}
+
+		// A reading saved since the upgrade is more recent than the one left under the bare id.
+		if err == nil && !renamed {
+			if err := s.rdb.Del(ctx, id).Err(); err != nil {
+				return moved, err
+			}
+		}
+
+		moved++
+	}
+
+	if err := iter.Err(); err != nil {
+		return moved, err
+	}
+
+	return moved, s.rdb.Set(ctx, latestKeysMigratedKey, time.Now().UTC().Format(time.RFC3339), 0).Err()
+}
+
+// migrateLatestKeys moves the latest readings of the stores to their latest key, a failure is logged and the
+// migration runs again at the next start
+func migrateLatestKeys(stores []*redisStore) {
+	for _, store := range stores {
+		moved, err := store.migrateLatestKeys(context.Background())
+
+		if err != nil {
+			log.Printf("Latest readings of %s not moved to their latest key, retried at the next start: %v", store.rdb.Options().Addr, err)
+			continue
+		}
+
+		if moved > 0 {
+			log.Printf("%d latest readings of %s moved to their latest key", moved, store.rdb.Options().Addr)
+		}
+	}
+}
+
+// Latest retrieves the last sensor data from Redis by device ID
+func (s *redisStore) Latest(ctx context.Context, id string) (*SensorData, error) {
+	fromDB, err := s.reader(ctx).Get(ctx, latestKeyPrefix+id).Bytes()
+
+	if err != nil {
+		if err == redis.Nil {
+			return nil, fmt.Errorf("sensor data for device id with %s %w", id, errNotFound)
+		}
+
+		return nil, fmt.Errorf("fatal error on retrieiving the sensor data for device id %s from the cache: %v", id, err)
+	}
+
+	var sensorData SensorData
+
+	err = json.Unmarshal(fromDB, &sensorData)
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on reading the sensor data for device id %s from cache: %v", id, err)
+	}
+
+	return &sensorData, nil
+}
+
+// Range retrieves the sensor data history of the device between from and to
+func (s *redisStore) Range(ctx context.Context, id string, from, to time.Time) ([]SensorData, error) {
+	members, err := s.reader(ctx).ZRangeByScore(ctx, historyKeyPrefix+id, &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.UnixMilli(), 10),
+		Max: strconv.FormatInt(to.UnixMilli(), 10),
+	}).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the sensor data history for device id %s from the cache: %v", id, err)
+	}
+
+	history := make([]SensorData, 0, len(members))
+
+	for _, member := range members {
+		var sensorData SensorData
+
+		if err := json.Unmarshal([]byte(member), &sensorData); err != nil {
+			return nil, fmt.Errorf("fatal error on reading the sensor data history for device id %s from cache: %v", id, err)
+		}
+
+		history = append(history, sensorData)
+	}
+
+	return history, nil
+}
+
+// Merge stores the reading in place of the ones at its time unless one was received later, in a single script
+func (s *redisStore) Merge(ctx context.Context, sensorData *SensorData) (bool, *SensorData, error) {
+	dataToSave, err := appendSensorData(nil, sensorData)
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on marshalling the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	timestamp, err := sensorData.Timestamp()
+
+	if err != nil {
+		return false, nil, fmt.Errorf("fatal error on reading the time of the sensor data for device %s: %v", sensorData.DeviceId, err)
+	}
+
+	id := sensorData.DeviceId
+	millis := strconv.FormatInt(timestamp.UnixMilli(), 10)
+	keys := []string{historyKeyPrefix + id, latestKeyPrefix + id, latestTimesKey, devicesKey, metricsKeyPrefix + id, metricKey(id, "")}
+	args := []interface{}{id, millis, dataToSave, sensorData.ReceivedAt, sensorData.Region}
+
+	for name, value := range sensorData.Measurements() {
+		args = append(args, name, millis+":"+strconv.FormatFloat(value, 'g', -1, 64))
+	}
+
+	result, err := mergeScript.Run(ctx, s.rdb, keys, args...).Slice()
+
+	if err != nil || len(result) != 2 {
+		return false, nil, fmt.Errorf("fatal error on merging the device id %s data in the cache: %v", id, err)
+	}
+
+	stored, _ := result[0].(int64)
+	raw, _ := result[1].(string)
+
+	if raw == "" {
+		return stored == 1, nil, nil
+	}
+
+	var existing SensorData
+
+	if err := json.Unmarshal([]byte(raw), &existing); err != nil {
+		return false, nil, fmt.Errorf("fatal error on reading the sensor data history for device id %s from the cache: %v", id, err)
+	}
+
+	return stored == 1, &existing, nil
+}
+
+// Devices lists the ids of all devices stored in Redis
+func (s *redisStore) Devices(ctx context.Context) ([]string, error) {
+	ids, err := s.reader(ctx).SMembers(ctx, devicesKey).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the device ids from the cache: %v", err)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// MetricRange retrieves the values of a measurement of the device between from and to
+func (s *redisStore) MetricRange(ctx context.Context, id, metric string, from, to time.Time) ([]MetricPoint, error) {
+	members, err := s.reader(ctx).ZRangeByScore(ctx, metricKey(id, metric), &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.UnixMilli(), 10),
+		Max: strconv.FormatInt(to.UnixMilli(), 10),
+	}).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the %s history for device id %s from the cache: %v", metric, id, err)
+	}
+
+	points := make([]MetricPoint, 0, len(members))
+
+	for _, member := range members {
+		millis, value, found := strings.Cut(member, ":")
+		timestamp, errTime := strconv.ParseInt(millis, 10, 64)
+		parsed, errValue := strconv.ParseFloat(value, 64)
+
+		if !found || errTime != nil || errValue != nil {
+			return nil, fmt.Errorf("fatal error on reading the %s history for device id %s from cache: malformed point %q", metric, id, member)
+		}
+
+		points = append(points, MetricPoint{Time: time.UnixMilli(timestamp).UTC().Format(time.RFC3339), Value: parsed})
+	}
+
+	return points, nil
+}
+
+// Metrics lists the names of the measurements reported by the device
+func (s *redisStore) Metrics(ctx context.Context, id string) ([]string, error) {
+	names, err := s.reader(ctx).SMembers(ctx, metricsKeyPrefix+id).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the metric names of device id %s from the cache: %v", id, err)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// metricKey returns the key of the sorted set indexing a measurement of the device
+func metricKey(id, metric string) string {
+	return metricKeyPrefix + id + ":" + metric
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdFirstFd is the first file descriptor passed by systemd, after stdin, stdout and stderr.
+const systemdFirstFd = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation, none when the process wasn't activated.
+// The variables of the activation are unset, so the child processes don't take the sockets for theirs.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS %q must be a positive number of sockets", os.Getenv("LISTEN_FDS"))
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+
+	for i := 0; i < count; i++ {
+		name := "systemd-socket-" + strconv.Itoa(i)
+
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// The listener works on a duplicate of the descriptor, the passed one is closed.
+		file := os.NewFile(uintptr(systemdFirstFd+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("socket %s passed by systemd isn't a stream socket: %w", name, err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// notifySystemd tells systemd the service is ready when it was started with Type=notify, it does nothing otherwise
+func notifySystemd(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+
+	if socket == "" {
+		return nil
+	}
+
+	// An abstract socket is given with a leading @.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+
+	if err != nil {
+		return fmt.Errorf("failed to connect to the systemd notification socket: %w", err)
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// TransformConfig registers a Lua script rewriting incoming payloads before validation.
+//
+// The script must define a global function transform(payload) receiving the decoded
+// payload as a table and returning the rewritten table, e.g.
+//
+//	function transform(p)
+//	  p.temp = p.temperature_c10 / 10
+//	  p.device_type = p.model == "TH-2" and "B" or "A"
+//	  return p
+//	end
+type TransformConfig struct {
+	Name    string   `json:"name"`    // Name of the transformation in errors and logs
+	Script  string   `json:"script"`  // Inline Lua source
+	File    string   `json:"file"`    // Lua source file, used when script is empty
+	Timeout Duration `json:"timeout"` // Maximum run time of the script per payload, 100ms by default
+}
+
+// luaLibs are the standard libraries available to the scripts and expressions, leaving out io, os and package loading.
+var luaLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// luaTransform is a compiled transformation script with a pool of interpreters running it.
+type luaTransform struct {
+	name    string
+	timeout time.Duration
+	proto   *lua.FunctionProto
+	states  sync.Pool
+}
+
+// transformer runs the payload through every configured transformation in order.
+type transformer struct {
+	transforms []*luaTransform
+}
+
+// newTransformer compiles the transformation scripts
+func newTransformer(configs []TransformConfig) (*transformer, error) {
+	t := &transformer{}
+
+	for i, config := range configs {
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("transform-%d", i)
+		}
+
+		source := config.Script
+
+		if source == "" && config.File != "" {
+			raw, err := os.ReadFile(config.File)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the script of transformation %s: %w", config.Name, err)
+			}
+
+			source = string(raw)
+		}
+
+		if source == "" {
+			return nil, fmt.Errorf("transformation %s has no script", config.Name)
+		}
+
+		proto, err := compileLua(config.Name, source)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile transformation %s: %w", config.Name, err)
+		}
+
+		transform := &luaTransform{name: config.Name, timeout: time.Duration(config.Timeout), proto: proto}
+
+		if transform.timeout <= 0 {
+			transform.timeout = 100 * time.Millisecond
+		}
+
+		// Loading the script once right away reports a missing transform function at startup.
+		L, err := transform.newState()
+
+		if err != nil {
+			return nil, err
+		}
+
+		transform.states.Put(L)
+		t.transforms = append(t.transforms, transform)
+	}
+
+	return t, nil
+}
+
+// enabled reports whether at least one transformation is configured
+func (t *transformer) enabled() bool {
+	return t != nil && len(t.transforms) > 0
+}
+
+// transform runs the payload through the transformations and decodes the result into sensor data
+func (t *transformer) transform(ctx context.Context, payload map[string]interface{}) (*SensorData, error) {
+	for _, transform := range t.transforms {
+		var err error
+
+		if payload, err = transform.run(ctx, payload); err != nil {
+			return nil, fmt.Errorf("transformation %s failed: %w", transform.name, err)
+		}
+	}
+
+	raw, err := json.Marshal(payload)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode the transformed payload: %w", err)
+	}
+
+	sensorData := new(SensorData)
+
+	if err := json.Unmarshal(raw, sensorData); err != nil {
+		return nil, fmt.Errorf("unable to decode the transformed payload: %w", err)
+	}
+
+	return sensorData, nil
+}
+
+// newState creates an interpreter with the script loaded
+func (t *luaTransform) newState() (*lua.LState, error) {
+	L, err := newLuaState()
+
+	if err != nil {
+		return nil, err
+	}
+
+	L.Push(L.NewFunctionFromProto(t.proto))
+
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to load transformation %s: %w", t.name, err)
+	}
+
+	if _, ok := L.GetGlobal("transform").(*lua.LFunction); !ok {
+		L.Close()
+		return nil, fmt.Errorf("transformation %s does not define a transform function", t.name)
+	}
+
+	return L, nil
+}
+
+// run calls the transform function of the script on the payload
+func (t *luaTransform) run(ctx context.Context, payload map[string]interface{}) (map[string]interface{}, error) {
+	L, ok := t.states.Get().(*lua.LState)
+
+	if !ok {
+		var err error
+
+		if L, err = t.newState(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	L.SetContext(ctx)
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal("transform"), NRet: 1, Protect: true}, toLua(L, payload))
+	L.RemoveContext()
+
+	if err != nil {
+		// The interpreter may be left in any state by a failed run, it is not reused.
+		L.Close()
+		return nil, err
+	}
+
+	result := L.Get(-1)
+	L.Pop(1)
+	t.states.Put(L)
+
+	transformed, ok := fromLua(result).(map[string]interface{})
+
+	if !ok {
+		return nil, errors.New("transform must return a table")
+	}
+
+	return transformed, nil
+}
+
+// compileLua parses and compiles a Lua chunk
+func compileLua(name, source string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return lua.Compile(chunk, name)
+}
+
+// newLuaState creates an interpreter with the luaLibs opened
+func newLuaState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	for _, lib := range luaLibs {
+		if err := L.CallByParam(lua.P{Fn: L.NewFunction(lib.open), NRet: 0, Protect: true}, lua.LString(lib.name)); err != nil {
+			L.Close()
+			return nil, fmt.Errorf("failed to open lua library %q: %w", lib.name, err)
+		}
+	}
+
+	return L, nil
+}
+
+// toLua converts a decoded JSON value into its Lua counterpart
+func toLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+
+		for _, item := range v {
+			table.Append(toLua(L, item))
+		}
+
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+
+		for key, item := range v {
+			table.RawSetString(key, toLua(L, item))
+		}
+
+		return table
+	}
+
+	return lua.LString(fmt.Sprint(value))
+}
+
+// fromLua converts a Lua value back into a JSON encodable value, tables with a sequence become arrays
+func fromLua(value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if v.MaxN() > 0 {
+			array := make([]interface{}, 0, v.MaxN())
+
+			for i := 1; i <= v.MaxN(); i++ {
+				array = append(array, fromLua(v.RawGetInt(i)))
+			}
+
+			return array
+		}
+
+		object := make(map[string]interface{})
+
+		v.ForEach(func(key, item lua.LValue) {
+			object[key.String()] = fromLua(item)
+		})
+
+		return object
+	}
+
+	return nil
+}
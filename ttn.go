@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TTNConfig configures the webhook receiving The Things Network (LoRaWAN) uplinks.
+type TTNConfig struct {
+	Secret            string                `json:"secret"`              // Expected "Authorization: Bearer <secret>" header of the webhook, optional
+	DefaultDeviceType string                `json:"default_device_type"` // Device type of the TTN devices missing from devices
+	Devices           map[string]TTNDevice  `json:"devices"`             // Mapping by TTN device id
+	Decoders          map[string]TTNDecoder `json:"decoders"`            // Payload decoder by device type, the webhook is disabled when empty
+}
+
+// TTNDevice maps a TTN end device to a device of this API.
+type TTNDevice struct {
+	DeviceId   string `json:"device_id"`   // Device id the readings are stored under, the TTN device id by default
+	DeviceType string `json:"device_type"` // Device type selecting the payload decoder
+}
+
+// TTNDecoder decodes the uplink of a device type either from the payload decoded by the TTN
+// payload formatter ("decoded_payload") or from the raw frame bytes ("bytes").
+type TTNDecoder struct {
+	Kind        string        `json:"kind"`         // "decoded_payload" (default) or "bytes"
+	TempField   string        `json:"temp_field"`   // Field of the decoded payload holding the temperature, "temp" by default
+	UptimeField string        `json:"uptime_field"` // Field of the decoded payload holding the uptime, "uptime" by default
+	Temp        *TTNByteField `json:"temp"`         // Location of the temperature in the raw frame
+	Uptime      *TTNByteField `json:"uptime"`       // Location of the uptime in the raw frame, optional
+}
+
+// TTNByteField locates a number in the raw frame payload.
+type TTNByteField struct {
+	Offset       int     `json:"offset"`        // Offset of the first byte
+	Format       string  `json:"format"`        // "int8", "uint8", "int16" (default), "uint16", "int32", "uint32" or "float32"
+	LittleEndian bool    `json:"little_endian"` // Big endian by default
+	Scale        float64 `json:"scale"`         // Factor applied to the raw value, 1 by default
+}
+
+// ttnUplink is the subset of the TTN v3 uplink message webhook used to build a reading.
+type ttnUplink struct {
+	EndDeviceIds struct {
+		DeviceId string `json:"device_id"`
+	} `json:"end_device_ids"`
+	ReceivedAt    string `json:"received_at"`
+	UplinkMessage *struct {
+		FPort          int                    `json:"f_port"`
+		FrmPayload     []byte                 `json:"frm_payload"`
+		DecodedPayload map[string]interface{} `json:"decoded_payload"`
+		ReceivedAt     string                 `json:"received_at"`
+	} `json:"uplink_message"`
+}
+
+// ttnWebhook turns TTN uplinks into sensor data.
+type ttnWebhook struct {
+	config TTNConfig
+	ing    *ingester
+}
+
+// newTTNWebhook validates the decoders and applies their defaults
+func newTTNWebhook(config TTNConfig, ing *ingester) (*ttnWebhook, error) {
+	decoders := make(map[string]TTNDecoder, len(config.Decoders))
+
+	for deviceType, decoder := range config.Decoders {
+		switch decoder.Kind {
+		case "", "decoded_payload":
+			decoder.Kind = "decoded_payload"
+
+			if decoder.TempField == "" {
+				decoder.TempField = "temp"
+			}
+
+			if decoder.UptimeField == "" {
+				decoder.UptimeField = "uptime"
+			}
+		case "bytes":
+			if decoder.Temp == nil {
+				return nil, fmt.Errorf("ttn decoder of device type %s requires a temp field", deviceType)
+			}
+
+			for _, field := range []*TTNByteField{decoder.Temp, decoder.Uptime} {
+				if field == nil {
+					continue
+				}
+
+				if field.Format == "" {
+					field.Format = "int16"
+				}
+
+				if numberSize(field.Format) == 0 || field.Offset < 0 {
+					return nil, fmt.Errorf("ttn decoder of device type %s has an invalid field %+v", deviceType, *field)
+				}
+
+				if field.Scale == 0 {
+					field.Scale = 1
+				}
+			}
+		default:
+			return nil, fmt.Errorf("ttn decoder of device type %s has unsupported kind %s", deviceType, decoder.Kind)
+		}
+
+		decoders[deviceType] = decoder
+	}
+
+	config.Decoders = decoders
+
+	return &ttnWebhook{config: config, ing: ing}, nil
+}
+
+// handle processes an uplink webhook call
+func (w *ttnWebhook) handle(c echo.Context) error {
+	if w.config.Secret != "" {
+		expected := "Bearer " + w.config.Secret
+
+		if subtle.ConstantTimeCompare([]byte(c.Request().Header.Get(echo.HeaderAuthorization)), []byte(expected)) != 1 {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid webhook secret")
+		}
+	}
+
+	uplink := new(ttnUplink)
+
+	if err := c.Bind(uplink); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to get the uplink from the request body: %v", err)).withFields(err)
+	}
+
+	sensorData, err := w.decode(uplink)
+
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "malformed_payload", fmt.Sprintf("Unable to decode the uplink: %v", err))
+	}
+
+	c.Set(deviceIdContextKey, sensorData.DeviceId)
+	err = w.ing.ingest(c.Request().Context(), sensorData)
+
+	if errors.Is(err, errInvalidSensorData) {
+		return newProblem(http.StatusBadRequest, "invalid_sensor_data", err.Error()).withFields(err)
+	}
+
+	if errors.Is(err, errDuplicateReading) {
+		return c.NoContent(http.StatusOK)
+	}
+
+	if err != nil {
+		log.Printf("TTN ingest of device %s failed: %v", sensorData.DeviceId, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error on saving the uplink in the cache")
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// decode maps the uplink into sensor data with the decoder of the device type
+func (w *ttnWebhook) decode(uplink *ttnUplink) (*SensorData, error) {
+	if uplink.UplinkMessage == nil {
+		return nil, errors.New("the message is not an uplink")
+	}
+
+	ttnDeviceId := uplink.EndDeviceIds.DeviceId
+
+	if ttnDeviceId == "" {
+		return nil, errors.New("end_device_ids.device_id is missing")
+	}
+
+	sensorData := &SensorData{DeviceId: ttnDeviceId, DeviceType: w.config.DefaultDeviceType}
+
+	if device, ok := w.config.Devices[ttnDeviceId]; ok {
+		if device.DeviceId != "" {
+			sensorData.DeviceId = device.DeviceId
+		}
+
+		if device.DeviceType != "" {
+			sensorData.DeviceType = device.DeviceType
+		}
+	}
+
+	decoder, ok := w.config.Decoders[sensorData.DeviceType]
+
+	if !ok {
+		return nil, fmt.Errorf("no decoder configured for device type %q", sensorData.DeviceType)
+	}
+
+	for _, receivedAt := range []string{uplink.UplinkMessage.ReceivedAt, uplink.ReceivedAt} {
+		if timestamp, err := time.Parse(time.RFC3339Nano, receivedAt); err == nil {
+			sensorData.Time = timestamp.UTC().Format(time.RFC3339)
+			break
+		}
+	}
+
+	if decoder.Kind == "bytes" {
+		return sensorData, decoder.decodeBytes(uplink.UplinkMessage.FrmPayload, sensorData)
+	}
+
+	return sensorData, decoder.decodePayload(uplink.UplinkMessage.DecodedPayload, sensorData)
+}
+
+// decodePayload reads the values from the payload decoded by the TTN payload formatter
+func (d TTNDecoder) decodePayload(payload map[string]interface{}, sensorData *SensorData) error {
+	temp, ok := payload[d.TempField].(float64)
+
+	if !ok {
+		return fmt.Errorf("decoded_payload has no numeric field %s", d.TempField)
+	}
+
+	sensorData.Temp = float32(temp)
+
+	if uptime, ok := payload[d.UptimeField].(float64); ok {
+		sensorData.Uptime = int(uptime)
+	}
+
+	return nil
+}
+
+// decodeBytes reads the values from the raw frame payload
+func (d TTNDecoder) decodeBytes(frame []byte, sensorData *SensorData) error {
+	temp, err := d.Temp.read(frame)
+
+	if err != nil {
+		return fmt.Errorf("temp: %w", err)
+	}
+
+	sensorData.Temp = float32(temp)
+
+	if d.Uptime != nil {
+		uptime, err := d.Uptime.read(frame)
+
+		if err != nil {
+			return fmt.Errorf("uptime: %w", err)
+		}
+
+		sensorData.Uptime = int(uptime)
+	}
+
+	return nil
+}
+
+// read decodes the scaled value of the field from the frame
+func (f TTNByteField) read(frame []byte) (float64, error) {
+	end := f.Offset + numberSize(f.Format)
+
+	if end > len(frame) {
+		return 0, fmt.Errorf("frame of %d bytes is too short for %s at offset %d", len(frame), f.Format, f.Offset)
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+
+	if f.LittleEndian {
+		order = binary.LittleEndian
+	}
+
+	value, err := decodeNumber(f.Format, frame[f.Offset:end], order)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return value * f.Scale, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FieldError reports a field of a payload breaking one of its constraints.
+type FieldError struct {
+	Field      string      `json:"field"`           // JSON path of the field, e.g. "metrics.co2"
+	Constraint string      `json:"constraint"`      // Constraint broken, e.g. "enum", "rfc3339", "pattern", "min", "max" or "type"
+	Value      interface{} `json:"value,omitempty"` // Value received, the JSON type received for a type mismatch
+	Message    string      `json:"message"`
+}
+
+// fieldErrors are the errors of all the fields of a payload failing the validation.
+type fieldErrors []FieldError
+
+// Error joins the messages of the field errors
+func (e fieldErrors) Error() string {
+	messages := make([]string, len(e))
+
+	for i, fieldError := range e {
+		messages[i] = fieldError.Message
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// add appends the error of a field
+func (e *fieldErrors) add(field, constraint string, value interface{}, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Constraint: constraint, Value: value, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns the field errors as an error, nil when there are none
+func (e fieldErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// fieldErrorsOf returns the field errors of a rejected payload, from the validation or from the JSON decoding
+func fieldErrorsOf(err error) []FieldError {
+	var fields fieldErrors
+
+	if errors.As(err, &fields) {
+		return fields
+	}
+
+	var typeError *json.UnmarshalTypeError
+
+	if errors.As(err, &typeError) {
+		return []FieldError{{
+			Field:      typeError.Field,
+			Constraint: "type",
+			Value:      typeError.Value,
+			Message:    fmt.Sprintf("%s must be a %s, not a %s", typeError.Field, typeError.Type, typeError.Value),
+		}}
+	}
+
+	var syntaxError *json.SyntaxError
+
+	if errors.As(err, &syntaxError) {
+		return []FieldError{{
+			Constraint: "syntax",
+			Message:    fmt.Sprintf("the payload is not valid JSON at offset %d: %v", syntaxError.Offset, syntaxError),
+		}}
+	}
+
+	var decoderSyntaxError *jsonSyntaxError
+
+	if errors.As(err, &decoderSyntaxError) {
+		return []FieldError{{
+			Constraint: "syntax",
+			Message:    fmt.Sprintf("the payload is not valid JSON at offset %d: %v", decoderSyntaxError.Offset, decoderSyntaxError),
+		}}
+	}
+
+	return nil
+}
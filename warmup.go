@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// warmDevicesKey is the Redis list of the devices the most requested from the cache, saved on shutdown.
+	warmDevicesKey = "warm-devices"
+	// defaultWarmConnections is the number of connections opened beforehand without a connections setting.
+	defaultWarmConnections = 10
+	// defaultWarmUpTimeout is the time the warm-up may take without a timeout setting.
+	defaultWarmUpTimeout = 10 * time.Second
+	// warmUpConcurrency is the number of latest readings pre-loaded at once.
+	warmUpConcurrency = 16
+)
+
+// WarmUpConfig prepares the API before it listens, so the first requests after a deployment are as fast as the next.
+type WarmUpConfig struct {
+	Enabled     bool     `json:"enabled"`
+	Devices     int      `json:"devices"`     // Latest readings loaded into the cache, of the devices the most requested before the restart, the cache size by default
+	Connections int      `json:"connections"` // Connections to Redis opened beforehand, 10 by default
+	Timeout     Duration `json:"timeout"`     // Time the warm-up may delay the startup, 10s by default
+}
+
+// warmUp opens the connections to Redis and loads the latest readings of the devices the most requested before the
+// restart into the cache, within the timeout. A failed warm-up is logged, the API starts anyway.
+func warmUp(config WarmUpConfig, rdb *redis.Client, reg *registry, cache *cachedStore) error {
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.Devices < 0 || config.Connections < 0 || config.Timeout < 0 {
+		return fmt.Errorf("devices %d, connections %d and timeout %v must be positive", config.Devices, config.Connections, time.Duration(config.Timeout))
+	}
+
+	if config.Connections == 0 {
+		config.Connections = defaultWarmConnections
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = Duration(defaultWarmUpTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout))
+	defer cancel()
+	start := time.Now()
+
+	// The concurrent pings each take a connection of the pool, which dials the missing ones.
+	var group errgroup.Group
+
+	for n := 0; n < config.Connections; n++ {
+		group.Go(func() error {
+			return rdb.Ping(ctx).Err()
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		log.Printf("Warm-up: connections to Redis not opened: %v", err)
+	}
+
+	if cache == nil {
+		log.Printf("Warm-up: %d connections opened in %v", config.Connections, time.Since(start).Round(time.Millisecond))
+		return nil
+	}
+
+	if config.Devices == 0 || config.Devices > cache.size {
+		config.Devices = cache.size
+	}
+
+	ids, err := reg.WarmDevices(ctx, config.Devices)
+
+	if err != nil {
+		log.Printf("Warm-up: devices to pre-load not read: %v", err)
+		return nil
+	}
+
+	loaded := cache.preload(ctx, ids)
+	log.Printf("Warm-up: %d connections opened and %d/%d latest readings cached in %v", config.Connections, loaded, len(ids), time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
+
+// preload caches the latest reading of the devices, the most requested first, it returns the number cached
+func (s *cachedStore) preload(ctx context.Context, ids []string) int {
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(warmUpConcurrency)
+	readings := make([]*SensorData, len(ids))
+
+	for i := range ids {
+		i, deviceId := i, ids[i]
+		group.Go(func() error {
+			sensorData, err := s.Store.Latest(ctx, deviceId)
+
+			if err != nil && !errors.Is(err, errNotFound) {
+				return err
+			}
+
+			readings[i] = sensorData
+
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		log.Printf("Warm-up: latest readings not all loaded: %v", err)
+	}
+
+	loaded := 0
+
+	// Put the least requested first, so the most requested end up the most recently used.
+	for i := len(ids) - 1; i >= 0; i-- {
+		if readings[i] != nil {
+			s.put(ids[i], readings[i])
+			loaded++
+		}
+	}
+
+	return loaded
+}
+
+// hottest returns the cached devices, the most recently requested first
+func (s *cachedStore) hottest() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, s.order.Len())
+
+	for element := s.order.Front(); element != nil; element = element.Next() {
+		ids = append(ids, element.Value.(*cacheEntry).deviceId)
+	}
+
+	return ids
+}
+
+// SaveWarmDevices replaces the devices pre-loaded by the next warm-up, the most requested first
+func (r *registry) SaveWarmDevices(ctx context.Context, ids []string) error {
+	pipe := r.rdb.TxPipeline()
+	pipe.Del(ctx, warmDevicesKey)
+
+	if len(ids) > 0 {
+		values := make([]interface{}, len(ids))
+
+		for i, id := range ids {
+			values[i] = id
+		}
+
+		pipe.RPush(ctx, warmDevicesKey, values...)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("fatal error on saving the devices to warm up in the cache: %v", err)
+	}
+
+	return nil
+}
+
+// WarmDevices returns up to the limit of the devices to pre-load, the most requested first
+func (r *registry) WarmDevices(ctx context.Context, limit int) ([]string, error) {
+	ids, err := r.rdb.LRange(ctx, warmDevicesKey, 0, int64(limit)-1).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("fatal error on retrieving the devices to warm up from the cache: %v", err)
+	}
+
+	return ids, nil
+}